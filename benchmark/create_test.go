@@ -0,0 +1,68 @@
+package benchmark
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// benchmarkCreate creates b.N files in a single directory of a
+// loopback mount, from GOMAXPROCS goroutines.
+func benchmarkCreate(b *testing.B, opts *fuse.MountOptions) {
+	b.StopTimer()
+	dir, err := ioutil.TempDir("", "create_test")
+	if err != nil {
+		b.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	orig := filepath.Join(dir, "orig")
+	mnt := filepath.Join(dir, "mnt")
+	os.Mkdir(orig, 0755)
+	os.Mkdir(mnt, 0755)
+
+	nfs := pathfs.NewPathNodeFs(pathfs.NewLoopbackFileSystem(orig), nil)
+	conn := nodefs.NewFileSystemConnector(nfs.Root(), nodefs.NewOptions())
+	state, err := fuse.NewServer(conn.RawFS(), mnt, opts)
+	if err != nil {
+		b.Fatalf("NewServer: %v", err)
+	}
+	go state.Serve()
+	defer state.Unmount()
+	state.WaitMount()
+
+	threads := runtime.GOMAXPROCS(0)
+	var wg sync.WaitGroup
+	b.StartTimer()
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func(t int) {
+			defer wg.Done()
+			for i := t; i < b.N; i += threads {
+				f, err := os.Create(filepath.Join(mnt, fmt.Sprintf("file%d", i)))
+				if err != nil {
+					b.Errorf("Create: %v", err)
+					return
+				}
+				f.Close()
+			}
+		}(t)
+	}
+	wg.Wait()
+	b.StopTimer()
+}
+
+func BenchmarkCreateSerialDirOps(b *testing.B) {
+	benchmarkCreate(b, &fuse.MountOptions{})
+}
+
+func BenchmarkCreateParallelDirOps(b *testing.B) {
+	benchmarkCreate(b, &fuse.MountOptions{EnableParallelDirOps: true})
+}
@@ -0,0 +1,72 @@
+package benchmark
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+const readBenchSize = 64 << 20
+
+// benchmarkRead reads a large file from a loopback mount b.N times.
+func benchmarkRead(b *testing.B, opts *fuse.MountOptions) {
+	b.StopTimer()
+	dir, err := ioutil.TempDir("", "read_test")
+	if err != nil {
+		b.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	orig := filepath.Join(dir, "orig")
+	mnt := filepath.Join(dir, "mnt")
+	os.Mkdir(orig, 0755)
+	os.Mkdir(mnt, 0755)
+	if err := ioutil.WriteFile(filepath.Join(orig, "file"), make([]byte, readBenchSize), 0644); err != nil {
+		b.Fatalf("WriteFile: %v", err)
+	}
+
+	nfs := pathfs.NewPathNodeFs(pathfs.NewLoopbackFileSystem(orig), nil)
+	conn := nodefs.NewFileSystemConnector(nfs.Root(), nodefs.NewOptions())
+	state, err := fuse.NewServer(conn.RawFS(), mnt, opts)
+	if err != nil {
+		b.Fatalf("NewServer: %v", err)
+	}
+	go state.Serve()
+	defer state.Unmount()
+	state.WaitMount()
+
+	buf := make([]byte, 128<<10)
+	b.SetBytes(readBenchSize)
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := os.Open(filepath.Join(mnt, "file"))
+		if err != nil {
+			b.Fatalf("Open: %v", err)
+		}
+		for {
+			_, err := f.Read(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatalf("Read: %v", err)
+			}
+		}
+		f.Close()
+	}
+	b.StopTimer()
+}
+
+func BenchmarkReadSplice(b *testing.B) {
+	benchmarkRead(b, &fuse.MountOptions{})
+}
+
+func BenchmarkReadCopy(b *testing.B) {
+	benchmarkRead(b, &fuse.MountOptions{DisableSplice: true})
+}
@@ -0,0 +1,102 @@
+package fuse
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// POSIX ACLs are passed through the system.posix_acl_access and
+// system.posix_acl_default extended attributes, in the binary format
+// of struct posix_acl_xattr_header from <linux/posix_acl_xattr.h>:
+// a little-endian version word, followed by a list of entries.
+//
+// Note that the kernel only evaluates ACLs for permission checks
+// (with the default_permissions mount option) if the filesystem
+// negotiates FUSE_POSIX_ACL, which requires protocol version 7.26.
+// Until then, ACLs are stored and returned, but enforcement is up to
+// the file system implementation.
+
+const (
+	_POSIX_ACL_XATTR_VERSION = 0x0002
+	_SIZEOF_ACL_HEADER       = 4
+	_SIZEOF_ACL_ENTRY        = 8
+)
+
+// Tag values for PosixACLEntry.
+const (
+	ACL_USER_OBJ  = 0x01
+	ACL_USER      = 0x02
+	ACL_GROUP_OBJ = 0x04
+	ACL_GROUP     = 0x08
+	ACL_MASK      = 0x10
+	ACL_OTHER     = 0x20
+)
+
+// ACL_UNDEFINED_ID is used as Id for entries that do not name a
+// user or group.
+const ACL_UNDEFINED_ID = ^uint32(0)
+
+// PosixACLEntry is a single entry of a POSIX ACL.
+type PosixACLEntry struct {
+	Tag  uint16
+	Perm uint16
+	Id   uint32
+}
+
+func (e *PosixACLEntry) String() string {
+	return fmt.Sprintf("{tag 0x%x perm 0%o id %d}", e.Tag, e.Perm, e.Id)
+}
+
+// PosixACL is the decoded form of a POSIX ACL extended attribute.
+type PosixACL []PosixACLEntry
+
+// IsPosixACLXAttr returns true if attr is one of the extended
+// attributes that carries a POSIX ACL.
+func IsPosixACLXAttr(attr string) bool {
+	return attr == _SECURITY_ACL || attr == _SECURITY_ACL_DEFAULT
+}
+
+// ParsePosixACL decodes the value of a POSIX ACL extended
+// attribute. It returns EINVAL if data is not a well formed ACL.
+func ParsePosixACL(data []byte) (PosixACL, Status) {
+	if len(data) < _SIZEOF_ACL_HEADER || (len(data)-_SIZEOF_ACL_HEADER)%_SIZEOF_ACL_ENTRY != 0 {
+		return nil, EINVAL
+	}
+	if binary.LittleEndian.Uint32(data) != _POSIX_ACL_XATTR_VERSION {
+		return nil, EINVAL
+	}
+
+	data = data[_SIZEOF_ACL_HEADER:]
+	acl := make(PosixACL, 0, len(data)/_SIZEOF_ACL_ENTRY)
+	for ; len(data) > 0; data = data[_SIZEOF_ACL_ENTRY:] {
+		e := PosixACLEntry{
+			Tag:  binary.LittleEndian.Uint16(data[0:]),
+			Perm: binary.LittleEndian.Uint16(data[2:]),
+			Id:   binary.LittleEndian.Uint32(data[4:]),
+		}
+		switch e.Tag {
+		case ACL_USER_OBJ, ACL_USER, ACL_GROUP_OBJ, ACL_GROUP, ACL_MASK, ACL_OTHER:
+		default:
+			return nil, EINVAL
+		}
+		if e.Perm&^7 != 0 {
+			return nil, EINVAL
+		}
+		acl = append(acl, e)
+	}
+	return acl, OK
+}
+
+// Bytes encodes the ACL in the extended attribute format.
+func (a PosixACL) Bytes() []byte {
+	data := make([]byte, _SIZEOF_ACL_HEADER+len(a)*_SIZEOF_ACL_ENTRY)
+	binary.LittleEndian.PutUint32(data, _POSIX_ACL_XATTR_VERSION)
+	b := data[_SIZEOF_ACL_HEADER:]
+	for _, e := range a {
+		binary.LittleEndian.PutUint16(b[0:], e.Tag)
+		binary.LittleEndian.PutUint16(b[2:], e.Perm)
+		binary.LittleEndian.PutUint32(b[4:], e.Id)
+		b = b[_SIZEOF_ACL_ENTRY:]
+	}
+	return data
+}
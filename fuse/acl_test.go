@@ -0,0 +1,52 @@
+package fuse
+
+import (
+	"testing"
+)
+
+func TestPosixACLRoundTrip(t *testing.T) {
+	acl := PosixACL{
+		{Tag: ACL_USER_OBJ, Perm: 7, Id: ACL_UNDEFINED_ID},
+		{Tag: ACL_GROUP, Perm: 5, Id: 100},
+		{Tag: ACL_OTHER, Perm: 0, Id: ACL_UNDEFINED_ID},
+	}
+	data := acl.Bytes()
+	if len(data) != 4+3*8 {
+		t.Fatalf("got %d bytes, want %d", len(data), 4+3*8)
+	}
+	got, code := ParsePosixACL(data)
+	if !code.Ok() {
+		t.Fatalf("ParsePosixACL: %v", code)
+	}
+	if len(got) != len(acl) {
+		t.Fatalf("got %v, want %v", got, acl)
+	}
+	for i := range acl {
+		if got[i] != acl[i] {
+			t.Errorf("entry %d: got %v, want %v", i, &got[i], &acl[i])
+		}
+	}
+}
+
+func TestPosixACLInvalid(t *testing.T) {
+	valid := PosixACL{{Tag: ACL_OTHER, Perm: 4, Id: ACL_UNDEFINED_ID}}.Bytes()
+
+	badVersion := append([]byte{}, valid...)
+	badVersion[0] = 1
+	badTag := append([]byte{}, valid...)
+	badTag[4] = 0x40
+	badPerm := append([]byte{}, valid...)
+	badPerm[6] = 010
+
+	for name, data := range map[string][]byte{
+		"empty":   nil,
+		"short":   valid[:len(valid)-1],
+		"version": badVersion,
+		"tag":     badTag,
+		"perm":    badPerm,
+	} {
+		if _, code := ParsePosixACL(data); code != EINVAL {
+			t.Errorf("%s: got %v, want EINVAL", name, code)
+		}
+	}
+}
@@ -4,6 +4,8 @@
 
 package fuse
 
+import "time"
+
 // Types for users to implement.
 
 // The result of Read is an array of bytes, but for performance
@@ -11,6 +13,14 @@ package fuse
 // tuple.  If the backing store for a file is another filesystem, this
 // reduces the amount of copying between the kernel and the FUSE
 // server.  The ReadResult interface captures both cases.
+//
+// Buffer ownership: the buffer passed to Read belongs to the Server.
+// It is returned to the BufferPool once the reply has been written,
+// so a ReadResult may point into it, but the filesystem must not
+// keep references to it after Done is called.  Slices that the
+// filesystem allocated itself are never passed to FreeBuffer by the
+// Server; use ReadResultPoolData to hand over a slice obtained from
+// BufferPool.AllocBuffer.
 type ReadResult interface {
 	// Returns the raw bytes for the read, possibly using the
 	// passed buffer. The buffer should be larger than the return
@@ -20,7 +30,9 @@ type ReadResult interface {
 	// Size returns how many bytes this return value takes at most.
 	Size() int
 
-	// Done() is called after sending the data to the kernel.
+	// Done() is called after sending the data to the kernel, or
+	// after giving up on sending it.  It is called exactly once
+	// for each non-nil ReadResult.
 	Done()
 }
 
@@ -59,6 +71,76 @@ type MountOptions struct {
 
 	// If set, wrap the file system in a single-threaded locking wrapper.
 	SingleThreaded bool
+
+	// If set, ask the kernel to issue lookups, creates and other
+	// operations on the same directory in parallel. Without
+	// this, the kernel serializes operations per directory. The
+	// file system must be safe for concurrent modification of a
+	// single directory.
+	EnableParallelDirOps bool
+
+	// If set, ask the kernel to split direct I/O into
+	// concurrent asynchronous requests. The file system must
+	// handle concurrent reads and writes on the same file handle.
+	EnableAsyncDIO bool
+
+	// If set, ask the kernel to cache writes, and send them to the
+	// file system later, eg. on fsync, close or memory pressure.
+	// The kernel then keeps the size and mtime of regular files
+	// from its own writes, and ignores those from GETATTR, so a
+	// stat right after a write is correct without a round trip.
+	// As the kernel reads pages of files opened write-only to fill
+	// them, and appends by itself, OPEN, CREATE and TMPFILE reach
+	// the file system with O_WRONLY changed to O_RDWR and without
+	// O_APPEND. The backing data must not change behind the
+	// kernel's back.
+	EnableWritebackCache bool
+
+	// If set, data returned as ReadResultFd is copied into the
+	// reply, even if the kernel supports splicing it to the
+	// device.
+	DisableSplice bool
+
+	// If positive, at most this many requests are handled at the
+	// same time. Further requests wait in a queue until a handler
+	// finishes, rather than each getting a goroutine. Once this
+	// many requests, or PriorityQueue if set, are waiting, the
+	// server reads from the kernel with a single goroutine, but
+	// it doesn't stop reading: forgets, interrupts and requests
+	// made by this process, eg. a file system that stats its own
+	// mount point, don't need a slot, so they must get through.
+	MaxInFlight int
+
+	// If positive, free MaxInFlight slots go to the waiting
+	// requests by priority: lookups, stats and directory listings
+	// first, then other metadata operations, then reads, writes
+	// and other bulk data operations. This keeps eg. ls
+	// responsive during a big copy. To avoid starving bulk work,
+	// the oldest waiting request is served after a few others
+	// have overtaken it. It replaces MaxInFlight as the number of
+	// waiting requests above which reading slows down.
+	PriorityQueue int
+
+	// If set, mount with the mount(2) system call on a /dev/fuse
+	// opened by this process, instead of running the setuid
+	// fusermount helper. This needs CAP_SYS_ADMIN, eg. running as
+	// root in a container; without it, fusermount is used after
+	// all. Only supported on Linux.
+	DirectMount bool
+
+	// Requests with a directory entry name longer than
+	// MaxNameLength bytes, or a symlink target longer than
+	// MaxPathLength, fail with ENAMETOOLONG before reaching the
+	// file system. The defaults are NAME_MAX and PATH_MAX from
+	// POSIX; negative values disable the check.
+	MaxNameLength int
+	MaxPathLength int
+
+	// If positive, requests that take longer than this are
+	// logged with their operation, node and names, to spot a slow
+	// backend. At most one such line is logged per second; the
+	// next one says how many were left out.
+	SlowRequestThreshold time.Duration
 }
 
 // RawFileSystem is an interface close to the FUSE wire protocol.
@@ -69,6 +151,15 @@ type MountOptions struct {
 // somewhat tricky and not very interesting.
 //
 // A null implementation is provided by NewDefaultRawFileSystem.
+//
+// For some operations, the kernel remembers an ENOSYS reply and
+// stops sending the operation for the whole mount: Access, Fsync,
+// FsyncDir, Create, Tmpfile, Fallocate, the xattr operations, Interrupt,
+// Bmap and Poll. To say an operation is not supported for this
+// request only, eg. for one node, return EOPNOTSUPP instead; for
+// Access, Fsync and FsyncDir it is answered as success, like the
+// kernel does after ENOSYS. ENOSYS from Flush is never passed on,
+// because files may differ in whether they need flushing.
 type RawFileSystem interface {
 	String() string
 
@@ -80,6 +171,13 @@ type RawFileSystem interface {
 
 	// Attributes.
 	GetAttr(input *GetAttrIn, out *AttrOut) (code Status)
+
+	// Statx is GetAttr with room for the birth time and the
+	// STATX_ATTR_* flags. The kernel sends it if statx(2) asks
+	// for more than the basic stats, and uses GetAttr for good
+	// after ENOSYS. Linux passes on the stats and the birth
+	// time, but not the STATX_ATTR_* flags.
+	Statx(input *StatxIn, out *StatxOut) (code Status)
 	SetAttr(input *SetAttrIn, out *AttrOut) (code Status)
 
 	// Modifying structure.
@@ -88,10 +186,20 @@ type RawFileSystem interface {
 	Unlink(header *InHeader, name string) (code Status)
 	Rmdir(header *InHeader, name string) (code Status)
 	Rename(input *RenameIn, oldName string, newName string) (code Status)
+
+	// Rename2 is Rename with the RENAME_* flags of renameat2(2).
+	// After ENOSYS, the kernel sends Rename for calls without
+	// flags, and fails the others with EINVAL.
+	Rename2(input *Rename2In, oldName string, newName string) (code Status)
 	Link(input *LinkIn, filename string, out *EntryOut) (code Status)
 
 	Symlink(header *InHeader, pointedTo string, linkName string, out *EntryOut) (code Status)
 	Readlink(header *InHeader) (out []byte, code Status)
+
+	// CanonicalPath returns the path of a node, so the kernel can
+	// resolve the node back to a file, eg. for getcwd(3) or
+	// overlay file systems. It is only sent by Android kernels.
+	CanonicalPath(header *InHeader) (path string, code Status)
 	Access(input *AccessIn) (code Status)
 
 	// Extended attributes.
@@ -103,6 +211,13 @@ type RawFileSystem interface {
 
 	// File handling.
 	Create(input *CreateIn, name string, out *CreateOut) (code Status)
+
+	// Tmpfile creates and opens an unnamed file in the directory
+	// input.NodeId, for open(2) with O_TMPFILE. The file can be
+	// given a name later with Link. The kernel sends it to servers
+	// of any protocol version, and fails O_TMPFILE opens with
+	// EOPNOTSUPP after ENOSYS.
+	Tmpfile(input *CreateIn, out *CreateOut) (code Status)
 	Open(input *OpenIn, out *OpenOut) (status Status)
 	Read(input *ReadIn, buf []byte) (ReadResult, Status)
 
@@ -112,6 +227,22 @@ type RawFileSystem interface {
 	Fsync(input *FsyncIn) (code Status)
 	Fallocate(input *FallocateIn) (code Status)
 
+	// CopyFileRange copies data between two open files of the
+	// mount, eg. for copy_file_range(2) or cp --reflink. Other
+	// than for ENOSYS, which disables it for the mount, the
+	// kernel copies the data through Read and Write if it fails
+	// with EOPNOTSUPP or EXDEV.
+	CopyFileRange(input *CopyFileRangeIn) (written uint32, code Status)
+
+	// DAX mappings. These are only sent by virtio-fs transports,
+	// which share a memory window between guest and server.
+	SetupMapping(input *SetupMappingIn) (code Status)
+	RemoveMapping(input *RemoveMappingIn, mappings []RemoveMappingOne) (code Status)
+
+	// SetVolumeName renames the volume, eg. from the Finder. It
+	// is only sent by OSXFUSE.
+	SetVolumeName(name string) (code Status)
+
 	// Directory handling
 	OpenDir(input *OpenIn, out *OpenOut) (status Status)
 	ReadDir(input *ReadIn, out *DirEntryList) Status
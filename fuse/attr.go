@@ -41,6 +41,14 @@ func (a *Attr) SetTimes(access *time.Time, mod *time.Time, chstatus *time.Time)
 	}
 }
 
+// Changed sets the ctime to now. File systems that manage their own
+// metadata should call it for every change of the metadata, such as
+// chmod, chown, utimens, truncate and changes of the link count.
+func (a *Attr) Changed() {
+	now := time.Now()
+	a.SetTimes(nil, nil, &now)
+}
+
 func (a *Attr) ChangeTime() time.Time {
 	return time.Unix(int64(a.Ctime), int64(a.Ctimensec))
 }
@@ -61,6 +69,9 @@ func ToStatT(f os.FileInfo) *syscall.Stat_t {
 	return nil
 }
 
+// ToAttr converts the stat data of f, as from os.Lstat, to an Attr.
+// Blocks comes from the allocation of the file, so du(1) sees what
+// sparse files really use. It returns nil if f has no stat data.
 func ToAttr(f os.FileInfo) *Attr {
 	if f == nil {
 		return nil
@@ -73,3 +84,21 @@ func ToAttr(f os.FileInfo) *Attr {
 	}
 	return nil
 }
+
+// ToFileMode converts the permission bits of a Unix mode, including
+// the setuid, setgid and sticky bits, to an os.FileMode. The os
+// package keeps the latter three elsewhere, so os.FileMode(mode)
+// drops them.
+func ToFileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
@@ -4,6 +4,24 @@ import (
 	"syscall"
 )
 
+// FromAttr sets the basic fields and the birth time of s from a.
+func (s *Statx) FromAttr(a *Attr) {
+	s.Mask = STATX_BASIC_STATS | STATX_BTIME
+	s.Nlink = a.Nlink
+	s.Uid = a.Uid
+	s.Gid = a.Gid
+	s.Mode = uint16(a.Mode)
+	s.Ino = a.Ino
+	s.Size = a.Size
+	s.Blocks = a.Blocks
+	s.Atime = SxTime{Sec: int64(a.Atime), Nsec: a.Atimensec}
+	s.Btime = SxTime{Sec: int64(a.Crtime_), Nsec: a.Crtimensec_}
+	s.Ctime = SxTime{Sec: int64(a.Ctime), Nsec: a.Ctimensec}
+	s.Mtime = SxTime{Sec: int64(a.Mtime), Nsec: a.Mtimensec}
+	s.RdevMajor = a.Rdev >> 24
+	s.RdevMinor = a.Rdev & 0xffffff
+}
+
 func (a *Attr) FromStat(s *syscall.Stat_t) {
 	a.Ino = uint64(s.Ino)
 	a.Size = uint64(s.Size)
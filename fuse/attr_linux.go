@@ -4,6 +4,24 @@ import (
 	"syscall"
 )
 
+// FromAttr sets the basic fields of s from a.
+func (s *Statx) FromAttr(a *Attr) {
+	s.Mask = STATX_BASIC_STATS
+	s.Blksize = a.Blksize
+	s.Nlink = a.Nlink
+	s.Uid = a.Uid
+	s.Gid = a.Gid
+	s.Mode = uint16(a.Mode)
+	s.Ino = a.Ino
+	s.Size = a.Size
+	s.Blocks = a.Blocks
+	s.Atime = SxTime{Sec: int64(a.Atime), Nsec: a.Atimensec}
+	s.Ctime = SxTime{Sec: int64(a.Ctime), Nsec: a.Ctimensec}
+	s.Mtime = SxTime{Sec: int64(a.Mtime), Nsec: a.Mtimensec}
+	s.RdevMajor = (a.Rdev >> 8) & 0xfff
+	s.RdevMinor = (a.Rdev & 0xff) | ((a.Rdev >> 12) & 0xfff00)
+}
+
 func (a *Attr) FromStat(s *syscall.Stat_t) {
 	a.Ino = uint64(s.Ino)
 	a.Size = uint64(s.Size)
@@ -0,0 +1,74 @@
+package fuse
+
+import "strings"
+
+// CapSet is a set of optional operations that a file system
+// implements.
+type CapSet uint64
+
+const (
+	// GetXAttr, ListXAttr, SetXAttr and RemoveXAttr.
+	CapXAttr CapSet = 1 << iota
+	// Fsync and FsyncDir.
+	CapFsync
+	CapFallocate
+	CapCopyFileRange
+	CapRename2
+	CapTmpfile
+	CapStatx
+	// IOCTL is not passed on to file systems yet.
+	CapIoctl
+
+	// CapAll holds all optional operations.
+	CapAll = CapIoctl<<1 - 1
+)
+
+var capNames = []string{
+	"XAttr",
+	"Fsync",
+	"Fallocate",
+	"CopyFileRange",
+	"Rename2",
+	"Tmpfile",
+	"Statx",
+	"Ioctl",
+}
+
+// Has reports whether c holds all operations of o.
+func (c CapSet) Has(o CapSet) bool {
+	return c&o == o
+}
+
+func (c CapSet) String() string {
+	var names []string
+	for i, n := range capNames {
+		if c&(1<<uint(i)) != 0 {
+			names = append(names, n)
+		}
+	}
+	return "{" + strings.Join(names, ",") + "}"
+}
+
+// CapabilityFileSystem is an optional interface for file systems
+// that declare which optional operations they implement. With
+// embedding, a method that only returns ENOSYS can't be told apart
+// from a real one otherwise.
+//
+// The Server answers requests for the other operations with ENOSYS
+// without calling the file system, so the kernel stops sending them.
+// Wrappers should pass on the Capabilities of the file system they
+// wrap, less those they take away.
+type CapabilityFileSystem interface {
+	Capabilities() CapSet
+}
+
+// Capabilities returns the operations that fs declares it
+// implements, or CapAll if it doesn't implement
+// CapabilityFileSystem. fs may be a RawFileSystem, or a file system
+// or node of the nodefs and pathfs APIs.
+func Capabilities(fs interface{}) CapSet {
+	if c, ok := fs.(CapabilityFileSystem); ok {
+		return c.Capabilities()
+	}
+	return CapAll
+}
@@ -49,6 +49,10 @@ func (fs *defaultRawFileSystem) Readlink(header *InHeader) (out []byte, code Sta
 	return nil, ENOSYS
 }
 
+func (fs *defaultRawFileSystem) CanonicalPath(header *InHeader) (path string, code Status) {
+	return "", ENOSYS
+}
+
 func (fs *defaultRawFileSystem) Mknod(input *MknodIn, name string, out *EntryOut) (code Status) {
 	return ENOSYS
 }
@@ -73,6 +77,10 @@ func (fs *defaultRawFileSystem) Rename(input *RenameIn, oldName string, newName
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) Rename2(input *Rename2In, oldName string, newName string) (code Status) {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) Link(input *LinkIn, name string, out *EntryOut) (code Status) {
 	return ENOSYS
 }
@@ -105,6 +113,10 @@ func (fs *defaultRawFileSystem) Create(input *CreateIn, name string, out *Create
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) Tmpfile(input *CreateIn, out *CreateOut) (code Status) {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) OpenDir(input *OpenIn, out *OpenOut) (status Status) {
 	return ENOSYS
 }
@@ -146,3 +158,23 @@ func (fs *defaultRawFileSystem) FsyncDir(input *FsyncIn) (code Status) {
 func (fs *defaultRawFileSystem) Fallocate(in *FallocateIn) (code Status) {
 	return ENOSYS
 }
+
+func (fs *defaultRawFileSystem) Statx(input *StatxIn, out *StatxOut) (code Status) {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) CopyFileRange(in *CopyFileRangeIn) (written uint32, code Status) {
+	return 0, ENOSYS
+}
+
+func (fs *defaultRawFileSystem) SetupMapping(in *SetupMappingIn) (code Status) {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) RemoveMapping(in *RemoveMappingIn, mappings []RemoveMappingOne) (code Status) {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) SetVolumeName(name string) (code Status) {
+	return ENOSYS
+}
@@ -0,0 +1,50 @@
+package fuse
+
+import (
+	"sync"
+)
+
+// errorRecorder maps the Context of each request that is being
+// handled with debugging on to its request.
+var errorRecorder = struct {
+	sync.Mutex
+	reqs map[*Context]*request
+}{reqs: map[*Context]*request{}}
+
+// RecordError attaches err to the request that context came with,
+// as the reason for code, and returns code. The debug output of the
+// request then shows the error behind the Status, for example:
+//
+//	if err != nil {
+//		return fuse.RecordError(context, fuse.EIO, fmt.Errorf("reading index: %v", err))
+//	}
+//
+// Errors are only kept while the server runs with debugging on, and
+// only until the request is answered. The wire protocol is not
+// affected.
+func RecordError(context *Context, code Status, err error) Status {
+	if err == nil || context == nil {
+		return code
+	}
+	errorRecorder.Lock()
+	if req := errorRecorder.reqs[context]; req != nil {
+		req.errors = append(req.errors, err)
+	}
+	errorRecorder.Unlock()
+	return code
+}
+
+// recordErrors starts collecting RecordError calls for req.
+func (r *request) recordErrors() {
+	errorRecorder.Lock()
+	errorRecorder.reqs[&r.inHeader.Context] = r
+	errorRecorder.Unlock()
+}
+
+// stopRecordingErrors stops collecting errors for req; after it
+// returns, r.errors is safe to read.
+func (r *request) stopRecordingErrors() {
+	errorRecorder.Lock()
+	delete(errorRecorder.reqs, &r.inHeader.Context)
+	errorRecorder.Unlock()
+}
@@ -65,6 +65,11 @@ func (fs *lockingRawFileSystem) Readlink(header *InHeader) (out []byte, code Sta
 	return fs.RawFS.Readlink(header)
 }
 
+func (fs *lockingRawFileSystem) CanonicalPath(header *InHeader) (path string, code Status) {
+	defer fs.locked()()
+	return fs.RawFS.CanonicalPath(header)
+}
+
 func (fs *lockingRawFileSystem) Mknod(input *MknodIn, name string, out *EntryOut) (code Status) {
 	defer fs.locked()()
 	return fs.RawFS.Mknod(input, name, out)
@@ -95,6 +100,11 @@ func (fs *lockingRawFileSystem) Rename(input *RenameIn, oldName string, newName
 	return fs.RawFS.Rename(input, oldName, newName)
 }
 
+func (fs *lockingRawFileSystem) Rename2(input *Rename2In, oldName string, newName string) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.Rename2(input, oldName, newName)
+}
+
 func (fs *lockingRawFileSystem) Link(input *LinkIn, name string, out *EntryOut) (code Status) {
 	defer fs.locked()()
 	return fs.RawFS.Link(input, name, out)
@@ -135,6 +145,11 @@ func (fs *lockingRawFileSystem) Create(input *CreateIn, name string, out *Create
 	return fs.RawFS.Create(input, name, out)
 }
 
+func (fs *lockingRawFileSystem) Tmpfile(input *CreateIn, out *CreateOut) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.Tmpfile(input, out)
+}
+
 func (fs *lockingRawFileSystem) OpenDir(input *OpenIn, out *OpenOut) (status Status) {
 	defer fs.locked()()
 	return fs.RawFS.OpenDir(input, out)
@@ -200,6 +215,35 @@ func (fs *lockingRawFileSystem) Fallocate(in *FallocateIn) (code Status) {
 	return fs.RawFS.Fallocate(in)
 }
 
+func (fs *lockingRawFileSystem) Statx(input *StatxIn, out *StatxOut) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.Statx(input, out)
+}
+
+func (fs *lockingRawFileSystem) CopyFileRange(in *CopyFileRangeIn) (written uint32, code Status) {
+	defer fs.locked()()
+	return fs.RawFS.CopyFileRange(in)
+}
+
+func (fs *lockingRawFileSystem) SetupMapping(in *SetupMappingIn) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.SetupMapping(in)
+}
+
+func (fs *lockingRawFileSystem) RemoveMapping(in *RemoveMappingIn, mappings []RemoveMappingOne) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.RemoveMapping(in, mappings)
+}
+
+func (fs *lockingRawFileSystem) SetVolumeName(name string) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.SetVolumeName(name)
+}
+
+func (fs *lockingRawFileSystem) Capabilities() CapSet {
+	return Capabilities(fs.RawFS)
+}
+
 func (fs *lockingRawFileSystem) String() string {
 	defer fs.locked()()
 	return fmt.Sprintf("Locked(%s)", fs.RawFS.String())
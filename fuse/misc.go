@@ -31,7 +31,9 @@ func (code Status) Ok() bool {
 }
 
 // ToStatus extracts an errno number from Go error objects.  If it
-// fails, it logs an error and returns ENOSYS.
+// fails, it logs an error and returns ENOSYS. Errnos are passed on
+// as is, so EACCES and EPERM stay distinct; only the bare
+// os.ErrPermission, which stands for both, becomes EPERM.
 func ToStatus(err error) Status {
 	switch err {
 	case nil:
@@ -50,11 +52,18 @@ func ToStatus(err error) Status {
 	case syscall.Errno:
 		return Status(t)
 	case *os.SyscallError:
-		return Status(t.Err.(syscall.Errno))
+		return ToStatus(t.Err)
 	case *os.PathError:
 		return ToStatus(t.Err)
 	case *os.LinkError:
 		return ToStatus(t.Err)
+	case interface {
+		Unwrap() error
+	}:
+		// Errors wrapped with fmt.Errorf("%w").
+		if inner := t.Unwrap(); inner != nil {
+			return ToStatus(inner)
+		}
 	}
 	log.Println("can't convert error type:", err)
 	return ENOSYS
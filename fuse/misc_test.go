@@ -1,6 +1,7 @@
 package fuse
 
 import (
+	"fmt"
 	"os"
 	"syscall"
 	"testing"
@@ -18,6 +19,16 @@ func TestToStatus(t *testing.T) {
 		t.Errorf("Wrong conversion %v != %v", errNo, syscall.EPERM)
 	}
 
+	e = os.NewSyscallError("syscall", syscall.EACCES)
+	if errNo = ToStatus(e); errNo != EACCES {
+		t.Errorf("Wrong conversion %v != %v", errNo, syscall.EACCES)
+	}
+
+	wrapped := fmt.Errorf("context: %w", &os.PathError{Op: "open", Path: "x", Err: syscall.EACCES})
+	if errNo = ToStatus(wrapped); errNo != EACCES {
+		t.Errorf("Wrong conversion %v != %v", errNo, syscall.EACCES)
+	}
+
 	e = os.Remove("this-file-surely-does-not-exist")
 	errNo = ToStatus(e)
 	if errNo != ENOENT {
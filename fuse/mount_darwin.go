@@ -112,7 +112,9 @@ import (
 	"unsafe"
 )
 
-func mount(dir string, options string) (int, error) {
+// mount ignores direct: the device is always mounted by the
+// mount_osxfusefs helper.
+func mount(dir string, options string, direct bool) (int, bool, error) {
 	errp := (**C.char)(C.malloc(16))
 	*errp = nil
 	defer C.free(unsafe.Pointer(errp))
@@ -120,9 +122,9 @@ func mount(dir string, options string) (int, error) {
 	defer C.free(unsafe.Pointer(cdir))
 	fd := C.mountfuse(cdir, errp)
 	if *errp != nil {
-		return -1, mountError(C.GoString(*errp))
+		return -1, false, mountError(C.GoString(*errp))
 	}
-	return int(fd), nil
+	return int(fd), false, nil
 }
 
 type mountError string
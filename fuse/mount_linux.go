@@ -3,10 +3,10 @@ package fuse
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"unsafe"
 )
@@ -26,8 +26,103 @@ func unixgramSocketpair() (l, r *os.File, err error) {
 }
 
 // Create a FUSE FS on the specified mount point.  The returned
-// mount point is always absolute.
-func mount(mountPoint string, options string) (fd int, err error) {
+// mount point is always absolute. If direct is set, the mount(2)
+// system call is tried first, and fusermount is only used if we lack
+// the privilege for it.
+func mount(mountPoint string, options string, direct bool) (fd int, isDirect bool, err error) {
+	if direct {
+		fd, err = mountDirect(mountPoint, options)
+		if err == nil {
+			return fd, true, nil
+		}
+		if err != syscall.EPERM {
+			return -1, false, fmt.Errorf("mount(%q): %v", mountPoint, err)
+		}
+	}
+	fd, err = mountFusermount(mountPoint, options)
+	return fd, false, err
+}
+
+// directMountFlags are the options that fusermount turns into mount
+// flags rather than passing them to the kernel.
+var directMountFlags = map[string]struct {
+	flag uintptr
+	set  bool
+}{
+	"ro":         {syscall.MS_RDONLY, true},
+	"rw":         {syscall.MS_RDONLY, false},
+	"nosuid":     {syscall.MS_NOSUID, true},
+	"suid":       {syscall.MS_NOSUID, false},
+	"nodev":      {syscall.MS_NODEV, true},
+	"dev":        {syscall.MS_NODEV, false},
+	"noexec":     {syscall.MS_NOEXEC, true},
+	"exec":       {syscall.MS_NOEXEC, false},
+	"sync":       {syscall.MS_SYNCHRONOUS, true},
+	"async":      {syscall.MS_SYNCHRONOUS, false},
+	"dirsync":    {syscall.MS_DIRSYNC, true},
+	"noatime":    {syscall.MS_NOATIME, true},
+	"atime":      {syscall.MS_NOATIME, false},
+	"nodiratime": {syscall.MS_NODIRATIME, true},
+	"diratime":   {syscall.MS_NODIRATIME, false},
+}
+
+// mountDirect opens /dev/fuse and mounts it with the mount(2) system
+// call. This needs CAP_SYS_ADMIN, but not the fusermount helper.
+func mountDirect(mountPoint string, options string) (fd int, err error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(mountPoint, &st); err != nil {
+		return -1, err
+	}
+
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV)
+	fstype := "fuse"
+	source := ""
+	var data []string
+	for _, o := range strings.Split(options, ",") {
+		if f, ok := directMountFlags[o]; ok {
+			if f.set {
+				flags |= f.flag
+			} else {
+				flags &^= f.flag
+			}
+			continue
+		}
+		switch {
+		case o == "":
+		case strings.HasPrefix(o, "subtype="):
+			fstype = "fuse." + o[len("subtype="):]
+		case strings.HasPrefix(o, "fsname="):
+			source = o[len("fsname="):]
+		default:
+			data = append(data, o)
+		}
+	}
+	if source == "" {
+		source = fstype
+	}
+
+	fd, err = syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	data = append(data,
+		fmt.Sprintf("fd=%d", fd),
+		fmt.Sprintf("rootmode=%o", st.Mode&syscall.S_IFMT),
+		fmt.Sprintf("user_id=%d", os.Geteuid()),
+		fmt.Sprintf("group_id=%d", os.Getegid()))
+	if err := syscall.Mount(source, mountPoint, fstype, flags, strings.Join(data, ",")); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// mountFusermount mounts through the setuid fusermount helper, which
+// passes the opened /dev/fuse back over a socket.
+func mountFusermount(mountPoint string, options string) (fd int, err error) {
+	if fusermountBinary == "" {
+		return -1, fmt.Errorf("fusermount not found in $PATH")
+	}
 	local, remote, err := unixgramSocketpair()
 	if err != nil {
 		return
@@ -121,13 +216,7 @@ func getConnection(local *os.File) (int, error) {
 }
 
 func init() {
-	var err error
-	fusermountBinary, err = exec.LookPath("fusermount")
-	if err != nil {
-		log.Fatalf("Could not find fusermount binary: %v", err)
-	}
+	// Without fusermount, only direct mounts work.
+	fusermountBinary, _ = exec.LookPath("fusermount")
 	umountBinary, _ = exec.LookPath("umount")
-	if err != nil {
-		log.Fatalf("Could not find umount binary: %v", err)
-	}
 }
@@ -0,0 +1,98 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// rootAttrFS only knows about its root directory. Access returns
+// accessCode, and counts its calls.
+type rootAttrFS struct {
+	RawFileSystem
+
+	accessCode  Status
+	accessCalls int32
+}
+
+func (fs *rootAttrFS) GetAttr(input *GetAttrIn, out *AttrOut) Status {
+	if input.NodeId != FUSE_ROOT_ID {
+		return ENOENT
+	}
+	out.Mode = S_IFDIR | 0755
+	out.Nlink = 2
+	return OK
+}
+
+func (fs *rootAttrFS) Access(input *AccessIn) Status {
+	atomic.AddInt32(&fs.accessCalls, 1)
+	return fs.accessCode
+}
+
+// directMount mounts fs on a temporary directory with mount(2), and
+// skips the test if that is not permitted.
+func directMount(t *testing.T, fs RawFileSystem) (dir string, clean func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("direct mounts need CAP_SYS_ADMIN")
+	}
+	dir, err := ioutil.TempDir("", "go-fuse-direct")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	ms, err := NewServer(fs, dir, &MountOptions{DirectMount: true})
+	if err != nil {
+		os.Remove(dir)
+		t.Fatalf("NewServer: %v", err)
+	}
+	go ms.Serve()
+	ms.WaitMount()
+	clean = func() {
+		if err := ms.Unmount(); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+		os.Remove(dir)
+	}
+	if !ms.directMount {
+		clean()
+		t.Skip("mount(2) not permitted, mounted with fusermount")
+	}
+	return dir, clean
+}
+
+func TestDirectMount(t *testing.T) {
+	dir, clean := directMount(t, &rootAttrFS{RawFileSystem: NewDefaultRawFileSystem()})
+	defer clean()
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Mode() != os.ModeDir|0755 {
+		t.Errorf("got mode %v, want %v", fi.Mode(), os.ModeDir|0755)
+	}
+}
+
+func TestAccessNotSupported(t *testing.T) {
+	for _, c := range []struct {
+		code Status
+		want int32
+	}{
+		// The kernel remembers ENOSYS, and stops asking.
+		{ENOSYS, 1},
+		{EOPNOTSUPP, 2},
+	} {
+		fs := &rootAttrFS{RawFileSystem: NewDefaultRawFileSystem(), accessCode: c.code}
+		dir, clean := directMount(t, fs)
+		for i := 0; i < 2; i++ {
+			if err := syscall.Access(dir, W_OK); err != nil {
+				t.Errorf("%v: Access: %v", c.code, err)
+			}
+		}
+		clean()
+		if got := atomic.LoadInt32(&fs.accessCalls); got != c.want {
+			t.Errorf("%v: got %d ACCESS calls, want %d", c.code, got, c.want)
+		}
+	}
+}
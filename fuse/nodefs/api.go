@@ -92,17 +92,129 @@ type Node interface {
 	SetXAttr(attr string, data []byte, flags int, context *fuse.Context) fuse.Status
 	ListXAttr(context *fuse.Context) (attrs []string, code fuse.Status)
 
-	// Attributes
+	// Attributes. Chmod, Chown, Truncate and Utimens should
+	// update the ctime, as should Link, Unlink and Rename for
+	// the node whose link count or name changes. Nodes that keep
+	// their own metadata can use fuse.Attr.Changed for this.
 	GetAttr(out *fuse.Attr, file File, context *fuse.Context) (code fuse.Status)
 	Chmod(file File, perms uint32, context *fuse.Context) (code fuse.Status)
 	Chown(file File, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status)
-	Truncate(file File, size uint64, context *fuse.Context) (code fuse.Status)
 	Utimens(file File, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status)
 	Fallocate(file File, off uint64, size uint64, mode uint32, context *fuse.Context) (code fuse.Status)
 
+	// Truncate sets the size of the file. Growing a file should
+	// leave a hole that reads as zeros, rather than storing
+	// zeroed data, so truncating a file to a large size is cheap.
+	Truncate(file File, size uint64, context *fuse.Context) (code fuse.Status)
+
 	StatFs() *fuse.StatfsOut
 }
 
+// DirStream produces the entries of a directory incrementally.
+type DirStream interface {
+	// Next returns at most n entries. An empty result signals
+	// the end of the directory.
+	Next(n int) ([]fuse.DirEntry, fuse.Status)
+
+	// Close releases the stream. It is called when the kernel
+	// releases the directory handle, or rewinds it.
+	Close()
+}
+
+// DirStreamNode is an optional interface for Nodes whose directories
+// are too large to list in a single slice. If a Node implements it,
+// OpenDirStream is tried before OpenDir, and OpenDir is used if it
+// returns ENOSYS. Entries are only requested as the kernel reads the
+// directory, so memory use is bounded by the kernel's READDIR buffer
+// size rather than the size of the directory.
+type DirStreamNode interface {
+	OpenDirStream(context *fuse.Context) (DirStream, fuse.Status)
+}
+
+// OpenDirFlagsNode is an optional interface for Nodes that want to
+// set FOPEN_* flags in the reply to OPENDIR. A Node whose listing
+// rarely changes can return FOPEN_CACHE_DIR|FOPEN_KEEP_CACHE, so the
+// kernel serves repeated listings from its cache. Without it, the
+// directory is read again on every open.
+type OpenDirFlagsNode interface {
+	OpenDirFlags(context *fuse.Context) uint32
+}
+
+// StatxNode is an optional interface for Nodes that can report
+// STATX_ATTR_* flags, such as immutable or append-only, for
+// statx(2). mask holds the flags the Node knows about; attributes
+// those that are set. file is the open file if the kernel passed a
+// handle, or nil. STATX for other Nodes, or if this returns ENOSYS,
+// fails with ENOSYS, and the kernel then uses GETATTR.
+type StatxNode interface {
+	StatxAttributes(file File, context *fuse.Context) (attributes uint64, mask uint64, code fuse.Status)
+}
+
+// CacheTimeoutNode is an optional interface for Nodes whose entry
+// and attributes the kernel may cache for longer or shorter than the
+// Options say, such as content-addressed blobs that never change, or
+// files that change all the time. The timeouts are used in the
+// replies to LOOKUP, GETATTR, SETATTR and STATX for the Node, and
+// when it is created. A negative timeout keeps the one of the
+// Options.
+type CacheTimeoutNode interface {
+	CacheTimeouts() (entry time.Duration, attr time.Duration)
+}
+
+// TmpfileNode is an optional interface for directory Nodes that
+// support open(2) with O_TMPFILE. Tmpfile returns the opened file and
+// the Node for it, which has no name until it is linked into a
+// directory with Link. Without it, O_TMPFILE opens fail with
+// EOPNOTSUPP.
+type TmpfileNode interface {
+	Tmpfile(flags uint32, mode uint32, context *fuse.Context) (file File, child Node, code fuse.Status)
+}
+
+// Rename2Node is an optional interface for directory Nodes that
+// support the fuse.RENAME_* flags of renameat2(2), such as
+// RENAME_WHITEOUT, which overlay file systems use to hide a lower
+// entry. Renames with flags fail with EINVAL on Nodes that don't
+// implement this. Renames without flags go to Rename.
+type Rename2Node interface {
+	Rename2(oldName string, newParent Node, newName string, flags uint32, context *fuse.Context) (code fuse.Status)
+}
+
+// VolumeNameNode is an optional interface for the root Node. On OSX,
+// SetVolumeName is called when the user renames the mounted volume
+// in the Finder. Without it, renaming fails with ENOSYS.
+type VolumeNameNode interface {
+	SetVolumeName(name string) fuse.Status
+}
+
+// CanonicalPathNode is an optional interface for Nodes that know a
+// path they can be reached by. Android kernels ask for it to resolve
+// a node back to a file, eg. for getcwd(3). Without it, the request
+// fails with ENOSYS.
+type CanonicalPathNode interface {
+	CanonicalPath(context *fuse.Context) (path string, code fuse.Status)
+}
+
+// CopyRangeFile is an optional interface for Files that can copy
+// data to another open file of the same mount without it passing
+// through the server, eg. by sharing extents. dst is the File that
+// was opened for the destination. If CopyFileRange returns
+// EOPNOTSUPP or EXDEV, or the File does not implement this, the
+// kernel copies the data through Read and Write instead.
+type CopyRangeFile interface {
+	CopyFileRange(dst File, offIn uint64, offOut uint64, length uint64, flags uint32) (written uint32, code fuse.Status)
+}
+
+// FlushOwnerFile is an optional interface for Files that keep POSIX
+// locks on behalf of their callers. close(2) releases all locks the
+// process holds on the file, so the kernel sends the lock owner of
+// the closing descriptor with FLUSH. If the File, or a File it wraps
+// as returned by InnerFile, implements this, FlushOwner is called
+// instead of Flush, and should release the locks of owner besides
+// flushing. Flush of the wrappers in between is not called.
+type FlushOwnerFile interface {
+	FlushOwner(owner uint64) fuse.Status
+}
+
 // A File object is returned from FileSystem.Open and
 // FileSystem.Create.  Include the NewDefaultFile return value into
 // the struct to inherit a null implementation.
@@ -117,6 +229,9 @@ type File interface {
 	// the inner file here.
 	InnerFile() File
 
+	// Read may return data in dest, which is reclaimed by the
+	// server after the reply is sent, or in a slice of its own;
+	// see fuse.ReadResult for the ownership rules.
 	Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status)
 	Write(data []byte, off int64) (written uint32, code fuse.Status)
 
@@ -130,16 +245,30 @@ type File interface {
 	// the call. Any cleanup that requires specific synchronization or
 	// could fail with I/O errors should happen in Flush instead.
 	Release()
+
+	// Fsync makes the file durable. flags are the FsyncFlags of
+	// the request: with fuse.FSYNC_FDATASYNC, as for fdatasync(2),
+	// metadata that isn't needed to read the data back may be left
+	// out. Wrappers must pass flags on to the file they wrap.
 	Fsync(flags int) (code fuse.Status)
 
 	// The methods below may be called on closed files, due to
 	// concurrency.  In that case, you should return EBADF.
-	Truncate(size uint64) fuse.Status
 	GetAttr(out *fuse.Attr) fuse.Status
 	Chown(uid uint32, gid uint32) fuse.Status
 	Chmod(perms uint32) fuse.Status
 	Utimens(atime *time.Time, mtime *time.Time) fuse.Status
 	Allocate(off uint64, size uint64, mode uint32) (code fuse.Status)
+
+	// Truncate may also be called on a closed file. See
+	// Node.Truncate on growing files.
+	Truncate(size uint64) fuse.Status
+
+	// SetupMapping maps length bytes at file offset foffset into
+	// the DAX window at window offset moffset; RemoveMapping
+	// undoes it. These are only called for virtio-fs mounts.
+	SetupMapping(foffset uint64, length uint64, moffset uint64, flags uint64) fuse.Status
+	RemoveMapping(moffset uint64, length uint64) fuse.Status
 }
 
 // Wrap a File return in this to set FUSE flags.  Also used internally
@@ -0,0 +1,196 @@
+package nodefs
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// ReadAhead selects when a BufferedFile reads ahead.
+type ReadAhead int
+
+const (
+	// ReadAheadAdaptive reads ahead while reads are sequential,
+	// doubling the amount for each refill, and stops at the first
+	// read elsewhere.
+	ReadAheadAdaptive ReadAhead = iota
+
+	// ReadAheadAlways reads the maximum ahead on every miss.
+	ReadAheadAlways
+
+	// ReadAheadNever passes each read on as it is.
+	ReadAheadNever
+)
+
+// _MIN_READ_AHEAD is the read-ahead of an adaptive BufferedFile after
+// its first sequential read.
+const _MIN_READ_AHEAD = 32 << 10
+
+// _DEFAULT_MAX_READ_AHEAD is the read-ahead limit of a BufferedFile
+// if none is given.
+const _DEFAULT_MAX_READ_AHEAD = 1 << 20
+
+// BufferedFile reads ahead of the reads on a File, so a backend with
+// a high cost per call, such as a network store, sees a few large
+// reads instead of many small ones. Reads that hit the data read
+// ahead are served from memory. The data is dropped on Write,
+// Truncate and Allocate through the handle, but not if the file
+// changes otherwise.
+//
+// A handle is often read sequentially and then at random, or the
+// other way around, so by default read-ahead follows the access
+// pattern: a read that starts where the previous one ended is
+// sequential, and grows the read-ahead window; any other read drops
+// the prefetched data and turns read-ahead off until reads are
+// sequential again.
+type BufferedFile struct {
+	File
+
+	mode      ReadAhead
+	maxWindow int
+
+	// mu serializes reads, so a run of sequential reads refills
+	// the buffer once, and keeps them from racing with writes.
+	mu sync.Mutex
+
+	// buf holds the data of the inner File from bufOff. If eof is
+	// set, the file ended within it.
+	buf    []byte
+	bufOff int64
+	eof    bool
+
+	// next is the offset just past the last read.
+	next int64
+
+	// window is the amount read ahead on the next miss.
+	window int
+}
+
+// NewBufferedFile returns a BufferedFile for f that reads ahead as
+// mode says, at most maxWindow bytes. If maxWindow is not positive,
+// it is 1 MiB.
+func NewBufferedFile(f File, mode ReadAhead, maxWindow int) *BufferedFile {
+	if maxWindow <= 0 {
+		maxWindow = _DEFAULT_MAX_READ_AHEAD
+	}
+	return &BufferedFile{File: f, mode: mode, maxWindow: maxWindow}
+}
+
+func (f *BufferedFile) InnerFile() File {
+	return f.File
+}
+
+func (f *BufferedFile) String() string {
+	return fmt.Sprintf("BufferedFile(%s)", f.File.String())
+}
+
+// Window returns the amount the next read past the buffered data
+// reads ahead.
+func (f *BufferedFile) Window() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.window
+}
+
+// adapt sets the window for a miss at off. Must be called with f.mu
+// held.
+func (f *BufferedFile) adapt(off int64) {
+	switch f.mode {
+	case ReadAheadAlways:
+		f.window = f.maxWindow
+	case ReadAheadNever:
+		f.window = 0
+	default:
+		if off != f.next {
+			f.window = 0
+		} else if f.window == 0 {
+			f.window = _MIN_READ_AHEAD
+		} else if f.window *= 2; f.window > f.maxWindow {
+			f.window = f.maxWindow
+		}
+	}
+}
+
+// Read copies the data into dest, so reads are not spliced.
+func (f *BufferedFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.mode == ReadAheadAdaptive && off != f.next {
+		// Random access: the prefetched data is unlikely to
+		// be read.
+		f.buf = nil
+	}
+	if n, ok := f.buffered(dest, off); ok {
+		f.next = off + int64(n)
+		return fuse.ReadResultData(dest[:n]), fuse.OK
+	}
+
+	f.adapt(off)
+	f.buf = nil
+	size := len(dest) + f.window
+	buf := make([]byte, size)
+	res, code := f.File.Read(buf, off)
+	if !code.Ok() {
+		return nil, code
+	}
+	data, code := res.Bytes(buf)
+	if code.Ok() && len(data) > 0 && &data[0] != &buf[0] {
+		data = append(buf[:0], data...)
+	}
+	res.Done()
+	if !code.Ok() {
+		return nil, code
+	}
+	if len(data) > len(dest) {
+		f.buf = data
+		f.bufOff = off
+		f.eof = len(data) < size
+	}
+	n := copy(dest, data)
+	f.next = off + int64(n)
+	return fuse.ReadResultData(dest[:n]), fuse.OK
+}
+
+// buffered copies the data at off from the buffer into dest, if
+// the buffer has all of it, or it ends where the file ends. Must be
+// called with f.mu held.
+func (f *BufferedFile) buffered(dest []byte, off int64) (int, bool) {
+	if f.buf == nil || off < f.bufOff || off > f.bufOff+int64(len(f.buf)) {
+		return 0, false
+	}
+	start := int(off - f.bufOff)
+	if len(f.buf)-start < len(dest) && !f.eof {
+		return 0, false
+	}
+	return copy(dest, f.buf[start:]), true
+}
+
+// drop forgets the data read ahead, and returns with f.mu held, so
+// a concurrent Read can't fetch the old data again.
+func (f *BufferedFile) drop() func() {
+	f.mu.Lock()
+	f.buf = nil
+	return f.mu.Unlock
+}
+
+func (f *BufferedFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	defer f.drop()()
+	return f.File.Write(data, off)
+}
+
+func (f *BufferedFile) Truncate(size uint64) fuse.Status {
+	defer f.drop()()
+	return f.File.Truncate(size)
+}
+
+func (f *BufferedFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	defer f.drop()()
+	return f.File.Allocate(off, size, mode)
+}
+
+func (f *BufferedFile) Release() {
+	defer f.drop()()
+	f.File.Release()
+}
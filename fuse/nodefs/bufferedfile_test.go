@@ -0,0 +1,170 @@
+package nodefs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// remoteFile is a File whose reads cost a round trip and time per
+// byte, like a network store.
+type remoteFile struct {
+	File
+	data []byte
+
+	latency time.Duration
+	perByte time.Duration
+
+	calls int
+}
+
+func newRemoteFile(size int) *remoteFile {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return &remoteFile{File: NewDefaultFile(), data: data}
+}
+
+func (f *remoteFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.calls++
+	end := off + int64(len(dest))
+	if end > int64(len(f.data)) {
+		end = int64(len(f.data))
+	}
+	if off > end {
+		off = end
+	}
+	if d := f.latency + time.Duration(end-off)*f.perByte; d > 0 {
+		time.Sleep(d)
+	}
+	return fuse.ReadResultData(f.data[off:end]), fuse.OK
+}
+
+func (f *remoteFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	copy(f.data[off:], data)
+	return uint32(len(data)), fuse.OK
+}
+
+func readAt(t *testing.T, f File, want []byte, off int64, size int) {
+	buf := make([]byte, size)
+	res, code := f.Read(buf, off)
+	if !code.Ok() {
+		t.Fatalf("Read(%d, %d): %v", off, size, code)
+	}
+	got, _ := res.Bytes(buf)
+	end := off + int64(size)
+	if end > int64(len(want)) {
+		end = int64(len(want))
+	}
+	if !bytes.Equal(got, want[off:end]) {
+		t.Fatalf("Read(%d, %d): got %d bytes, not the file data", off, size, len(got))
+	}
+}
+
+func TestBufferedFileAdaptive(t *testing.T) {
+	inner := newRemoteFile(1 << 20)
+	f := NewBufferedFile(inner, ReadAheadAdaptive, 256<<10)
+	want := inner.data
+
+	// Sequential reads grow the window up to the maximum.
+	for off := int64(0); off < 512<<10; off += 4096 {
+		readAt(t, f, want, off, 4096)
+	}
+	if got := f.Window(); got != 256<<10 {
+		t.Errorf("window after sequential reads: got %d, want %d", got, 256<<10)
+	}
+	if inner.calls > 8 {
+		t.Errorf("sequential reads: %d inner reads for 128 reads", inner.calls)
+	}
+
+	// A read elsewhere turns read-ahead off, and drops the
+	// prefetched data.
+	inner.calls = 0
+	readAt(t, f, want, 100<<10, 4096)
+	if got := f.Window(); got != 0 {
+		t.Errorf("window after random read: got %d, want 0", got)
+	}
+	readAt(t, f, want, 600<<10, 4096)
+	readAt(t, f, want, 16<<10, 4096)
+	if inner.calls != 3 {
+		t.Errorf("random reads: got %d inner reads, want 3", inner.calls)
+	}
+
+	// It comes back when reads are sequential again.
+	readAt(t, f, want, 20<<10, 4096)
+	if got := f.Window(); got != _MIN_READ_AHEAD {
+		t.Errorf("window after sequential read: got %d, want %d", got, _MIN_READ_AHEAD)
+	}
+
+	// Writes drop the data read ahead.
+	if _, code := f.Write([]byte("xyz"), 24<<10); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+	readAt(t, f, want, 24<<10, 4096)
+
+	// Reads at the end of the file are served from the buffer.
+	readAt(t, f, want, 1<<20-12288, 4096)
+	readAt(t, f, want, 1<<20-8192, 4096)
+	inner.calls = 0
+	readAt(t, f, want, 1<<20-4096, 8192)
+	if inner.calls != 0 {
+		t.Errorf("read at EOF: got %d inner reads, want 0", inner.calls)
+	}
+}
+
+func TestBufferedFileStatic(t *testing.T) {
+	inner := newRemoteFile(1 << 20)
+	f := NewBufferedFile(inner, ReadAheadNever, 0)
+	for off := int64(0); off < 64<<10; off += 4096 {
+		readAt(t, f, inner.data, off, 4096)
+	}
+	if inner.calls != 16 {
+		t.Errorf("ReadAheadNever: got %d inner reads, want 16", inner.calls)
+	}
+
+	inner.calls = 0
+	f = NewBufferedFile(inner, ReadAheadAlways, 64<<10)
+	readAt(t, f, inner.data, 512<<10, 4096)
+	readAt(t, f, inner.data, 520<<10, 4096)
+	if inner.calls != 1 {
+		t.Errorf("ReadAheadAlways: got %d inner reads, want 1", inner.calls)
+	}
+}
+
+// benchmarkMixed reads a handle in runs of sequential reads,
+// alternating with runs of random reads.
+func benchmarkMixed(b *testing.B, mode ReadAhead) {
+	const size = 16 << 20
+	const block = 4096
+	inner := newRemoteFile(size)
+	inner.latency = 100 * time.Microsecond
+	inner.perByte = time.Nanosecond
+	f := NewBufferedFile(inner, mode, 1<<20)
+	r := rand.New(rand.NewSource(1))
+	buf := make([]byte, block)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		off := int64(r.Intn(size/block-64)) * block
+		for j := 0; j < 64; j++ {
+			f.Read(buf, off+int64(j*block))
+		}
+		for j := 0; j < 64; j++ {
+			f.Read(buf, int64(r.Intn(size/block))*block)
+		}
+	}
+}
+
+func BenchmarkBufferedFileAdaptive(b *testing.B) {
+	benchmarkMixed(b, ReadAheadAdaptive)
+}
+
+func BenchmarkBufferedFileAlways(b *testing.B) {
+	benchmarkMixed(b, ReadAheadAlways)
+}
+
+func BenchmarkBufferedFileNever(b *testing.B) {
+	benchmarkMixed(b, ReadAheadNever)
+}
@@ -0,0 +1,98 @@
+package nodefs
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// CountingFile counts the bytes read and written through a File, for
+// example to bill the traffic of an open handle.
+type CountingFile struct {
+	File
+
+	// If positive, Limit caps the bytes read and written
+	// together. A Read or Write that would exceed it fails with
+	// EDQUOT.
+	Limit int64
+
+	mu      sync.Mutex
+	read    int64
+	written int64
+}
+
+// NewCountingFile returns a CountingFile for f, limited to limit
+// bytes if limit is positive.
+func NewCountingFile(f File, limit int64) *CountingFile {
+	return &CountingFile{File: f, Limit: limit}
+}
+
+func (f *CountingFile) InnerFile() File {
+	return f.File
+}
+
+func (f *CountingFile) String() string {
+	return fmt.Sprintf("CountingFile(%s)", f.File.String())
+}
+
+// BytesRead returns the number of bytes read so far.
+func (f *CountingFile) BytesRead() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.read
+}
+
+// BytesWritten returns the number of bytes written so far.
+func (f *CountingFile) BytesWritten() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.written
+}
+
+// fits reports whether n more bytes stay within the limit. Must be
+// called with f.mu held.
+func (f *CountingFile) fits(n int) bool {
+	return f.Limit <= 0 || f.read+f.written+int64(n) <= f.Limit
+}
+
+// Read copies the data out of the result of the inner File to count
+// it, so reads are not spliced.
+func (f *CountingFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	res, code := f.File.Read(buf, off)
+	if !code.Ok() {
+		return nil, code
+	}
+	data, code := res.Bytes(buf)
+	res.Done()
+	if !code.Ok() {
+		return nil, code
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.fits(len(data)) {
+		return nil, fuse.EDQUOT
+	}
+	f.read += int64(len(data))
+	return fuse.ReadResultData(data), fuse.OK
+}
+
+func (f *CountingFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	// Reserve the bytes first, so concurrent writes can't overrun
+	// the limit together.
+	f.mu.Lock()
+	if !f.fits(len(data)) {
+		f.mu.Unlock()
+		return 0, fuse.EDQUOT
+	}
+	f.written += int64(len(data))
+	f.mu.Unlock()
+
+	n, code := f.File.Write(data, off)
+
+	f.mu.Lock()
+	f.written -= int64(len(data)) - int64(n)
+	f.mu.Unlock()
+	return n, code
+}
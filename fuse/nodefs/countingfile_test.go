@@ -0,0 +1,58 @@
+package nodefs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestCountingFile(t *testing.T) {
+	osf, err := ioutil.TempFile("", "go-fuse-counting")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(osf.Name())
+
+	f := NewCountingFile(NewLoopbackFile(osf), 100)
+	defer f.Release()
+
+	if _, code := f.Write(make([]byte, 30), 0); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+	if _, code := f.Write(make([]byte, 20), 30); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+
+	// Reading past the end only counts what was there.
+	buf := make([]byte, 40)
+	if _, code := f.Read(buf, 0); !code.Ok() {
+		t.Fatalf("Read: %v", code)
+	}
+	res, code := f.Read(buf, 40)
+	if !code.Ok() {
+		t.Fatalf("Read: %v", code)
+	}
+	if res.Size() != 10 {
+		t.Errorf("Read at 40: got %d bytes, want 10", res.Size())
+	}
+
+	if got := f.BytesWritten(); got != 50 {
+		t.Errorf("BytesWritten: got %d, want 50", got)
+	}
+	if got := f.BytesRead(); got != 50 {
+		t.Errorf("BytesRead: got %d, want 50", got)
+	}
+
+	// The limit of 100 is used up.
+	if _, code := f.Write([]byte{1}, 50); code != fuse.EDQUOT {
+		t.Errorf("Write over limit: got %v, want EDQUOT", code)
+	}
+	if _, code := f.Read(buf, 0); code != fuse.EDQUOT {
+		t.Errorf("Read over limit: got %v, want EDQUOT", code)
+	}
+	if got := f.BytesWritten() + f.BytesRead(); got != 100 {
+		t.Errorf("failed operations were counted: total %d", got)
+	}
+}
@@ -8,8 +8,12 @@ import (
 
 type defaultFile struct{}
 
+var _ File = (*defaultFile)(nil)
+
 // NewDefaultFile returns a File instance that returns ENOSYS for
-// every operation.
+// every operation, except Flush, which succeeds, and SetInode and
+// Release, which do nothing. Embed it, rather than a nil File, to
+// get these for the methods a File doesn't implement.
 func NewDefaultFile() File {
 	return (*defaultFile)(nil)
 }
@@ -68,3 +72,11 @@ func (f *defaultFile) Chmod(perms uint32) fuse.Status {
 func (f *defaultFile) Allocate(off uint64, size uint64, mode uint32) (code fuse.Status) {
 	return fuse.ENOSYS
 }
+
+func (f *defaultFile) SetupMapping(foffset uint64, length uint64, moffset uint64, flags uint64) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (f *defaultFile) RemoveMapping(moffset uint64, length uint64) fuse.Status {
+	return fuse.ENOSYS
+}
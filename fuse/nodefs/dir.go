@@ -6,15 +6,33 @@ import (
 	"github.com/hanwen/go-fuse/fuse"
 )
 
+// Smallest size of an entry in the READDIR reply: the fuse_dirent
+// header and a name padded to 8 bytes.
+const _MIN_DIRENT_SIZE = 32
+
 type connectorDir struct {
 	node       Node
 	stream     []fuse.DirEntry
 	lastOffset uint64
 	rawFS      fuse.RawFileSystem
 	lookups    []fuse.EntryOut
+
+	// If set, entries are read incrementally from dirStream,
+	// and stream only holds the entries from offset streamOff
+	// on that the kernel has not consumed yet.
+	dirStream DirStream
+	streamOff uint64
+	// The lookups for stream in READDIRPLUS, nil if not done yet.
+	streamLookups []*fuse.EntryOut
+	// Entries to add after the end of dirStream.
+	extra []fuse.DirEntry
+	eof   bool
 }
 
 func (d *connectorDir) ReadDir(input *fuse.ReadIn, out *fuse.DirEntryList) (code fuse.Status) {
+	if d.dirStream != nil {
+		return d.readStream(input, out, false)
+	}
 	if d.stream == nil {
 		return fuse.OK
 	}
@@ -48,6 +66,9 @@ func (d *connectorDir) ReadDir(input *fuse.ReadIn, out *fuse.DirEntryList) (code
 }
 
 func (d *connectorDir) ReadDirPlus(input *fuse.ReadIn, out *fuse.DirEntryList) (code fuse.Status) {
+	if d.dirStream != nil {
+		return d.readStream(input, out, true)
+	}
 	if d.stream == nil {
 		return fuse.OK
 	}
@@ -95,6 +116,119 @@ func (d *connectorDir) ReadDirPlus(input *fuse.ReadIn, out *fuse.DirEntryList) (
 
 }
 
+// fetch reads more entries from dirStream.
+func (d *connectorDir) fetch(n int) fuse.Status {
+	entries, code := d.dirStream.Next(n)
+	if !code.Ok() {
+		return code
+	}
+	if len(entries) == 0 {
+		d.eof = true
+		entries = d.extra
+	}
+	d.stream = append(d.stream, entries...)
+	d.streamLookups = append(d.streamLookups, make([]*fuse.EntryOut, len(entries))...)
+	return fuse.OK
+}
+
+func (d *connectorDir) readStream(input *fuse.ReadIn, out *fuse.DirEntryList, plus bool) (code fuse.Status) {
+	// rewinddir() should be as if reopening directory.
+	if d.lastOffset > 0 && input.Offset == 0 {
+		d.dirStream.Close()
+		d.dirStream, code = d.node.(DirStreamNode).OpenDirStream((*fuse.Context)(&input.Context))
+		if !code.Ok() {
+			d.dirStream = &emptyDirStream{}
+			d.eof = true
+			return code
+		}
+		d.stream = nil
+		d.streamLookups = nil
+		d.streamOff = 0
+		d.lastOffset = 0
+		d.eof = false
+	}
+
+	if input.Offset < d.streamOff {
+		// We can only go back by restarting at 0.
+		return fuse.EINVAL
+	}
+
+	batch := int(input.Size) / _MIN_DIRENT_SIZE
+	if batch < 1 {
+		batch = 1
+	}
+
+	// Drop what the kernel has consumed.
+	for input.Offset > d.streamOff+uint64(len(d.stream)) && !d.eof {
+		d.streamOff += uint64(len(d.stream))
+		d.stream = d.stream[:0]
+		d.streamLookups = d.streamLookups[:0]
+		if code := d.fetch(batch); !code.Ok() {
+			return code
+		}
+	}
+	skip := input.Offset - d.streamOff
+	if skip > uint64(len(d.stream)) {
+		// This shouldn't happen, but let's not crash.
+		return fuse.EINVAL
+	}
+	d.stream = append([]fuse.DirEntry(nil), d.stream[skip:]...)
+	d.streamLookups = append([]*fuse.EntryOut(nil), d.streamLookups[skip:]...)
+	d.streamOff = input.Offset
+
+	for i := 0; ; i++ {
+		if i >= len(d.stream) && !d.eof {
+			if code := d.fetch(batch); !code.Ok() {
+				return code
+			}
+		}
+		if i >= len(d.stream) {
+			break
+		}
+
+		e := d.stream[i]
+		if e.Name == "" {
+			log.Printf("got empty directory entry, mode %o.", e.Mode)
+			continue
+		}
+		var ok bool
+		var off uint64
+		if plus {
+			if d.streamLookups[i] == nil {
+				d.streamLookups[i] = &fuse.EntryOut{}
+				if e.Name != "." && e.Name != ".." {
+					if code := d.rawFS.Lookup(&input.InHeader, e.Name, d.streamLookups[i]); !code.Ok() {
+						*d.streamLookups[i] = fuse.EntryOut{}
+					}
+				}
+			}
+			ok, off = out.AddDirLookupEntry(e, d.streamLookups[i])
+		} else {
+			ok, off = out.AddDirEntry(e)
+		}
+		d.lastOffset = off
+		if !ok {
+			break
+		}
+	}
+	return fuse.OK
+}
+
+func (d *connectorDir) release() {
+	if d.dirStream != nil {
+		d.dirStream.Close()
+	}
+}
+
+type emptyDirStream struct{}
+
+func (s *emptyDirStream) Next(n int) ([]fuse.DirEntry, fuse.Status) {
+	return nil, fuse.OK
+}
+
+func (s *emptyDirStream) Close() {
+}
+
 type rawDir interface {
 	ReadDir(out *fuse.DirEntryList, input *fuse.ReadIn, c *fuse.Context) fuse.Status
 	ReadDirPlus(out *fuse.DirEntryList, input *fuse.ReadIn, c *fuse.Context) fuse.Status
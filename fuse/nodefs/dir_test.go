@@ -0,0 +1,96 @@
+package nodefs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// countingDirStream produces count entries, and records how many
+// entries were asked for at once.
+type countingDirStream struct {
+	next, count int
+	maxAsked    int
+	closed      bool
+}
+
+func (s *countingDirStream) Next(n int) ([]fuse.DirEntry, fuse.Status) {
+	if n > s.maxAsked {
+		s.maxAsked = n
+	}
+	var out []fuse.DirEntry
+	for ; len(out) < n && s.next < s.count; s.next++ {
+		out = append(out, fuse.DirEntry{Mode: fuse.S_IFREG, Name: fmt.Sprintf("file%d", s.next)})
+	}
+	return out, fuse.OK
+}
+
+func (s *countingDirStream) Close() {
+	s.closed = true
+}
+
+type streamDirNode struct {
+	Node
+	streams []*countingDirStream
+}
+
+func (n *streamDirNode) OpenDirStream(context *fuse.Context) (DirStream, fuse.Status) {
+	s := &countingDirStream{count: 10000}
+	n.streams = append(n.streams, s)
+	return s, fuse.OK
+}
+
+// readAll reads the directory like the kernel does, and returns the
+// number of entries read.
+func readAll(t *testing.T, d *connectorDir) int {
+	const size = 4096
+	offset := uint64(0)
+	for {
+		out := fuse.NewDirEntryList(make([]byte, size), offset)
+		if code := d.ReadDir(&fuse.ReadIn{Offset: offset, Size: size}, out); !code.Ok() {
+			t.Fatalf("ReadDir: %v", code)
+		}
+		if max := 2 * size / _MIN_DIRENT_SIZE; len(d.stream) > max {
+			t.Fatalf("buffered %d entries, want at most %d", len(d.stream), max)
+		}
+		if d.lastOffset == offset {
+			return int(offset)
+		}
+		offset = d.lastOffset
+	}
+}
+
+func TestConnectorDirStream(t *testing.T) {
+	node := &streamDirNode{Node: NewDefaultNode()}
+	s, _ := node.OpenDirStream(nil)
+	d := &connectorDir{
+		node:      node,
+		dirStream: s,
+		extra: []fuse.DirEntry{
+			{Mode: fuse.S_IFDIR, Name: "."},
+			{Mode: fuse.S_IFDIR, Name: ".."},
+		},
+	}
+
+	if got, want := readAll(t, d), 10002; got != want {
+		t.Errorf("read %d entries, want %d", got, want)
+	}
+	first := node.streams[0]
+	if first.maxAsked > 4096/_MIN_DIRENT_SIZE {
+		t.Errorf("asked for %d entries at once", first.maxAsked)
+	}
+
+	// Rewinding restarts the stream.
+	if got, want := readAll(t, d), 10002; got != want {
+		t.Errorf("reread %d entries, want %d", got, want)
+	}
+	if len(node.streams) != 2 || !first.closed {
+		t.Errorf("rewind should close and reopen the stream")
+	}
+
+	d.release()
+	if !node.streams[1].closed {
+		t.Errorf("release did not close the stream")
+	}
+}
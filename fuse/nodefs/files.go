@@ -2,9 +2,11 @@ package nodefs
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"syscall"
+	"unsafe"
 
 	"github.com/hanwen/go-fuse/fuse"
 )
@@ -91,8 +93,42 @@ func (f *devNullFile) Truncate(size uint64) (code fuse.Status) {
 ////////////////
 
 // LoopbackFile delegates all operations back to an underlying os.File.
+//
+// Fifos, sockets and character devices are read and written
+// sequentially. The kernel never sends I/O for them through a mount,
+// as it opens special files itself, so this only matters for callers
+// of the File API, such as wrapping file systems.
 func NewLoopbackFile(f *os.File) File {
-	return &loopbackFile{File: f}
+	return &loopbackFile{File: f, appendMode: isAppend(f), stream: isStream(f)}
+}
+
+// NewSizeLimitedLoopbackFile is NewLoopbackFile for a file that may
+// not grow beyond maxSize bytes. Writes are cut short at maxSize,
+// and writes that start there, and Truncate or Allocate beyond it,
+// fail with EFBIG, as for a file at RLIMIT_FSIZE. This catches
+// offsets that would otherwise create a huge sparse file.
+func NewSizeLimitedLoopbackFile(f *os.File, maxSize int64) File {
+	return &loopbackFile{File: f, appendMode: isAppend(f), stream: isStream(f), maxSize: maxSize}
+}
+
+// isAppend reports whether f was opened with O_APPEND.
+func isAppend(f *os.File) bool {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETFL, 0)
+	return errno == 0 && flags&syscall.O_APPEND != 0
+}
+
+// isStream reports whether f is a fifo, socket or character device,
+// which don't support positioned I/O. Block devices do.
+func isStream(f *os.File) bool {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return false
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFCHR:
+		return true
+	}
+	return false
 }
 
 type loopbackFile struct {
@@ -104,6 +140,23 @@ type loopbackFile struct {
 	// with another close, they may lead to confusion as which
 	// file gets written in the end.
 	lock sync.Mutex
+
+	// appendMode is set if the file was opened with O_APPEND.
+	// Writes then go to the end of the file, whatever offset the
+	// kernel passes, so concurrent appends don't overwrite each
+	// other.
+	appendMode bool
+
+	// stream is set for files without positioned I/O. They are
+	// read and written at their current position, ignoring the
+	// offset passed in.
+	stream bool
+
+	// maxSize, if positive, is the size the file may not exceed.
+	maxSize int64
+
+	// released is set by Release. Later calls fail with EBADF.
+	released bool
 }
 
 func (f *loopbackFile) InnerFile() File {
@@ -118,7 +171,19 @@ func (f *loopbackFile) String() string {
 }
 
 func (f *loopbackFile) Read(buf []byte, off int64) (res fuse.ReadResult, code fuse.Status) {
-	f.lock.Lock()
+	if len(buf) == 0 {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	if f.stream {
+		if !f.lockOpen() {
+			return nil, fuse.EBADF
+		}
+		f.lock.Unlock()
+		return f.readStream(buf)
+	}
+	if !f.lockOpen() {
+		return nil, fuse.EBADF
+	}
 	// This is not racy by virtue of the kernel properly
 	// synchronizing the open/write/close.
 	r := fuse.ReadResultFd(f.File.Fd(), off, len(buf))
@@ -127,20 +192,127 @@ func (f *loopbackFile) Read(buf []byte, off int64) (res fuse.ReadResult, code fu
 }
 
 func (f *loopbackFile) Write(data []byte, off int64) (uint32, fuse.Status) {
-	f.lock.Lock()
-	n, err := f.File.WriteAt(data, off)
-	f.lock.Unlock()
-	return uint32(n), fuse.ToStatus(err)
+	if len(data) == 0 {
+		return 0, fuse.OK
+	}
+	if f.stream {
+		if !f.lockOpen() {
+			return 0, fuse.EBADF
+		}
+		f.lock.Unlock()
+		// Like readStream, this doesn't hold the lock, as it
+		// may block until a reader drains the fifo.
+		return writeFull(func(p []byte, off int64) (int, error) {
+			return f.File.Write(p)
+		}, data, off)
+	}
+	if !f.lockOpen() {
+		return 0, fuse.EBADF
+	}
+	defer f.lock.Unlock()
+	if f.maxSize > 0 {
+		var code fuse.Status
+		if data, code = f.limitWrite(data, off); !code.Ok() {
+			return 0, code
+		}
+	}
+	if f.appendMode {
+		return writeFull(func(p []byte, off int64) (int, error) {
+			return f.File.Write(p)
+		}, data, off)
+	}
+	return writeFull(f.File.WriteAt, data, off)
+}
+
+// limitWrite cuts data short so a write at off ends at maxSize. An
+// appending write starts at the end of the file, whatever off is.
+func (f *loopbackFile) limitWrite(data []byte, off int64) ([]byte, fuse.Status) {
+	if f.appendMode {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(int(f.File.Fd()), &st); err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+		off = st.Size
+	}
+	if off < 0 || off >= f.maxSize {
+		return nil, fuse.EFBIG
+	}
+	if room := f.maxSize - off; int64(len(data)) > room {
+		data = data[:room]
+	}
+	return data, fuse.OK
+}
+
+// readStream returns the data that is available, rather than
+// filling buf, as more may never arrive. It doesn't hold the lock,
+// as it may block until a writer shows up, and a Write through the
+// same handle of a fifo must not wait for it.
+func (f *loopbackFile) readStream(buf []byte) (fuse.ReadResult, fuse.Status) {
+	for {
+		n, err := f.File.Read(buf)
+		if err == io.EOF {
+			return fuse.ReadResultData(nil), fuse.OK
+		}
+		if err != nil && fuse.ToStatus(err) == fuse.Status(syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+		return fuse.ReadResultData(buf[:n]), fuse.OK
+	}
+}
+
+// writeFull writes all of data at off with write, retrying short
+// writes and EINTR. If an error stops it after some data was
+// written, it returns the short count with OK, so the caller sees a
+// short write, and gets the error when it retries the rest.
+func writeFull(write func(p []byte, off int64) (int, error), data []byte, off int64) (uint32, fuse.Status) {
+	written := 0
+	for written < len(data) {
+		n, err := write(data[written:], off+int64(written))
+		written += n
+		if err != nil && fuse.ToStatus(err) == fuse.Status(syscall.EINTR) {
+			continue
+		}
+		if err == nil && n == 0 {
+			err = syscall.EIO
+		}
+		if err != nil {
+			if written > 0 {
+				break
+			}
+			return 0, fuse.ToStatus(err)
+		}
+	}
+	return uint32(written), fuse.OK
 }
 
 func (f *loopbackFile) Release() {
 	f.lock.Lock()
-	f.File.Close()
+	if !f.released {
+		f.released = true
+		f.File.Close()
+	}
 	f.lock.Unlock()
 }
 
-func (f *loopbackFile) Flush() fuse.Status {
+// lockOpen takes the lock, unless the file was released. The
+// descriptor may then already be reused by another file, so callers
+// return EBADF rather than use it.
+func (f *loopbackFile) lockOpen() bool {
 	f.lock.Lock()
+	if f.released {
+		f.lock.Unlock()
+		return false
+	}
+	return true
+}
+
+func (f *loopbackFile) Flush() fuse.Status {
+	if !f.lockOpen() {
+		return fuse.EBADF
+	}
 
 	// Since Flush() may be called for each dup'd fd, we don't
 	// want to really close the file, we just want to flush. This
@@ -156,15 +328,27 @@ func (f *loopbackFile) Flush() fuse.Status {
 }
 
 func (f *loopbackFile) Fsync(flags int) (code fuse.Status) {
-	f.lock.Lock()
-	r := fuse.ToStatus(syscall.Fsync(int(f.File.Fd())))
+	if !f.lockOpen() {
+		return fuse.EBADF
+	}
+	var r fuse.Status
+	if flags&fuse.FSYNC_FDATASYNC != 0 {
+		r = fuse.ToStatus(fdatasync(int(f.File.Fd())))
+	} else {
+		r = fuse.ToStatus(syscall.Fsync(int(f.File.Fd())))
+	}
 	f.lock.Unlock()
 
 	return r
 }
 
 func (f *loopbackFile) Truncate(size uint64) fuse.Status {
-	f.lock.Lock()
+	if f.maxSize > 0 && size > uint64(f.maxSize) {
+		return fuse.EFBIG
+	}
+	if !f.lockOpen() {
+		return fuse.EBADF
+	}
 	r := fuse.ToStatus(syscall.Ftruncate(int(f.File.Fd()), int64(size)))
 	f.lock.Unlock()
 
@@ -172,15 +356,19 @@ func (f *loopbackFile) Truncate(size uint64) fuse.Status {
 }
 
 func (f *loopbackFile) Chmod(mode uint32) fuse.Status {
-	f.lock.Lock()
-	r := fuse.ToStatus(f.File.Chmod(os.FileMode(mode)))
+	if !f.lockOpen() {
+		return fuse.EBADF
+	}
+	r := fuse.ToStatus(f.File.Chmod(fuse.ToFileMode(mode)))
 	f.lock.Unlock()
 
 	return r
 }
 
 func (f *loopbackFile) Chown(uid uint32, gid uint32) fuse.Status {
-	f.lock.Lock()
+	if !f.lockOpen() {
+		return fuse.EBADF
+	}
 	r := fuse.ToStatus(f.File.Chown(int(uid), int(gid)))
 	f.lock.Unlock()
 
@@ -189,7 +377,9 @@ func (f *loopbackFile) Chown(uid uint32, gid uint32) fuse.Status {
 
 func (f *loopbackFile) GetAttr(a *fuse.Attr) fuse.Status {
 	st := syscall.Stat_t{}
-	f.lock.Lock()
+	if !f.lockOpen() {
+		return fuse.EBADF
+	}
 	err := syscall.Fstat(int(f.File.Fd()), &st)
 	f.lock.Unlock()
 	if err != nil {
@@ -200,7 +390,41 @@ func (f *loopbackFile) GetAttr(a *fuse.Attr) fuse.Status {
 	return fuse.OK
 }
 
-// Allocate, Utimens implemented in files_linux.go
+// The plain loopback file has no DAX window to map into; see
+// NewDAXLoopbackFile.
+func (f *loopbackFile) SetupMapping(foffset uint64, length uint64, moffset uint64, flags uint64) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (f *loopbackFile) RemoveMapping(moffset uint64, length uint64) fuse.Status {
+	return fuse.ENOSYS
+}
+
+// loopback returns the loopbackFile itself, also for types that
+// embed it, so CopyFileRange can find the backing file of dst.
+func (f *loopbackFile) loopback() *loopbackFile {
+	return f
+}
+
+// lockPair locks f and g, in a fixed order so concurrent copies in
+// opposite directions don't deadlock, and returns the unlock.
+func lockPair(f, g *loopbackFile) func() {
+	if f == g {
+		f.lock.Lock()
+		return f.lock.Unlock
+	}
+	if uintptr(unsafe.Pointer(f)) > uintptr(unsafe.Pointer(g)) {
+		f, g = g, f
+	}
+	f.lock.Lock()
+	g.lock.Lock()
+	return func() {
+		g.lock.Unlock()
+		f.lock.Unlock()
+	}
+}
+
+// Allocate, Utimens, CopyFileRange implemented in files_linux.go
 
 ////////////////////////////////////////////////////////////////
 
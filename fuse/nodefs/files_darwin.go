@@ -9,6 +9,10 @@ import (
 )
 
 func (f *loopbackFile) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
+	if f.maxSize > 0 && (off+sz < off || off+sz > uint64(f.maxSize)) {
+		return fuse.EFBIG
+	}
+
 	// TODO: Handle `mode` parameter.
 
 	// From `man fcntl` on OSX:
@@ -52,7 +56,9 @@ func (f *loopbackFile) Allocate(off uint64, sz uint64, mode uint32) fuse.Status
 	// Linux version for reference:
 	// err := syscall.Fallocate(int(f.File.Fd()), mode, int64(off), int64(sz))
 
-	f.lock.Lock()
+	if !f.lockOpen() {
+		return fuse.EBADF
+	}
 	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.File.Fd(), uintptr(syscall.F_PREALLOCATE), uintptr(unsafe.Pointer(&k)))
 	f.lock.Unlock()
 	if errno != 0 {
@@ -80,9 +86,22 @@ func (f *loopbackFile) Utimens(a *time.Time, m *time.Time) fuse.Status {
 		tv[1] = syscall.NsecToTimeval(n)
 	}
 
-	f.lock.Lock()
+	if !f.lockOpen() {
+		return fuse.EBADF
+	}
 	err := syscall.Futimes(int(f.File.Fd()), tv)
 	f.lock.Unlock()
 
 	return fuse.ToStatus(err)
 }
+
+// CopyFileRange is not supported; OSXFUSE doesn't send it.
+func (f *loopbackFile) CopyFileRange(dst File, offIn uint64, offOut uint64, length uint64, flags uint32) (uint32, fuse.Status) {
+	return 0, fuse.EOPNOTSUPP
+}
+
+// fdatasync is fsync, as Darwin has no fdatasync(2) in the syscall
+// package.
+func fdatasync(fd int) error {
+	return syscall.Fsync(fd)
+}
@@ -0,0 +1,108 @@
+package nodefs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestDefaultFileMapping(t *testing.T) {
+	f := NewDefaultFile()
+	if code := f.SetupMapping(0, fuse.PAGESIZE, 0, fuse.SETUPMAPPING_FLAG_READ); code != fuse.ENOSYS {
+		t.Errorf("SetupMapping: got %v, want ENOSYS", code)
+	}
+	if code := f.RemoveMapping(0, fuse.PAGESIZE); code != fuse.ENOSYS {
+		t.Errorf("RemoveMapping: got %v, want ENOSYS", code)
+	}
+}
+
+func TestDAXLoopbackFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "go-fuse-dax")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	content := make([]byte, 2*fuse.PAGESIZE)
+	copy(content[fuse.PAGESIZE:], "hello")
+	if _, err := f.Write(content); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	window, err := syscall.Mmap(-1, 0, 4*fuse.PAGESIZE, syscall.PROT_NONE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		t.Fatalf("Mmap: %v", err)
+	}
+	defer syscall.Munmap(window)
+
+	dax := NewDAXLoopbackFile(f, window)
+	if code := dax.SetupMapping(fuse.PAGESIZE, fuse.PAGESIZE, 2*fuse.PAGESIZE, fuse.SETUPMAPPING_FLAG_READ); !code.Ok() {
+		t.Fatalf("SetupMapping: %v", code)
+	}
+	if got := string(window[2*fuse.PAGESIZE : 2*fuse.PAGESIZE+5]); got != "hello" {
+		t.Errorf("window content: got %q, want %q", got, "hello")
+	}
+
+	if code := dax.RemoveMapping(2*fuse.PAGESIZE, fuse.PAGESIZE); !code.Ok() {
+		t.Errorf("RemoveMapping: %v", code)
+	}
+	if code := dax.SetupMapping(0, fuse.PAGESIZE, 4*fuse.PAGESIZE, fuse.SETUPMAPPING_FLAG_READ); code != fuse.EINVAL {
+		t.Errorf("out of window SetupMapping: got %v, want EINVAL", code)
+	}
+}
+
+func TestLoopbackFileCopyFileRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-copyrange")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 2*fuse.PAGESIZE)
+	if err := ioutil.WriteFile(filepath.Join(dir, "src"), content, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	srcf, err := os.Open(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	dstf, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	src := NewLoopbackFile(srcf)
+	dst := NewLoopbackFile(dstf)
+	defer src.Release()
+	defer dst.Release()
+
+	if _, code := src.(CopyRangeFile).CopyFileRange(NewDefaultFile(), 0, 0, 10, 0); code != fuse.EOPNOTSUPP {
+		t.Errorf("copy to non-loopback file: got %v, want EOPNOTSUPP", code)
+	}
+
+	var done uint64
+	for done < uint64(len(content)) {
+		n, code := src.(CopyRangeFile).CopyFileRange(dst, done, done, uint64(len(content))-done, 0)
+		if code == fuse.EOPNOTSUPP || code == fuse.EXDEV || code == fuse.ENOSYS {
+			t.Skipf("copy_file_range not supported here: %v", code)
+		}
+		if !code.Ok() || n == 0 {
+			t.Fatalf("CopyFileRange at %d: %d, %v", done, n, code)
+		}
+		done += uint64(n)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("dst differs from src: got %d bytes, want %d", len(got), len(content))
+	}
+}
@@ -0,0 +1,255 @@
+package nodefs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestDefaultFile(t *testing.T) {
+	f := NewDefaultFile()
+	f.SetInode(nil)
+	f.Release()
+	if f.InnerFile() != nil {
+		t.Errorf("InnerFile: got %v, want nil", f.InnerFile())
+	}
+	if code := f.Flush(); !code.Ok() {
+		t.Errorf("Flush: got %v, want OK", code)
+	}
+
+	var attr fuse.Attr
+	now := time.Now()
+	_, readCode := f.Read(make([]byte, 10), 0)
+	_, writeCode := f.Write([]byte("x"), 0)
+	for name, code := range map[string]fuse.Status{
+		"Read":          readCode,
+		"Write":         writeCode,
+		"GetAttr":       f.GetAttr(&attr),
+		"Fsync":         f.Fsync(0),
+		"Utimens":       f.Utimens(&now, &now),
+		"Truncate":      f.Truncate(0),
+		"Chown":         f.Chown(0, 0),
+		"Chmod":         f.Chmod(0644),
+		"Allocate":      f.Allocate(0, 10, 0),
+		"SetupMapping":  f.SetupMapping(0, 4096, 0, 0),
+		"RemoveMapping": f.RemoveMapping(0, 4096),
+	} {
+		if code != fuse.ENOSYS {
+			t.Errorf("%s: got %v, want ENOSYS", name, code)
+		}
+	}
+}
+
+func TestLoopbackFileAppend(t *testing.T) {
+	f, err := ioutil.TempFile("", "go-fuse-append")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	const writers = 2
+	const records = 100
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		osf, err := os.OpenFile(f.Name(), os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+		lf := NewLoopbackFile(osf)
+		defer lf.Release()
+
+		record := bytes.Repeat([]byte{byte('a' + i)}, 16)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < records; j++ {
+				// The offset is stale on purpose, like
+				// the kernel's view of a file that
+				// another writer extends.
+				if _, code := lf.Write(record, 0); !code.Ok() {
+					t.Errorf("Write: %v", code)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if len(content) != writers*records*16 {
+		t.Fatalf("got %d bytes, want %d", len(content), writers*records*16)
+	}
+	counts := map[byte]int{}
+	for i := 0; i < len(content); i += 16 {
+		rec := content[i : i+16]
+		if !bytes.Equal(rec, bytes.Repeat(rec[:1], 16)) {
+			t.Fatalf("interleaved record at %d: %q", i, rec)
+		}
+		counts[rec[0]]++
+	}
+	for i := 0; i < writers; i++ {
+		if c := counts[byte('a'+i)]; c != records {
+			t.Errorf("writer %d: got %d records, want %d", i, c, records)
+		}
+	}
+}
+
+// chunkedWriter stores at most chunk bytes per call, fails every
+// other call with EINTR, and fails with ENOSPC beyond capacity.
+type chunkedWriter struct {
+	data     []byte
+	chunk    int
+	capacity int
+	calls    int
+}
+
+func (w *chunkedWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.calls++
+	if w.calls%2 == 0 {
+		return 0, syscall.EINTR
+	}
+	if int(off) >= w.capacity {
+		return 0, syscall.ENOSPC
+	}
+	n := len(p)
+	if n > w.chunk {
+		n = w.chunk
+	}
+	if int(off)+n > w.capacity {
+		n = w.capacity - int(off)
+	}
+	for len(w.data) < int(off)+n {
+		w.data = append(w.data, 0)
+	}
+	copy(w.data[off:], p[:n])
+	return n, nil
+}
+
+func TestWriteFull(t *testing.T) {
+	w := &chunkedWriter{chunk: 3, capacity: 100}
+	data := []byte("hello, short writes")
+	n, code := writeFull(w.WriteAt, data, 2)
+	if !code.Ok() || int(n) != len(data) {
+		t.Fatalf("writeFull: got %d, %v; want %d, OK", n, code, len(data))
+	}
+	if got := string(w.data[2:]); got != string(data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+
+	// Running out of space gives a short write, then the error.
+	w = &chunkedWriter{chunk: 3, capacity: 10}
+	n, code = writeFull(w.WriteAt, data, 0)
+	if !code.Ok() || n != 10 {
+		t.Errorf("writeFull at capacity: got %d, %v; want 10, OK", n, code)
+	}
+	n, code = writeFull(w.WriteAt, data[n:], int64(n))
+	if code != fuse.ENOSPC || n != 0 {
+		t.Errorf("writeFull past capacity: got %d, %v; want 0, ENOSPC", n, code)
+	}
+}
+
+func TestLoopbackFileFifo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-fifo")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(name, 0644); err != nil {
+		t.Fatalf("Mkfifo: %v", err)
+	}
+	// Opening read-write doesn't wait for the other end.
+	osf, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	lf := NewLoopbackFile(osf)
+	defer lf.Release()
+
+	// The offsets are meaningless for a fifo, and positioned I/O
+	// would fail with ESPIPE.
+	if n, code := lf.Write([]byte("hello"), 100); !code.Ok() || n != 5 {
+		t.Fatalf("Write: %d, %v", n, code)
+	}
+	buf := make([]byte, 100)
+	res, code := lf.Read(buf, 42)
+	if !code.Ok() {
+		t.Fatalf("Read: %v", code)
+	}
+	data, _ := res.Bytes(buf)
+	if string(data) != "hello" {
+		t.Errorf("Read: got %q, want %q", data, "hello")
+	}
+	res.Done()
+}
+
+func TestSizeLimitedLoopbackFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "go-fuse-maxsize")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	lf := NewSizeLimitedLoopbackFile(f, 10)
+	defer lf.Release()
+
+	if n, code := lf.Write([]byte("0123456789abc"), 0); !code.Ok() || n != 10 {
+		t.Errorf("Write across the limit: got %d, %v, want 10, OK", n, code)
+	}
+	if _, code := lf.Write([]byte("x"), 1<<40); code != fuse.EFBIG {
+		t.Errorf("Write past the limit: got %v, want EFBIG", code)
+	}
+	if code := lf.Truncate(11); code != fuse.EFBIG {
+		t.Errorf("Truncate past the limit: got %v, want EFBIG", code)
+	}
+	if code := lf.Truncate(5); !code.Ok() {
+		t.Errorf("Truncate: %v", code)
+	}
+	var a fuse.Attr
+	if code := lf.GetAttr(&a); !code.Ok() || a.Size != 5 {
+		t.Errorf("GetAttr: size %d, %v, want 5", a.Size, code)
+	}
+}
+
+func TestLoopbackFileReleased(t *testing.T) {
+	f, err := ioutil.TempFile("", "go-fuse-released")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	lf := NewLoopbackFile(f)
+	lf.Release()
+
+	// Another open may get the same descriptor number.
+	other, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer other.Close()
+
+	if _, code := lf.Read(make([]byte, 10), 0); code != fuse.EBADF {
+		t.Errorf("Read: got %v, want EBADF", code)
+	}
+	if _, code := lf.Write([]byte("x"), 0); code != fuse.EBADF {
+		t.Errorf("Write: got %v, want EBADF", code)
+	}
+	if code := lf.Fsync(0); code != fuse.EBADF {
+		t.Errorf("Fsync: got %v, want EBADF", code)
+	}
+	var a fuse.Attr
+	if code := lf.GetAttr(&a); code != fuse.EBADF {
+		t.Errorf("GetAttr: got %v, want EBADF", code)
+	}
+	// A second release is harmless.
+	lf.Release()
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -36,6 +37,10 @@ type FileSystemConnector struct {
 
 	// The root of the FUSE file system.
 	rootNode *Inode
+
+	// The open files, for OpenHandles.
+	handlesMu sync.Mutex
+	handles   map[*openedFile]openHandle
 }
 
 // NewOptions generates FUSE options that correspond to libfuse's
@@ -57,6 +62,7 @@ func NewFileSystemConnector(root Node, opts *Options) (c *FileSystemConnector) {
 		opts = NewOptions()
 	}
 	c.inodeMap = newHandleMap(opts.PortableInodes)
+	c.handles = map[*openedFile]openHandle{}
 	c.rootNode = newInode(true, root)
 
 	// Make sure we don't reuse generation numbers.
@@ -99,7 +105,7 @@ func (c *FileSystemConnector) verify() {
 // childLookup fills entry information for a newly created child inode
 func (c *rawBridge) childLookup(out *fuse.EntryOut, n *Inode, context *fuse.Context) {
 	n.Node().GetAttr((*fuse.Attr)(&out.Attr), nil, context)
-	n.mount.fillEntry(out)
+	n.mount.fillEntry(out, n)
 	out.Ino = c.fsConn().lookupUpdate(n)
 	out.NodeId = out.Ino
 	if out.Nlink == 0 {
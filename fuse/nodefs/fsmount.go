@@ -3,6 +3,8 @@ package nodefs
 import (
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -15,6 +17,17 @@ type openedFile struct {
 	WithFlags
 
 	dir *connectorDir
+
+	// When the file was opened, and whether it was released,
+	// possibly by CloseStaleHandles before the kernel did.
+	opened time.Time
+	closed uint32
+}
+
+// markClosed marks the file released. It returns false if it was
+// already.
+func (f *openedFile) markClosed() bool {
+	return atomic.CompareAndSwapUint32(&f.closed, 0, 1)
 }
 
 type fileSystemMount struct {
@@ -59,17 +72,34 @@ func (m *fileSystemMount) setOwner(attr *fuse.Attr) {
 	}
 }
 
-func (m *fileSystemMount) fillEntry(out *fuse.EntryOut) {
-	splitDuration(m.options.EntryTimeout, &out.EntryValid, &out.EntryValidNsec)
-	splitDuration(m.options.AttrTimeout, &out.AttrValid, &out.AttrValidNsec)
+// timeouts returns the entry and attribute timeouts for n.
+func (m *fileSystemMount) timeouts(n *Inode) (entry time.Duration, attr time.Duration) {
+	entry, attr = m.options.EntryTimeout, m.options.AttrTimeout
+	if cn, ok := n.fsInode.(CacheTimeoutNode); ok {
+		e, a := cn.CacheTimeouts()
+		if e >= 0 {
+			entry = e
+		}
+		if a >= 0 {
+			attr = a
+		}
+	}
+	return entry, attr
+}
+
+func (m *fileSystemMount) fillEntry(out *fuse.EntryOut, n *Inode) {
+	entry, attr := m.timeouts(n)
+	splitDuration(entry, &out.EntryValid, &out.EntryValidNsec)
+	splitDuration(attr, &out.AttrValid, &out.AttrValidNsec)
 	m.setOwner(&out.Attr)
 	if out.Mode&fuse.S_IFDIR == 0 && out.Nlink == 0 {
 		out.Nlink = 1
 	}
 }
 
-func (m *fileSystemMount) fillAttr(out *fuse.AttrOut, nodeId uint64) {
-	splitDuration(m.options.AttrTimeout, &out.AttrValid, &out.AttrValidNsec)
+func (m *fileSystemMount) fillAttr(out *fuse.AttrOut, n *Inode, nodeId uint64) {
+	_, attr := m.timeouts(n)
+	splitDuration(attr, &out.AttrValid, &out.AttrValidNsec)
 	m.setOwner(&out.Attr)
 	out.Ino = nodeId
 }
@@ -79,6 +109,9 @@ func (m *fileSystemMount) getOpenedFile(h uint64) *openedFile {
 	if h != 0 {
 		b = (*openedFile)(unsafe.Pointer(m.openFiles.Decode(h)))
 	}
+	if b != nil && atomic.LoadUint32(&b.closed) != 0 {
+		return closedHandle
+	}
 
 	if b != nil && m.connector.debug && b.WithFlags.Description != "" {
 		log.Printf("File %d = %q", h, b.WithFlags.Description)
@@ -90,23 +123,11 @@ func (m *fileSystemMount) unregisterFileHandle(handle uint64, node *Inode) *open
 	_, obj := m.openFiles.Forget(handle, 1)
 	opened := (*openedFile)(unsafe.Pointer(obj))
 	node.openFilesMutex.Lock()
-	idx := -1
-	for i, v := range node.openFiles {
-		if v == opened {
-			idx = i
-			break
-		}
-	}
-
-	l := len(node.openFiles)
-	if idx == l-1 {
-		node.openFiles[idx] = nil
-	} else {
-		node.openFiles[idx] = node.openFiles[l-1]
-	}
-	node.openFiles = node.openFiles[:l-1]
+	node.removeOpenFile(opened)
 	node.openFilesMutex.Unlock()
-
+	if opened.dir == nil {
+		m.connector.removeHandle(opened)
+	}
 	return opened
 }
 
@@ -118,6 +139,7 @@ func (m *fileSystemMount) registerFileHandle(node *Inode, dir *connectorDir, f F
 			File:      f,
 			OpenFlags: flags,
 		},
+		opened: time.Now(),
 	}
 
 	for {
@@ -138,6 +160,9 @@ func (m *fileSystemMount) registerFileHandle(node *Inode, dir *connectorDir, f F
 	node.openFiles = append(node.openFiles, b)
 	handle := m.openFiles.Register(&b.handled)
 	node.openFilesMutex.Unlock()
+	if dir == nil {
+		m.connector.addHandle(b, node, handle)
+	}
 	return handle, b
 }
 
@@ -21,6 +21,10 @@ func (c *FileSystemConnector) RawFS() fuse.RawFileSystem {
 type rawBridge FileSystemConnector
 
 func (c *rawBridge) Fsync(input *fuse.FsyncIn) fuse.Status {
+	node := c.toInode(input.NodeId)
+	if opened := node.mount.getOpenedFile(input.Fh); opened != nil {
+		return opened.WithFlags.File.Fsync(int(input.FsyncFlags))
+	}
 	return fuse.ENOSYS
 }
 
@@ -62,6 +66,20 @@ func (c *FileSystemConnector) lookupMountUpdate(out *fuse.Attr, mount *fileSyste
 }
 
 func (c *FileSystemConnector) internalLookup(out *fuse.Attr, parent *Inode, name string, header *fuse.InHeader) (node *Inode, code fuse.Status) {
+	// The kernel resolves "." and ".." itself, except for NFS
+	// exports, where it looks up ".." to reconnect a directory
+	// handle to the tree.
+	switch name {
+	case ".":
+		return parent, parent.fsInode.GetAttr(out, nil, &header.Context)
+	case "..":
+		p := parent.parent()
+		if p == nil {
+			return nil, fuse.ENOENT
+		}
+		return p, p.fsInode.GetAttr(out, nil, &header.Context)
+	}
+
 	child := parent.GetChild(name)
 	if child != nil && child.mountPoint != nil {
 		return c.lookupMountUpdate(out, child.mountPoint)
@@ -97,9 +115,16 @@ func (c *rawBridge) Lookup(header *fuse.InHeader, name string, out *fuse.EntryOu
 		log.Println("Lookup returned fuse.OK with nil child", name)
 	}
 
-	child.mount.fillEntry(out)
-	out.NodeId = c.fsConn().lookupUpdate(child)
-	out.Generation = child.generation
+	child.mount.fillEntry(out, child)
+	if child == c.rootNode {
+		// Looking up ".." may reach the root, which the
+		// kernel knows as nodeid 1, with generation 0.
+		out.NodeId = fuse.FUSE_ROOT_ID
+		out.Generation = 0
+	} else {
+		out.NodeId = c.fsConn().lookupUpdate(child)
+		out.Generation = child.generation
+	}
 	out.Ino = out.NodeId
 
 	return fuse.OK
@@ -112,25 +137,71 @@ func (c *rawBridge) Forget(nodeID, nlookup uint64) {
 func (c *rawBridge) GetAttr(input *fuse.GetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
 	node := c.toInode(input.NodeId)
 
-	var f File
-	if input.Flags()&fuse.FUSE_GETATTR_FH != 0 {
-		if opened := node.mount.getOpenedFile(input.Fh()); opened != nil {
-			f = opened.WithFlags.File
-		}
-	}
-
+	f := node.getattrFile(input.Flags(), input.Fh())
 	dest := (*fuse.Attr)(&out.Attr)
 	code = node.fsInode.GetAttr(dest, f, &input.Context)
 	if !code.Ok() {
 		return code
 	}
 
-	node.mount.fillAttr(out, input.NodeId)
+	node.mount.fillAttr(out, node, input.NodeId)
+	return fuse.OK
+}
+
+func (c *rawBridge) Statx(input *fuse.StatxIn, out *fuse.StatxOut) (code fuse.Status) {
+	node := c.toInode(input.NodeId)
+	sn, ok := node.fsInode.(StatxNode)
+	if !ok {
+		return fuse.ENOSYS
+	}
+
+	f := node.getattrFile(input.GetattrFlags, input.Fh)
+	attributes, mask, code := sn.StatxAttributes(f, &input.Context)
+	if !code.Ok() {
+		return code
+	}
+	var attr fuse.Attr
+	code = node.fsInode.GetAttr(&attr, f, &input.Context)
+	if !code.Ok() {
+		return code
+	}
+	node.mount.setOwner(&attr)
+	attr.Ino = input.NodeId
+	out.Stat.FromAttr(&attr)
+	out.Stat.Attributes = attributes & mask
+	out.Stat.AttributesMask = mask
+	_, attrTimeout := node.mount.timeouts(node)
+	splitDuration(attrTimeout, &out.AttrValid, &out.AttrValidNsec)
 	return fuse.OK
 }
 
 func (c *rawBridge) OpenDir(input *fuse.OpenIn, out *fuse.OpenOut) (code fuse.Status) {
 	node := c.toInode(input.NodeId)
+	var dirFlags uint32
+	if fn, ok := node.fsInode.(OpenDirFlagsNode); ok {
+		dirFlags = fn.OpenDirFlags(&input.Context)
+	}
+	if sn, ok := node.fsInode.(DirStreamNode); ok {
+		ds, code := sn.OpenDirStream(&input.Context)
+		if code.Ok() {
+			de := &connectorDir{
+				node:      node.Node(),
+				dirStream: ds,
+				extra: append(node.getMountDirEntries(),
+					fuse.DirEntry{Mode: fuse.S_IFDIR, Name: "."},
+					fuse.DirEntry{Mode: fuse.S_IFDIR, Name: ".."}),
+				rawFS: c,
+			}
+			h, opened := node.mount.registerFileHandle(node, de, nil, input.Flags)
+			out.OpenFlags = opened.FuseFlags | dirFlags
+			out.Fh = h
+			return fuse.OK
+		}
+		if code != fuse.ENOSYS {
+			return code
+		}
+	}
+
 	stream, err := node.fsInode.OpenDir(&input.Context)
 	if err != fuse.OK {
 		return err
@@ -144,7 +215,7 @@ func (c *rawBridge) OpenDir(input *fuse.OpenIn, out *fuse.OpenOut) (code fuse.St
 		rawFS: c,
 	}
 	h, opened := node.mount.registerFileHandle(node, de, nil, input.Flags)
-	out.OpenFlags = opened.FuseFlags
+	out.OpenFlags = opened.FuseFlags | dirFlags
 	out.Fh = h
 	return fuse.OK
 }
@@ -176,18 +247,19 @@ func (c *rawBridge) Open(input *fuse.OpenIn, out *fuse.OpenOut) (status fuse.Sta
 func (c *rawBridge) SetAttr(input *fuse.SetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
 	node := c.toInode(input.NodeId)
 
+	// The kernel only sends a handle along with a size change,
+	// for ftruncate(2).
 	var f File
-	if input.Valid&fuse.FATTR_FH != 0 {
-		opened := node.mount.getOpenedFile(input.Fh)
-		f = opened.WithFlags.File
+	if input.Valid&(fuse.FATTR_FH|fuse.FATTR_SIZE) == fuse.FATTR_FH|fuse.FATTR_SIZE {
+		f = node.getattrFile(fuse.FUSE_GETATTR_FH, input.Fh)
 	}
 
 	if code.Ok() && input.Valid&fuse.FATTR_MODE != 0 {
 		permissions := uint32(07777) & input.Mode
-		code = node.fsInode.Chmod(f, permissions, &input.Context)
+		code = node.fsInode.Chmod(nil, permissions, &input.Context)
 	}
 	if code.Ok() && (input.Valid&(fuse.FATTR_UID|fuse.FATTR_GID) != 0) {
-		code = node.fsInode.Chown(f, uint32(input.Uid), uint32(input.Gid), &input.Context)
+		code = node.fsInode.Chown(nil, uint32(input.Uid), uint32(input.Gid), &input.Context)
 	}
 	if code.Ok() && input.Valid&fuse.FATTR_SIZE != 0 {
 		code = node.fsInode.Truncate(f, input.Size, &input.Context)
@@ -215,7 +287,7 @@ func (c *rawBridge) SetAttr(input *fuse.SetAttrIn, out *fuse.AttrOut) (code fuse
 			}
 		}
 
-		code = node.fsInode.Utimens(f, atime, mtime, &input.Context)
+		code = node.fsInode.Utimens(nil, atime, mtime, &input.Context)
 	}
 
 	if !code.Ok() {
@@ -225,9 +297,9 @@ func (c *rawBridge) SetAttr(input *fuse.SetAttrIn, out *fuse.AttrOut) (code fuse
 	// Must call GetAttr(); the filesystem may override some of
 	// the changes we effect here.
 	attr := (*fuse.Attr)(&out.Attr)
-	code = node.fsInode.GetAttr(attr, nil, &input.Context)
+	code = node.fsInode.GetAttr(attr, f, &input.Context)
 	if code.Ok() {
-		node.mount.fillAttr(out, input.NodeId)
+		node.mount.fillAttr(out, node, input.NodeId)
 	}
 	return code
 }
@@ -239,11 +311,74 @@ func (c *rawBridge) Fallocate(input *fuse.FallocateIn) (code fuse.Status) {
 	return n.fsInode.Fallocate(opened, input.Offset, input.Length, input.Mode, &input.Context)
 }
 
+func (c *rawBridge) CopyFileRange(input *fuse.CopyFileRangeIn) (written uint32, code fuse.Status) {
+	n := c.toInode(input.NodeId)
+	src := n.mount.getOpenedFile(input.FhIn)
+	dstNode := c.toInode(input.NodeIdOut)
+	dst := dstNode.mount.getOpenedFile(input.FhOut)
+	if src == nil || dst == nil {
+		return 0, fuse.EBADF
+	}
+	if n.mount != dstNode.mount {
+		return 0, fuse.EXDEV
+	}
+	f, ok := src.WithFlags.File.(CopyRangeFile)
+	if !ok {
+		return 0, fuse.EOPNOTSUPP
+	}
+	return f.CopyFileRange(dst.WithFlags.File, input.OffIn, input.OffOut, input.Len, uint32(input.Flags))
+}
+
+func (c *rawBridge) SetupMapping(input *fuse.SetupMappingIn) (code fuse.Status) {
+	n := c.toInode(input.NodeId)
+	opened := n.mount.getOpenedFile(input.Fh)
+	if opened == nil {
+		return fuse.EBADF
+	}
+	return opened.WithFlags.File.SetupMapping(input.Foffset, input.Len, input.Moffset, input.Flags)
+}
+
+// RemoveMapping does not carry a file handle; mappings belong to the
+// inode, so any open file for it will do.
+func (c *rawBridge) RemoveMapping(input *fuse.RemoveMappingIn, mappings []fuse.RemoveMappingOne) (code fuse.Status) {
+	n := c.toInode(input.NodeId)
+	f := n.AnyFile()
+	if f == nil {
+		return fuse.EBADF
+	}
+	for _, m := range mappings {
+		if code = f.RemoveMapping(m.Moffset, m.Len); !code.Ok() {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+func (c *rawBridge) SetVolumeName(name string) (code fuse.Status) {
+	if v, ok := c.rootNode.Node().(VolumeNameNode); ok {
+		return v.SetVolumeName(name)
+	}
+	return fuse.ENOSYS
+}
+
+// Capabilities are those of the root Node.
+func (c *rawBridge) Capabilities() fuse.CapSet {
+	return fuse.Capabilities(c.rootNode.Node())
+}
+
 func (c *rawBridge) Readlink(header *fuse.InHeader) (out []byte, code fuse.Status) {
 	n := c.toInode(header.NodeId)
 	return n.fsInode.Readlink(&header.Context)
 }
 
+func (c *rawBridge) CanonicalPath(header *fuse.InHeader) (path string, code fuse.Status) {
+	n := c.toInode(header.NodeId)
+	if cp, ok := n.fsInode.(CanonicalPathNode); ok {
+		return cp.CanonicalPath(&header.Context)
+	}
+	return "", fuse.ENOSYS
+}
+
 func (c *rawBridge) Mknod(input *fuse.MknodIn, name string, out *fuse.EntryOut) (code fuse.Status) {
 	parent := c.toInode(input.NodeId)
 
@@ -287,25 +422,56 @@ func (c *rawBridge) Symlink(header *fuse.InHeader, pointedTo string, linkName st
 	return code
 }
 
-func (c *rawBridge) Rename(input *fuse.RenameIn, oldName string, newName string) (code fuse.Status) {
-	oldParent := c.toInode(input.NodeId)
+// renameParents returns the directories of a rename from oldName
+// in oldDir to newDir, checking that the rename stays within a
+// mount and does not move a mount point.
+func (c *rawBridge) renameParents(oldDir uint64, oldName string, newDir uint64) (oldParent *Inode, newParent *Inode, code fuse.Status) {
+	oldParent = c.toInode(oldDir)
 
 	child := oldParent.GetChild(oldName)
 	if child == nil {
-		return fuse.ENOENT
+		return nil, nil, fuse.ENOENT
 	}
 	if child.mountPoint != nil {
-		return fuse.EBUSY
+		return nil, nil, fuse.EBUSY
 	}
 
-	newParent := c.toInode(input.Newdir)
+	newParent = c.toInode(newDir)
 	if oldParent.mount != newParent.mount {
-		return fuse.EXDEV
+		return nil, nil, fuse.EXDEV
 	}
+	return oldParent, newParent, fuse.OK
+}
 
+func (c *rawBridge) Rename(input *fuse.RenameIn, oldName string, newName string) (code fuse.Status) {
+	oldParent, newParent, code := c.renameParents(input.NodeId, oldName, input.Newdir)
+	if !code.Ok() {
+		return code
+	}
 	return oldParent.fsInode.Rename(oldName, newParent.fsInode, newName, &input.Context)
 }
 
+func (c *rawBridge) Rename2(input *fuse.Rename2In, oldName string, newName string) (code fuse.Status) {
+	if input.Flags == 0 {
+		return c.Rename(&fuse.RenameIn{InHeader: input.InHeader, Newdir: input.Newdir}, oldName, newName)
+	}
+	oldParent, newParent, code := c.renameParents(input.NodeId, oldName, input.Newdir)
+	if !code.Ok() {
+		return code
+	}
+	if input.Flags&fuse.RENAME_EXCHANGE != 0 {
+		// The target moves too.
+		if target := newParent.GetChild(newName); target != nil && target.mountPoint != nil {
+			return fuse.EBUSY
+		}
+	}
+	r, ok := oldParent.fsInode.(Rename2Node)
+	if !ok {
+		return fuse.EINVAL
+	}
+	return r.Rename2(oldName, newParent.fsInode, newName, input.Flags, &input.Context)
+}
+
 func (c *rawBridge) Link(input *fuse.LinkIn, name string, out *fuse.EntryOut) (code fuse.Status) {
 	existing := c.toInode(input.Oldnodeid)
 	parent := c.toInode(input.NodeId)
@@ -343,18 +509,46 @@ func (c *rawBridge) Create(input *fuse.CreateIn, name string, out *fuse.CreateOu
 	return code
 }
 
+func (c *rawBridge) Tmpfile(input *fuse.CreateIn, out *fuse.CreateOut) (code fuse.Status) {
+	parent := c.toInode(input.NodeId)
+	tn, ok := parent.fsInode.(TmpfileNode)
+	if !ok {
+		return fuse.ENOSYS
+	}
+	f, node, code := tn.Tmpfile(uint32(input.Flags), input.Mode, &input.Context)
+	if !code.Ok() {
+		return code
+	}
+
+	child := newInode(false, node)
+	child.mount = parent.mount
+	// The file has no name to stat it by, so register the handle
+	// before the lookup, for GetAttr to find it.
+	handle, opened := parent.mount.registerFileHandle(child, nil, f, input.Flags)
+	c.childLookup(&out.EntryOut, child, &input.Context)
+
+	out.OpenOut.OpenFlags = opened.FuseFlags
+	out.OpenOut.Fh = handle
+	return code
+}
+
 func (c *rawBridge) Release(input *fuse.ReleaseIn) {
 	if input.Fh != 0 {
 		node := c.toInode(input.NodeId)
 		opened := node.mount.unregisterFileHandle(input.Fh, node)
-		opened.WithFlags.File.Release()
+		if opened.markClosed() {
+			opened.WithFlags.File.Release()
+		}
 	}
 }
 
 func (c *rawBridge) ReleaseDir(input *fuse.ReleaseIn) {
 	if input.Fh != 0 {
 		node := c.toInode(input.NodeId)
-		node.mount.unregisterFileHandle(input.Fh, node)
+		opened := node.mount.unregisterFileHandle(input.Fh, node)
+		if opened.dir != nil {
+			opened.dir.release()
+		}
 	}
 }
 
@@ -436,8 +630,23 @@ func (c *rawBridge) Flush(input *fuse.FlushIn) fuse.Status {
 	node := c.toInode(input.NodeId)
 	opened := node.mount.getOpenedFile(input.Fh)
 
-	if opened != nil {
-		return opened.WithFlags.File.Flush()
+	if opened == nil {
+		return fuse.OK
 	}
-	return fuse.OK
+	if f := findFlushOwnerFile(opened.WithFlags.File); f != nil {
+		return f.FlushOwner(input.LockOwner)
+	}
+	return opened.WithFlags.File.Flush()
+}
+
+// findFlushOwnerFile returns the first File in the InnerFile chain of
+// file that implements FlushOwnerFile, or nil.
+func findFlushOwnerFile(file File) FlushOwnerFile {
+	for file != nil {
+		if f, ok := file.(FlushOwnerFile); ok {
+			return f
+		}
+		file = file.InnerFile()
+	}
+	return nil
 }
@@ -0,0 +1,66 @@
+package nodefs
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// getattrNode records the file that GetAttr was passed.
+type getattrNode struct {
+	Node
+	got File
+}
+
+func (n *getattrNode) Open(flags uint32, context *fuse.Context) (File, fuse.Status) {
+	return NewDefaultFile(), fuse.OK
+}
+
+func (n *getattrNode) GetAttr(out *fuse.Attr, file File, context *fuse.Context) fuse.Status {
+	n.got = file
+	out.Mode = fuse.S_IFREG | 0644
+	return fuse.OK
+}
+
+func TestGetAttrHandle(t *testing.T) {
+	root := &getattrNode{Node: NewDefaultNode()}
+	conn := NewFileSystemConnector(root, nil)
+	other := &getattrNode{Node: NewDefaultNode()}
+	root.Inode().NewChild("other", false, other)
+	rawFS := conn.RawFS()
+
+	var entry fuse.EntryOut
+	if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "other", &entry); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	open := func(node uint64) uint64 {
+		var out fuse.OpenOut
+		if code := rawFS.Open(&fuse.OpenIn{InHeader: fuse.InHeader{NodeId: node}}, &out); !code.Ok() {
+			t.Fatalf("Open: %v", code)
+		}
+		return out.Fh
+	}
+	rootFh, otherFh := open(fuse.FUSE_ROOT_ID), open(entry.NodeId)
+
+	for _, c := range []struct {
+		name  string
+		flags uint32
+		fh    uint64
+		file  bool
+	}{
+		{"with handle", fuse.FUSE_GETATTR_FH, rootFh, true},
+		{"without handle", 0, rootFh, false},
+		{"handle of other node", fuse.FUSE_GETATTR_FH, otherFh, false},
+		{"unknown handle", fuse.FUSE_GETATTR_FH, 1 << 20, false},
+	} {
+		root.got = nil
+		in := &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, Flags_: c.flags, Fh_: c.fh}
+		var out fuse.AttrOut
+		if code := rawFS.GetAttr(in, &out); !code.Ok() {
+			t.Fatalf("%s: GetAttr: %v", c.name, code)
+		}
+		if (root.got != nil) != c.file {
+			t.Errorf("%s: GetAttr got file %v, want file: %v", c.name, root.got, c.file)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package nodefs
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestLookupDotDot(t *testing.T) {
+	rawFS := NewFileSystemConnector(NewMemNodeFSRoot(""), nil).RawFS()
+
+	mkdir := func(parent uint64, name string) uint64 {
+		in := &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: parent}, Mode: 0755}
+		var out fuse.EntryOut
+		if code := rawFS.Mkdir(in, name, &out); !code.Ok() {
+			t.Fatalf("Mkdir(%q): %v", name, code)
+		}
+		return out.NodeId
+	}
+	lookup := func(parent uint64, name string) uint64 {
+		var out fuse.EntryOut
+		if code := rawFS.Lookup(&fuse.InHeader{NodeId: parent}, name, &out); !code.Ok() {
+			t.Fatalf("Lookup(%d, %q): %v", parent, name, code)
+		}
+		if !out.Attr.IsDir() {
+			t.Errorf("Lookup(%d, %q): got mode %o, want a directory", parent, name, out.Attr.Mode)
+		}
+		return out.NodeId
+	}
+
+	sub := mkdir(fuse.FUSE_ROOT_ID, "sub")
+	deeper := mkdir(sub, "deeper")
+
+	for _, c := range []struct {
+		parent uint64
+		name   string
+		want   uint64
+	}{
+		{deeper, "..", sub},
+		{sub, "..", fuse.FUSE_ROOT_ID},
+		{fuse.FUSE_ROOT_ID, "..", fuse.FUSE_ROOT_ID},
+		{deeper, ".", deeper},
+		{fuse.FUSE_ROOT_ID, ".", fuse.FUSE_ROOT_ID},
+	} {
+		if got := lookup(c.parent, c.name); got != c.want {
+			t.Errorf("Lookup(%d, %q): got node %d, want %d", c.parent, c.name, got, c.want)
+		}
+	}
+}
+
+type cachedDirNode struct {
+	Node
+}
+
+func (n *cachedDirNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	return []fuse.DirEntry{{Mode: fuse.S_IFREG, Name: "file"}}, fuse.OK
+}
+
+func (n *cachedDirNode) OpenDirFlags(context *fuse.Context) uint32 {
+	return fuse.FOPEN_CACHE_DIR | fuse.FOPEN_KEEP_CACHE
+}
+
+func TestOpenDirFlags(t *testing.T) {
+	for _, c := range []struct {
+		root Node
+		want uint32
+	}{
+		{&cachedDirNode{NewDefaultNode()}, fuse.FOPEN_CACHE_DIR | fuse.FOPEN_KEEP_CACHE},
+		{NewMemNodeFSRoot(""), 0},
+	} {
+		rawFS := NewFileSystemConnector(c.root, nil).RawFS()
+		in := &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}}
+		var out fuse.OpenOut
+		if code := rawFS.OpenDir(in, &out); !code.Ok() {
+			t.Fatalf("OpenDir: %v", code)
+		}
+		if out.OpenFlags != c.want {
+			t.Errorf("%T: got flags %x, want %x", c.root, out.OpenFlags, c.want)
+		}
+		rawFS.ReleaseDir(&fuse.ReleaseIn{InHeader: in.InHeader, Fh: out.Fh})
+	}
+}
+
+func TestLookupForget(t *testing.T) {
+	conn := NewFileSystemConnector(NewMemNodeFSRoot(""), nil)
+	rawFS := conn.RawFS()
+
+	in := &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, Mode: 0755}
+	var out fuse.EntryOut
+	if code := rawFS.Mkdir(in, "sub", &out); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	id := out.NodeId
+	before := conn.InodeHandleCount()
+
+	// Each Lookup returns the same node and takes another
+	// reference to it, on top of the one from Mkdir.
+	for i := 0; i < 2; i++ {
+		var out fuse.EntryOut
+		if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "sub", &out); !code.Ok() {
+			t.Fatalf("Lookup: %v", code)
+		}
+		if out.NodeId != id {
+			t.Errorf("Lookup %d: got node %d, want %d", i, out.NodeId, id)
+		}
+		if out.Ino != id {
+			t.Errorf("Lookup %d: got ino %d, want %d", i, out.Ino, id)
+		}
+	}
+	if got := conn.InodeHandleCount(); got != before {
+		t.Errorf("Lookup changed the number of nodes from %d to %d", before, got)
+	}
+
+	rawFS.Forget(id, 2)
+	if !conn.inodeMap.Has(id) {
+		t.Fatalf("node %d forgotten while still referenced", id)
+	}
+	rawFS.Forget(id, 1)
+	if conn.inodeMap.Has(id) {
+		t.Errorf("node %d still registered after forgetting all references", id)
+	}
+	if got := conn.InodeHandleCount(); got != before-1 {
+		t.Errorf("got %d nodes after Forget, want %d", got, before-1)
+	}
+}
+
+// ownerLockFile records which lock owners hold a lock on it.
+type ownerLockFile struct {
+	File
+	locks map[uint64]bool
+}
+
+func (f *ownerLockFile) FlushOwner(owner uint64) fuse.Status {
+	delete(f.locks, owner)
+	return f.File.Flush()
+}
+
+type ownerLockNode struct {
+	Node
+	file File
+}
+
+func (n *ownerLockNode) Open(flags uint32, context *fuse.Context) (File, fuse.Status) {
+	return n.file, fuse.OK
+}
+
+func TestFlushLockOwner(t *testing.T) {
+	file := &ownerLockFile{
+		File:  NewDefaultFile(),
+		locks: map[uint64]bool{1: true, 2: true},
+	}
+	node := &ownerLockNode{NewDefaultNode(), file}
+	rawFS := NewFileSystemConnector(node, nil).RawFS()
+
+	in := &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}}
+	var out fuse.OpenOut
+	if code := rawFS.Open(in, &out); !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	if code := rawFS.Flush(&fuse.FlushIn{InHeader: in.InHeader, Fh: out.Fh, LockOwner: 1}); !code.Ok() {
+		t.Fatalf("Flush: %v", code)
+	}
+	if file.locks[1] || !file.locks[2] {
+		t.Errorf("after flushing owner 1, got locks %v, want only owner 2", file.locks)
+	}
+	rawFS.Release(&fuse.ReleaseIn{InHeader: in.InHeader, Fh: out.Fh})
+
+	// Wrappers don't hide it.
+	node.file = NewLockingFile(&sync.Mutex{}, NewReadOnlyFile(file))
+	if code := rawFS.Open(in, &out); !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	if code := rawFS.Flush(&fuse.FlushIn{InHeader: in.InHeader, Fh: out.Fh, LockOwner: 2}); !code.Ok() {
+		t.Fatalf("Flush: %v", code)
+	}
+	if len(file.locks) != 0 {
+		t.Errorf("after flushing owner 2 through wrappers, got locks %v, want none", file.locks)
+	}
+	rawFS.Release(&fuse.ReleaseIn{InHeader: in.InHeader, Fh: out.Fh})
+}
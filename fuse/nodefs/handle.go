@@ -128,7 +128,7 @@ func (m *portableHandleMap) Forget(h uint64, count int) (forgotten bool, obj *ha
 
 func (m *portableHandleMap) Has(h uint64) bool {
 	m.RLock()
-	ok := m.handles[h] != nil
+	ok := h < uint64(len(m.handles)) && m.handles[h] != nil
 	m.RUnlock()
 	return ok
 }
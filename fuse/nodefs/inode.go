@@ -33,6 +33,10 @@ type Inode struct {
 	// All data below is protected by treeLock.
 	children map[string]*Inode
 
+	// parents counts the names of this inode in each directory
+	// of the same mount.
+	parents map[*Inode]int
+
 	// Non-nil if this inode is a mountpoint, ie. the Root of a
 	// NodeFileSystem.
 	mountPoint *fileSystemMount
@@ -63,6 +67,39 @@ func (n *Inode) AnyFile() (file File) {
 	return file
 }
 
+// getattrFile returns the file of the handle that came with a
+// GETATTR, STATX or SETATTR request. It is nil if the flags carry no
+// FUSE_GETATTR_FH, or if fh is not open on n, so that the attributes
+// are looked up by path.
+func (n *Inode) getattrFile(flags uint32, fh uint64) File {
+	if flags&fuse.FUSE_GETATTR_FH == 0 || !n.mount.openFiles.Has(fh) {
+		return nil
+	}
+	opened := n.mount.getOpenedFile(fh)
+	n.openFilesMutex.Lock()
+	defer n.openFilesMutex.Unlock()
+	for _, f := range n.openFiles {
+		if f == opened {
+			return f.WithFlags.File
+		}
+	}
+	return nil
+}
+
+// removeOpenFile drops f from the open files, if it is there. Must
+// be called with openFilesMutex held.
+func (n *Inode) removeOpenFile(f *openedFile) {
+	for i, v := range n.openFiles {
+		if v == f {
+			l := len(n.openFiles)
+			n.openFiles[i] = n.openFiles[l-1]
+			n.openFiles[l-1] = nil
+			n.openFiles = n.openFiles[:l-1]
+			return
+		}
+	}
+}
+
 // Children returns all children of this inode.
 func (n *Inode) Children() (out map[string]*Inode) {
 	n.mount.treeLock.RLock()
@@ -163,7 +200,16 @@ func (n *Inode) addChild(name string, child *Inode) {
 			log.Panicf("Already have an Inode with same name: %v: %v", name, ch)
 		}
 	}
+	if old := n.children[name]; old != nil {
+		old.rmParent(n)
+	}
 	n.children[name] = child
+	if child.mount == n.mount {
+		if child.parents == nil {
+			child.parents = make(map[*Inode]int, 1)
+		}
+		child.parents[n]++
+	}
 }
 
 // Must be called with treeLock for the mount held.
@@ -171,10 +217,40 @@ func (n *Inode) rmChild(name string) (ch *Inode) {
 	ch = n.children[name]
 	if ch != nil {
 		delete(n.children, name)
+		ch.rmParent(n)
 	}
 	return ch
 }
 
+// Must be called with treeLock for the mount held.
+func (n *Inode) rmParent(parent *Inode) {
+	if c := n.parents[parent]; c > 1 {
+		n.parents[parent] = c - 1
+	} else {
+		delete(n.parents, parent)
+	}
+}
+
+// parent returns the directory containing n. The root of a mount
+// returns the directory it is mounted in, and the root of the file
+// system returns itself. For an inode that is linked into several
+// directories, any of them is returned. It returns nil if n is
+// not in the tree.
+func (n *Inode) parent() *Inode {
+	if n.mountPoint != nil {
+		if n.mountPoint.parentInode == nil {
+			return n
+		}
+		return n.mountPoint.parentInode
+	}
+	n.mount.treeLock.RLock()
+	defer n.mount.treeLock.RUnlock()
+	for p := range n.parents {
+		return p
+	}
+	return nil
+}
+
 // Can only be called on untouched root inodes.
 func (n *Inode) mountFs(opts *Options) {
 	n.mountPoint = &fileSystemMount{
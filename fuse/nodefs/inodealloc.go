@@ -0,0 +1,83 @@
+package nodefs
+
+import (
+	"log"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// InodeAllocator hands out inode numbers for synthetic file systems,
+// which have no backing store to take them from. Numbers start after
+// the root (fuse.FUSE_ROOT_ID) and are unique among the allocated
+// ones. If numbers are recycled, the generation of a number is bumped
+// each time it is reused, so (ino, generation) pairs stay unique.
+//
+// This structure is thread-safe.
+type InodeAllocator interface {
+	// Allocate returns an unused inode number.
+	Allocate() uint64
+
+	// Release returns ino, so it may be handed out again.
+	Release(ino uint64)
+
+	// Generation returns the generation of ino, which should be
+	// reported for it in fuse.EntryOut.
+	Generation(ino uint64) uint64
+}
+
+type inodeAllocator struct {
+	mu      sync.Mutex
+	recycle bool
+	next    uint64
+	used    map[uint64]bool
+	free    []uint64
+	gens    map[uint64]uint64
+}
+
+// NewInodeAllocator returns an InodeAllocator. If recycle is set,
+// released numbers are reused, with a new generation.
+func NewInodeAllocator(recycle bool) InodeAllocator {
+	return &inodeAllocator{
+		recycle: recycle,
+		next:    fuse.FUSE_ROOT_ID + 1,
+		used:    map[uint64]bool{},
+		gens:    map[uint64]uint64{},
+	}
+}
+
+func (a *inodeAllocator) Allocate() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var ino uint64
+	if n := len(a.free); n > 0 {
+		ino = a.free[n-1]
+		a.free = a.free[:n-1]
+		a.gens[ino]++
+	} else {
+		ino = a.next
+		a.next++
+	}
+	a.used[ino] = true
+	return ino
+}
+
+func (a *inodeAllocator) Release(ino uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.used[ino] {
+		log.Panicf("release of unallocated inode %d", ino)
+	}
+	delete(a.used, ino)
+	if a.recycle {
+		a.free = append(a.free, ino)
+	}
+}
+
+func (a *inodeAllocator) Generation(ino uint64) uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.gens[ino]
+}
@@ -0,0 +1,55 @@
+package nodefs
+
+import (
+	"testing"
+)
+
+func TestInodeAllocatorRecycle(t *testing.T) {
+	a := NewInodeAllocator(true)
+
+	type key struct{ ino, gen uint64 }
+	seen := map[key]bool{}
+	live := map[uint64]bool{}
+	alloc := func() uint64 {
+		ino := a.Allocate()
+		if ino <= 1 {
+			t.Fatalf("got reserved inode %d", ino)
+		}
+		if live[ino] {
+			t.Fatalf("inode %d handed out twice", ino)
+		}
+		k := key{ino, a.Generation(ino)}
+		if seen[k] {
+			t.Fatalf("(ino, gen) %v reused", k)
+		}
+		seen[k] = true
+		live[ino] = true
+		return ino
+	}
+
+	var inos []uint64
+	for i := 0; i < 10; i++ {
+		inos = append(inos, alloc())
+	}
+	for round := 0; round < 3; round++ {
+		for _, ino := range inos[:5] {
+			a.Release(ino)
+			delete(live, ino)
+		}
+		for i := 0; i < 5; i++ {
+			inos[i] = alloc()
+		}
+	}
+	if len(seen) != 25 {
+		t.Errorf("got %d distinct pairs, want 25", len(seen))
+	}
+}
+
+func TestInodeAllocatorNoRecycle(t *testing.T) {
+	a := NewInodeAllocator(false)
+	first := a.Allocate()
+	a.Release(first)
+	if second := a.Allocate(); second == first {
+		t.Errorf("released inode %d was reused", first)
+	}
+}
@@ -97,3 +97,15 @@ func (f *lockingFile) Allocate(off uint64, size uint64, mode uint32) (code fuse.
 	defer f.mu.Unlock()
 	return f.file.Allocate(off, size, mode)
 }
+
+func (f *lockingFile) SetupMapping(foffset uint64, length uint64, moffset uint64, flags uint64) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.SetupMapping(foffset, length, moffset, flags)
+}
+
+func (f *lockingFile) RemoveMapping(moffset uint64, length uint64) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.RemoveMapping(moffset, length)
+}
@@ -0,0 +1,367 @@
+package nodefs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// The journal of a persistent MemNodeFs records each change to the
+// tree before it is applied. Each record is framed as a little-endian
+// uint32 payload length, a CRC-32 of the payload, and the payload as
+// JSON. A record that was torn by a crash fails the length or checksum
+// test, and it and anything after it are discarded on replay.
+//
+// After _MEM_JOURNAL_CHECKPOINT records, the journal is replaced
+// with a snapshot of the tree, so replay time stays bounded.
+
+const _MEM_JOURNAL_CHECKPOINT = 1024
+
+const _MEM_JOURNAL_HEADER = 8
+
+const (
+	_JOURNAL_CREATE = "create"
+	_JOURNAL_LINK   = "link"
+	_JOURNAL_UNLINK = "unlink"
+	_JOURNAL_RENAME = "rename"
+	_JOURNAL_ATTR   = "attr"
+)
+
+type memJournalRecord struct {
+	Op        string
+	Parent    int       `json:",omitempty"`
+	Name      string    `json:",omitempty"`
+	NewParent int       `json:",omitempty"`
+	NewName   string    `json:",omitempty"`
+	Node      int       `json:",omitempty"`
+	Attr      fuse.Attr `json:",omitempty"`
+	Link      string    `json:",omitempty"`
+}
+
+func encodeJournalRecord(rec *memJournalRecord) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, _MEM_JOURNAL_HEADER, _MEM_JOURNAL_HEADER+len(payload))
+	binary.LittleEndian.PutUint32(b, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(b[4:], crc32.ChecksumIEEE(payload))
+	return append(b, payload...), nil
+}
+
+// decodeJournal returns the intact records at the start of data, and
+// the length of data they take up.
+func decodeJournal(data []byte) (recs []*memJournalRecord, good int64) {
+	for len(data) >= _MEM_JOURNAL_HEADER {
+		sz := binary.LittleEndian.Uint32(data)
+		sum := binary.LittleEndian.Uint32(data[4:])
+		if uint64(len(data)-_MEM_JOURNAL_HEADER) < uint64(sz) {
+			break
+		}
+		payload := data[_MEM_JOURNAL_HEADER : _MEM_JOURNAL_HEADER+sz]
+		if crc32.ChecksumIEEE(payload) != sum {
+			break
+		}
+		rec := &memJournalRecord{}
+		if err := json.Unmarshal(payload, rec); err != nil {
+			break
+		}
+		recs = append(recs, rec)
+		good += int64(_MEM_JOURNAL_HEADER + sz)
+		data = data[_MEM_JOURNAL_HEADER+sz:]
+	}
+	return recs, good
+}
+
+type memJournal struct {
+	mu   sync.Mutex
+	name string
+	f    *os.File
+
+	// size is the length of the intact part of the file.
+	size int64
+
+	// records counts the records since the last checkpoint.
+	records int
+}
+
+// openMemJournal opens or creates the journal, and returns the
+// records it holds. A torn tail is cut off.
+func openMemJournal(name string) (*memJournal, []*memJournalRecord, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	recs, good := decodeJournal(data)
+	if good < int64(len(data)) {
+		log.Printf("journal %s: discarding %d bytes of torn records", name, int64(len(data))-good)
+		if err := f.Truncate(good); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+	return &memJournal{
+		name:    name,
+		f:       f,
+		size:    good,
+		records: len(recs),
+	}, recs, nil
+}
+
+// update appends rec to the journal, and then runs apply. Updates
+// are serialized, so a checkpoint never misses a logged record.
+func (j *memJournal) update(rec *memJournalRecord, apply func(), snapshot func() []*memJournalRecord) fuse.Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.records >= _MEM_JOURNAL_CHECKPOINT {
+		if err := j.checkpoint(snapshot()); err != nil {
+			log.Printf("journal %s: checkpoint failed: %v", j.name, err)
+		}
+	}
+
+	b, err := encodeJournalRecord(rec)
+	if err != nil {
+		return fuse.EIO
+	}
+	_, err = j.f.Write(b)
+	if err == nil {
+		err = j.f.Sync()
+	}
+	if err != nil {
+		// Don't leave a partial record for later ones to
+		// follow.
+		j.f.Truncate(j.size)
+		return fuse.ToStatus(err)
+	}
+	j.size += int64(len(b))
+	j.records++
+	apply()
+	return fuse.OK
+}
+
+// checkpoint replaces the journal with recs, which should recreate
+// the current tree.
+func (j *memJournal) checkpoint(recs []*memJournalRecord) error {
+	var buf bytes.Buffer
+	for _, r := range recs {
+		b, err := encodeJournalRecord(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+
+	tmp := j.name + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, j.name); err != nil {
+		f.Close()
+		return err
+	}
+
+	j.f.Close()
+	j.f = f
+	j.size = int64(buf.Len())
+	j.records = 0
+
+	// The rename is only durable once the directory is synced.
+	return syncDir(filepath.Dir(j.name))
+}
+
+// syncDir flushes the entries of a directory to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (j *memJournal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Close()
+}
+
+// NewPersistentMemNodeFSRoot is like NewMemNodeFSRoot, but also
+// keeps the tree structure and attributes in a journal next to the
+// backing store, named prefix + "journal". On startup, the journal is
+// replayed, so the tree survives restarts and crashes. The restored
+// tree becomes visible once the root is mounted.
+func NewPersistentMemNodeFSRoot(prefix string) (Node, error) {
+	fs := &memNodeFs{
+		backingStorePrefix: prefix,
+		clock:              fuse.RealClock,
+	}
+	fs.root = fs.newNode()
+
+	j, recs, err := openMemJournal(prefix + "journal")
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.replay(recs); err != nil {
+		j.close()
+		return nil, err
+	}
+	fs.journal = j
+	return fs.root, nil
+}
+
+// replay rebuilds the tree from journal records into the restored
+// maps of the nodes.
+func (fs *memNodeFs) replay(recs []*memJournalRecord) error {
+	nodes := map[int]*memNode{fs.root.id: fs.root}
+	dir := func(id int) (*memNode, error) {
+		n := nodes[id]
+		if n == nil {
+			return nil, fmt.Errorf("journal: unknown node %d", id)
+		}
+		if n.restored == nil {
+			n.restored = map[string]*memNode{}
+		}
+		return n, nil
+	}
+
+	for _, r := range recs {
+		switch r.Op {
+		case _JOURNAL_CREATE:
+			p, err := dir(r.Parent)
+			if err != nil {
+				return err
+			}
+			ch := &memNode{
+				Node: NewDefaultNode(),
+				fs:   fs,
+				id:   r.Node,
+				info: r.Attr,
+				link: r.Link,
+			}
+			nodes[ch.id] = ch
+			p.restored[r.Name] = ch
+			if ch.id >= fs.nextFree {
+				fs.nextFree = ch.id + 1
+			}
+		case _JOURNAL_LINK:
+			p, err := dir(r.Parent)
+			if err != nil {
+				return err
+			}
+			ch := nodes[r.Node]
+			if ch == nil {
+				return fmt.Errorf("journal: unknown node %d", r.Node)
+			}
+			p.restored[r.Name] = ch
+		case _JOURNAL_UNLINK:
+			p, err := dir(r.Parent)
+			if err != nil {
+				return err
+			}
+			delete(p.restored, r.Name)
+		case _JOURNAL_RENAME:
+			p, err := dir(r.Parent)
+			if err != nil {
+				return err
+			}
+			np, err := dir(r.NewParent)
+			if err != nil {
+				return err
+			}
+			if ch := p.restored[r.Name]; ch != nil {
+				delete(p.restored, r.Name)
+				np.restored[r.NewName] = ch
+				if r.Node == ch.id {
+					ch.info = r.Attr
+				}
+			}
+		case _JOURNAL_ATTR:
+			n := nodes[r.Node]
+			if n == nil {
+				return fmt.Errorf("journal: unknown node %d", r.Node)
+			}
+			n.info = r.Attr
+		default:
+			return fmt.Errorf("journal: unknown operation %q", r.Op)
+		}
+	}
+	return nil
+}
+
+// snapshot returns records that recreate the current tree.
+func (fs *memNodeFs) snapshot() []*memJournalRecord {
+	recs := []*memJournalRecord{{Op: _JOURNAL_ATTR, Node: fs.root.id, Attr: fs.root.getInfo()}}
+	seen := map[*memNode]bool{fs.root: true}
+
+	var walk func(n *memNode)
+	walk = func(n *memNode) {
+		for name, ch := range n.Inode().FsChildren() {
+			c, ok := ch.Node().(*memNode)
+			if !ok {
+				continue
+			}
+			if seen[c] {
+				recs = append(recs, &memJournalRecord{Op: _JOURNAL_LINK, Parent: n.id, Name: name, Node: c.id})
+				continue
+			}
+			seen[c] = true
+			info := c.getInfo()
+			recs = append(recs, &memJournalRecord{Op: _JOURNAL_CREATE, Parent: n.id, Name: name, Node: c.id, Attr: info, Link: c.link})
+			if info.IsDir() {
+				walk(c)
+			}
+		}
+	}
+	walk(fs.root)
+	return recs
+}
+
+// update logs rec if the file system is persistent, and then runs
+// apply.
+func (fs *memNodeFs) update(rec *memJournalRecord, apply func()) fuse.Status {
+	if fs.journal == nil {
+		apply()
+		return fuse.OK
+	}
+	return fs.journal.update(rec, apply, fs.snapshot)
+}
+
+// restoreChildren creates the Inodes for a tree read from the
+// journal.
+func (n *memNode) restoreChildren() {
+	for name, ch := range n.restored {
+		if ch.Inode() != nil {
+			n.Inode().AddChild(name, ch.Inode())
+			continue
+		}
+		n.Inode().NewChild(name, ch.info.IsDir(), ch)
+		ch.restoreChildren()
+	}
+	n.restored = nil
+}
@@ -0,0 +1,243 @@
+package nodefs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestMemJournalReplayTornRecord(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "go-fuse-memjournal_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	prefix := tmp + "/"
+
+	root, err := NewPersistentMemNodeFSRoot(prefix)
+	if err != nil {
+		t.Fatalf("NewPersistentMemNodeFSRoot: %v", err)
+	}
+	fs := root.(*memNode).fs
+	for _, r := range []*memJournalRecord{
+		{Op: _JOURNAL_CREATE, Parent: 0, Name: "dir", Node: 1, Attr: fuse.Attr{Mode: fuse.S_IFDIR | 0755}},
+		{Op: _JOURNAL_CREATE, Parent: 1, Name: "file", Node: 2, Attr: fuse.Attr{Mode: fuse.S_IFREG | 0644}},
+		{Op: _JOURNAL_LINK, Parent: 0, Name: "link", Node: 2},
+		{Op: _JOURNAL_RENAME, Parent: 1, Name: "file", NewParent: 1, NewName: "renamed"},
+		{Op: _JOURNAL_ATTR, Node: 2, Attr: fuse.Attr{Mode: fuse.S_IFREG | 0644, Size: 5}},
+	} {
+		if code := fs.update(r, func() {}); !code.Ok() {
+			t.Fatalf("update %v: %v", r, code)
+		}
+	}
+	fs.journal.close()
+
+	// Simulate a crash halfway through writing a record.
+	torn, err := encodeJournalRecord(&memJournalRecord{Op: _JOURNAL_UNLINK, Parent: 0, Name: "link"})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	journal := prefix + "journal"
+	good, err := os.Stat(journal)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	f, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	f.Write(torn[:len(torn)/2])
+	f.Close()
+
+	root, err = NewPersistentMemNodeFSRoot(prefix)
+	if err != nil {
+		t.Fatalf("NewPersistentMemNodeFSRoot after crash: %v", err)
+	}
+	defer root.(*memNode).fs.journal.close()
+
+	if fi, err := os.Stat(journal); err != nil || fi.Size() != good.Size() {
+		t.Errorf("torn record was not cut off: %v, %v", fi, err)
+	}
+
+	r := root.(*memNode)
+	dir := r.restored["dir"]
+	if dir == nil || !dir.info.IsDir() {
+		t.Fatalf("dir not restored: %v", r.restored)
+	}
+	file := dir.restored["renamed"]
+	if file == nil || dir.restored["file"] != nil {
+		t.Fatalf("rename not restored: %v", dir.restored)
+	}
+	if file.info.Size != 5 {
+		t.Errorf("got size %d, want 5", file.info.Size)
+	}
+	if r.restored["link"] != file {
+		t.Errorf("hard link not restored: %v", r.restored)
+	}
+	if file.filename() != prefix+"2" {
+		t.Errorf("got backing file %q, want %q", file.filename(), prefix+"2")
+	}
+	if n := r.fs.newNode(); n.id != 3 {
+		t.Errorf("got new id %d, want 3", n.id)
+	}
+}
+
+func TestPersistentMemNodeFs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "go-fuse-memjournal_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	prefix := tmp + "/backing"
+	mnt := tmp + "/mnt"
+	os.Mkdir(mnt, 0700)
+
+	mount := func() *fuse.Server {
+		root, err := NewPersistentMemNodeFSRoot(prefix)
+		if err != nil {
+			t.Fatalf("NewPersistentMemNodeFSRoot: %v", err)
+		}
+		state, _, err := MountRoot(mnt, root, nil)
+		if err != nil {
+			t.Fatalf("MountRoot: %v", err)
+		}
+		go state.Serve()
+		return state
+	}
+
+	state := mount()
+	if err := os.Mkdir(mnt+"/dir", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := ioutil.WriteFile(mnt+"/dir/file", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Rename(mnt+"/dir/file", mnt+"/dir/renamed"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := os.Symlink("dir/renamed", mnt+"/symlink"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	state.Unmount()
+
+	state = mount()
+	defer state.Unmount()
+	content, err := ioutil.ReadFile(mnt + "/symlink")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+	fi, err := os.Lstat(mnt + "/dir/renamed")
+	if err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if fi.Size() != 5 {
+		t.Errorf("got size %d, want 5", fi.Size())
+	}
+}
+
+func TestMemJournalRenameCtime(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "go-fuse-memjournal_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	prefix := tmp + "/"
+
+	clock := fuse.NewFakeClock(time.Unix(1000, 0))
+	root, err := NewPersistentMemNodeFSRoot(prefix)
+	if err != nil {
+		t.Fatalf("NewPersistentMemNodeFSRoot: %v", err)
+	}
+	root.(*memNode).fs.clock = clock
+	NewFileSystemConnector(root, nil)
+	ch, code := root.Mkdir("dir", 0755, nil)
+	if !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	if code := root.Rename("dir", NewDefaultNode(), "moved", nil); code != fuse.EXDEV {
+		t.Errorf("Rename to a foreign Node: got %v, want EXDEV", code)
+	}
+
+	clock.Advance(time.Second)
+	if code := root.Rename("dir", root, "moved", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	id := ch.Node().(*memNode).id
+	root.(*memNode).fs.journal.close()
+
+	data, err := ioutil.ReadFile(prefix + "journal")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	recs, _ := decodeJournal(data)
+	var renames, attrs int
+	for _, r := range recs {
+		switch {
+		case r.Op == _JOURNAL_RENAME:
+			renames++
+			if r.Node != id || r.Attr.Ctime != 1001 {
+				t.Errorf("rename record: got node %d, ctime %d; want %d, 1001", r.Node, r.Attr.Ctime, id)
+			}
+		case r.Op == _JOURNAL_ATTR && r.Node == id:
+			attrs++
+		}
+	}
+	if renames != 1 || attrs != 0 {
+		t.Errorf("got %d renames and %d attribute records for the node, want 1 and 0", renames, attrs)
+	}
+
+	root, err = NewPersistentMemNodeFSRoot(prefix)
+	if err != nil {
+		t.Fatalf("NewPersistentMemNodeFSRoot: %v", err)
+	}
+	defer root.(*memNode).fs.journal.close()
+	if moved := root.(*memNode).restored["moved"]; moved == nil || moved.info.Ctime != 1001 {
+		t.Errorf("restored %v, want ctime 1001", moved)
+	}
+}
+
+func TestMemJournalCreateFails(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "go-fuse-memjournal_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	prefix := tmp + "/"
+
+	root, err := NewPersistentMemNodeFSRoot(prefix)
+	if err != nil {
+		t.Fatalf("NewPersistentMemNodeFSRoot: %v", err)
+	}
+	NewFileSystemConnector(root, nil)
+
+	// A directory in the way of the backing file fails os.Create.
+	next := fmt.Sprintf("%s%d", prefix, root.(*memNode).fs.nextFree)
+	if err := os.Mkdir(next, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if _, _, code := root.Create("file", uint32(os.O_WRONLY), 0644, nil); code.Ok() {
+		t.Fatalf("Create succeeded without a backing file")
+	}
+	if ch := root.Inode().GetChild("file"); ch != nil {
+		t.Errorf("Create left child %v", ch)
+	}
+	root.(*memNode).fs.journal.close()
+
+	data, err := ioutil.ReadFile(prefix + "journal")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	recs, _ := decodeJournal(data)
+	for _, r := range recs {
+		if r.Op == _JOURNAL_CREATE && r.Name == "file" {
+			t.Errorf("journal has create record %v", r)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package nodefs
 import (
 	"fmt"
 	"os"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
@@ -13,8 +14,15 @@ import (
 // NewMemNodeFSRoot creates an in-memory node-based filesystem. Files
 // are written into a backing store under the given prefix.
 func NewMemNodeFSRoot(prefix string) Node {
+	return NewMemNodeFSRootWithClock(prefix, fuse.RealClock)
+}
+
+// NewMemNodeFSRootWithClock is like NewMemNodeFSRoot, but the
+// timestamps of the nodes are taken from clock.
+func NewMemNodeFSRootWithClock(prefix string, clock fuse.Clock) Node {
 	fs := &memNodeFs{
 		backingStorePrefix: prefix,
+		clock:              clock,
 	}
 	fs.root = fs.newNode()
 	return fs.root
@@ -23,9 +31,13 @@ func NewMemNodeFSRoot(prefix string) Node {
 type memNodeFs struct {
 	backingStorePrefix string
 	root               *memNode
+	clock              fuse.Clock
 
 	mutex    sync.Mutex
 	nextFree int
+
+	// If non-nil, changes to the tree are logged here.
+	journal *memJournal
 }
 
 func (fs *memNodeFs) String() string {
@@ -52,7 +64,7 @@ func (fs *memNodeFs) newNode() *memNode {
 		fs:   fs,
 		id:   fs.nextFree,
 	}
-	now := time.Now()
+	now := fs.clock.Now()
 	n.info.SetTimes(&now, &now, &now)
 	n.info.Mode = fuse.S_IFDIR | 0777
 	fs.nextFree++
@@ -60,6 +72,12 @@ func (fs *memNodeFs) newNode() *memNode {
 	return n
 }
 
+// touch sets the ctime of info to the time of the clock.
+func (fs *memNodeFs) touch(info *fuse.Attr) {
+	now := fs.clock.Now()
+	info.SetTimes(nil, nil, &now)
+}
+
 func (fs *memNodeFs) Filename(n *Inode) string {
 	mn := n.Node().(*memNode)
 	return mn.filename()
@@ -71,13 +89,88 @@ type memNode struct {
 	id int
 
 	link string
-	info fuse.Attr
+
+	// infoMu guards info, which Write changes outside the journal.
+	infoMu sync.Mutex
+	info   fuse.Attr
+
+	// Children read from the journal, which get Inodes once the
+	// file system is mounted.
+	restored map[string]*memNode
 }
 
-func (n *memNode) newNode(name string, isDir bool) *memNode {
+func (n *memNode) newNode(name string, mode uint32, link string) (*memNode, fuse.Status) {
+	if n.Inode().GetChild(name) != nil {
+		return nil, fuse.Status(syscall.EEXIST)
+	}
 	newNode := n.fs.newNode()
-	n.Inode().NewChild(name, isDir, newNode)
-	return newNode
+	newNode.info.Mode = mode
+	newNode.link = link
+	if code := n.addChild(name, newNode); !code.Ok() {
+		return nil, code
+	}
+	return newNode, n.changed(true)
+}
+
+// addChild logs and then adds a new node under name.
+func (n *memNode) addChild(name string, ch *memNode) fuse.Status {
+	return n.fs.update(&memJournalRecord{
+		Op:     _JOURNAL_CREATE,
+		Parent: n.id,
+		Name:   name,
+		Node:   ch.id,
+		Attr:   ch.info,
+		Link:   ch.link,
+	}, func() {
+		n.Inode().NewChild(name, ch.info.IsDir(), ch)
+	})
+}
+
+// getInfo returns a copy of the attributes.
+func (n *memNode) getInfo() fuse.Attr {
+	n.infoMu.Lock()
+	defer n.infoMu.Unlock()
+	return n.info
+}
+
+// setInfo logs and then stores new attributes.
+func (n *memNode) setInfo(info *fuse.Attr) fuse.Status {
+	return n.fs.update(&memJournalRecord{
+		Op:   _JOURNAL_ATTR,
+		Node: n.id,
+		Attr: *info,
+	}, func() {
+		n.storeInfo(info)
+	})
+}
+
+// storeInfo stores attributes that were logged.
+func (n *memNode) storeInfo(info *fuse.Attr) {
+	n.infoMu.Lock()
+	n.info = *info
+	n.infoMu.Unlock()
+}
+
+// changed updates the ctime after a change to the node's metadata.
+// If modified is set, the mtime is updated too, as for changes to
+// the entries of a directory.
+func (n *memNode) changed(modified bool) fuse.Status {
+	info := n.getInfo()
+	n.fs.touch(&info)
+	if modified {
+		info.Mtime, info.Mtimensec = info.Ctime, info.Ctimensec
+	}
+	return n.setInfo(&info)
+}
+
+func (n *memNode) OnMount(c *FileSystemConnector) {
+	n.restoreChildren()
+}
+
+func (n *memNode) OnUnmount() {
+	if n == n.fs.root && n.fs.journal != nil {
+		n.fs.journal.close()
+	}
 }
 
 func (n *memNode) filename() string {
@@ -97,17 +190,34 @@ func (n *memNode) StatFs() *fuse.StatfsOut {
 }
 
 func (n *memNode) Mkdir(name string, mode uint32, context *fuse.Context) (newNode *Inode, code fuse.Status) {
-	ch := n.newNode(name, true)
-	ch.info.Mode = mode | fuse.S_IFDIR
+	ch, code := n.newNode(name, mode|fuse.S_IFDIR, "")
+	if !code.Ok() {
+		return nil, code
+	}
 	return ch.Inode(), fuse.OK
 }
 
 func (n *memNode) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	ch := n.Inode().RmChild(name)
+	ch := n.Inode().GetChild(name)
 	if ch == nil {
 		return fuse.ENOENT
 	}
-	return fuse.OK
+	code = n.fs.update(&memJournalRecord{
+		Op:     _JOURNAL_UNLINK,
+		Parent: n.id,
+		Name:   name,
+	}, func() {
+		n.Inode().RmChild(name)
+	})
+	if !code.Ok() {
+		return code
+	}
+	if mn, ok := ch.Node().(*memNode); ok {
+		if code := mn.changed(false); !code.Ok() {
+			return code
+		}
+	}
+	return n.changed(true)
 }
 
 func (n *memNode) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
@@ -115,36 +225,128 @@ func (n *memNode) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
 }
 
 func (n *memNode) Symlink(name string, content string, context *fuse.Context) (newNode *Inode, code fuse.Status) {
-	ch := n.newNode(name, false)
-	ch.info.Mode = fuse.S_IFLNK | 0777
-	ch.link = content
-
+	ch, code := n.newNode(name, fuse.S_IFLNK|0777, content)
+	if !code.Ok() {
+		return nil, code
+	}
 	return ch.Inode(), fuse.OK
 }
 
 func (n *memNode) Rename(oldName string, newParent Node, newName string, context *fuse.Context) (code fuse.Status) {
-	ch := n.Inode().RmChild(oldName)
-	newParent.Inode().RmChild(newName)
-	newParent.Inode().AddChild(newName, ch)
-	return fuse.OK
+	np, ok := newParent.(*memNode)
+	if !ok {
+		return fuse.EXDEV
+	}
+	ch := n.Inode().GetChild(oldName)
+	if ch == nil {
+		return fuse.ENOENT
+	}
+	rec := &memJournalRecord{
+		Op:        _JOURNAL_RENAME,
+		Parent:    n.id,
+		Name:      oldName,
+		NewParent: np.id,
+		NewName:   newName,
+	}
+	// The new ctime of the renamed node goes in the same record.
+	mn, _ := ch.Node().(*memNode)
+	if mn != nil {
+		rec.Node = mn.id
+		rec.Attr = mn.getInfo()
+		n.fs.touch(&rec.Attr)
+	}
+	code = n.fs.update(rec, func() {
+		ch := n.Inode().RmChild(oldName)
+		np.Inode().RmChild(newName)
+		np.Inode().AddChild(newName, ch)
+		if mn != nil {
+			mn.storeInfo(&rec.Attr)
+		}
+	})
+	if !code.Ok() {
+		return code
+	}
+	if np != n {
+		if code := np.changed(true); !code.Ok() {
+			return code
+		}
+	}
+	return n.changed(true)
 }
 
 func (n *memNode) Link(name string, existing Node, context *fuse.Context) (*Inode, fuse.Status) {
-	n.Inode().AddChild(name, existing.Inode())
-	return existing.Inode(), fuse.OK
+	mn, ok := existing.(*memNode)
+	if !ok {
+		return nil, fuse.EXDEV
+	}
+	if n.Inode().GetChild(name) != nil {
+		return nil, fuse.Status(syscall.EEXIST)
+	}
+	code := n.fs.update(&memJournalRecord{
+		Op:     _JOURNAL_LINK,
+		Parent: n.id,
+		Name:   name,
+		Node:   mn.id,
+	}, func() {
+		n.Inode().AddChild(name, existing.Inode())
+	})
+	if !code.Ok() {
+		return nil, code
+	}
+	if code := mn.changed(false); !code.Ok() {
+		return nil, code
+	}
+	return existing.Inode(), n.changed(true)
 }
 
 func (n *memNode) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file File, node *Inode, code fuse.Status) {
-	ch := n.newNode(name, false)
+	if existing := n.Inode().GetChild(name); existing != nil {
+		return n.createExisting(existing, flags, context)
+	}
+	// Create the backing file first, so the journal never records
+	// a node without one.
+	ch := n.fs.newNode()
 	ch.info.Mode = mode | fuse.S_IFREG
-
 	f, err := os.Create(ch.filename())
 	if err != nil {
 		return nil, nil, fuse.ToStatus(err)
 	}
+	if code := n.addChild(name, ch); !code.Ok() {
+		f.Close()
+		os.Remove(ch.filename())
+		return nil, nil, code
+	}
+	if code := n.changed(true); !code.Ok() {
+		f.Close()
+		return nil, nil, code
+	}
 	return ch.newFile(f), ch.Inode(), fuse.OK
 }
 
+// createExisting opens the existing entry for Create, as open(2)
+// with O_CREAT does. The kernel only creates names it doesn't have
+// in its cache, but its entry may have expired.
+func (n *memNode) createExisting(existing *Inode, flags uint32, context *fuse.Context) (File, *Inode, fuse.Status) {
+	if flags&uint32(os.O_EXCL) != 0 {
+		return nil, nil, fuse.Status(syscall.EEXIST)
+	}
+	ch := existing.Node().(*memNode)
+	if info := ch.getInfo(); info.IsDir() {
+		return nil, nil, fuse.Status(syscall.EISDIR)
+	}
+	f, code := ch.Open(flags&^uint32(os.O_CREATE|os.O_TRUNC), context)
+	if !code.Ok() {
+		return nil, nil, code
+	}
+	if flags&uint32(os.O_TRUNC) != 0 {
+		if code := ch.Truncate(f, 0, context); !code.Ok() {
+			f.Release()
+			return nil, nil, code
+		}
+	}
+	return f, existing, fuse.OK
+}
+
 type memNodeFile struct {
 	File
 	node *memNode
@@ -158,6 +360,28 @@ func (n *memNodeFile) InnerFile() File {
 	return n.File
 }
 
+// Write updates the size and mtime that GetAttr returns, so a stat
+// right after the write sees them without waiting for Flush. They
+// are persisted to the journal on Flush.
+func (n *memNodeFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	written, code := n.File.Write(data, off)
+	if !code.Ok() || written == 0 {
+		return written, code
+	}
+
+	var st fuse.Attr
+	if n.File.GetAttr(&st) == fuse.OK {
+		n.node.infoMu.Lock()
+		info := &n.node.info
+		info.Size = st.Size
+		info.Blocks = st.Blocks
+		n.node.fs.touch(info)
+		info.Mtime, info.Mtimensec = info.Ctime, info.Ctimensec
+		n.node.infoMu.Unlock()
+	}
+	return written, code
+}
+
 func (n *memNodeFile) Flush() fuse.Status {
 	code := n.File.Flush()
 
@@ -167,9 +391,13 @@ func (n *memNodeFile) Flush() fuse.Status {
 
 	st := syscall.Stat_t{}
 	err := syscall.Stat(n.node.filename(), &st)
-	n.node.info.Size = uint64(st.Size)
-	n.node.info.Blocks = uint64(st.Blocks)
-	return fuse.ToStatus(err)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	info := n.node.getInfo()
+	info.Size = uint64(st.Size)
+	info.Blocks = uint64(st.Blocks)
+	return n.node.setInfo(&info)
 }
 
 func (n *memNode) newFile(f *os.File) File {
@@ -188,8 +416,82 @@ func (n *memNode) Open(flags uint32, context *fuse.Context) (file File, code fus
 	return n.newFile(f), fuse.OK
 }
 
+// OpenDirStream lists the directory in name order, a page at a time.
+func (n *memNode) OpenDirStream(context *fuse.Context) (DirStream, fuse.Status) {
+	return &memDirStream{node: n}, fuse.OK
+}
+
+// memDirStream only keeps the last name it returned, so a listing
+// doesn't copy the directory. Each page costs a scan of the
+// children instead. Entries added or removed during the listing are
+// returned or not depending on where they sort.
+type memDirStream struct {
+	node    *memNode
+	last    string
+	started bool
+}
+
+type memDirChild struct {
+	name  string
+	inode *Inode
+}
+
+type memDirChildren []memDirChild
+
+func (c memDirChildren) Len() int           { return len(c) }
+func (c memDirChildren) Less(i, j int) bool { return c[i].name < c[j].name }
+func (c memDirChildren) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+func (s *memDirStream) Next(n int) ([]fuse.DirEntry, fuse.Status) {
+	if n < 1 {
+		n = 1
+	}
+	// Keep the n first names after the last one returned. The
+	// candidates are trimmed to n as they reach 2n, so the scan
+	// takes O(n) memory.
+	var page memDirChildren
+	full := false
+	dir := s.node.Inode()
+	dir.mount.treeLock.RLock()
+	for name, ch := range dir.children {
+		if (s.started && name <= s.last) || ch.mountPoint != nil {
+			continue
+		}
+		if full && name > page[n-1].name {
+			continue
+		}
+		page = append(page, memDirChild{name, ch})
+		if len(page) == 2*n {
+			sort.Sort(page)
+			page = page[:n]
+			full = true
+		}
+	}
+	dir.mount.treeLock.RUnlock()
+	sort.Sort(page)
+	if len(page) > n {
+		page = page[:n]
+	}
+
+	out := make([]fuse.DirEntry, 0, len(page))
+	for _, c := range page {
+		var a fuse.Attr
+		if code := c.inode.Node().GetAttr(&a, nil, nil); code.Ok() {
+			out = append(out, fuse.DirEntry{Name: c.name, Mode: a.Mode})
+		}
+	}
+	if len(page) > 0 {
+		s.started = true
+		s.last = page[len(page)-1].name
+	}
+	return out, fuse.OK
+}
+
+func (s *memDirStream) Close() {
+}
+
 func (n *memNode) GetAttr(fi *fuse.Attr, file File, context *fuse.Context) (code fuse.Status) {
-	*fi = n.info
+	*fi = n.getInfo()
 	return fuse.OK
 }
 
@@ -201,31 +503,33 @@ func (n *memNode) Truncate(file File, size uint64, context *fuse.Context) (code
 		code = fuse.ToStatus(err)
 	}
 	if code.Ok() {
-		now := time.Now()
-		n.info.SetTimes(nil, nil, &now)
-		// TODO - should update mtime too?
-		n.info.Size = size
+		info := n.getInfo()
+		n.fs.touch(&info)
+		info.Mtime, info.Mtimensec = info.Ctime, info.Ctimensec
+		info.Size = size
+		code = n.setInfo(&info)
 	}
 	return code
 }
 
 func (n *memNode) Utimens(file File, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
-	c := time.Now()
-	n.info.SetTimes(atime, mtime, &c)
-	return fuse.OK
+	info := n.getInfo()
+	info.SetTimes(atime, mtime, nil)
+	n.fs.touch(&info)
+	return n.setInfo(&info)
 }
 
 func (n *memNode) Chmod(file File, perms uint32, context *fuse.Context) (code fuse.Status) {
-	n.info.Mode = (n.info.Mode ^ 07777) | perms
-	now := time.Now()
-	n.info.SetTimes(nil, nil, &now)
-	return fuse.OK
+	info := n.getInfo()
+	info.Mode = (info.Mode &^ 07777) | perms
+	n.fs.touch(&info)
+	return n.setInfo(&info)
 }
 
 func (n *memNode) Chown(file File, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
-	n.info.Uid = uid
-	n.info.Gid = gid
-	now := time.Now()
-	n.info.SetTimes(nil, nil, &now)
-	return fuse.OK
+	info := n.getInfo()
+	info.Uid = uid
+	info.Gid = gid
+	n.fs.touch(&info)
+	return n.setInfo(&info)
 }
@@ -1,8 +1,11 @@
 package nodefs
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"runtime"
+	"syscall"
 	"testing"
 	"time"
 
@@ -108,3 +111,307 @@ func TestMemNodeSetattr(t *testing.T) {
 		t.Errorf("Size should be 4096 after Truncate: %d", fi.Size())
 	}
 }
+
+func TestMemNodeFsChmodCtime(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "go-fuse-memnode_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := NewMemNodeFSRoot(tmp + "/")
+	NewFileSystemConnector(root, nil)
+
+	f, ch, code := root.Create("file", uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Release()
+
+	var before fuse.Attr
+	ch.Node().GetAttr(&before, nil, nil)
+	time.Sleep(10 * time.Millisecond)
+
+	if code := ch.Node().Chmod(nil, 0600, nil); !code.Ok() {
+		t.Fatalf("Chmod: %v", code)
+	}
+	var after fuse.Attr
+	ch.Node().GetAttr(&after, nil, nil)
+
+	if after.Mode != fuse.S_IFREG|0600 {
+		t.Errorf("got mode %o, want %o", after.Mode, fuse.S_IFREG|0600)
+	}
+	if !after.ChangeTime().After(before.ChangeTime()) {
+		t.Errorf("ctime did not advance: before %v, after %v", before.ChangeTime(), after.ChangeTime())
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("mtime changed: before %v, after %v", before.ModTime(), after.ModTime())
+	}
+}
+
+func TestMemNodeFsWriteUpdatesAttr(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "go-fuse-memnode_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := NewMemNodeFSRoot(tmp + "/")
+	NewFileSystemConnector(root, nil)
+
+	f, ch, code := root.Create("file", uint32(os.O_RDWR), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	defer f.Release()
+
+	var before fuse.Attr
+	ch.Node().GetAttr(&before, nil, nil)
+	time.Sleep(10 * time.Millisecond)
+
+	// No Flush: the size must be visible while the file is open.
+	if _, code := f.Write([]byte("hello"), 100); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+	var after fuse.Attr
+	ch.Node().GetAttr(&after, nil, nil)
+	if after.Size != 105 {
+		t.Errorf("size after write past EOF: got %d, want 105", after.Size)
+	}
+	if !after.ModTime().After(before.ModTime()) {
+		t.Errorf("mtime did not advance: before %v, after %v", before.ModTime(), after.ModTime())
+	}
+}
+
+// TestMemNodeFsWriteConcurrentGetAttr is for the race detector: Write
+// updates the attributes outside the journal.
+func TestMemNodeFsWriteConcurrentGetAttr(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "go-fuse-memnode_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := NewMemNodeFSRoot(tmp + "/")
+	NewFileSystemConnector(root, nil)
+	f, ch, code := root.Create("file", uint32(os.O_RDWR), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	defer f.Release()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			var a fuse.Attr
+			ch.Node().GetAttr(&a, nil, nil)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		f.Write([]byte("x"), int64(i))
+	}
+	<-done
+
+	var a fuse.Attr
+	if ch.Node().GetAttr(&a, nil, nil); a.Size != 100 {
+		t.Errorf("got size %d, want 100", a.Size)
+	}
+}
+
+func TestMemNodeFsTruncateGrow(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "go-fuse-memnode_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := NewMemNodeFSRoot(tmp + "/")
+	NewFileSystemConnector(root, nil)
+
+	f, ch, code := root.Create("file", uint32(os.O_RDWR), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	defer f.Release()
+	if _, code := f.Write([]byte("hello"), 0); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+
+	const size = 1 << 30
+	if code := ch.Node().Truncate(nil, size, nil); !code.Ok() {
+		t.Fatalf("Truncate: %v", code)
+	}
+	var attr fuse.Attr
+	ch.Node().GetAttr(&attr, nil, nil)
+	if attr.Size != size {
+		t.Errorf("got size %d, want %d", attr.Size, size)
+	}
+
+	buf := make([]byte, 16)
+	for _, off := range []int64{0, size / 2, size - int64(len(buf))} {
+		res, code := f.Read(buf, off)
+		if !code.Ok() {
+			t.Fatalf("Read: %v", code)
+		}
+		got, _ := res.Bytes(buf)
+		want := make([]byte, len(buf))
+		if off == 0 {
+			copy(want, "hello")
+		}
+		if string(got) != string(want) {
+			t.Errorf("read at %d: got %q, want %q", off, got, want)
+		}
+	}
+
+	// The hole takes no space in the backing store.
+	var st syscall.Stat_t
+	if err := syscall.Stat(ch.Node().(*memNode).filename(), &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if used := st.Blocks * 512; used > 1<<20 {
+		t.Errorf("backing file uses %d bytes for a %d byte sparse file", used, size)
+	}
+}
+
+func TestMemNodeFsCreateExisting(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "go-fuse-memnode_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := NewMemNodeFSRoot(tmp + "/")
+	NewFileSystemConnector(root, nil)
+
+	f, ch, code := root.Create("file", uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Write([]byte("hello"), 0)
+	f.Release()
+	if _, code := root.Mkdir("dir", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+
+	eexist := fuse.Status(syscall.EEXIST)
+	for _, name := range []string{"file", "dir"} {
+		if _, code := root.Mkdir(name, 0755, nil); code != eexist {
+			t.Errorf("Mkdir(%q): got %v, want EEXIST", name, code)
+		}
+		if _, code := root.Symlink(name, "target", nil); code != eexist {
+			t.Errorf("Symlink(%q): got %v, want EEXIST", name, code)
+		}
+		if _, code := root.Link(name, ch.Node(), nil); code != eexist {
+			t.Errorf("Link(%q): got %v, want EEXIST", name, code)
+		}
+	}
+	if _, _, code := root.Create("file", uint32(os.O_WRONLY|os.O_EXCL), 0644, nil); code != eexist {
+		t.Errorf("Create(O_EXCL): got %v, want EEXIST", code)
+	}
+	if _, _, code := root.Create("dir", uint32(os.O_WRONLY), 0644, nil); code != fuse.Status(syscall.EISDIR) {
+		t.Errorf("Create(dir): got %v, want EISDIR", code)
+	}
+
+	f, again, code := root.Create("file", uint32(os.O_RDWR|os.O_TRUNC), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create without O_EXCL: %v", code)
+	}
+	f.Release()
+	if again != ch {
+		t.Errorf("Create without O_EXCL made a new node")
+	}
+	var a fuse.Attr
+	if ch.Node().GetAttr(&a, nil, nil); a.Size != 0 {
+		t.Errorf("O_TRUNC: got size %d, want 0", a.Size)
+	}
+}
+
+func TestMemNodeFsFakeClock(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "go-fuse-memnode_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	start := time.Unix(1000, 0)
+	clock := fuse.NewFakeClock(start)
+	root := NewMemNodeFSRootWithClock(tmp+"/", clock)
+	NewFileSystemConnector(root, nil)
+
+	ch, code := root.Mkdir("dir", 0755, nil)
+	if !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	var a fuse.Attr
+	ch.Node().GetAttr(&a, nil, nil)
+	if got := a.ModTime(); !got.Equal(start) {
+		t.Errorf("mtime of new node: got %v, want %v", got, start)
+	}
+
+	clock.Advance(time.Hour)
+	if code := ch.Node().Chmod(nil, 0700, nil); !code.Ok() {
+		t.Fatalf("Chmod: %v", code)
+	}
+	ch.Node().GetAttr(&a, nil, nil)
+	if got, want := a.ChangeTime(), start.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("ctime after Chmod: got %v, want %v", got, want)
+	}
+}
+
+// pageAlloc returns the bytes allocated to read a page of s.
+func pageAlloc(t *testing.T, s DirStream, n int) ([]fuse.DirEntry, uint64) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	entries, code := s.Next(n)
+	runtime.ReadMemStats(&after)
+	if !code.Ok() {
+		t.Fatalf("Next: %v", code)
+	}
+	return entries, after.TotalAlloc - before.TotalAlloc
+}
+
+func TestMemNodeDirStream(t *testing.T) {
+	const count = 100000
+	const page = 500
+	root := NewMemNodeFSRoot(os.TempDir() + "/go-fuse-memnode_test")
+	NewFileSystemConnector(root, nil)
+	for i := 0; i < count; i++ {
+		// Add in reverse, so the listing has to be sorted.
+		if _, code := root.Symlink(fmt.Sprintf("%06d", count-1-i), "target", nil); !code.Ok() {
+			t.Fatalf("Symlink: %v", code)
+		}
+	}
+
+	s, code := root.(DirStreamNode).OpenDirStream(nil)
+	if !code.Ok() {
+		t.Fatalf("OpenDirStream: %v", code)
+	}
+	defer s.Close()
+
+	// A listing of the whole directory takes megabytes; a page
+	// should take memory for the page only.
+	const maxAlloc = 256 << 10
+	seen := 0
+	for {
+		entries, alloc := pageAlloc(t, s, page)
+		if alloc > maxAlloc {
+			t.Fatalf("Next(%d) allocated %d bytes, want at most %d", page, alloc, maxAlloc)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if len(entries) > page {
+			t.Fatalf("Next(%d) returned %d entries", page, len(entries))
+		}
+		for _, e := range entries {
+			if want := fmt.Sprintf("%06d", seen); e.Name != want || e.Mode&fuse.S_IFLNK == 0 {
+				t.Fatalf("entry %d is %q, mode %o, want symlink %q", seen, e.Name, e.Mode, want)
+			}
+			seen++
+		}
+	}
+	if seen != count {
+		t.Errorf("listed %d entries, want %d", seen, count)
+	}
+}
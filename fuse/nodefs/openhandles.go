@@ -0,0 +1,199 @@
+package nodefs
+
+import (
+	"sort"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// OpenHandle describes an open file, as returned by
+// FileSystemConnector.OpenHandles.
+type OpenHandle struct {
+	// Handle is the file handle that the kernel uses.
+	Handle uint64
+
+	// Path of the file, relative to the root of the file system.
+	// It is empty if the file is no longer in the tree.
+	Path string
+
+	// Opened is when the file was opened.
+	Opened time.Time
+
+	File File
+}
+
+// openHandle is what the connector keeps for an open file.
+type openHandle struct {
+	node   *Inode
+	handle uint64
+}
+
+func (c *FileSystemConnector) addHandle(f *openedFile, node *Inode, handle uint64) {
+	c.handlesMu.Lock()
+	c.handles[f] = openHandle{node, handle}
+	c.handlesMu.Unlock()
+}
+
+func (c *FileSystemConnector) removeHandle(f *openedFile) {
+	c.handlesMu.Lock()
+	delete(c.handles, f)
+	c.handlesMu.Unlock()
+}
+
+type openHandles []OpenHandle
+
+func (h openHandles) Len() int           { return len(h) }
+func (h openHandles) Less(i, j int) bool { return h[i].Opened.Before(h[j].Opened) }
+func (h openHandles) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+// OpenHandles returns the files that are open, oldest first, eg. to
+// look for handles that a client leaks. Open directories are not
+// listed.
+func (c *FileSystemConnector) OpenHandles() []OpenHandle {
+	c.handlesMu.Lock()
+	handles := make(map[*openedFile]openHandle, len(c.handles))
+	for f, h := range c.handles {
+		handles[f] = h
+	}
+	c.handlesMu.Unlock()
+
+	var out openHandles
+	for f, h := range handles {
+		out = append(out, OpenHandle{
+			Handle: h.handle,
+			Path:   c.nodePath(h.node),
+			Opened: f.opened,
+			File:   f.WithFlags.File,
+		})
+	}
+	sort.Sort(out)
+	return out
+}
+
+// CloseStaleHandles releases the files that have been open for
+// longer than olderThan, and returns how many it released. Requests
+// on their handles fail with ENODEV until the kernel releases the
+// handles too. A File may be released while a request is still
+// using it, so it should fail such requests, as the loopback File
+// does with EBADF.
+func (c *FileSystemConnector) CloseStaleHandles(olderThan time.Duration) int {
+	deadline := time.Now().Add(-olderThan)
+	var stale []*openedFile
+	var nodes []*Inode
+	c.handlesMu.Lock()
+	for f, h := range c.handles {
+		if f.opened.Before(deadline) {
+			stale = append(stale, f)
+			nodes = append(nodes, h.node)
+			delete(c.handles, f)
+		}
+	}
+	c.handlesMu.Unlock()
+
+	n := 0
+	for i, f := range stale {
+		if !f.markClosed() {
+			continue
+		}
+		node := nodes[i]
+		node.openFilesMutex.Lock()
+		node.removeOpenFile(f)
+		node.openFilesMutex.Unlock()
+		f.WithFlags.File.Release()
+		n++
+	}
+	return n
+}
+
+// nodePath returns the path of n, or "" if it is not in the tree.
+func (c *FileSystemConnector) nodePath(n *Inode) string {
+	var parts []string
+	for n != c.rootNode {
+		p := n.parent()
+		if p == nil || p == n {
+			return ""
+		}
+		name, ok := p.childName(n)
+		if !ok {
+			return ""
+		}
+		parts = append(parts, name)
+		n = p
+	}
+	path := ""
+	for i := len(parts) - 1; i >= 0; i-- {
+		if path != "" {
+			path += "/"
+		}
+		path += parts[i]
+	}
+	return path
+}
+
+// childName returns a name of child in n.
+func (n *Inode) childName(child *Inode) (string, bool) {
+	n.mount.treeLock.RLock()
+	defer n.mount.treeLock.RUnlock()
+	for name, ch := range n.children {
+		if ch == child {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// closedHandle is what getOpenedFile returns for files that
+// CloseStaleHandles released.
+var closedHandle = &openedFile{
+	WithFlags: WithFlags{File: &closedFile{NewDefaultFile()}},
+}
+
+// closedFile fails all operations with ENODEV.
+type closedFile struct {
+	File
+}
+
+func (f *closedFile) String() string {
+	return "closedFile"
+}
+
+func (f *closedFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	return nil, fuse.ENODEV
+}
+
+func (f *closedFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	return 0, fuse.ENODEV
+}
+
+func (f *closedFile) Flush() fuse.Status {
+	return fuse.ENODEV
+}
+
+func (f *closedFile) Fsync(flags int) fuse.Status {
+	return fuse.ENODEV
+}
+
+func (f *closedFile) GetAttr(*fuse.Attr) fuse.Status {
+	return fuse.ENODEV
+}
+
+func (f *closedFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	return fuse.ENODEV
+}
+
+func (f *closedFile) Truncate(size uint64) fuse.Status {
+	return fuse.ENODEV
+}
+
+func (f *closedFile) Chown(uid uint32, gid uint32) fuse.Status {
+	return fuse.ENODEV
+}
+
+func (f *closedFile) Chmod(perms uint32) fuse.Status {
+	return fuse.ENODEV
+}
+
+func (f *closedFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	return fuse.ENODEV
+}
@@ -0,0 +1,103 @@
+package nodefs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+type releaseCountFile struct {
+	File
+	released int
+}
+
+func (f *releaseCountFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	return fuse.ReadResultData([]byte("data")), fuse.OK
+}
+
+func (f *releaseCountFile) Release() {
+	f.released++
+}
+
+type releaseCountNode struct {
+	Node
+	file *releaseCountFile
+
+	// The files passed to Chmod and Truncate.
+	chmodFile, truncateFile File
+}
+
+func (n *releaseCountNode) Chmod(file File, perms uint32, context *fuse.Context) fuse.Status {
+	n.chmodFile = file
+	return fuse.OK
+}
+
+func (n *releaseCountNode) Truncate(file File, size uint64, context *fuse.Context) fuse.Status {
+	n.truncateFile = file
+	return fuse.OK
+}
+
+func (n *releaseCountNode) Open(flags uint32, context *fuse.Context) (File, fuse.Status) {
+	return n.file, fuse.OK
+}
+
+func TestCloseStaleHandles(t *testing.T) {
+	root := NewDefaultNode()
+	conn := NewFileSystemConnector(root, nil)
+	rawFS := conn.RawFS()
+	file := &releaseCountFile{File: NewDefaultFile()}
+	node := &releaseCountNode{Node: NewDefaultNode(), file: file}
+	root.Inode().NewChild("dir", true, NewDefaultNode()).NewChild("file", false, node)
+
+	id := uint64(fuse.FUSE_ROOT_ID)
+	for _, name := range []string{"dir", "file"} {
+		var out fuse.EntryOut
+		if code := rawFS.Lookup(&fuse.InHeader{NodeId: id}, name, &out); !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, code)
+		}
+		id = out.NodeId
+	}
+	in := &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: id}}
+	var out fuse.OpenOut
+	if code := rawFS.Open(in, &out); !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+
+	// The handle is only used for truncation.
+	setAttr := func(valid uint32) fuse.Status {
+		in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{InHeader: in.InHeader, Valid: valid | fuse.FATTR_FH, Fh: out.Fh}}
+		return rawFS.SetAttr(in, &fuse.AttrOut{})
+	}
+	if code := setAttr(fuse.FATTR_MODE | fuse.FATTR_SIZE); !code.Ok() || node.chmodFile != nil || node.truncateFile != file {
+		t.Errorf("SetAttr: got %v, Chmod file %v, Truncate file %v", code, node.chmodFile, node.truncateFile)
+	}
+
+	handles := conn.OpenHandles()
+	if len(handles) != 1 || handles[0].Handle != out.Fh || handles[0].Path != "dir/file" || handles[0].File != file {
+		t.Fatalf("OpenHandles: got %+v", handles)
+	}
+	if n := conn.CloseStaleHandles(time.Hour); n != 0 {
+		t.Errorf("closed %d handles younger than an hour", n)
+	}
+	if n := conn.CloseStaleHandles(0); n != 1 || file.released != 1 {
+		t.Errorf("CloseStaleHandles: closed %d, released %d times, want 1", n, file.released)
+	}
+	if handles := conn.OpenHandles(); len(handles) != 0 {
+		t.Errorf("OpenHandles after closing: %+v", handles)
+	}
+
+	// A closed handle is not used: the size is set by path.
+	if code := setAttr(fuse.FATTR_SIZE); !code.Ok() || node.truncateFile != nil {
+		t.Errorf("SetAttr on closed handle: got %v, Truncate file %v", code, node.truncateFile)
+	}
+
+	buf := make([]byte, 10)
+	if _, code := rawFS.Read(&fuse.ReadIn{InHeader: in.InHeader, Fh: out.Fh, Size: 10}, buf); code != fuse.ENODEV {
+		t.Errorf("Read on closed handle: got %v, want ENODEV", code)
+	}
+	rawFS.Release(&fuse.ReleaseIn{InHeader: in.InHeader, Fh: out.Fh})
+	if file.released != 1 {
+		t.Errorf("released %d times, want 1", file.released)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"reflect"
 	"runtime"
+	"syscall"
 	"unsafe"
 )
 
@@ -51,6 +52,20 @@ const (
 	_OP_BATCH_FORGET = int32(42)
 	_OP_FALLOCATE    = int32(43) // protocol version 19.
 	_OP_READDIRPLUS  = int32(44) // protocol version 21.
+	_OP_RENAME2      = int32(45) // protocol version 23.
+
+	_OP_COPY_FILE_RANGE = int32(47) // protocol version 28.
+	_OP_TMPFILE         = int32(51) // protocol version 37.
+	_OP_STATX           = int32(52) // protocol version 39.
+
+	_OP_SETUPMAPPING  = int32(48) // protocol version 31, virtio-fs only.
+	_OP_REMOVEMAPPING = int32(49) // protocol version 31, virtio-fs only.
+
+	_OP_SETVOLNAME = int32(61) // OSXFUSE only.
+
+	// Android only. It is far above the others, so it is handled
+	// outside operationHandlers.
+	_OP_CANONICAL_PATH = int32(2016)
 
 	// The following entries don't have to be compatible across Go-FUSE versions.
 	_OP_NOTIFY_ENTRY  = int32(100)
@@ -78,13 +93,29 @@ func doInit(server *Server, req *request) {
 	server.reqMu.Lock()
 	server.kernelSettings = *input
 	server.kernelSettings.Flags = input.Flags & (CAP_ASYNC_READ | CAP_BIG_WRITES | CAP_FILE_OPS |
-		CAP_AUTO_INVAL_DATA | CAP_READDIRPLUS)
+		CAP_AUTO_INVAL_DATA | CAP_READDIRPLUS | _PLATFORM_INIT_FLAGS)
+	if server.opts.EnableParallelDirOps {
+		server.kernelSettings.Flags |= input.Flags & CAP_PARALLEL_DIROPS
+	}
+	if server.opts.EnableAsyncDIO {
+		server.kernelSettings.Flags |= input.Flags & CAP_ASYNC_DIO
+	}
+	if server.opts.EnableWritebackCache {
+		server.kernelSettings.Flags |= input.Flags & CAP_WRITEBACK_CACHE
+	}
 
-	if input.Minor >= 13 {
+	// The kernel announces SPLICE_WRITE if replies may be
+	// spliced into the device.
+	if input.Flags&CAP_SPLICE_WRITE != 0 && !server.opts.DisableSplice {
 		server.setSplice()
+		if server.canSplice {
+			server.kernelSettings.Flags |= CAP_SPLICE_WRITE
+		}
 	}
 	server.reqMu.Unlock()
 
+	// Protocol 7.23 adds a time granularity to the reply. The
+	// kernel reads the missing field as 0, which keeps its default.
 	out := &InitOut{
 		Major:               _FUSE_KERNEL_VERSION,
 		Minor:               _OUR_MINOR_VERSION,
@@ -102,9 +133,24 @@ func doInit(server *Server, req *request) {
 	req.status = OK
 }
 
+// writebackFlags returns the open flags the file system gets if the
+// kernel caches writes: it may read from files opened write-only,
+// and it does O_APPEND writes at the size it knows.
+func (ms *Server) writebackFlags(flags uint32) uint32 {
+	if ms.kernelSettings.Flags&CAP_WRITEBACK_CACHE == 0 {
+		return flags
+	}
+	if flags&syscall.O_ACCMODE == syscall.O_WRONLY {
+		flags = flags&^syscall.O_ACCMODE | syscall.O_RDWR
+	}
+	return flags &^ syscall.O_APPEND
+}
+
 func doOpen(server *Server, req *request) {
 	out := (*OpenOut)(req.outData)
-	status := server.fileSystem.Open((*OpenIn)(req.inData), out)
+	in := (*OpenIn)(req.inData)
+	in.Flags = server.writebackFlags(in.Flags)
+	status := server.fileSystem.Open(in, out)
 	req.status = status
 	if status != OK {
 		return
@@ -113,12 +159,26 @@ func doOpen(server *Server, req *request) {
 
 func doCreate(server *Server, req *request) {
 	out := (*CreateOut)(req.outData)
-	status := server.fileSystem.Create((*CreateIn)(req.inData), req.filenames[0], out)
+	in := (*CreateIn)(req.inData)
+	in.Flags = server.writebackFlags(in.Flags)
+	status := server.fileSystem.Create(in, req.filenames[0], out)
 	req.status = status
 }
 
+func doTmpfile(server *Server, req *request) {
+	out := (*CreateOut)(req.outData)
+	in := (*CreateIn)(req.inData)
+	in.Flags = server.writebackFlags(in.Flags)
+	req.status = server.fileSystem.Tmpfile(in, out)
+}
+
 func doReadDir(server *Server, req *request) {
 	in := (*ReadIn)(req.inData)
+	if in.Size == 0 {
+		// Don't take a buffer from the pool for nothing.
+		req.status = OK
+		return
+	}
 	buf := server.allocOut(req, in.Size)
 	out := NewDirEntryList(buf, uint64(in.Offset))
 
@@ -129,6 +189,11 @@ func doReadDir(server *Server, req *request) {
 
 func doReadDirPlus(server *Server, req *request) {
 	in := (*ReadIn)(req.inData)
+	if in.Size == 0 {
+		// Don't take a buffer from the pool for nothing.
+		req.status = OK
+		return
+	}
 	buf := server.allocOut(req, in.Size)
 	out := NewDirEntryList(buf, uint64(in.Offset))
 
@@ -149,6 +214,11 @@ func doSetattr(server *Server, req *request) {
 }
 
 func doWrite(server *Server, req *request) {
+	if len(req.arg) == 0 {
+		// Some backends behave oddly for empty writes.
+		req.status = OK
+		return
+	}
 	n, status := server.fileSystem.Write((*WriteIn)(req.inData), req.arg)
 	o := (*WriteOut)(req.outData)
 	o.Size = n
@@ -220,6 +290,11 @@ func doGetAttr(server *Server, req *request) {
 	req.status = s
 }
 
+func doStatx(server *Server, req *request) {
+	out := (*StatxOut)(req.outData)
+	req.status = server.fileSystem.Statx((*StatxIn)(req.inData), out)
+}
+
 func doForget(server *Server, req *request) {
 	if !server.opts.RememberInodes {
 		server.fileSystem.Forget(req.inHeader.NodeId, (*ForgetIn)(req.inData).Nlookup)
@@ -245,6 +320,65 @@ func doBatchForget(server *Server, req *request) {
 
 func doReadlink(server *Server, req *request) {
 	req.flatData, req.status = server.fileSystem.Readlink(req.inHeader)
+	// The kernel reads the target into a page, and fails the
+	// request with EIO for a longer reply.
+	if req.status.Ok() && len(req.flatData) > _PATH_MAX-1 {
+		req.flatData, req.status = nil, ENAMETOOLONG
+	}
+}
+
+func doCanonicalPath(server *Server, req *request) {
+	var path string
+	path, req.status = server.fileSystem.CanonicalPath(req.inHeader)
+	if !req.status.Ok() {
+		return
+	}
+	// Like a symlink target, the path is read into a page.
+	if len(path) > _PATH_MAX-1 {
+		req.status = ENAMETOOLONG
+		return
+	}
+	req.flatData = []byte(path)
+}
+
+// checkCapability returns ENOSYS for a request for an optional
+// operation that the file system doesn't declare.
+func (ms *Server) checkCapability(req *request) Status {
+	if req.handler.Capability&ms.unsupported != 0 {
+		return ENOSYS
+	}
+	return OK
+}
+
+const (
+	_NAME_MAX = 255
+	_PATH_MAX = 4096
+)
+
+// checkNames returns ENAMETOOLONG if a directory entry name or
+// symlink target in req is longer than MountOptions allows. Xattr
+// and volume names are not checked.
+func (ms *Server) checkNames(req *request) Status {
+	names := req.filenames
+	switch req.inHeader.Opcode {
+	case _OP_LOOKUP, _OP_MKNOD, _OP_MKDIR, _OP_UNLINK, _OP_RMDIR,
+		_OP_LINK, _OP_CREATE, _OP_RENAME, _OP_RENAME2:
+	case _OP_SYMLINK:
+		if max := ms.opts.MaxPathLength; max > 0 && len(names[0]) > max {
+			return ENAMETOOLONG
+		}
+		names = names[1:]
+	default:
+		return OK
+	}
+	if max := ms.opts.MaxNameLength; max > 0 {
+		for _, n := range names {
+			if len(n) > max {
+				return ENAMETOOLONG
+			}
+		}
+	}
+	return OK
 }
 
 func doLookup(server *Server, req *request) {
@@ -278,12 +412,28 @@ func doLink(server *Server, req *request) {
 	req.status = server.fileSystem.Link((*LinkIn)(req.inData), req.filenames[0], out)
 }
 
+// _READ_CHUNK caps the buffer that a READ takes up front. Larger
+// reads are passed to the file system in chunks, and the buffer only
+// grows while the file system fills them, so a large read of a short
+// file doesn't cost the full size.
+const _READ_CHUNK = 64 << 10
+
 func doRead(server *Server, req *request) {
 	in := (*ReadIn)(req.inData)
+	if in.Size == 0 {
+		// Don't take a buffer from the pool for nothing.
+		req.status = OK
+		return
+	}
+	if in.Size > _READ_CHUNK {
+		doReadChunked(server, req, in)
+		return
+	}
 	buf := server.allocOut(req, in.Size)
 
 	req.readResult, req.status = server.fileSystem.Read(in, buf)
 	if fd, ok := req.readResult.(*readResultFd); ok {
+		fd.clampSize()
 		req.fdData = fd
 		req.flatData = nil
 	} else if req.readResult != nil && req.status.Ok() {
@@ -291,8 +441,99 @@ func doRead(server *Server, req *request) {
 	}
 }
 
+// doReadChunked reads in pieces of at most _READ_CHUNK, until the
+// file system returns less than asked for. Consecutive results for
+// the same file descriptor are merged, so they are still spliced;
+// other results are copied into the output buffer.
+func doReadChunked(server *Server, req *request, in *ReadIn) {
+	chunk := *in
+	buf := server.allocOut(req, _READ_CHUNK)[:0]
+	var fd *readResultFd
+	for done := uint32(0); done < in.Size; {
+		chunk.Offset = in.Offset + uint64(done)
+		chunk.Size = in.Size - done
+		if chunk.Size > _READ_CHUNK {
+			chunk.Size = _READ_CHUNK
+		}
+		if need := len(buf) + int(chunk.Size); need > cap(buf) {
+			grown := 2 * cap(buf)
+			if grown < need {
+				grown = need
+			}
+			if grown > int(in.Size) {
+				grown = int(in.Size)
+			}
+			buf = server.growOut(req, buf, grown)
+		}
+		dest := buf[len(buf) : len(buf)+int(chunk.Size)]
+
+		res, code := server.fileSystem.Read(&chunk, dest)
+		if !code.Ok() || res == nil {
+			if done == 0 {
+				req.status = code
+				return
+			}
+			// Return what was read so far.
+			break
+		}
+
+		n := 0
+		if r, ok := res.(*readResultFd); ok && len(buf) == 0 &&
+			(fd == nil || r.Fd == fd.Fd && r.Off >= 0 && r.Off == fd.Off+int64(fd.Sz)) {
+			r.clampSize()
+			n = r.Sz
+			if fd == nil {
+				fd = r
+			} else {
+				fd.Sz += r.Sz
+			}
+		} else {
+			data, code := res.Bytes(dest)
+			if fd != nil {
+				// The data follows a file descriptor: read
+				// that into the buffer first.
+				data = append([]byte{}, data...)
+				buf = server.growOut(req, buf, fd.Sz+int(chunk.Size))
+				var fdCode Status
+				buf, fdCode = fd.Bytes(buf[:fd.Sz])
+				if !fdCode.Ok() {
+					code = fdCode
+				}
+				fd = nil
+				dest = buf[len(buf) : len(buf)+int(chunk.Size)]
+			}
+			n = copy(dest, data)
+			res.Done()
+			buf = buf[:len(buf)+n]
+			if !code.Ok() {
+				if len(buf) == 0 {
+					req.status = code
+					return
+				}
+				break
+			}
+		}
+		done += uint32(n)
+		if n < int(chunk.Size) {
+			break
+		}
+	}
+
+	req.status = OK
+	if fd != nil {
+		req.readResult = fd
+		req.fdData = fd
+	} else {
+		req.flatData = buf
+	}
+}
+
 func doFlush(server *Server, req *request) {
 	req.status = server.fileSystem.Flush((*FlushIn)(req.inData))
+	if req.status == ENOSYS || req.status == EOPNOTSUPP {
+		// The kernel would stop flushing all files.
+		req.status = OK
+	}
 }
 
 func doRelease(server *Server, req *request) {
@@ -300,20 +541,66 @@ func doRelease(server *Server, req *request) {
 }
 
 func doFsync(server *Server, req *request) {
-	req.status = server.fileSystem.Fsync((*FsyncIn)(req.inData))
+	req.status = notSupportedOK(server.fileSystem.Fsync((*FsyncIn)(req.inData)))
 }
 
 func doReleaseDir(server *Server, req *request) {
 	server.fileSystem.ReleaseDir((*ReleaseIn)(req.inData))
 }
 
+// undoReply releases the handle, and for CREATE the node, that a
+// successful request handed out, if its reply could not be
+// delivered. The kernel doesn't know about them then, so it would
+// never send the RELEASE or FORGET for them.
+func undoReply(server *Server, req *request) {
+	switch req.inHeader.Opcode {
+	case _OP_OPEN:
+		out := (*OpenOut)(req.outData)
+		server.fileSystem.Release(&ReleaseIn{InHeader: *req.inHeader, Fh: out.Fh})
+	case _OP_OPENDIR:
+		out := (*OpenOut)(req.outData)
+		server.fileSystem.ReleaseDir(&ReleaseIn{InHeader: *req.inHeader, Fh: out.Fh})
+	case _OP_CREATE, _OP_TMPFILE:
+		out := (*CreateOut)(req.outData)
+		in := ReleaseIn{InHeader: *req.inHeader, Fh: out.Fh}
+		in.NodeId = out.NodeId
+		server.fileSystem.Release(&in)
+		if !server.opts.RememberInodes {
+			server.fileSystem.Forget(out.NodeId, 1)
+		}
+	}
+}
+
 func doFsyncDir(server *Server, req *request) {
-	req.status = server.fileSystem.FsyncDir((*FsyncIn)(req.inData))
+	req.status = notSupportedOK(server.fileSystem.FsyncDir((*FsyncIn)(req.inData)))
+}
+
+// notSupportedOK answers EOPNOTSUPP as success, which is what the
+// kernel makes of ENOSYS for the operation, without making it stop
+// sending the operation.
+func notSupportedOK(code Status) Status {
+	if code == EOPNOTSUPP {
+		return OK
+	}
+	return code
 }
 
 func doSetXAttr(server *Server, req *request) {
 	splits := bytes.SplitN(req.arg, []byte{0}, 2)
-	req.status = server.fileSystem.SetXAttr((*SetXAttrIn)(req.inData), string(splits[0]), splits[1])
+	attr := string(splits[0])
+	if IsPosixACLXAttr(attr) {
+		// Reject malformed ACLs here, so file systems can
+		// store the value verbatim.
+		if _, code := ParsePosixACL(splits[1]); !code.Ok() {
+			req.status = code
+			return
+		}
+	}
+	req.status = server.fileSystem.SetXAttr((*SetXAttrIn)(req.inData), attr, splits[1])
+}
+
+func doSetVolName(server *Server, req *request) {
+	req.status = server.fileSystem.SetVolumeName(req.filenames[0])
 }
 
 func doRemoveXAttr(server *Server, req *request) {
@@ -321,7 +608,7 @@ func doRemoveXAttr(server *Server, req *request) {
 }
 
 func doAccess(server *Server, req *request) {
-	req.status = server.fileSystem.Access((*AccessIn)(req.inData))
+	req.status = notSupportedOK(server.fileSystem.Access((*AccessIn)(req.inData)))
 }
 
 func doSymlink(server *Server, req *request) {
@@ -333,6 +620,10 @@ func doRename(server *Server, req *request) {
 	req.status = server.fileSystem.Rename((*RenameIn)(req.inData), req.filenames[0], req.filenames[1])
 }
 
+func doRename2(server *Server, req *request) {
+	req.status = server.fileSystem.Rename2((*Rename2In)(req.inData), req.filenames[0], req.filenames[1])
+}
+
 func doStatFs(server *Server, req *request) {
 	out := (*StatfsOut)(req.outData)
 	req.status = server.fileSystem.StatFs(req.inHeader, out)
@@ -356,6 +647,36 @@ func doFallocate(server *Server, req *request) {
 	req.status = server.fileSystem.Fallocate((*FallocateIn)(req.inData))
 }
 
+func doCopyFileRange(server *Server, req *request) {
+	n, status := server.fileSystem.CopyFileRange((*CopyFileRangeIn)(req.inData))
+	o := (*WriteOut)(req.outData)
+	o.Size = n
+	req.status = status
+}
+
+func doSetupMapping(server *Server, req *request) {
+	req.status = server.fileSystem.SetupMapping((*SetupMappingIn)(req.inData))
+}
+
+func doRemoveMapping(server *Server, req *request) {
+	in := (*RemoveMappingIn)(req.inData)
+	wantBytes := uintptr(in.Count) * unsafe.Sizeof(RemoveMappingOne{})
+	if in.Count == 0 || uintptr(len(req.arg)) < wantBytes {
+		log.Printf("Too few bytes for remove mapping. Got %d bytes, want %d (%d entries)",
+			len(req.arg), wantBytes, in.Count)
+		req.status = EINVAL
+		return
+	}
+
+	// The entries follow a 4-byte count, so they are not 8-byte
+	// aligned in the input buffer; copy them out.
+	mappings := make([]RemoveMappingOne, in.Count)
+	var dest []byte
+	toSlice(&dest, unsafe.Pointer(&mappings[0]), wantBytes)
+	copy(dest, req.arg)
+	req.status = server.fileSystem.RemoveMapping(in, mappings)
+}
+
 ////////////////////////////////////////////////////////////////
 
 type operationFunc func(*Server, *request)
@@ -370,10 +691,20 @@ type operationHandler struct {
 	DecodeOut   castPointerFunc
 	FileNames   int
 	FileNameOut bool
+
+	// Capability is the optional operation that the opcode is
+	// for, or 0.
+	Capability CapSet
 }
 
 var operationHandlers []*operationHandler
 
+var canonicalPathHandler = &operationHandler{
+	Name:        "CANONICAL_PATH",
+	Func:        doCanonicalPath,
+	FileNameOut: true,
+}
+
 func operationName(op int32) string {
 	h := getHandler(op)
 	if h == nil {
@@ -383,6 +714,9 @@ func operationName(op int32) string {
 }
 
 func getHandler(o int32) *operationHandler {
+	if o == _OP_CANONICAL_PATH {
+		return canonicalPathHandler
+	}
 	if o >= _OPCODE_COUNT {
 		return nil
 	}
@@ -401,151 +735,174 @@ func init() {
 	}
 
 	for op, sz := range map[int32]uintptr{
-		_OP_FORGET:       unsafe.Sizeof(ForgetIn{}),
-		_OP_BATCH_FORGET: unsafe.Sizeof(_BatchForgetIn{}),
-		_OP_GETATTR:      unsafe.Sizeof(GetAttrIn{}),
-		_OP_SETATTR:      unsafe.Sizeof(SetAttrIn{}),
-		_OP_MKNOD:        unsafe.Sizeof(MknodIn{}),
-		_OP_MKDIR:        unsafe.Sizeof(MkdirIn{}),
-		_OP_RENAME:       unsafe.Sizeof(RenameIn{}),
-		_OP_LINK:         unsafe.Sizeof(LinkIn{}),
-		_OP_OPEN:         unsafe.Sizeof(OpenIn{}),
-		_OP_READ:         unsafe.Sizeof(ReadIn{}),
-		_OP_WRITE:        unsafe.Sizeof(WriteIn{}),
-		_OP_RELEASE:      unsafe.Sizeof(ReleaseIn{}),
-		_OP_FSYNC:        unsafe.Sizeof(FsyncIn{}),
-		_OP_SETXATTR:     unsafe.Sizeof(SetXAttrIn{}),
-		_OP_GETXATTR:     unsafe.Sizeof(GetXAttrIn{}),
-		_OP_LISTXATTR:    unsafe.Sizeof(GetXAttrIn{}),
-		_OP_FLUSH:        unsafe.Sizeof(FlushIn{}),
-		_OP_INIT:         unsafe.Sizeof(InitIn{}),
-		_OP_OPENDIR:      unsafe.Sizeof(OpenIn{}),
-		_OP_READDIR:      unsafe.Sizeof(ReadIn{}),
-		_OP_RELEASEDIR:   unsafe.Sizeof(ReleaseIn{}),
-		_OP_FSYNCDIR:     unsafe.Sizeof(FsyncIn{}),
-		_OP_ACCESS:       unsafe.Sizeof(AccessIn{}),
-		_OP_CREATE:       unsafe.Sizeof(CreateIn{}),
-		_OP_INTERRUPT:    unsafe.Sizeof(InterruptIn{}),
-		_OP_BMAP:         unsafe.Sizeof(_BmapIn{}),
-		_OP_IOCTL:        unsafe.Sizeof(_IoctlIn{}),
-		_OP_POLL:         unsafe.Sizeof(_PollIn{}),
-		_OP_FALLOCATE:    unsafe.Sizeof(FallocateIn{}),
-		_OP_READDIRPLUS:  unsafe.Sizeof(ReadIn{}),
+		_OP_FORGET:          unsafe.Sizeof(ForgetIn{}),
+		_OP_BATCH_FORGET:    unsafe.Sizeof(_BatchForgetIn{}),
+		_OP_GETATTR:         unsafe.Sizeof(GetAttrIn{}),
+		_OP_SETATTR:         unsafe.Sizeof(SetAttrIn{}),
+		_OP_MKNOD:           unsafe.Sizeof(MknodIn{}),
+		_OP_MKDIR:           unsafe.Sizeof(MkdirIn{}),
+		_OP_RENAME:          unsafe.Sizeof(RenameIn{}),
+		_OP_RENAME2:         unsafe.Sizeof(Rename2In{}),
+		_OP_LINK:            unsafe.Sizeof(LinkIn{}),
+		_OP_OPEN:            unsafe.Sizeof(OpenIn{}),
+		_OP_READ:            unsafe.Sizeof(ReadIn{}),
+		_OP_WRITE:           unsafe.Sizeof(WriteIn{}),
+		_OP_RELEASE:         unsafe.Sizeof(ReleaseIn{}),
+		_OP_FSYNC:           unsafe.Sizeof(FsyncIn{}),
+		_OP_SETXATTR:        unsafe.Sizeof(SetXAttrIn{}),
+		_OP_GETXATTR:        unsafe.Sizeof(GetXAttrIn{}),
+		_OP_LISTXATTR:       unsafe.Sizeof(GetXAttrIn{}),
+		_OP_FLUSH:           unsafe.Sizeof(FlushIn{}),
+		_OP_INIT:            unsafe.Sizeof(InitIn{}),
+		_OP_OPENDIR:         unsafe.Sizeof(OpenIn{}),
+		_OP_READDIR:         unsafe.Sizeof(ReadIn{}),
+		_OP_RELEASEDIR:      unsafe.Sizeof(ReleaseIn{}),
+		_OP_FSYNCDIR:        unsafe.Sizeof(FsyncIn{}),
+		_OP_ACCESS:          unsafe.Sizeof(AccessIn{}),
+		_OP_CREATE:          unsafe.Sizeof(CreateIn{}),
+		_OP_TMPFILE:         unsafe.Sizeof(CreateIn{}),
+		_OP_INTERRUPT:       unsafe.Sizeof(InterruptIn{}),
+		_OP_BMAP:            unsafe.Sizeof(_BmapIn{}),
+		_OP_IOCTL:           unsafe.Sizeof(_IoctlIn{}),
+		_OP_POLL:            unsafe.Sizeof(_PollIn{}),
+		_OP_FALLOCATE:       unsafe.Sizeof(FallocateIn{}),
+		_OP_READDIRPLUS:     unsafe.Sizeof(ReadIn{}),
+		_OP_COPY_FILE_RANGE: unsafe.Sizeof(CopyFileRangeIn{}),
+		_OP_STATX:           unsafe.Sizeof(StatxIn{}),
+		_OP_SETUPMAPPING:    unsafe.Sizeof(SetupMappingIn{}),
+		_OP_REMOVEMAPPING:   sizeOfRemoveMappingIn,
 	} {
 		operationHandlers[op].InputSize = sz
 	}
 
 	for op, sz := range map[int32]uintptr{
-		_OP_LOOKUP:        unsafe.Sizeof(EntryOut{}),
-		_OP_GETATTR:       unsafe.Sizeof(AttrOut{}),
-		_OP_SETATTR:       unsafe.Sizeof(AttrOut{}),
-		_OP_SYMLINK:       unsafe.Sizeof(EntryOut{}),
-		_OP_MKNOD:         unsafe.Sizeof(EntryOut{}),
-		_OP_MKDIR:         unsafe.Sizeof(EntryOut{}),
-		_OP_LINK:          unsafe.Sizeof(EntryOut{}),
-		_OP_OPEN:          unsafe.Sizeof(OpenOut{}),
-		_OP_WRITE:         unsafe.Sizeof(WriteOut{}),
-		_OP_STATFS:        unsafe.Sizeof(StatfsOut{}),
-		_OP_GETXATTR:      unsafe.Sizeof(GetXAttrOut{}),
-		_OP_LISTXATTR:     unsafe.Sizeof(GetXAttrOut{}),
-		_OP_INIT:          unsafe.Sizeof(InitOut{}),
-		_OP_OPENDIR:       unsafe.Sizeof(OpenOut{}),
-		_OP_CREATE:        unsafe.Sizeof(CreateOut{}),
-		_OP_BMAP:          unsafe.Sizeof(_BmapOut{}),
-		_OP_IOCTL:         unsafe.Sizeof(_IoctlOut{}),
-		_OP_POLL:          unsafe.Sizeof(_PollOut{}),
-		_OP_NOTIFY_ENTRY:  unsafe.Sizeof(NotifyInvalEntryOut{}),
-		_OP_NOTIFY_INODE:  unsafe.Sizeof(NotifyInvalInodeOut{}),
-		_OP_NOTIFY_DELETE: unsafe.Sizeof(NotifyInvalDeleteOut{}),
+		_OP_LOOKUP:          unsafe.Sizeof(EntryOut{}),
+		_OP_GETATTR:         unsafe.Sizeof(AttrOut{}),
+		_OP_SETATTR:         unsafe.Sizeof(AttrOut{}),
+		_OP_SYMLINK:         unsafe.Sizeof(EntryOut{}),
+		_OP_MKNOD:           unsafe.Sizeof(EntryOut{}),
+		_OP_MKDIR:           unsafe.Sizeof(EntryOut{}),
+		_OP_LINK:            unsafe.Sizeof(EntryOut{}),
+		_OP_OPEN:            unsafe.Sizeof(OpenOut{}),
+		_OP_WRITE:           unsafe.Sizeof(WriteOut{}),
+		_OP_COPY_FILE_RANGE: unsafe.Sizeof(WriteOut{}),
+		_OP_STATX:           unsafe.Sizeof(StatxOut{}),
+		_OP_STATFS:          unsafe.Sizeof(StatfsOut{}),
+		_OP_GETXATTR:        unsafe.Sizeof(GetXAttrOut{}),
+		_OP_LISTXATTR:       unsafe.Sizeof(GetXAttrOut{}),
+		_OP_INIT:            unsafe.Sizeof(InitOut{}),
+		_OP_OPENDIR:         unsafe.Sizeof(OpenOut{}),
+		_OP_CREATE:          unsafe.Sizeof(CreateOut{}),
+		_OP_TMPFILE:         unsafe.Sizeof(CreateOut{}),
+		_OP_BMAP:            unsafe.Sizeof(_BmapOut{}),
+		_OP_IOCTL:           unsafe.Sizeof(_IoctlOut{}),
+		_OP_POLL:            unsafe.Sizeof(_PollOut{}),
+		_OP_NOTIFY_ENTRY:    unsafe.Sizeof(NotifyInvalEntryOut{}),
+		_OP_NOTIFY_INODE:    unsafe.Sizeof(NotifyInvalInodeOut{}),
+		_OP_NOTIFY_DELETE:   unsafe.Sizeof(NotifyInvalDeleteOut{}),
 	} {
 		operationHandlers[op].OutputSize = sz
 	}
 
 	for op, v := range map[int32]string{
-		_OP_LOOKUP:        "LOOKUP",
-		_OP_FORGET:        "FORGET",
-		_OP_BATCH_FORGET:  "BATCH_FORGET",
-		_OP_GETATTR:       "GETATTR",
-		_OP_SETATTR:       "SETATTR",
-		_OP_READLINK:      "READLINK",
-		_OP_SYMLINK:       "SYMLINK",
-		_OP_MKNOD:         "MKNOD",
-		_OP_MKDIR:         "MKDIR",
-		_OP_UNLINK:        "UNLINK",
-		_OP_RMDIR:         "RMDIR",
-		_OP_RENAME:        "RENAME",
-		_OP_LINK:          "LINK",
-		_OP_OPEN:          "OPEN",
-		_OP_READ:          "READ",
-		_OP_WRITE:         "WRITE",
-		_OP_STATFS:        "STATFS",
-		_OP_RELEASE:       "RELEASE",
-		_OP_FSYNC:         "FSYNC",
-		_OP_SETXATTR:      "SETXATTR",
-		_OP_GETXATTR:      "GETXATTR",
-		_OP_LISTXATTR:     "LISTXATTR",
-		_OP_REMOVEXATTR:   "REMOVEXATTR",
-		_OP_FLUSH:         "FLUSH",
-		_OP_INIT:          "INIT",
-		_OP_OPENDIR:       "OPENDIR",
-		_OP_READDIR:       "READDIR",
-		_OP_RELEASEDIR:    "RELEASEDIR",
-		_OP_FSYNCDIR:      "FSYNCDIR",
-		_OP_GETLK:         "GETLK",
-		_OP_SETLK:         "SETLK",
-		_OP_SETLKW:        "SETLKW",
-		_OP_ACCESS:        "ACCESS",
-		_OP_CREATE:        "CREATE",
-		_OP_INTERRUPT:     "INTERRUPT",
-		_OP_BMAP:          "BMAP",
-		_OP_DESTROY:       "DESTROY",
-		_OP_IOCTL:         "IOCTL",
-		_OP_POLL:          "POLL",
-		_OP_NOTIFY_ENTRY:  "NOTIFY_ENTRY",
-		_OP_NOTIFY_INODE:  "NOTIFY_INODE",
-		_OP_NOTIFY_DELETE: "NOTIFY_DELETE",
-		_OP_FALLOCATE:     "FALLOCATE",
-		_OP_READDIRPLUS:   "READDIRPLUS",
+		_OP_LOOKUP:          "LOOKUP",
+		_OP_FORGET:          "FORGET",
+		_OP_BATCH_FORGET:    "BATCH_FORGET",
+		_OP_GETATTR:         "GETATTR",
+		_OP_SETATTR:         "SETATTR",
+		_OP_READLINK:        "READLINK",
+		_OP_SYMLINK:         "SYMLINK",
+		_OP_MKNOD:           "MKNOD",
+		_OP_MKDIR:           "MKDIR",
+		_OP_UNLINK:          "UNLINK",
+		_OP_RMDIR:           "RMDIR",
+		_OP_RENAME:          "RENAME",
+		_OP_RENAME2:         "RENAME2",
+		_OP_LINK:            "LINK",
+		_OP_OPEN:            "OPEN",
+		_OP_READ:            "READ",
+		_OP_WRITE:           "WRITE",
+		_OP_STATFS:          "STATFS",
+		_OP_RELEASE:         "RELEASE",
+		_OP_FSYNC:           "FSYNC",
+		_OP_SETXATTR:        "SETXATTR",
+		_OP_GETXATTR:        "GETXATTR",
+		_OP_LISTXATTR:       "LISTXATTR",
+		_OP_REMOVEXATTR:     "REMOVEXATTR",
+		_OP_FLUSH:           "FLUSH",
+		_OP_INIT:            "INIT",
+		_OP_OPENDIR:         "OPENDIR",
+		_OP_READDIR:         "READDIR",
+		_OP_RELEASEDIR:      "RELEASEDIR",
+		_OP_FSYNCDIR:        "FSYNCDIR",
+		_OP_GETLK:           "GETLK",
+		_OP_SETLK:           "SETLK",
+		_OP_SETLKW:          "SETLKW",
+		_OP_ACCESS:          "ACCESS",
+		_OP_CREATE:          "CREATE",
+		_OP_TMPFILE:         "TMPFILE",
+		_OP_INTERRUPT:       "INTERRUPT",
+		_OP_BMAP:            "BMAP",
+		_OP_DESTROY:         "DESTROY",
+		_OP_IOCTL:           "IOCTL",
+		_OP_POLL:            "POLL",
+		_OP_NOTIFY_ENTRY:    "NOTIFY_ENTRY",
+		_OP_NOTIFY_INODE:    "NOTIFY_INODE",
+		_OP_NOTIFY_DELETE:   "NOTIFY_DELETE",
+		_OP_FALLOCATE:       "FALLOCATE",
+		_OP_READDIRPLUS:     "READDIRPLUS",
+		_OP_COPY_FILE_RANGE: "COPY_FILE_RANGE",
+		_OP_STATX:           "STATX",
+		_OP_SETUPMAPPING:    "SETUPMAPPING",
+		_OP_REMOVEMAPPING:   "REMOVEMAPPING",
+		_OP_SETVOLNAME:      "SETVOLNAME",
 	} {
 		operationHandlers[op].Name = v
 	}
 
 	for op, v := range map[int32]operationFunc{
-		_OP_OPEN:         doOpen,
-		_OP_READDIR:      doReadDir,
-		_OP_WRITE:        doWrite,
-		_OP_OPENDIR:      doOpenDir,
-		_OP_CREATE:       doCreate,
-		_OP_SETATTR:      doSetattr,
-		_OP_GETXATTR:     doGetXAttr,
-		_OP_LISTXATTR:    doGetXAttr,
-		_OP_GETATTR:      doGetAttr,
-		_OP_FORGET:       doForget,
-		_OP_BATCH_FORGET: doBatchForget,
-		_OP_READLINK:     doReadlink,
-		_OP_INIT:         doInit,
-		_OP_LOOKUP:       doLookup,
-		_OP_MKNOD:        doMknod,
-		_OP_MKDIR:        doMkdir,
-		_OP_UNLINK:       doUnlink,
-		_OP_RMDIR:        doRmdir,
-		_OP_LINK:         doLink,
-		_OP_READ:         doRead,
-		_OP_FLUSH:        doFlush,
-		_OP_RELEASE:      doRelease,
-		_OP_FSYNC:        doFsync,
-		_OP_RELEASEDIR:   doReleaseDir,
-		_OP_FSYNCDIR:     doFsyncDir,
-		_OP_SETXATTR:     doSetXAttr,
-		_OP_REMOVEXATTR:  doRemoveXAttr,
-		_OP_ACCESS:       doAccess,
-		_OP_SYMLINK:      doSymlink,
-		_OP_RENAME:       doRename,
-		_OP_STATFS:       doStatFs,
-		_OP_IOCTL:        doIoctl,
-		_OP_DESTROY:      doDestroy,
-		_OP_FALLOCATE:    doFallocate,
-		_OP_READDIRPLUS:  doReadDirPlus,
+		_OP_OPEN:            doOpen,
+		_OP_READDIR:         doReadDir,
+		_OP_WRITE:           doWrite,
+		_OP_OPENDIR:         doOpenDir,
+		_OP_CREATE:          doCreate,
+		_OP_TMPFILE:         doTmpfile,
+		_OP_SETATTR:         doSetattr,
+		_OP_GETXATTR:        doGetXAttr,
+		_OP_LISTXATTR:       doGetXAttr,
+		_OP_GETATTR:         doGetAttr,
+		_OP_FORGET:          doForget,
+		_OP_BATCH_FORGET:    doBatchForget,
+		_OP_READLINK:        doReadlink,
+		_OP_INIT:            doInit,
+		_OP_LOOKUP:          doLookup,
+		_OP_MKNOD:           doMknod,
+		_OP_MKDIR:           doMkdir,
+		_OP_UNLINK:          doUnlink,
+		_OP_RMDIR:           doRmdir,
+		_OP_LINK:            doLink,
+		_OP_READ:            doRead,
+		_OP_FLUSH:           doFlush,
+		_OP_RELEASE:         doRelease,
+		_OP_FSYNC:           doFsync,
+		_OP_RELEASEDIR:      doReleaseDir,
+		_OP_FSYNCDIR:        doFsyncDir,
+		_OP_SETXATTR:        doSetXAttr,
+		_OP_REMOVEXATTR:     doRemoveXAttr,
+		_OP_ACCESS:          doAccess,
+		_OP_SYMLINK:         doSymlink,
+		_OP_RENAME:          doRename,
+		_OP_RENAME2:         doRename2,
+		_OP_STATFS:          doStatFs,
+		_OP_IOCTL:           doIoctl,
+		_OP_DESTROY:         doDestroy,
+		_OP_FALLOCATE:       doFallocate,
+		_OP_READDIRPLUS:     doReadDirPlus,
+		_OP_COPY_FILE_RANGE: doCopyFileRange,
+		_OP_STATX:           doStatx,
+		_OP_SETUPMAPPING:    doSetupMapping,
+		_OP_REMOVEMAPPING:   doRemoveMapping,
+		_OP_SETVOLNAME:      doSetVolName,
 	} {
 		operationHandlers[op].Func = v
 	}
@@ -557,6 +914,7 @@ func init() {
 		_OP_OPENDIR:       func(ptr unsafe.Pointer) interface{} { return (*OpenOut)(ptr) },
 		_OP_GETATTR:       func(ptr unsafe.Pointer) interface{} { return (*AttrOut)(ptr) },
 		_OP_CREATE:        func(ptr unsafe.Pointer) interface{} { return (*CreateOut)(ptr) },
+		_OP_TMPFILE:       func(ptr unsafe.Pointer) interface{} { return (*CreateOut)(ptr) },
 		_OP_LINK:          func(ptr unsafe.Pointer) interface{} { return (*EntryOut)(ptr) },
 		_OP_SETATTR:       func(ptr unsafe.Pointer) interface{} { return (*AttrOut)(ptr) },
 		_OP_INIT:          func(ptr unsafe.Pointer) interface{} { return (*InitOut)(ptr) },
@@ -571,28 +929,34 @@ func init() {
 
 	// Inputs.
 	for op, f := range map[int32]castPointerFunc{
-		_OP_FLUSH:        func(ptr unsafe.Pointer) interface{} { return (*FlushIn)(ptr) },
-		_OP_GETATTR:      func(ptr unsafe.Pointer) interface{} { return (*GetAttrIn)(ptr) },
-		_OP_GETXATTR:     func(ptr unsafe.Pointer) interface{} { return (*GetXAttrIn)(ptr) },
-		_OP_LISTXATTR:    func(ptr unsafe.Pointer) interface{} { return (*GetXAttrIn)(ptr) },
-		_OP_SETATTR:      func(ptr unsafe.Pointer) interface{} { return (*SetAttrIn)(ptr) },
-		_OP_INIT:         func(ptr unsafe.Pointer) interface{} { return (*InitIn)(ptr) },
-		_OP_IOCTL:        func(ptr unsafe.Pointer) interface{} { return (*_IoctlIn)(ptr) },
-		_OP_OPEN:         func(ptr unsafe.Pointer) interface{} { return (*OpenIn)(ptr) },
-		_OP_MKNOD:        func(ptr unsafe.Pointer) interface{} { return (*MknodIn)(ptr) },
-		_OP_CREATE:       func(ptr unsafe.Pointer) interface{} { return (*CreateIn)(ptr) },
-		_OP_READ:         func(ptr unsafe.Pointer) interface{} { return (*ReadIn)(ptr) },
-		_OP_READDIR:      func(ptr unsafe.Pointer) interface{} { return (*ReadIn)(ptr) },
-		_OP_ACCESS:       func(ptr unsafe.Pointer) interface{} { return (*AccessIn)(ptr) },
-		_OP_FORGET:       func(ptr unsafe.Pointer) interface{} { return (*ForgetIn)(ptr) },
-		_OP_BATCH_FORGET: func(ptr unsafe.Pointer) interface{} { return (*_BatchForgetIn)(ptr) },
-		_OP_LINK:         func(ptr unsafe.Pointer) interface{} { return (*LinkIn)(ptr) },
-		_OP_MKDIR:        func(ptr unsafe.Pointer) interface{} { return (*MkdirIn)(ptr) },
-		_OP_RELEASE:      func(ptr unsafe.Pointer) interface{} { return (*ReleaseIn)(ptr) },
-		_OP_RELEASEDIR:   func(ptr unsafe.Pointer) interface{} { return (*ReleaseIn)(ptr) },
-		_OP_FALLOCATE:    func(ptr unsafe.Pointer) interface{} { return (*FallocateIn)(ptr) },
-		_OP_READDIRPLUS:  func(ptr unsafe.Pointer) interface{} { return (*ReadIn)(ptr) },
-		_OP_RENAME:       func(ptr unsafe.Pointer) interface{} { return (*RenameIn)(ptr) },
+		_OP_FLUSH:           func(ptr unsafe.Pointer) interface{} { return (*FlushIn)(ptr) },
+		_OP_GETATTR:         func(ptr unsafe.Pointer) interface{} { return (*GetAttrIn)(ptr) },
+		_OP_GETXATTR:        func(ptr unsafe.Pointer) interface{} { return (*GetXAttrIn)(ptr) },
+		_OP_LISTXATTR:       func(ptr unsafe.Pointer) interface{} { return (*GetXAttrIn)(ptr) },
+		_OP_SETATTR:         func(ptr unsafe.Pointer) interface{} { return (*SetAttrIn)(ptr) },
+		_OP_INIT:            func(ptr unsafe.Pointer) interface{} { return (*InitIn)(ptr) },
+		_OP_IOCTL:           func(ptr unsafe.Pointer) interface{} { return (*_IoctlIn)(ptr) },
+		_OP_OPEN:            func(ptr unsafe.Pointer) interface{} { return (*OpenIn)(ptr) },
+		_OP_MKNOD:           func(ptr unsafe.Pointer) interface{} { return (*MknodIn)(ptr) },
+		_OP_CREATE:          func(ptr unsafe.Pointer) interface{} { return (*CreateIn)(ptr) },
+		_OP_TMPFILE:         func(ptr unsafe.Pointer) interface{} { return (*CreateIn)(ptr) },
+		_OP_READ:            func(ptr unsafe.Pointer) interface{} { return (*ReadIn)(ptr) },
+		_OP_READDIR:         func(ptr unsafe.Pointer) interface{} { return (*ReadIn)(ptr) },
+		_OP_ACCESS:          func(ptr unsafe.Pointer) interface{} { return (*AccessIn)(ptr) },
+		_OP_FORGET:          func(ptr unsafe.Pointer) interface{} { return (*ForgetIn)(ptr) },
+		_OP_BATCH_FORGET:    func(ptr unsafe.Pointer) interface{} { return (*_BatchForgetIn)(ptr) },
+		_OP_LINK:            func(ptr unsafe.Pointer) interface{} { return (*LinkIn)(ptr) },
+		_OP_MKDIR:           func(ptr unsafe.Pointer) interface{} { return (*MkdirIn)(ptr) },
+		_OP_RELEASE:         func(ptr unsafe.Pointer) interface{} { return (*ReleaseIn)(ptr) },
+		_OP_RELEASEDIR:      func(ptr unsafe.Pointer) interface{} { return (*ReleaseIn)(ptr) },
+		_OP_FALLOCATE:       func(ptr unsafe.Pointer) interface{} { return (*FallocateIn)(ptr) },
+		_OP_READDIRPLUS:     func(ptr unsafe.Pointer) interface{} { return (*ReadIn)(ptr) },
+		_OP_RENAME:          func(ptr unsafe.Pointer) interface{} { return (*RenameIn)(ptr) },
+		_OP_RENAME2:         func(ptr unsafe.Pointer) interface{} { return (*Rename2In)(ptr) },
+		_OP_COPY_FILE_RANGE: func(ptr unsafe.Pointer) interface{} { return (*CopyFileRangeIn)(ptr) },
+		_OP_STATX:           func(ptr unsafe.Pointer) interface{} { return (*StatxIn)(ptr) },
+		_OP_SETUPMAPPING:    func(ptr unsafe.Pointer) interface{} { return (*SetupMappingIn)(ptr) },
+		_OP_REMOVEMAPPING:   func(ptr unsafe.Pointer) interface{} { return (*RemoveMappingIn)(ptr) },
 	} {
 		operationHandlers[op].DecodeIn = f
 	}
@@ -607,13 +971,32 @@ func init() {
 		_OP_MKNOD:       1,
 		_OP_REMOVEXATTR: 1,
 		_OP_RENAME:      2,
+		_OP_RENAME2:     2,
 		_OP_RMDIR:       1,
+		_OP_SETVOLNAME:  1,
 		_OP_SYMLINK:     2,
 		_OP_UNLINK:      1,
 	} {
 		operationHandlers[op].FileNames = count
 	}
 
+	for op, c := range map[int32]CapSet{
+		_OP_GETXATTR:        CapXAttr,
+		_OP_LISTXATTR:       CapXAttr,
+		_OP_SETXATTR:        CapXAttr,
+		_OP_REMOVEXATTR:     CapXAttr,
+		_OP_FSYNC:           CapFsync,
+		_OP_FSYNCDIR:        CapFsync,
+		_OP_FALLOCATE:       CapFallocate,
+		_OP_COPY_FILE_RANGE: CapCopyFileRange,
+		_OP_RENAME2:         CapRename2,
+		_OP_TMPFILE:         CapTmpfile,
+		_OP_STATX:           CapStatx,
+		_OP_IOCTL:           CapIoctl,
+	} {
+		operationHandlers[op].Capability = c
+	}
+
 	var r request
 	sizeOfOutHeader := unsafe.Sizeof(OutHeader{})
 	for code, h := range operationHandlers {
@@ -0,0 +1,579 @@
+package fuse
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/splice"
+)
+
+type mappingFS struct {
+	RawFileSystem
+
+	setup   *SetupMappingIn
+	removed []RemoveMappingOne
+}
+
+func (fs *mappingFS) SetupMapping(in *SetupMappingIn) Status {
+	c := *in
+	fs.setup = &c
+	return OK
+}
+
+func (fs *mappingFS) RemoveMapping(in *RemoveMappingIn, mappings []RemoveMappingOne) Status {
+	fs.removed = append(fs.removed, mappings...)
+	return OK
+}
+
+func newTestServer(fs RawFileSystem) *Server {
+	return &Server{
+		fileSystem:  fs,
+		opts:        &MountOptions{Buffers: NewGcBufferPool()},
+		unsupported: CapAll &^ Capabilities(fs),
+	}
+}
+
+// dispatch parses input as a kernel request and runs its handler.
+func dispatch(ms *Server, input []byte) *request {
+	req := new(request)
+	req.setInput(input)
+	req.parse()
+	if req.status.Ok() {
+		req.status = ms.checkNames(req)
+	}
+	if req.status.Ok() {
+		req.status = ms.checkCapability(req)
+	}
+	if req.status.Ok() {
+		req.handler.Func(ms, req)
+	}
+	return req
+}
+
+func setupMappingInput() []byte {
+	in := SetupMappingIn{
+		InHeader: InHeader{Opcode: _OP_SETUPMAPPING, NodeId: 2},
+		Fh:       3,
+		Foffset:  4096,
+		Len:      8192,
+		Flags:    SETUPMAPPING_FLAG_READ,
+		Moffset:  2 * 4096,
+	}
+	in.Length = uint32(unsafe.Sizeof(in))
+
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	return append([]byte{}, b...)
+}
+
+func removeMappingInput(mappings []RemoveMappingOne) []byte {
+	hdr := RemoveMappingIn{
+		InHeader: InHeader{Opcode: _OP_REMOVEMAPPING, NodeId: 2},
+		Count:    uint32(len(mappings)),
+	}
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&hdr), sizeOfRemoveMappingIn)
+	input := append([]byte{}, b...)
+
+	toSlice(&b, unsafe.Pointer(&mappings[0]), uintptr(len(mappings))*unsafe.Sizeof(RemoveMappingOne{}))
+	input = append(input, b...)
+	(*InHeader)(unsafe.Pointer(&input[0])).Length = uint32(len(input))
+	return input
+}
+
+func TestMappingDefaultENOSYS(t *testing.T) {
+	fs := NewDefaultRawFileSystem()
+	if req := dispatch(newTestServer(fs), setupMappingInput()); req.status != ENOSYS {
+		t.Errorf("SETUPMAPPING: got %v, want ENOSYS", req.status)
+	}
+
+	input := removeMappingInput([]RemoveMappingOne{{Moffset: 0, Len: 4096}})
+	if req := dispatch(newTestServer(fs), input); req.status != ENOSYS {
+		t.Errorf("REMOVEMAPPING: got %v, want ENOSYS", req.status)
+	}
+}
+
+func TestMappingDispatch(t *testing.T) {
+	fs := &mappingFS{RawFileSystem: NewDefaultRawFileSystem()}
+	if req := dispatch(newTestServer(fs), setupMappingInput()); !req.status.Ok() {
+		t.Fatalf("SETUPMAPPING: %v", req.status)
+	}
+	if fs.setup == nil {
+		t.Fatal("SetupMapping not called")
+	}
+	if got := *fs.setup; got.Fh != 3 || got.Foffset != 4096 || got.Len != 8192 ||
+		got.Moffset != 8192 || got.Flags != SETUPMAPPING_FLAG_READ || got.NodeId != 2 {
+		t.Errorf("SetupMapping got %v", Print(&got))
+	}
+
+	want := []RemoveMappingOne{{Moffset: 0, Len: 4096}, {Moffset: 8192, Len: 12288}}
+	if req := dispatch(newTestServer(fs), removeMappingInput(want)); !req.status.Ok() {
+		t.Fatalf("REMOVEMAPPING: %v", req.status)
+	}
+	if len(fs.removed) != len(want) {
+		t.Fatalf("got %d mappings, want %d", len(fs.removed), len(want))
+	}
+	for i := range want {
+		if fs.removed[i] != want[i] {
+			t.Errorf("mapping %d: got %v, want %v", i, fs.removed[i], want[i])
+		}
+	}
+}
+
+type copyRangeFS struct {
+	RawFileSystem
+
+	in *CopyFileRangeIn
+}
+
+func (fs *copyRangeFS) CopyFileRange(in *CopyFileRangeIn) (uint32, Status) {
+	c := *in
+	fs.in = &c
+	return uint32(in.Len), OK
+}
+
+func TestCopyFileRangeDispatch(t *testing.T) {
+	in := CopyFileRangeIn{
+		InHeader:  InHeader{Opcode: _OP_COPY_FILE_RANGE, NodeId: 2},
+		FhIn:      3,
+		OffIn:     4096,
+		NodeIdOut: 5,
+		FhOut:     6,
+		OffOut:    8192,
+		Len:       1000,
+	}
+	in.Length = uint32(unsafe.Sizeof(in))
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	input := append([]byte{}, b...)
+
+	if req := dispatch(newTestServer(NewDefaultRawFileSystem()), input); req.status != ENOSYS {
+		t.Errorf("default COPY_FILE_RANGE: got %v, want ENOSYS", req.status)
+	}
+
+	fs := &copyRangeFS{RawFileSystem: NewDefaultRawFileSystem()}
+	req := dispatch(newTestServer(fs), input)
+	if !req.status.Ok() {
+		t.Fatalf("COPY_FILE_RANGE: %v", req.status)
+	}
+	if fs.in == nil {
+		t.Fatal("CopyFileRange not called")
+	}
+	if got := *fs.in; got.FhIn != 3 || got.OffIn != 4096 || got.NodeIdOut != 5 ||
+		got.FhOut != 6 || got.OffOut != 8192 || got.Len != 1000 {
+		t.Errorf("CopyFileRange got %v", Print(&got))
+	}
+	if out := (*WriteOut)(req.outData); out.Size != 1000 {
+		t.Errorf("written: got %d, want 1000", out.Size)
+	}
+}
+
+type statxFS struct {
+	RawFileSystem
+}
+
+func (fs *statxFS) Statx(in *StatxIn, out *StatxOut) Status {
+	out.Stat.Mask = STATX_BASIC_STATS
+	out.Stat.Size = in.Fh
+	out.Stat.Attributes = STATX_ATTR_IMMUTABLE
+	return OK
+}
+
+func TestStatxDispatch(t *testing.T) {
+	// These must match struct fuse_statx_in, fuse_statx and
+	// fuse_statx_out in the kernel.
+	if sz := unsafe.Sizeof(StatxIn{}) - unsafe.Sizeof(InHeader{}); sz != 24 {
+		t.Errorf("StatxIn payload is %d bytes, want 24", sz)
+	}
+	if sz := unsafe.Sizeof(Statx{}); sz != 256 {
+		t.Errorf("Statx is %d bytes, want 256", sz)
+	}
+	if sz := unsafe.Sizeof(StatxOut{}); sz != 288 {
+		t.Errorf("StatxOut is %d bytes, want 288", sz)
+	}
+
+	in := StatxIn{
+		InHeader: InHeader{Opcode: _OP_STATX, NodeId: 2},
+		Fh:       42,
+	}
+	in.Length = uint32(unsafe.Sizeof(in))
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	input := append([]byte{}, b...)
+
+	if req := dispatch(newTestServer(NewDefaultRawFileSystem()), input); req.status != ENOSYS {
+		t.Errorf("default STATX: got %v, want ENOSYS", req.status)
+	}
+	req := dispatch(newTestServer(&statxFS{NewDefaultRawFileSystem()}), input)
+	if !req.status.Ok() {
+		t.Fatalf("STATX: %v", req.status)
+	}
+	if out := (*StatxOut)(req.outData); out.Stat.Size != 42 || out.Stat.Attributes != STATX_ATTR_IMMUTABLE {
+		t.Errorf("STATX reply: %v", Print(out))
+	}
+}
+
+type createFS struct {
+	RawFileSystem
+	created []string
+}
+
+func (fs *createFS) Create(in *CreateIn, name string, out *CreateOut) Status {
+	fs.created = append(fs.created, name)
+	return OK
+}
+
+func createInput(name string) []byte {
+	in := CreateIn{InHeader: InHeader{Opcode: _OP_CREATE, NodeId: 1}}
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	input := append(append([]byte{}, b...), name...)
+	input = append(input, 0)
+	(*InHeader)(unsafe.Pointer(&input[0])).Length = uint32(len(input))
+	return input
+}
+
+func TestNameTooLong(t *testing.T) {
+	fs := &createFS{RawFileSystem: NewDefaultRawFileSystem()}
+	ms := newTestServer(fs)
+	ms.opts.MaxNameLength = _NAME_MAX
+
+	long := strings.Repeat("x", 300)
+	if req := dispatch(ms, createInput(long)); req.status != ENAMETOOLONG {
+		t.Errorf("CREATE with %d byte name: got %v, want ENAMETOOLONG", len(long), req.status)
+	}
+	ok := strings.Repeat("x", _NAME_MAX)
+	if req := dispatch(ms, createInput(ok)); !req.status.Ok() {
+		t.Errorf("CREATE with %d byte name: %v", len(ok), req.status)
+	}
+	if len(fs.created) != 1 || fs.created[0] != ok {
+		t.Errorf("file system saw %d creates, want 1", len(fs.created))
+	}
+
+	// Negative limits switch the check off.
+	ms.opts.MaxNameLength = -1
+	if req := dispatch(ms, createInput(long)); !req.status.Ok() {
+		t.Errorf("CREATE without limit: %v", req.status)
+	}
+}
+
+type tmpfileFS struct {
+	RawFileSystem
+}
+
+func (fs *tmpfileFS) Tmpfile(in *CreateIn, out *CreateOut) Status {
+	out.NodeId = 2
+	out.Fh = uint64(in.Mode)
+	return OK
+}
+
+func TestTmpfileDispatch(t *testing.T) {
+	in := CreateIn{InHeader: InHeader{Opcode: _OP_TMPFILE, NodeId: 1}, Mode: 0600}
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	// The kernel sends the name of the dentry after the
+	// arguments; it has no meaning.
+	input := append(append([]byte{}, b...), '/', 0)
+	(*InHeader)(unsafe.Pointer(&input[0])).Length = uint32(len(input))
+
+	if req := dispatch(newTestServer(NewDefaultRawFileSystem()), input); req.status != ENOSYS {
+		t.Errorf("default TMPFILE: got %v, want ENOSYS", req.status)
+	}
+	req := dispatch(newTestServer(&tmpfileFS{NewDefaultRawFileSystem()}), input)
+	if !req.status.Ok() {
+		t.Fatalf("TMPFILE: %v", req.status)
+	}
+	if out := (*CreateOut)(req.outData); out.NodeId != 2 || out.Fh != 0600 {
+		t.Errorf("TMPFILE reply: %v", Print(out))
+	}
+}
+
+func initInput(flags uint32) []byte {
+	in := InitIn{
+		InHeader: InHeader{Opcode: _OP_INIT},
+		Major:    _FUSE_KERNEL_VERSION,
+		Minor:    _MINIMUM_MINOR_VERSION,
+		Flags:    flags,
+	}
+	in.Length = uint32(unsafe.Sizeof(in))
+
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	return append([]byte{}, b...)
+}
+
+func TestInitOptInCapabilities(t *testing.T) {
+	const caps = CAP_PARALLEL_DIROPS | CAP_ASYNC_DIO
+	for _, opt := range []bool{false, true} {
+		ms := newTestServer(NewDefaultRawFileSystem())
+		ms.opts.EnableParallelDirOps = opt
+		ms.opts.EnableAsyncDIO = opt
+
+		req := dispatch(ms, initInput(caps|CAP_ASYNC_READ))
+		if !req.status.Ok() {
+			t.Fatalf("INIT: %v", req.status)
+		}
+		out := (*InitOut)(req.outData)
+		want := uint32(0)
+		if opt {
+			want = caps
+		}
+		if got := out.Flags & caps; got != want {
+			t.Errorf("opt-in %v: got flags %x, want %x", opt, got, want)
+		}
+		if out.Flags&CAP_ASYNC_READ == 0 {
+			t.Errorf("opt-in %v: lost ASYNC_READ", opt)
+		}
+	}
+}
+
+type openFlagsFS struct {
+	RawFileSystem
+	flags uint32
+}
+
+func (fs *openFlagsFS) Open(in *OpenIn, out *OpenOut) Status {
+	fs.flags = in.Flags
+	return OK
+}
+
+func TestWritebackCacheOpen(t *testing.T) {
+	for _, opt := range []bool{false, true} {
+		fs := &openFlagsFS{RawFileSystem: NewDefaultRawFileSystem()}
+		ms := newTestServer(fs)
+		ms.opts.EnableWritebackCache = opt
+		req := dispatch(ms, initInput(CAP_WRITEBACK_CACHE))
+		if !req.status.Ok() {
+			t.Fatalf("INIT: %v", req.status)
+		}
+		if got := (*InitOut)(req.outData).Flags&CAP_WRITEBACK_CACHE != 0; got != opt {
+			t.Errorf("opt-in %v: got WRITEBACK_CACHE %v", opt, got)
+		}
+
+		in := OpenIn{InHeader: InHeader{Opcode: _OP_OPEN, NodeId: 2}, Flags: syscall.O_WRONLY | syscall.O_APPEND}
+		in.Length = uint32(unsafe.Sizeof(in))
+		var b []byte
+		toSlice(&b, unsafe.Pointer(&in), unsafe.Sizeof(in))
+		if req := dispatch(ms, append([]byte{}, b...)); !req.status.Ok() {
+			t.Fatalf("OPEN: %v", req.status)
+		}
+		want := uint32(syscall.O_WRONLY | syscall.O_APPEND)
+		if opt {
+			want = syscall.O_RDWR
+		}
+		if fs.flags != want {
+			t.Errorf("opt-in %v: file system got flags %x, want %x", opt, fs.flags, want)
+		}
+	}
+}
+
+type volNameFS struct {
+	RawFileSystem
+
+	name string
+}
+
+func (fs *volNameFS) SetVolumeName(name string) Status {
+	fs.name = name
+	return OK
+}
+
+func setVolNameInput(name string) []byte {
+	hdr := InHeader{Opcode: _OP_SETVOLNAME, NodeId: 1}
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&hdr), unsafe.Sizeof(hdr))
+	input := append([]byte{}, b...)
+	input = append(input, name...)
+	input = append(input, 0)
+	(*InHeader)(unsafe.Pointer(&input[0])).Length = uint32(len(input))
+	return input
+}
+
+func TestSetVolName(t *testing.T) {
+	if req := dispatch(newTestServer(NewDefaultRawFileSystem()), setVolNameInput("vol")); req.status != ENOSYS {
+		t.Errorf("default SETVOLNAME: got %v, want ENOSYS", req.status)
+	}
+
+	fs := &volNameFS{RawFileSystem: NewDefaultRawFileSystem()}
+	if req := dispatch(newTestServer(fs), setVolNameInput("My Volume")); !req.status.Ok() {
+		t.Fatalf("SETVOLNAME: %v", req.status)
+	}
+	if fs.name != "My Volume" {
+		t.Errorf("got name %q, want %q", fs.name, "My Volume")
+	}
+}
+
+// notSupportedFS answers Flush, Fsync and Access with code.
+type notSupportedFS struct {
+	RawFileSystem
+	code Status
+}
+
+func (fs *notSupportedFS) Flush(input *FlushIn) Status {
+	return fs.code
+}
+
+func (fs *notSupportedFS) Fsync(input *FsyncIn) Status {
+	return fs.code
+}
+
+func (fs *notSupportedFS) Access(input *AccessIn) Status {
+	return fs.code
+}
+
+func headerInput(opcode int32, size uintptr) []byte {
+	input := make([]byte, size)
+	h := (*InHeader)(unsafe.Pointer(&input[0]))
+	h.Opcode = opcode
+	h.NodeId = 1
+	h.Length = uint32(size)
+	return input
+}
+
+func TestNotSupported(t *testing.T) {
+	for _, c := range []struct {
+		opcode int32
+		size   uintptr
+		code   Status
+		want   Status
+	}{
+		// The kernel would stop sending these.
+		{_OP_FSYNC, unsafe.Sizeof(FsyncIn{}), ENOSYS, ENOSYS},
+		{_OP_ACCESS, unsafe.Sizeof(AccessIn{}), ENOSYS, ENOSYS},
+
+		// Not supported this time.
+		{_OP_FSYNC, unsafe.Sizeof(FsyncIn{}), EOPNOTSUPP, OK},
+		{_OP_ACCESS, unsafe.Sizeof(AccessIn{}), EOPNOTSUPP, OK},
+
+		// Flush must keep coming.
+		{_OP_FLUSH, unsafe.Sizeof(FlushIn{}), ENOSYS, OK},
+		{_OP_FLUSH, unsafe.Sizeof(FlushIn{}), EOPNOTSUPP, OK},
+		{_OP_FLUSH, unsafe.Sizeof(FlushIn{}), EIO, EIO},
+	} {
+		ms := newTestServer(&notSupportedFS{NewDefaultRawFileSystem(), c.code})
+		req := dispatch(ms, headerInput(c.opcode, c.size))
+		if req.status != c.want {
+			t.Errorf("%s returning %v: got %v, want %v", operationName(c.opcode), c.code, req.status, c.want)
+		}
+	}
+}
+
+func TestInitSplice(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		ms := newTestServer(NewDefaultRawFileSystem())
+		ms.opts.DisableSplice = disable
+
+		req := dispatch(ms, initInput(CAP_SPLICE_WRITE|CAP_SPLICE_READ))
+		if !req.status.Ok() {
+			t.Fatalf("INIT: %v", req.status)
+		}
+		out := (*InitOut)(req.outData)
+		if out.Flags&CAP_SPLICE_READ != 0 {
+			t.Errorf("disable %v: got SPLICE_READ, which is not implemented", disable)
+		}
+		want := !disable && splice.Resizable()
+		if got := out.Flags&CAP_SPLICE_WRITE != 0; got != want || ms.canSplice != want {
+			t.Errorf("disable %v: got SPLICE_WRITE %v, canSplice %v, want %v", disable, got, ms.canSplice, want)
+		}
+	}
+
+	ms := newTestServer(NewDefaultRawFileSystem())
+	dispatch(ms, initInput(0))
+	if ms.canSplice {
+		t.Errorf("splicing without SPLICE_WRITE from the kernel")
+	}
+}
+
+type readlinkFS struct {
+	RawFileSystem
+	target string
+}
+
+func (fs *readlinkFS) Readlink(header *InHeader) ([]byte, Status) {
+	return []byte(fs.target), OK
+}
+
+func (fs *readlinkFS) CanonicalPath(header *InHeader) (string, Status) {
+	return fs.target, OK
+}
+
+func TestCanonicalPath(t *testing.T) {
+	fs := &readlinkFS{RawFileSystem: NewDefaultRawFileSystem(), target: "/data/media/0/file"}
+	ms := newTestServer(fs)
+	in := InHeader{Opcode: _OP_CANONICAL_PATH, NodeId: 2}
+	in.Length = uint32(unsafe.Sizeof(in))
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&in), unsafe.Sizeof(in))
+
+	req := dispatch(ms, append([]byte{}, b...))
+	if !req.status.Ok() || string(req.flatData) != fs.target {
+		t.Errorf("CANONICAL_PATH: got %q, %v, want %q", req.flatData, req.status, fs.target)
+	}
+	if got := operationName(_OP_CANONICAL_PATH); got != "CANONICAL_PATH" {
+		t.Errorf("got name %q, want CANONICAL_PATH", got)
+	}
+	if len(operationHandlers) != int(_OPCODE_COUNT) || _OPCODE_COUNT > 256 {
+		t.Errorf("got %d opcode handlers", len(operationHandlers))
+	}
+}
+
+func TestReadlinkTooLong(t *testing.T) {
+	fs := &readlinkFS{RawFileSystem: NewDefaultRawFileSystem()}
+	ms := newTestServer(fs)
+	in := InHeader{Opcode: _OP_READLINK, NodeId: 2}
+	in.Length = uint32(unsafe.Sizeof(in))
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	input := append([]byte{}, b...)
+
+	fs.target = strings.Repeat("x", _PATH_MAX-1)
+	if req := dispatch(ms, input); !req.status.Ok() || string(req.flatData) != fs.target {
+		t.Errorf("READLINK of %d bytes: got %d bytes, %v", len(fs.target), len(req.flatData), req.status)
+	}
+	fs.target += "x"
+	if req := dispatch(ms, input); req.status != ENAMETOOLONG || req.flatData != nil {
+		t.Errorf("READLINK of %d bytes: got %d bytes, %v, want ENAMETOOLONG", len(fs.target), len(req.flatData), req.status)
+	}
+}
+
+type noXAttrFS struct {
+	RawFileSystem
+
+	calls int
+}
+
+func (fs *noXAttrFS) Capabilities() CapSet {
+	return CapAll &^ CapXAttr
+}
+
+func (fs *noXAttrFS) RemoveXAttr(header *InHeader, attr string) Status {
+	fs.calls++
+	return OK
+}
+
+func TestUndeclaredCapability(t *testing.T) {
+	hdr := InHeader{Opcode: _OP_REMOVEXATTR, NodeId: 1}
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&hdr), unsafe.Sizeof(hdr))
+	input := append([]byte{}, b...)
+	input = append(input, "user.x\x00"...)
+	(*InHeader)(unsafe.Pointer(&input[0])).Length = uint32(len(input))
+
+	fs := &noXAttrFS{RawFileSystem: NewDefaultRawFileSystem()}
+	for _, ms := range []*Server{newTestServer(fs), newTestServer(NewLockingRawFileSystem(fs))} {
+		if req := dispatch(ms, input); req.status != ENOSYS {
+			t.Errorf("REMOVEXATTR: got %v, want ENOSYS", req.status)
+		}
+	}
+	if fs.calls != 0 {
+		t.Errorf("RemoveXAttr called %d times for an undeclared capability", fs.calls)
+	}
+
+	// Without a declaration, everything is passed on.
+	fs.RawFileSystem = NewDefaultRawFileSystem()
+	if req := dispatch(newTestServer(&struct{ RawFileSystem }{fs}), input); !req.status.Ok() || fs.calls != 1 {
+		t.Errorf("REMOVEXATTR undeclared: got %v after %d calls, want OK after 1", req.status, fs.calls)
+	}
+}
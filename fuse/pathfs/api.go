@@ -29,11 +29,20 @@ type FileSystem interface {
 	// hardlinks incurs a performance hit.
 	GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status)
 
-	// These should update the file's ctime too.
+	// These should update the file's ctime too, as should
+	// Truncate, and Link, Unlink and Rename for the file whose
+	// link count or name changes. File systems that do not store
+	// their metadata in a backing file system can use
+	// fuse.Attr.Changed for this.
 	Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status)
+
+	// Chown changes the owner of name itself, so a symlink is not
+	// followed.
 	Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status)
 	Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status)
 
+	// Growing a file should leave a hole that reads as zeros,
+	// like truncate(2) does, rather than writing zeros.
 	Truncate(name string, size uint64, context *fuse.Context) (code fuse.Status)
 
 	Access(name string, mode uint32, context *fuse.Context) (code fuse.Status)
@@ -71,8 +80,139 @@ type FileSystem interface {
 	StatFs(name string) *fuse.StatfsOut
 }
 
+// DirStreamFileSystem is an optional interface for FileSystems that
+// can list directories incrementally. See nodefs.DirStreamNode.
+type DirStreamFileSystem interface {
+	OpenDirStream(name string, context *fuse.Context) (nodefs.DirStream, fuse.Status)
+}
+
+// StatxFileSystem is an optional interface for FileSystems that
+// report STATX_ATTR_* flags. See nodefs.StatxNode.
+type StatxFileSystem interface {
+	StatxAttributes(name string, context *fuse.Context) (attributes uint64, mask uint64, code fuse.Status)
+}
+
+// Rename2FileSystem is an optional interface for FileSystems that
+// support the fuse.RENAME_* flags of renameat2(2). See
+// nodefs.Rename2Node.
+type Rename2FileSystem interface {
+	Rename2(oldName string, newName string, flags uint32, context *fuse.Context) (code fuse.Status)
+}
+
+// TmpfileFileSystem is an optional interface for FileSystems that
+// support open(2) with O_TMPFILE. Tmpfile opens an unnamed file in
+// the directory dir. LinkTmpfile gives a file returned by Tmpfile the
+// name name, for linkat(2) of the /proc/self/fd/N path. See
+// nodefs.TmpfileNode.
+type TmpfileFileSystem interface {
+	Tmpfile(dir string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status)
+	LinkTmpfile(file nodefs.File, name string, context *fuse.Context) fuse.Status
+}
+
+// CacheTimeoutFileSystem is an optional interface for FileSystems
+// that want the kernel to cache some files for longer or shorter than
+// the mount's timeouts. See nodefs.CacheTimeoutNode.
+type CacheTimeoutFileSystem interface {
+	CacheTimeouts(name string) (entry time.Duration, attr time.Duration)
+}
+
+// OpenDirFlagsFileSystem is an optional interface for FileSystems
+// that set FOPEN_* flags when a directory is opened. See
+// nodefs.OpenDirFlagsNode.
+type OpenDirFlagsFileSystem interface {
+	OpenDirFlags(name string, context *fuse.Context) uint32
+}
+
+// VolumeNameFileSystem is an optional interface for FileSystems that
+// support renaming the mounted volume. See nodefs.VolumeNameNode.
+type VolumeNameFileSystem interface {
+	SetVolumeName(name string) fuse.Status
+}
+
+// CanonicalPathFileSystem is an optional interface for FileSystems
+// that can say which path a file is reached by. CanonicalPath gets
+// the name of the node in the mount. See nodefs.CanonicalPathNode.
+type CanonicalPathFileSystem interface {
+	CanonicalPath(name string, context *fuse.Context) (path string, code fuse.Status)
+}
+
+// ReadOnlyFileSystem is an optional interface for FileSystems that
+// know they can't be written, such as a loopback of a read-only
+// mount. MountAt mounts them read-only, so the kernel fails writes
+// with EROFS without sending them.
+type ReadOnlyFileSystem interface {
+	ReadOnly() bool
+}
+
+// LoopbackOptions are options for NewLoopbackFileSystemWithOptions.
+type LoopbackOptions struct {
+	// If NoAtimeFallback is set, an open with O_NOATIME that fails
+	// because the server doesn't own the backing file is retried
+	// without O_NOATIME, and so updates the access time. By
+	// default, the EPERM is returned, so the caller can decide.
+	NoAtimeFallback bool
+
+	// If FdWait is set, an open that fails because the process or
+	// the system is out of file descriptors (EMFILE, ENFILE) is
+	// retried with backoff for up to FdWait, so a burst of opens
+	// waits for others to be closed instead of failing. By default,
+	// the error is returned at once.
+	FdWait time.Duration
+
+	// OnFdShortage, if set, is called before each such retry. It
+	// can free descriptors held for later use, for example by
+	// unpinning files of a PinningFileSystem.
+	OnFdShortage func()
+
+	// If MaxFileSize is positive, files may not grow beyond it:
+	// writes past it, and truncates to a larger size, fail with
+	// EFBIG. See nodefs.NewSizeLimitedLoopbackFile.
+	MaxFileSize int64
+
+	// If MaxDirEntries is positive, listing a directory with more
+	// entries fails with EFBIG, so a huge or hostile directory
+	// can't make the server buffer all of it. If TruncateDirs is
+	// also set, the listing is cut at MaxDirEntries instead, and a
+	// warning is logged.
+	MaxDirEntries int
+	TruncateDirs  bool
+
+	// If IgnoreUmask is set, Create, Mkdir and Mknod give the new
+	// entry the mode from the kernel, which has the caller's umask
+	// applied already, without also masking it with the umask of
+	// the server process. The umask is per process, so it is
+	// cleared for the duration of each such call, and the calls are
+	// serialized; other code in the process that creates files
+	// meanwhile is not masked either.
+	IgnoreUmask bool
+
+	// By default, other file systems mounted beneath Root are
+	// crossed, as by a plain path lookup, and their inode numbers
+	// can collide with those of Root's file system. If
+	// NoCrossMounts is set, a directory on another device than Root
+	// is shown as an empty directory, and entries beyond it, as
+	// well as files mounted on their own, are hidden with ENOENT.
+	// Creating, opening or removing entries in the empty directory
+	// fails with EACCES. This is decided by the device ID from
+	// GetAttr.
+	NoCrossMounts bool
+
+	// If RetryStale is set, an operation on a path that fails with
+	// ESTALE, as an NFS client returns when the server no longer
+	// knows a file handle it had looked up, is tried once more,
+	// which looks up the path again. Operations on open files
+	// can't be recovered that way, and return ESTALE at once.
+	RetryStale bool
+}
+
 type PathNodeFsOptions struct {
 	// If ClientInodes is set, use Inode returned from GetAttr to
 	// find hard-linked files.
 	ClientInodes bool
+
+	// If ResolveUnknownTypes is set, directory entries from
+	// OpenDir and OpenDirStream whose Mode has no file type bits,
+	// as for DT_UNKNOWN, get their type from GetAttr. This costs
+	// a call for each such entry.
+	ResolveUnknownTypes bool
 }
@@ -0,0 +1,242 @@
+// +build go1.16
+
+package pathfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// archiveMembers are written without entries for their directories.
+var archiveMembers = []struct {
+	name, data string
+}{
+	{"top.txt", "top level"},
+	{"a/b/c/deep.txt", "0123456789abcdef"},
+	{"a/other.txt", "other"},
+}
+
+func readAt(t *testing.T, fs FileSystem, name string, off int64, n int) string {
+	f, code := fs.Open(name, uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("%v: Open(%q): %v", fs, name, code)
+	}
+	defer f.Release()
+	buf := make([]byte, n)
+	res, code := f.Read(buf, off)
+	if !code.Ok() {
+		t.Fatalf("%v: Read(%q): %v", fs, name, code)
+	}
+	data, _ := res.Bytes(buf)
+	res.Done()
+	return string(data)
+}
+
+func checkArchive(t *testing.T, fs FileSystem) {
+	for _, dir := range []string{"", "a", "a/b", "a/b/c"} {
+		a, code := fs.GetAttr(dir, nil)
+		if !code.Ok() || !a.IsDir() {
+			t.Errorf("%v: GetAttr(%q): %v, %v", fs, dir, a, code)
+		}
+	}
+	entries, code := fs.OpenDir("a", nil)
+	if !code.Ok() || len(entries) != 2 || entries[0].Name != "b" || entries[1].Name != "other.txt" {
+		t.Errorf("%v: OpenDir(a): got %v, %v", fs, entries, code)
+	}
+	a, code := fs.GetAttr("a/b/c/deep.txt", nil)
+	if !code.Ok() || !a.IsRegular() || a.Size != 16 {
+		t.Errorf("%v: GetAttr(deep.txt): %v, %v", fs, a, code)
+	}
+	if got := readAt(t, fs, "a/b/c/deep.txt", 10, 4); got != "abcd" {
+		t.Errorf("%v: read at 10: got %q, want %q", fs, got, "abcd")
+	}
+	if got := readAt(t, fs, "a/b/c/deep.txt", 14, 10); got != "ef" {
+		t.Errorf("%v: read at 14: got %q, want %q", fs, got, "ef")
+	}
+	if got := readAt(t, fs, "top.txt", 0, 100); got != "top level" {
+		t.Errorf("%v: read top.txt: got %q", fs, got)
+	}
+	if target, code := fs.Readlink("link", nil); !code.Ok() || target != "a/other.txt" {
+		t.Errorf("%v: Readlink: got %q, %v", fs, target, code)
+	}
+	if code := fs.Unlink("top.txt", nil); code != fuse.EROFS {
+		t.Errorf("%v: Unlink: got %v, want EROFS", fs, code)
+	}
+}
+
+func TestZipFS(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for i, m := range archiveMembers {
+		// Mix stored and compressed members.
+		method := zip.Deflate
+		if i%2 == 1 {
+			method = zip.Store
+		}
+		f, err := w.CreateHeader(&zip.FileHeader{Name: m.name, Method: method})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		io.WriteString(f, m.data)
+	}
+	h := &zip.FileHeader{Name: "link"}
+	h.SetMode(os.ModeSymlink | 0777)
+	f, err := w.CreateHeader(h)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	io.WriteString(f, "a/other.txt")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	fs, err := NewZipFS(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewZipFS: %v", err)
+	}
+	checkArchive(t, fs)
+}
+
+func TestTarFS(t *testing.T) {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, m := range archiveMembers {
+		if err := w.WriteHeader(&tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("WriteHeader: %v", err)
+		}
+		io.WriteString(w, m.data)
+	}
+	if err := w.WriteHeader(&tar.Header{Name: "link", Linkname: "a/other.txt", Mode: 0777, Typeflag: tar.TypeSymlink}); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Random access into a plain tar.
+	fs, err := NewTarFS(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("NewTarFS: %v", err)
+	}
+	checkArchive(t, fs)
+
+	// A .tar.gz is read into memory.
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(buf.Bytes())
+	zw.Close()
+	zr, err := gzip.NewReader(&gz)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	fs, err = NewTarFS(zr)
+	if err != nil {
+		t.Fatalf("NewTarFS: %v", err)
+	}
+	checkArchive(t, fs)
+}
+
+func TestArchiveModes(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	// Without SetMode, the members have MS-DOS attributes only.
+	for _, name := range []string{"a/b/plain.txt", "a/dir/"} {
+		if _, err := w.CreateHeader(&zip.FileHeader{Name: name}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	h := &zip.FileHeader{Name: "a/unix.txt"}
+	h.SetMode(0600)
+	if _, err := w.CreateHeader(h); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	for _, c := range []struct {
+		opts            *ArchiveOptions
+		file, dir, unix uint32
+	}{
+		{nil, 0644, 0755, 0600},
+		{&ArchiveOptions{FileMode: 0444, DirMode: 0555}, 0444, 0555, 0600},
+	} {
+		fs, err := NewZipFSWithOptions(bytes.NewReader(buf.Bytes()), int64(buf.Len()), c.opts)
+		if err != nil {
+			t.Fatalf("NewZipFS: %v", err)
+		}
+		for name, want := range map[string]uint32{
+			"":              c.dir,
+			"a":             c.dir,
+			"a/b":           c.dir,
+			"a/dir":         c.dir,
+			"a/b/plain.txt": c.file,
+			"a/unix.txt":    c.unix,
+		} {
+			a, code := fs.GetAttr(name, nil)
+			if !code.Ok() {
+				t.Fatalf("GetAttr(%q): %v", name, code)
+			}
+			if got := a.Mode & 07777; got != want {
+				t.Errorf("%+v: %q has mode %o, want %o", c.opts, name, got, want)
+			}
+		}
+	}
+}
+
+func TestArchiveDirStream(t *testing.T) {
+	const count = 100000
+	a := newArchiveFS(nil)
+	for i := 0; i < count; i++ {
+		// Add in reverse, so the listing has to be sorted.
+		a.add(&archiveEntry{name: fmt.Sprintf("big/%06d", count-1-i), mode: 0644})
+	}
+	fs := NewIoFSFileSystem(a).(DirStreamFileSystem)
+	s, code := fs.OpenDirStream("big", nil)
+	if !code.Ok() {
+		t.Fatalf("OpenDirStream: %v", code)
+	}
+	defer s.Close()
+
+	// The first page sorts the directory's index, which is kept.
+	// After that, a page should only take memory for the page,
+	// where a full listing takes megabytes.
+	const maxAlloc = 64 << 10
+	seen := 0
+	for {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		entries, code := s.Next(100)
+		runtime.ReadMemStats(&after)
+		if !code.Ok() {
+			t.Fatalf("Next: %v", code)
+		}
+		if alloc := after.TotalAlloc - before.TotalAlloc; seen > 0 && alloc > maxAlloc {
+			t.Fatalf("Next(100) allocated %d bytes, want at most %d", alloc, maxAlloc)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if len(entries) > 100 {
+			t.Fatalf("Next(100) returned %d entries", len(entries))
+		}
+		for _, e := range entries {
+			if want := fmt.Sprintf("%06d", seen); e.Name != want {
+				t.Fatalf("entry %d is %q, want %q", seen, e.Name, want)
+			}
+			seen++
+		}
+	}
+	if seen != count {
+		t.Errorf("listed %d entries, want %d", seen, count)
+	}
+}
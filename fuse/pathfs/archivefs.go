@@ -0,0 +1,423 @@
+// +build go1.16
+
+package pathfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	iofs "io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveEntry is a member of an archive, or a directory implied by
+// the member paths. It is its own fs.FileInfo and fs.DirEntry.
+type archiveEntry struct {
+	name  string
+	mode  iofs.FileMode
+	size  int64
+	mtime time.Time
+
+	// target is the target of a symlink.
+	target string
+
+	// data gives random access to the contents. If it is nil,
+	// open reads them sequentially.
+	data io.ReaderAt
+	open func() (io.ReadCloser, error)
+
+	// children of a directory, by name.
+	children map[string]*archiveEntry
+
+	// sorted holds the children ordered by name. It is computed on
+	// the first listing, after the archive has been indexed.
+	sortOnce sync.Once
+	sorted   []*archiveEntry
+}
+
+func (e *archiveEntry) Name() string                 { return path.Base(e.name) }
+func (e *archiveEntry) Size() int64                  { return e.size }
+func (e *archiveEntry) Mode() iofs.FileMode          { return e.mode }
+func (e *archiveEntry) ModTime() time.Time           { return e.mtime }
+func (e *archiveEntry) IsDir() bool                  { return e.mode.IsDir() }
+func (e *archiveEntry) Sys() interface{}             { return nil }
+func (e *archiveEntry) Type() iofs.FileMode          { return e.mode.Type() }
+func (e *archiveEntry) Info() (iofs.FileInfo, error) { return e, nil }
+
+type archiveEntriesByName []*archiveEntry
+
+func (s archiveEntriesByName) Len() int           { return len(s) }
+func (s archiveEntriesByName) Less(i, j int) bool { return s[i].Name() < s[j].Name() }
+func (s archiveEntriesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// sortedChildren returns the children of a directory by name. The
+// result must not be modified.
+func (e *archiveEntry) sortedChildren() []*archiveEntry {
+	e.sortOnce.Do(func() {
+		e.sorted = make([]*archiveEntry, 0, len(e.children))
+		for _, c := range e.children {
+			e.sorted = append(e.sorted, c)
+		}
+		sort.Sort(archiveEntriesByName(e.sorted))
+	})
+	return e.sorted
+}
+
+// ArchiveOptions are options for NewTarFSWithOptions and
+// NewZipFSWithOptions.
+type ArchiveOptions struct {
+	// FileMode holds the permission bits for members that don't
+	// record Unix permissions, such as zip members written on
+	// Windows. The default is 0644.
+	FileMode iofs.FileMode
+
+	// DirMode holds the permission bits for directories that only
+	// appear in member paths, or don't record Unix permissions.
+	// The default is 0755.
+	DirMode iofs.FileMode
+}
+
+// archiveFS is an in-memory index of an archive, as an fs.FS.
+type archiveFS struct {
+	entries map[string]*archiveEntry
+	opts    ArchiveOptions
+}
+
+func newArchiveFS(opts *ArchiveOptions) *archiveFS {
+	a := &archiveFS{}
+	if opts != nil {
+		a.opts = *opts
+	}
+	if a.opts.FileMode == 0 {
+		a.opts.FileMode = 0644
+	}
+	if a.opts.DirMode == 0 {
+		a.opts.DirMode = 0755
+	}
+	a.entries = map[string]*archiveEntry{
+		".": {name: ".", mode: iofs.ModeDir | a.opts.DirMode, children: map[string]*archiveEntry{}},
+	}
+	return a
+}
+
+// cleanArchivePath returns the fs.FS name of an archive member.
+// Leading slashes and ".." components that would leave the archive
+// are dropped, as tar(1) does when extracting.
+func cleanArchivePath(name string) string {
+	name = path.Clean("/" + strings.Trim(name, "/"))[1:]
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// dir returns the directory entry for name, creating it and its
+// parents if the archive doesn't list them. A member that is not a
+// directory is replaced.
+func (a *archiveFS) dir(name string) *archiveEntry {
+	if e := a.entries[name]; e != nil && e.IsDir() {
+		return e
+	}
+	e := &archiveEntry{name: name, mode: iofs.ModeDir | a.opts.DirMode, children: map[string]*archiveEntry{}}
+	a.entries[name] = e
+	a.dir(path.Dir(name)).children[path.Base(name)] = e
+	return e
+}
+
+// add adds e, replacing an earlier member of the same name, as
+// extracting the archive would. A directory member only updates
+// the attributes of a directory that already has children.
+func (a *archiveFS) add(e *archiveEntry) {
+	e.name = cleanArchivePath(e.name)
+	if e.IsDir() {
+		d := a.dir(e.name)
+		d.mode, d.mtime = e.mode, e.mtime
+		return
+	}
+	if e.name == "." {
+		return
+	}
+	if e.mode&iofs.ModeSymlink != 0 {
+		e.size = int64(len(e.target))
+	}
+	a.entries[e.name] = e
+	a.dir(path.Dir(e.name)).children[path.Base(e.name)] = e
+}
+
+func (a *archiveFS) lookup(op string, name string) (*archiveEntry, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	e := a.entries[name]
+	if e == nil {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrNotExist}
+	}
+	return e, nil
+}
+
+// Stat doesn't follow symlinks.
+func (a *archiveFS) Stat(name string) (iofs.FileInfo, error) {
+	return a.lookup("stat", name)
+}
+
+func (a *archiveFS) Lstat(name string) (iofs.FileInfo, error) {
+	return a.lookup("lstat", name)
+}
+
+func (a *archiveFS) ReadLink(name string) (string, error) {
+	e, err := a.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if e.mode&iofs.ModeSymlink == 0 {
+		return "", &iofs.PathError{Op: "readlink", Path: name, Err: iofs.ErrInvalid}
+	}
+	return e.target, nil
+}
+
+func (a *archiveFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	e, err := a.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsDir() {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: iofs.ErrInvalid}
+	}
+	children := e.sortedChildren()
+	out := make([]iofs.DirEntry, 0, len(children))
+	for _, c := range children {
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func (a *archiveFS) Open(name string) (iofs.File, error) {
+	e, err := a.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.data != nil {
+		return &archiveRandomFile{io.NewSectionReader(e.data, 0, e.size), e}, nil
+	}
+	f := &archiveFile{entry: e}
+	if e.open != nil {
+		r, err := e.open()
+		if err != nil {
+			return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+		}
+		f.Reader, f.closer = r, r
+	} else {
+		f.Reader = bytes.NewReader(nil)
+	}
+	return f, nil
+}
+
+// archiveFile is a member that is read sequentially, or a directory.
+type archiveFile struct {
+	io.Reader
+	entry  *archiveEntry
+	closer io.Closer
+
+	// dirPos is the number of children ReadDir has returned.
+	dirPos int
+}
+
+func (f *archiveFile) Stat() (iofs.FileInfo, error) { return f.entry, nil }
+
+// ReadDir implements fs.ReadDirFile, so a directory can be listed a
+// page at a time.
+func (f *archiveFile) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if !f.entry.IsDir() {
+		return nil, &iofs.PathError{Op: "readdir", Path: f.entry.name, Err: iofs.ErrInvalid}
+	}
+	rest := f.entry.sortedChildren()[f.dirPos:]
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(rest) {
+			rest = rest[:n]
+		}
+	}
+	f.dirPos += len(rest)
+	out := make([]iofs.DirEntry, 0, len(rest))
+	for _, c := range rest {
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func (f *archiveFile) Close() error {
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
+
+// archiveRandomFile is a member with random access.
+type archiveRandomFile struct {
+	*io.SectionReader
+	entry *archiveEntry
+}
+
+func (f *archiveRandomFile) Stat() (iofs.FileInfo, error) { return f.entry, nil }
+func (f *archiveRandomFile) Close() error                 { return nil }
+
+// NewTarFS indexes the tar archive read from r and serves it as a
+// read-only FileSystem. If r is an io.ReaderAt, such as an *os.File,
+// members are read from it on demand, so r must stay open. Otherwise,
+// for example for a .tar.gz through gzip.NewReader, r is read once,
+// and the contents of all members are kept in memory.
+//
+// Hard links share the contents of their target. Directories that
+// only appear in member paths are listed with mode 0755.
+func NewTarFS(r io.Reader) (FileSystem, error) {
+	return NewTarFSWithOptions(r, nil)
+}
+
+// NewTarFSWithOptions is NewTarFS with options; nil opts gives the
+// defaults.
+func NewTarFSWithOptions(r io.Reader, opts *ArchiveOptions) (FileSystem, error) {
+	a := newArchiveFS(opts)
+	ra, random := r.(io.ReaderAt)
+	var sr *io.SectionReader
+	if random {
+		// Reading through a SectionReader gives the offset of
+		// each member, and lets tar skip contents by seeking.
+		sr = io.NewSectionReader(ra, 0, 1<<63-1)
+		r = sr
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		e := &archiveEntry{
+			name:   h.Name,
+			mode:   h.FileInfo().Mode(),
+			mtime:  h.ModTime,
+			target: h.Linkname,
+		}
+		switch h.Typeflag {
+		case tar.TypeLink:
+			orig := a.entries[cleanArchivePath(h.Linkname)]
+			if orig == nil || orig.IsDir() {
+				continue
+			}
+			e.mode, e.size, e.data, e.target = orig.mode, orig.size, orig.data, ""
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			e.size = h.Size
+			// The holes of sparse files are not stored, so
+			// their contents are not a contiguous range of r.
+			if random && !isSparse(h) {
+				off, err := sr.Seek(0, io.SeekCurrent)
+				if err != nil {
+					return nil, err
+				}
+				e.data = io.NewSectionReader(ra, off, h.Size)
+			} else {
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					return nil, err
+				}
+				e.data = bytes.NewReader(data)
+			}
+		}
+		a.add(e)
+	}
+	return NewIoFSFileSystem(a), nil
+}
+
+func isSparse(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// NewZipFS indexes the zip archive in r, which is size bytes long,
+// and serves it as a read-only FileSystem. Stored members are read
+// at random from r; compressed members are decompressed from the
+// start, up to the offset that is read. Directories that only appear
+// in member paths are listed with mode 0755, and members without
+// Unix permissions with 0644 or 0755.
+func NewZipFS(r io.ReaderAt, size int64) (FileSystem, error) {
+	return NewZipFSWithOptions(r, size, nil)
+}
+
+// NewZipFSWithOptions is NewZipFS with options; nil opts gives the
+// defaults.
+func NewZipFSWithOptions(r io.ReaderAt, size int64, opts *ArchiveOptions) (FileSystem, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	a := newArchiveFS(opts)
+	for _, f := range zr.File {
+		e := &archiveEntry{
+			name:  f.Name,
+			mode:  f.Mode(),
+			size:  int64(f.UncompressedSize64),
+			mtime: f.Modified,
+			open:  f.Open,
+		}
+		if strings.HasSuffix(f.Name, "/") {
+			e.mode |= iofs.ModeDir
+		}
+		if !zipUnixMode(f) {
+			perm := a.opts.FileMode
+			if e.IsDir() {
+				perm = a.opts.DirMode
+			}
+			e.mode = e.mode.Type() | perm
+		}
+		switch {
+		case e.IsDir():
+		case e.mode&iofs.ModeSymlink != 0:
+			// The contents are the target.
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			target, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			e.target, e.open = string(target), nil
+		case f.Method == zip.Store:
+			off, err := f.DataOffset()
+			if err != nil {
+				return nil, err
+			}
+			e.data, e.open = io.NewSectionReader(r, off, e.size), nil
+		}
+		a.add(e)
+	}
+	return NewIoFSFileSystem(a), nil
+}
+
+// zipUnixMode returns whether f records Unix permissions, which
+// is the case if it was written on Unix or OS X. Otherwise
+// f.Mode only has the MS-DOS attributes.
+func zipUnixMode(f *zip.File) bool {
+	switch f.CreatorVersion >> 8 {
+	case 3, 19:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestAttrOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-attroverride")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub/file"), []byte("hello"), 0664); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "sub/file"), 0664); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+
+	var root uint32
+	fs := NewAttrOverrideFileSystem(NewLoopbackFileSystem(dir), &AttrOverrideOptions{
+		Uid:       &root,
+		Gid:       &root,
+		ClearMode: 0222,
+		SetMode:   0444,
+	})
+	checkAttr := func(what string, a *fuse.Attr, want uint32) {
+		if a.Uid != 0 || a.Gid != 0 || a.Mode&07777 != want {
+			t.Errorf("%s: got %d:%d 0%o, want 0:0 0%o", what, a.Uid, a.Gid, a.Mode&07777, want)
+		}
+	}
+	for name, want := range map[string]uint32{"": 0555, "sub": 0555, "sub/file": 0444} {
+		a, code := fs.GetAttr(name, nil)
+		if !code.Ok() {
+			t.Fatalf("GetAttr(%q): %v", name, code)
+		}
+		checkAttr(name, a, want)
+	}
+
+	f, code := fs.Open("sub/file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	defer f.Release()
+	var a fuse.Attr
+	if code := f.GetAttr(&a); !code.Ok() {
+		t.Fatalf("File.GetAttr: %v", code)
+	}
+	checkAttr("open file", &a, 0444)
+
+	// Changes to the overridden attributes are dropped.
+	if code := fs.Chmod("sub/file", 0600, nil); !code.Ok() {
+		t.Errorf("Chmod: %v", code)
+	}
+	fi, err := os.Lstat(filepath.Join(dir, "sub/file"))
+	if err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if fi.Mode().Perm() != 0664 {
+		t.Errorf("backing file mode changed to %v", fi.Mode())
+	}
+
+	fs = NewAttrOverrideFileSystem(NewLoopbackFileSystem(dir), &AttrOverrideOptions{
+		Gid:           &root,
+		RejectChanges: true,
+	})
+	if code := fs.Chown("sub/file", ^uint32(0), 1, nil); code != fuse.EPERM {
+		t.Errorf("Chown of the group: got %v, want EPERM", code)
+	}
+	if code := fs.Chmod("sub/file", 0600, nil); !code.Ok() {
+		t.Errorf("Chmod without a mode override: %v", code)
+	}
+}
@@ -0,0 +1,168 @@
+package pathfs
+
+import (
+	"fmt"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// AttrOverrideOptions configures NewAttrOverrideFileSystem.
+type AttrOverrideOptions struct {
+	// If Uid or Gid is set, all files report that owner.
+	Uid *uint32
+	Gid *uint32
+
+	// The permission bits in ClearMode are cleared, and then
+	// those in SetMode are set. For example, ClearMode 0222 makes
+	// everything look read-only.
+	ClearMode uint32
+	SetMode   uint32
+
+	// If RejectChanges is set, Chmod, and Chown of an overridden
+	// owner, fail with EPERM. Otherwise they succeed without
+	// doing anything, as the result wouldn't be visible.
+	RejectChanges bool
+}
+
+type attrOverrideFileSystem struct {
+	FileSystem
+	opts AttrOverrideOptions
+}
+
+// NewAttrOverrideFileSystem returns a wrapper that presents the
+// files of fs with a fixed owner and masked permissions, whatever
+// the backing store says, for example to show a shared dataset as
+// root:root 0444. It changes the attributes that GetAttr returns,
+// and so those of READDIRPLUS, and those of open files. Only the
+// view changes: access to the backing files is still checked
+// against their real attributes.
+func NewAttrOverrideFileSystem(fs FileSystem, opts *AttrOverrideOptions) FileSystem {
+	o := &attrOverrideFileSystem{FileSystem: fs}
+	if opts != nil {
+		o.opts = *opts
+	}
+	o.opts.ClearMode &= 07777
+	o.opts.SetMode &= 07777
+	return o
+}
+
+func (fs *attrOverrideFileSystem) String() string {
+	return fmt.Sprintf("attrOverrideFileSystem(%v)", fs.FileSystem)
+}
+
+func (fs *attrOverrideFileSystem) override(a *fuse.Attr) {
+	if fs.opts.Uid != nil {
+		a.Uid = *fs.opts.Uid
+	}
+	if fs.opts.Gid != nil {
+		a.Gid = *fs.opts.Gid
+	}
+	a.Mode = a.Mode&^fs.opts.ClearMode | fs.opts.SetMode
+}
+
+// chmod returns whether a chmod should be passed on, and if not, its
+// result.
+func (fs *attrOverrideFileSystem) chmod() (bool, fuse.Status) {
+	if fs.opts.ClearMode|fs.opts.SetMode == 0 {
+		return true, fuse.OK
+	}
+	if fs.opts.RejectChanges {
+		return false, fuse.EPERM
+	}
+	return false, fuse.OK
+}
+
+// chown returns the uid and gid to pass on, leaving out the
+// overridden ones, and whether there is anything left to pass on.
+func (fs *attrOverrideFileSystem) chown(uid uint32, gid uint32) (uint32, uint32, bool, fuse.Status) {
+	const unchanged = ^uint32(0)
+	overridden := false
+	if fs.opts.Uid != nil && uid != unchanged {
+		uid, overridden = unchanged, true
+	}
+	if fs.opts.Gid != nil && gid != unchanged {
+		gid, overridden = unchanged, true
+	}
+	if overridden && fs.opts.RejectChanges {
+		return uid, gid, false, fuse.EPERM
+	}
+	return uid, gid, !overridden || uid != unchanged || gid != unchanged, fuse.OK
+}
+
+func (fs *attrOverrideFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if a != nil {
+		c := *a
+		a = &c
+		fs.override(a)
+	}
+	return a, code
+}
+
+func (fs *attrOverrideFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if pass, code := fs.chmod(); !pass {
+		return code
+	}
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *attrOverrideFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	uid, gid, pass, code := fs.chown(uid, gid)
+	if !pass {
+		return code
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *attrOverrideFileSystem) wrap(f nodefs.File, code fuse.Status) (nodefs.File, fuse.Status) {
+	if f == nil {
+		return f, code
+	}
+	return &attrOverrideFile{File: f, fs: fs}, code
+}
+
+func (fs *attrOverrideFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return fs.wrap(fs.FileSystem.Open(name, flags, context))
+}
+
+func (fs *attrOverrideFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return fs.wrap(fs.FileSystem.Create(name, flags, mode, context))
+}
+
+// attrOverrideFile applies the overrides to an open file.
+type attrOverrideFile struct {
+	nodefs.File
+	fs *attrOverrideFileSystem
+}
+
+func (f *attrOverrideFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *attrOverrideFile) String() string {
+	return fmt.Sprintf("attrOverrideFile(%s)", f.File.String())
+}
+
+func (f *attrOverrideFile) GetAttr(out *fuse.Attr) fuse.Status {
+	code := f.File.GetAttr(out)
+	if code.Ok() {
+		f.fs.override(out)
+	}
+	return code
+}
+
+func (f *attrOverrideFile) Chmod(mode uint32) fuse.Status {
+	if pass, code := f.fs.chmod(); !pass {
+		return code
+	}
+	return f.File.Chmod(mode)
+}
+
+func (f *attrOverrideFile) Chown(uid uint32, gid uint32) fuse.Status {
+	uid, gid, pass, code := f.fs.chown(uid, gid)
+	if !pass {
+		return code
+	}
+	return f.File.Chown(uid, gid)
+}
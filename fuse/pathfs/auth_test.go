@@ -0,0 +1,74 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestAuthFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-auth")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "protected"), 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "protected", "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	const guest = 1234
+	fs := NewAuthFileSystem(NewLoopbackFileSystem(dir), func(caller *fuse.Context, op Operation, name string) fuse.Status {
+		if caller == nil || caller.Uid != guest || !strings.HasPrefix(name, "protected/") {
+			return fuse.OK
+		}
+		switch op {
+		case OpOpen, OpOpenDir, OpReadlink, OpAccess, OpXAttr:
+			return fuse.OK
+		}
+		return fuse.EACCES
+	})
+	guestCtx := &fuse.Context{Owner: fuse.Owner{Uid: guest, Gid: guest}}
+	otherCtx := &fuse.Context{Owner: fuse.Owner{Uid: guest + 1, Gid: guest}}
+
+	f, code := fs.Open("protected/file", uint32(os.O_RDONLY), guestCtx)
+	if !code.Ok() {
+		t.Fatalf("read Open: %v", code)
+	}
+	f.Release()
+
+	if _, code := fs.Open("protected/file", uint32(os.O_WRONLY), guestCtx); code != fuse.EACCES {
+		t.Errorf("write Open: got %v, want EACCES", code)
+	}
+	if _, code := fs.Create("protected/new", uint32(os.O_WRONLY), 0644, guestCtx); code != fuse.EACCES {
+		t.Errorf("Create: got %v, want EACCES", code)
+	}
+	if code := fs.Unlink("protected/file", guestCtx); code != fuse.EACCES {
+		t.Errorf("Unlink: got %v, want EACCES", code)
+	}
+	// Moving a file in is a write to protected/ too.
+	if code := fs.Rename("outside", "protected/outside", guestCtx); code != fuse.EACCES {
+		t.Errorf("Rename: got %v, want EACCES", code)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "protected", "file")); err != nil {
+		t.Errorf("protected file is gone: %v", err)
+	}
+
+	// Other users and other paths are not affected.
+	f, code = fs.Open("protected/file", uint32(os.O_WRONLY), otherCtx)
+	if !code.Ok() {
+		t.Fatalf("write Open by other uid: %v", code)
+	}
+	f.Release()
+	f, code = fs.Create("file", uint32(os.O_WRONLY), 0644, guestCtx)
+	if !code.Ok() {
+		t.Fatalf("Create outside protected/: %v", code)
+	}
+	f.Release()
+}
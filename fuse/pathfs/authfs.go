@@ -0,0 +1,198 @@
+package pathfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// Authorizer decides whether the caller may do op on name, which is
+// relative to the root of the file system, without a leading slash.
+// It returns OK to allow the call, or the status to fail it with,
+// typically EACCES. caller is nil for calls that don't come from the
+// kernel, such as StatFs.
+type Authorizer func(caller *fuse.Context, op Operation, name string) fuse.Status
+
+type authFileSystem struct {
+	FileSystem
+	authorize Authorizer
+}
+
+// NewAuthFileSystem returns a wrapper that asks authorize before each
+// operation it passes on to fs, whatever the permissions in fs say.
+// Operations on two names, Link and Rename, are checked for both.
+// GetAttr is always allowed, so the kernel can still resolve paths.
+func NewAuthFileSystem(fs FileSystem, authorize Authorizer) FileSystem {
+	return &authFileSystem{
+		FileSystem: fs,
+		authorize:  authorize,
+	}
+}
+
+func (fs *authFileSystem) String() string {
+	return fmt.Sprintf("authFileSystem(%v)", fs.FileSystem)
+}
+
+// check returns the first refusal of op on any of names, or OK.
+func (fs *authFileSystem) check(context *fuse.Context, op Operation, names ...string) fuse.Status {
+	for _, name := range names {
+		if code := fs.authorize(context, op, name); !code.Ok() {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+func (fs *authFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpChmod, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *authFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpChown, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *authFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpUtimens, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+func (fs *authFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpTruncate, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *authFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpAccess, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+func (fs *authFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpLink, oldName, newName); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *authFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpMkdir, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *authFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpMknod, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *authFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpRename, oldName, newName); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *authFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpRmdir, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *authFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpUnlink, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *authFileSystem) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	if code := fs.check(context, OpXAttr, name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.GetXAttr(name, attribute, context)
+}
+
+func (fs *authFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	if code := fs.check(context, OpXAttr, name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *authFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpXAttr, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *authFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpXAttr, name); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *authFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if code := fs.check(context, OpOpen, name); !code.Ok() {
+		return nil, code
+	}
+	if isWriteOpen(flags) {
+		if code := fs.check(context, OpWrite, name); !code.Ok() {
+			return nil, code
+		}
+	}
+	return fs.FileSystem.Open(name, flags, context)
+}
+
+func (fs *authFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if code := fs.check(context, OpCreate, name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.Create(name, flags, mode, context)
+}
+
+func (fs *authFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if code := fs.check(context, OpOpenDir, name); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+func (fs *authFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	if code := fs.check(context, OpSymlink, linkName); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *authFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	if code := fs.check(context, OpReadlink, name); !code.Ok() {
+		return "", code
+	}
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *authFileSystem) StatFs(name string) *fuse.StatfsOut {
+	if code := fs.check(nil, OpStatFs, name); !code.Ok() {
+		return nil
+	}
+	return fs.FileSystem.StatFs(name)
+}
@@ -0,0 +1,44 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestCapabilityFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-capability")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := NewCapabilityFilterFileSystem(NewLoopbackFileSystem(dir), map[Operation]fuse.Status{
+		OpSymlink: fuse.EPERM,
+		OpMknod:   fuse.ENOSYS,
+	})
+	if code := fs.Symlink("target", "link", nil); code != fuse.EPERM {
+		t.Errorf("Symlink: got %v, want EPERM", code)
+	}
+	if code := fs.Mknod("fifo", syscall.S_IFIFO|0644, 0, nil); code != fuse.ENOSYS {
+		t.Errorf("Mknod: got %v, want ENOSYS", code)
+	}
+	for _, name := range []string{"link", "fifo"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s was created", name)
+		}
+	}
+
+	f, code := fs.Create("file", uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Release()
+	if _, err := os.Lstat(filepath.Join(dir, "file")); err != nil {
+		t.Errorf("Create: %v", err)
+	}
+}
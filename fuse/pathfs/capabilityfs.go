@@ -0,0 +1,269 @@
+package pathfs
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// Operation names a group of FileSystem methods that a
+// CapabilityFilterFileSystem can deny.
+type Operation int
+
+const (
+	OpChmod Operation = iota
+	OpChown
+	OpUtimens
+	OpTruncate
+	OpAccess
+	OpLink
+	OpMkdir
+	OpMknod
+	OpRename
+	OpRmdir
+	OpUnlink
+	// GetXAttr, ListXAttr, SetXAttr and RemoveXAttr.
+	OpXAttr
+	OpOpen
+	// Open with O_WRONLY, O_RDWR or O_TRUNC. Such an Open is
+	// checked for OpOpen too.
+	OpWrite
+	OpCreate
+	OpOpenDir
+	OpSymlink
+	OpReadlink
+	OpStatFs
+)
+
+var operationNames = map[Operation]string{
+	OpChmod:    "Chmod",
+	OpChown:    "Chown",
+	OpUtimens:  "Utimens",
+	OpTruncate: "Truncate",
+	OpAccess:   "Access",
+	OpLink:     "Link",
+	OpMkdir:    "Mkdir",
+	OpMknod:    "Mknod",
+	OpRename:   "Rename",
+	OpRmdir:    "Rmdir",
+	OpUnlink:   "Unlink",
+	OpXAttr:    "XAttr",
+	OpOpen:     "Open",
+	OpWrite:    "Write",
+	OpCreate:   "Create",
+	OpOpenDir:  "OpenDir",
+	OpSymlink:  "Symlink",
+	OpReadlink: "Readlink",
+	OpStatFs:   "StatFs",
+}
+
+func (op Operation) String() string {
+	if s, ok := operationNames[op]; ok {
+		return s
+	}
+	return fmt.Sprintf("Operation(%d)", int(op))
+}
+
+// isWriteOpen reports whether Open flags may change the file.
+func isWriteOpen(flags uint32) bool {
+	return flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0
+}
+
+// CapabilityFilterFileSystem refuses a configured set of operations,
+// whatever the wrapped FileSystem supports, and passes on the rest.
+type CapabilityFilterFileSystem struct {
+	FileSystem
+	denied map[Operation]fuse.Status
+}
+
+// NewCapabilityFilterFileSystem returns a wrapper that answers each
+// operation in denied with the given status. Note that the kernel
+// stops sending some operations, such as the xattr ones, after it
+// gets ENOSYS; EPERM is refused per call.
+func NewCapabilityFilterFileSystem(fs FileSystem, denied map[Operation]fuse.Status) *CapabilityFilterFileSystem {
+	d := make(map[Operation]fuse.Status, len(denied))
+	for op, code := range denied {
+		d[op] = code
+	}
+	return &CapabilityFilterFileSystem{
+		FileSystem: fs,
+		denied:     d,
+	}
+}
+
+func (fs *CapabilityFilterFileSystem) String() string {
+	return fmt.Sprintf("CapabilityFilterFileSystem(%v)", fs.FileSystem)
+}
+
+// Capabilities are those of the wrapped FileSystem, without the
+// xattr operations if they are denied with ENOSYS.
+func (fs *CapabilityFilterFileSystem) Capabilities() fuse.CapSet {
+	c := fuse.Capabilities(fs.FileSystem)
+	if fs.denied[OpXAttr] == fuse.ENOSYS {
+		c &^= fuse.CapXAttr
+	}
+	return c
+}
+
+// check returns the status for op if it is denied, or OK.
+func (fs *CapabilityFilterFileSystem) check(op Operation) fuse.Status {
+	if code, ok := fs.denied[op]; ok {
+		return code
+	}
+	return fuse.OK
+}
+
+func (fs *CapabilityFilterFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpChmod); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpChown); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpUtimens); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpTruncate); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpAccess); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpLink); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpMkdir); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpMknod); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpRename); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpRmdir); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpUnlink); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *CapabilityFilterFileSystem) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	if code := fs.check(OpXAttr); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.GetXAttr(name, attribute, context)
+}
+
+func (fs *CapabilityFilterFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	if code := fs.check(OpXAttr); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *CapabilityFilterFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpXAttr); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *CapabilityFilterFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpXAttr); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if code := fs.check(OpOpen); !code.Ok() {
+		return nil, code
+	}
+	if isWriteOpen(flags) {
+		if code := fs.check(OpWrite); !code.Ok() {
+			return nil, code
+		}
+	}
+	return fs.FileSystem.Open(name, flags, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if code := fs.check(OpCreate); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.Create(name, flags, mode, context)
+}
+
+func (fs *CapabilityFilterFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if code := fs.check(OpOpenDir); !code.Ok() {
+		return nil, code
+	}
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	if code := fs.check(OpSymlink); !code.Ok() {
+		return code
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *CapabilityFilterFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	if code := fs.check(OpReadlink); !code.Ok() {
+		return "", code
+	}
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *CapabilityFilterFileSystem) StatFs(name string) *fuse.StatfsOut {
+	if code := fs.check(OpStatFs); !code.Ok() {
+		return nil
+	}
+	return fs.FileSystem.StatFs(name)
+}
@@ -0,0 +1,21 @@
+package pathfs
+
+// Middleware wraps a FileSystem. Constructors that take only the
+// wrapped FileSystem, such as NewReadonlyFileSystem and
+// NewLockingFileSystem, are Middlewares as they are; others can be
+// adapted with a closure, eg.
+//
+//	func(fs FileSystem) FileSystem {
+//		return NewTimeoutFileSystem(fs, time.Second, fuse.EIO)
+//	}
+type Middleware func(fs FileSystem) FileSystem
+
+// Chain wraps base in middlewares. The first middleware is the
+// outermost, so it sees each call first, and base sees it last.
+func Chain(base FileSystem, middlewares ...Middleware) FileSystem {
+	fs := base
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		fs = middlewares[i](fs)
+	}
+	return fs
+}
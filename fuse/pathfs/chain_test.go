@@ -0,0 +1,51 @@
+package pathfs
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// tracingFileSystem records GetAttr calls in a shared trace.
+type tracingFileSystem struct {
+	FileSystem
+	name  string
+	trace *[]string
+}
+
+func (fs *tracingFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	*fs.trace = append(*fs.trace, fs.name)
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func TestChain(t *testing.T) {
+	var trace []string
+	tracer := func(name string) Middleware {
+		return func(fs FileSystem) FileSystem {
+			return &tracingFileSystem{FileSystem: fs, name: name, trace: &trace}
+		}
+	}
+	base := &tracingFileSystem{FileSystem: NewDefaultFileSystem(), name: "base", trace: &trace}
+
+	fs := Chain(base, tracer("outer"), NewReadonlyFileSystem, tracer("inner"))
+	fs.GetAttr("file", nil)
+
+	want := []string{"outer", "inner", "base"}
+	if len(trace) != len(want) {
+		t.Fatalf("got calls %v, want %v", trace, want)
+	}
+	for i := range want {
+		if trace[i] != want[i] {
+			t.Errorf("call %d: got %q, want %q", i, trace[i], want[i])
+		}
+	}
+
+	// The middle wrapper is in place.
+	if code := fs.Mkdir("dir", 0755, nil); code != fuse.EPERM {
+		t.Errorf("Mkdir: got %v, want EPERM from the read-only wrapper", code)
+	}
+
+	if got := Chain(base); got != FileSystem(base) {
+		t.Errorf("Chain without middlewares: got %v, want the base", got)
+	}
+}
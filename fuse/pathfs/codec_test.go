@@ -0,0 +1,139 @@
+package pathfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// xorCodec flips the bits of each byte, and prefixes each block with
+// its index, so misplaced blocks are caught.
+type xorCodec struct {
+	blockSize int
+}
+
+func (c xorCodec) xor(in []byte) []byte {
+	out := make([]byte, len(in))
+	for i, b := range in {
+		out[i] = b ^ 0xff
+	}
+	return out
+}
+
+func (c xorCodec) Encode(plain []byte) ([]byte, error)  { return c.xor(plain), nil }
+func (c xorCodec) Decode(stored []byte) ([]byte, error) { return c.xor(stored), nil }
+func (c xorCodec) BlockSize() int                       { return c.blockSize }
+func (c xorCodec) Overhead() int                        { return 1 }
+
+func (c xorCodec) EncodeBlock(index int64, plain []byte) ([]byte, error) {
+	return append([]byte{byte(index)}, c.xor(plain)...), nil
+}
+
+func (c xorCodec) DecodeBlock(index int64, stored []byte) ([]byte, error) {
+	if stored[0] != byte(index) {
+		return nil, fmt.Errorf("block %d has index %d", index, stored[0])
+	}
+	return c.xor(stored[1:]), nil
+}
+
+// wholeXorCodec hides the block methods of xorCodec.
+type wholeXorCodec struct {
+	Codec
+}
+
+func TestCodecFileSystem(t *testing.T) {
+	for name, codec := range map[string]Codec{
+		"block": xorCodec{blockSize: 16},
+		"whole": wholeXorCodec{xorCodec{}},
+		"gzip":  GzipCodec{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testCodecFileSystem(t, codec)
+		})
+	}
+}
+
+func testCodecFileSystem(t *testing.T, codec Codec) {
+	dir, err := ioutil.TempDir("", "go-fuse-codec")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := NewCodecFileSystem(NewLoopbackFileSystem(dir), codec)
+	f, code := fs.Create("file", uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	var want []byte
+	for i := 0; i < 50; i++ {
+		off := rnd.Intn(200)
+		data := make([]byte, rnd.Intn(40)+1)
+		rnd.Read(data)
+		if _, code := f.Write(data, int64(off)); !code.Ok() {
+			t.Fatalf("Write: %v", code)
+		}
+		if end := off + len(data); end > len(want) {
+			want = append(want, make([]byte, end-len(want))...)
+		}
+		copy(want[off:], data)
+	}
+	if code := f.Truncate(uint64(len(want) - 7)); !code.Ok() {
+		t.Fatalf("Truncate: %v", code)
+	}
+	want = want[:len(want)-7]
+	f.Flush()
+	f.Release()
+
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if bytes.Equal(stored, want) {
+		t.Errorf("stored file holds plain data")
+	}
+
+	if code := fs.Truncate("file", uint64(len(want)+20), nil); !code.Ok() {
+		t.Fatalf("Truncate: %v", code)
+	}
+	want = append(want, make([]byte, 20)...)
+
+	a, code := fs.GetAttr("file", nil)
+	if !code.Ok() {
+		t.Fatalf("GetAttr: %v", code)
+	}
+	if int(a.Size) != len(want) {
+		t.Errorf("GetAttr: got size %d, want %d", a.Size, len(want))
+	}
+
+	f, code = fs.Open("file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	defer f.Release()
+	for i := 0; i < 50; i++ {
+		off := rnd.Intn(len(want) + 10)
+		buf := make([]byte, rnd.Intn(40)+1)
+		res, code := f.Read(buf, int64(off))
+		if !code.Ok() {
+			t.Fatalf("Read: %v", code)
+		}
+		got, _ := res.Bytes(buf)
+		var exp []byte
+		if off < len(want) {
+			exp = want[off:]
+			if len(exp) > len(buf) {
+				exp = exp[:len(buf)]
+			}
+		}
+		if !bytes.Equal(got, exp) {
+			t.Fatalf("Read(%d, %d): got %x, want %x", off, len(buf), got, exp)
+		}
+	}
+}
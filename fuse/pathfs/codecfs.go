@@ -0,0 +1,527 @@
+package pathfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// Codec transforms file contents between their plain form and the
+// form stored in the underlying file system, for example to encrypt
+// or to compress them.
+type Codec interface {
+	Encode(plain []byte) (stored []byte, err error)
+	Decode(stored []byte) (plain []byte, err error)
+}
+
+// BlockCodec is a Codec that can also encode a file as a sequence of
+// independent blocks, so it can be read and written at random
+// offsets. Each block is BlockSize plain bytes, except for the last
+// one, which may be shorter. A stored block is Overhead bytes longer
+// than its plain block.
+type BlockCodec interface {
+	Codec
+
+	BlockSize() int
+	Overhead() int
+
+	// EncodeBlock and DecodeBlock transform block number index.
+	EncodeBlock(index int64, plain []byte) (stored []byte, err error)
+	DecodeBlock(index int64, stored []byte) (plain []byte, err error)
+}
+
+// GzipCodec compresses whole files with gzip.
+type GzipCodec struct {
+	// Level is the compression level. Zero means
+	// gzip.DefaultCompression.
+	Level int
+}
+
+func (c GzipCodec) Encode(plain []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plain); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c GzipCodec) Decode(stored []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type codecFileSystem struct {
+	FileSystem
+	codec Codec
+}
+
+// NewCodecFileSystem returns a wrapper that stores the contents of
+// regular files through codec. If codec is a BlockCodec, files are
+// read and written one block at a time. Otherwise, each open file is
+// decoded into memory as a whole, and encoded again on Flush, Fsync
+// and Release; GetAttr then has to decode a file to find its size,
+// and handles for the same file don't see each other's writes.
+//
+// Holes are written out, since an encoded block of zeros is usually
+// not zeros.
+func NewCodecFileSystem(fs FileSystem, codec Codec) FileSystem {
+	return &codecFileSystem{
+		FileSystem: fs,
+		codec:      codec,
+	}
+}
+
+func (fs *codecFileSystem) String() string {
+	return fmt.Sprintf("codecFileSystem(%v)", fs.FileSystem)
+}
+
+// plainSize returns the size of a file of storedSize bytes, encoded by
+// c.
+func plainSize(c BlockCodec, storedSize uint64) uint64 {
+	bs := uint64(c.BlockSize())
+	sb := bs + uint64(c.Overhead())
+	size := storedSize / sb * bs
+	if rem := storedSize % sb; rem > uint64(c.Overhead()) {
+		size += rem - uint64(c.Overhead())
+	}
+	return size
+}
+
+func (fs *codecFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if !code.Ok() || !a.IsRegular() {
+		return a, code
+	}
+	if bc, ok := fs.codec.(BlockCodec); ok {
+		a.Size = plainSize(bc, a.Size)
+		return a, fuse.OK
+	}
+
+	f, code := fs.open(name, uint32(syscall.O_RDONLY), context)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer f.Release()
+	return a, f.GetAttr(a)
+}
+
+// innerFlags returns the flags to open the stored file with. Writes
+// to blocks need to read them first, and appends are done by the
+// codecFile.
+func innerFlags(flags uint32) uint32 {
+	if flags&syscall.O_ACCMODE == syscall.O_WRONLY {
+		flags = flags&^syscall.O_ACCMODE | syscall.O_RDWR
+	}
+	return flags &^ syscall.O_APPEND
+}
+
+func (fs *codecFileSystem) open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, code := fs.FileSystem.Open(name, innerFlags(flags), context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.newFile(f, flags)
+}
+
+func (fs *codecFileSystem) newFile(f nodefs.File, flags uint32) (nodefs.File, fuse.Status) {
+	appendMode := flags&syscall.O_APPEND != 0
+	if bc, ok := fs.codec.(BlockCodec); ok {
+		return &blockCodecFile{File: f, codec: bc, appendMode: appendMode}, fuse.OK
+	}
+
+	wf := &wholeCodecFile{File: f, codec: fs.codec, appendMode: appendMode}
+	if code := wf.load(); !code.Ok() {
+		f.Release()
+		return nil, code
+	}
+	return wf, fuse.OK
+}
+
+func (fs *codecFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return fs.open(name, flags, context)
+}
+
+func (fs *codecFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, code := fs.FileSystem.Create(name, innerFlags(flags), mode, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.newFile(f, flags)
+}
+
+func (fs *codecFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	f, code := fs.open(name, uint32(syscall.O_RDWR), context)
+	if !code.Ok() {
+		return code
+	}
+	defer f.Release()
+	if code := f.Truncate(size); !code.Ok() {
+		return code
+	}
+	return f.Flush()
+}
+
+// readStored reads up to n stored bytes at off.
+func readStored(f nodefs.File, n int, off int64) ([]byte, fuse.Status) {
+	buf := make([]byte, n)
+	res, code := f.Read(buf, off)
+	if !code.Ok() {
+		return nil, code
+	}
+	data, code := res.Bytes(buf)
+	res.Done()
+	return data, code
+}
+
+func writeStored(f nodefs.File, data []byte, off int64) fuse.Status {
+	n, code := f.Write(data, off)
+	if code.Ok() && int(n) < len(data) {
+		code = fuse.EIO
+	}
+	return code
+}
+
+// blockCodecFile reads and writes a file encoded by a BlockCodec.
+type blockCodecFile struct {
+	nodefs.File
+	codec      BlockCodec
+	appendMode bool
+
+	// mu serializes the read-modify-write cycles on blocks.
+	mu sync.Mutex
+}
+
+func (f *blockCodecFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *blockCodecFile) String() string {
+	return fmt.Sprintf("blockCodecFile(%s)", f.File.String())
+}
+
+func (f *blockCodecFile) storedBlockSize() int64 {
+	return int64(f.codec.BlockSize() + f.codec.Overhead())
+}
+
+func (f *blockCodecFile) size() (int64, fuse.Status) {
+	var a fuse.Attr
+	if code := f.File.GetAttr(&a); !code.Ok() {
+		return 0, code
+	}
+	return int64(plainSize(f.codec, a.Size)), fuse.OK
+}
+
+// readBlock returns the plain contents of block i, which are empty
+// past the end of the file.
+func (f *blockCodecFile) readBlock(i int64) ([]byte, fuse.Status) {
+	stored, code := readStored(f.File, int(f.storedBlockSize()), i*f.storedBlockSize())
+	if !code.Ok() || len(stored) == 0 {
+		return nil, code
+	}
+	plain, err := f.codec.DecodeBlock(i, stored)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	return plain, fuse.OK
+}
+
+func (f *blockCodecFile) writeBlock(i int64, plain []byte) fuse.Status {
+	stored, err := f.codec.EncodeBlock(i, plain)
+	if err != nil {
+		return fuse.EIO
+	}
+	return writeStored(f.File, stored, i*f.storedBlockSize())
+}
+
+// grow extends the file from size to newSize with zeros.
+func (f *blockCodecFile) grow(size int64, newSize int64) fuse.Status {
+	bs := int64(f.codec.BlockSize())
+	for pos := size; pos < newSize; {
+		i := pos / bs
+		plain, code := f.readBlock(i)
+		if !code.Ok() {
+			return code
+		}
+		end := (i + 1) * bs
+		if end > newSize {
+			end = newSize
+		}
+		plain = append(plain, make([]byte, int(end-i*bs)-len(plain))...)
+		if code := f.writeBlock(i, plain); !code.Ok() {
+			return code
+		}
+		pos = end
+	}
+	return fuse.OK
+}
+
+func (f *blockCodecFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bs := int64(f.codec.BlockSize())
+	n := 0
+	for n < len(buf) {
+		pos := off + int64(n)
+		i := pos / bs
+		plain, code := f.readBlock(i)
+		if !code.Ok() {
+			return nil, code
+		}
+		start := int(pos - i*bs)
+		if start >= len(plain) {
+			break
+		}
+		n += copy(buf[n:], plain[start:])
+		if len(plain) < int(bs) {
+			break
+		}
+	}
+	return fuse.ReadResultData(buf[:n]), fuse.OK
+}
+
+func (f *blockCodecFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	size, code := f.size()
+	if !code.Ok() {
+		return 0, code
+	}
+	if f.appendMode {
+		off = size
+	}
+	if off > size {
+		if code := f.grow(size, off); !code.Ok() {
+			return 0, code
+		}
+	}
+
+	bs := int64(f.codec.BlockSize())
+	written := 0
+	for written < len(data) {
+		pos := off + int64(written)
+		i := pos / bs
+		start := int(pos - i*bs)
+		n := len(data) - written
+		if n > int(bs)-start {
+			n = int(bs) - start
+		}
+
+		plain, code := f.readBlock(i)
+		if !code.Ok() {
+			return uint32(written), code
+		}
+		if len(plain) < start+n {
+			plain = append(plain, make([]byte, start+n-len(plain))...)
+		}
+		copy(plain[start:], data[written:written+n])
+		if code := f.writeBlock(i, plain); !code.Ok() {
+			return uint32(written), code
+		}
+		written += n
+	}
+	return uint32(written), fuse.OK
+}
+
+func (f *blockCodecFile) Truncate(newSize uint64) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	size, code := f.size()
+	if !code.Ok() {
+		return code
+	}
+	if int64(newSize) >= size {
+		return f.grow(size, int64(newSize))
+	}
+
+	bs := int64(f.codec.BlockSize())
+	i := int64(newSize) / bs
+	rem := int(int64(newSize) - i*bs)
+	var plain []byte
+	if rem > 0 {
+		if plain, code = f.readBlock(i); !code.Ok() {
+			return code
+		}
+	}
+	if code := f.File.Truncate(uint64(i * f.storedBlockSize())); !code.Ok() || rem == 0 {
+		return code
+	}
+	return f.writeBlock(i, plain[:rem])
+}
+
+func (f *blockCodecFile) GetAttr(out *fuse.Attr) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if code := f.File.GetAttr(out); !code.Ok() {
+		return code
+	}
+	out.Size = plainSize(f.codec, out.Size)
+	return fuse.OK
+}
+
+func (f *blockCodecFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	return fuse.ENOSYS
+}
+
+// wholeCodecFile keeps the decoded contents of a file in memory.
+type wholeCodecFile struct {
+	nodefs.File
+	codec      Codec
+	appendMode bool
+
+	mu    sync.Mutex
+	data  []byte
+	dirty bool
+}
+
+func (f *wholeCodecFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *wholeCodecFile) String() string {
+	return fmt.Sprintf("wholeCodecFile(%s)", f.File.String())
+}
+
+// load reads and decodes the stored file.
+func (f *wholeCodecFile) load() fuse.Status {
+	var stored []byte
+	for {
+		chunk, code := readStored(f.File, 1<<16, int64(len(stored)))
+		if !code.Ok() {
+			return code
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		stored = append(stored, chunk...)
+	}
+	if len(stored) == 0 {
+		return fuse.OK
+	}
+	plain, err := f.codec.Decode(stored)
+	if err != nil {
+		return fuse.EIO
+	}
+	f.data = plain
+	return fuse.OK
+}
+
+// store encodes and writes back the contents, if they changed. Must
+// be called with f.mu held.
+func (f *wholeCodecFile) store() fuse.Status {
+	if !f.dirty {
+		return fuse.OK
+	}
+	stored, err := f.codec.Encode(f.data)
+	if err != nil {
+		return fuse.EIO
+	}
+	if code := writeStored(f.File, stored, 0); !code.Ok() {
+		return code
+	}
+	if code := f.File.Truncate(uint64(len(stored))); !code.Ok() {
+		return code
+	}
+	f.dirty = false
+	return fuse.OK
+}
+
+func (f *wholeCodecFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= int64(len(f.data)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	n := copy(buf, f.data[off:])
+	return fuse.ReadResultData(buf[:n]), fuse.OK
+}
+
+func (f *wholeCodecFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.appendMode {
+		off = int64(len(f.data))
+	}
+	if end := off + int64(len(data)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, int(end)-len(f.data))...)
+	}
+	copy(f.data[off:], data)
+	f.dirty = true
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *wholeCodecFile) Truncate(size uint64) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if int(size) <= len(f.data) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, int(size)-len(f.data))...)
+	}
+	f.dirty = true
+	return fuse.OK
+}
+
+func (f *wholeCodecFile) GetAttr(out *fuse.Attr) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if code := f.File.GetAttr(out); !code.Ok() {
+		return code
+	}
+	out.Size = uint64(len(f.data))
+	return fuse.OK
+}
+
+func (f *wholeCodecFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (f *wholeCodecFile) Flush() fuse.Status {
+	f.mu.Lock()
+	code := f.store()
+	f.mu.Unlock()
+	if !code.Ok() {
+		return code
+	}
+	return f.File.Flush()
+}
+
+func (f *wholeCodecFile) Fsync(flags int) fuse.Status {
+	f.mu.Lock()
+	code := f.store()
+	f.mu.Unlock()
+	if !code.Ok() {
+		return code
+	}
+	return f.File.Fsync(flags)
+}
+
+func (f *wholeCodecFile) Release() {
+	f.mu.Lock()
+	f.store()
+	f.mu.Unlock()
+	f.File.Release()
+}
@@ -0,0 +1,457 @@
+package pathfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// openHow mirrors struct open_how from <linux/openat2.h>.
+type openHow struct {
+	Flags   uint64
+	Mode    uint64
+	Resolve uint64
+}
+
+const (
+	_SYS_OPENAT2 = 437
+
+	// O_PATH is missing from package syscall. This is the value
+	// for all architectures except alpha and sparc.
+	_O_PATH = 0x200000
+
+	_RESOLVE_NO_MAGICLINKS = 0x02
+	_RESOLVE_BENEATH       = 0x08
+)
+
+func openat2(dirfd int, path string, flags int, resolve uint64) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	how := openHow{
+		Flags:   uint64(flags | syscall.O_CLOEXEC),
+		Resolve: resolve,
+	}
+	for {
+		fd, _, errno := syscall.Syscall6(_SYS_OPENAT2, uintptr(dirfd),
+			uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&how)),
+			unsafe.Sizeof(how), 0, 0)
+		// EAGAIN means a concurrent rename kept the kernel
+		// from checking a "..", and the lookup may be retried.
+		if errno == syscall.EINTR || errno == syscall.EAGAIN {
+			continue
+		}
+		if errno != 0 {
+			return -1, errno
+		}
+		return int(fd), nil
+	}
+}
+
+func procFdPath(fd int) string {
+	return fmt.Sprintf("/proc/self/fd/%d", fd)
+}
+
+// confinedLoopbackFileSystem is a loopback file system that resolves
+// every name with openat2(RESOLVE_BENEATH) against a descriptor for
+// the root, and then operates on the result through /proc/self/fd.
+type confinedLoopbackFileSystem struct {
+	loopbackFileSystem
+	rootFd int
+}
+
+// NewConfinedLoopbackFileSystem is like NewLoopbackFileSystem, but
+// never reaches outside root, even if the backing tree is changed
+// under it. Symlinks in the tree are followed only if they are
+// relative and stay beneath root; lookups that would leave it fail
+// with EACCES. This needs Linux 5.6 or later, for openat2.
+func NewConfinedLoopbackFileSystem(root string) (FileSystem, error) {
+	fd, err := syscall.Open(root, _O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	fs := &confinedLoopbackFileSystem{
+		loopbackFileSystem: loopbackFileSystem{
+			FileSystem: NewDefaultFileSystem(),
+			Root:       root,
+		},
+		rootFd: fd,
+	}
+
+	// Fail early if the kernel has no openat2.
+	probe, err := openat2(fd, ".", _O_PATH, _RESOLVE_BENEATH)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("openat2: %v", err)
+	}
+	syscall.Close(probe)
+	return fs, nil
+}
+
+func (fs *confinedLoopbackFileSystem) String() string {
+	return fmt.Sprintf("ConfinedLoopbackFs(%s)", fs.Root)
+}
+
+// resolve opens name beneath the root as an O_PATH descriptor. If
+// follow is false, a symlink as the last component is not followed.
+func (fs *confinedLoopbackFileSystem) resolve(name string, follow bool) (int, fuse.Status) {
+	if name == "" {
+		name = "."
+	}
+	flags := _O_PATH
+	if !follow {
+		flags |= syscall.O_NOFOLLOW
+	}
+	fd, err := openat2(fs.rootFd, name, flags, _RESOLVE_BENEATH|_RESOLVE_NO_MAGICLINKS)
+	if err == syscall.EXDEV {
+		return -1, fuse.EACCES
+	}
+	if err != nil {
+		return -1, fuse.ToStatus(err)
+	}
+	return fd, fuse.OK
+}
+
+// resolveParent opens the directory holding name. The returned path
+// reaches name through that directory, and doesn't follow it if it is
+// a symlink.
+func (fs *confinedLoopbackFileSystem) resolveParent(name string) (fd int, path string, code fuse.Status) {
+	fd, code = fs.resolve(filepath.Dir(name), true)
+	if !code.Ok() {
+		return -1, "", code
+	}
+	return fd, filepath.Join(procFdPath(fd), filepath.Base(name)), fuse.OK
+}
+
+func (fs *confinedLoopbackFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	// As in the plain loopback, look through symlinks only for
+	// the toplevel directory.
+	fd, code := fs.resolve(name, name == "")
+	if !code.Ok() {
+		return nil, code
+	}
+	defer syscall.Close(fd)
+
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	a := &fuse.Attr{}
+	a.FromStat(&st)
+	return a, fuse.OK
+}
+
+func (fs *confinedLoopbackFileSystem) StatxAttributes(name string, context *fuse.Context) (uint64, uint64, fuse.Status) {
+	fd, code := fs.resolve(name, name == "")
+	if !code.Ok() {
+		return 0, 0, code
+	}
+	defer syscall.Close(fd)
+
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return 0, 0, fuse.ToStatus(err)
+	}
+	if !hasInodeFlags(st.Mode) {
+		return 0, 0, fuse.OK
+	}
+	// Unlike the O_PATH descriptor, this one can take ioctls.
+	rfd, err := syscall.Open(procFdPath(fd), syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, 0, fuse.OK
+	}
+	defer syscall.Close(rfd)
+	return inodeAttributes(rfd)
+}
+
+func (fs *confinedLoopbackFileSystem) openDir(name string) (*os.File, fuse.Status) {
+	fd, code := fs.resolve(name, true)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer syscall.Close(fd)
+	f, err := os.Open(procFdPath(fd))
+	return f, fuse.ToStatus(err)
+}
+
+func (fs *confinedLoopbackFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	f, code := fs.openDir(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer f.Close()
+	return fs.readDirEntries(f, name)
+}
+
+func (fs *confinedLoopbackFileSystem) OpenDirStream(name string, context *fuse.Context) (nodefs.DirStream, fuse.Status) {
+	f, code := fs.openDir(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &loopbackDirStream{fs: &fs.loopbackFileSystem, f: f, name: name}, fuse.OK
+}
+
+func (fs *confinedLoopbackFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	fd, code := fs.resolve(name, flags&syscall.O_NOFOLLOW == 0)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer syscall.Close(fd)
+
+	if flags&syscall.O_NOFOLLOW != 0 {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+		if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+			return nil, fuse.Status(syscall.ELOOP)
+		}
+	}
+
+	// The /proc/self/fd entry is itself a symlink.
+	f, err := fs.openFile(procFdPath(fd), flags&^syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return fs.newFile(f), fuse.OK
+}
+
+func (fs *confinedLoopbackFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	fd, path, code := fs.resolveParent(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer syscall.Close(fd)
+
+	// Don't create or open the target of a symlink.
+	var f *os.File
+	err := fs.create(func() (err error) {
+		f, err = fs.openFile(path, flags|uint32(os.O_CREATE|syscall.O_NOFOLLOW), fuse.ToFileMode(mode))
+		return err
+	})
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return fs.newFile(f), fuse.OK
+}
+
+func (fs *confinedLoopbackFileSystem) Tmpfile(dir string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	fd, code := fs.resolve(dir, true)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer syscall.Close(fd)
+	return fs.tmpfile(procFdPath(fd), flags, mode)
+}
+
+func (fs *confinedLoopbackFileSystem) LinkTmpfile(file nodefs.File, name string, context *fuse.Context) fuse.Status {
+	t := findTmpfile(file)
+	if t == nil {
+		return fuse.EINVAL
+	}
+	return fs.onEntry(name, func(path string) error {
+		if code := linkTmpfile(t.f, path); !code.Ok() {
+			return syscall.Errno(code)
+		}
+		return nil
+	})
+}
+
+// onFile runs op on the path of the resolved name, following
+// symlinks that stay beneath the root.
+func (fs *confinedLoopbackFileSystem) onFile(name string, op func(path string) error) fuse.Status {
+	fd, code := fs.resolve(name, true)
+	if !code.Ok() {
+		return code
+	}
+	defer syscall.Close(fd)
+	return fuse.ToStatus(op(procFdPath(fd)))
+}
+
+// onEntry runs op on a path for name in its resolved parent
+// directory.
+func (fs *confinedLoopbackFileSystem) onEntry(name string, op func(path string) error) fuse.Status {
+	fd, path, code := fs.resolveParent(name)
+	if !code.Ok() {
+		return code
+	}
+	defer syscall.Close(fd)
+	return fuse.ToStatus(op(path))
+}
+
+func (fs *confinedLoopbackFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.onFile(name, func(p string) error {
+		return os.Chmod(p, fuse.ToFileMode(mode))
+	})
+}
+
+func (fs *confinedLoopbackFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	return fs.onEntry(name, func(p string) error {
+		return os.Lchown(p, int(uid), int(gid))
+	})
+}
+
+func (fs *confinedLoopbackFileSystem) Truncate(name string, offset uint64, context *fuse.Context) fuse.Status {
+	if fs.opts.MaxFileSize > 0 && offset > uint64(fs.opts.MaxFileSize) {
+		return fuse.EFBIG
+	}
+	return fs.onFile(name, func(p string) error {
+		return os.Truncate(p, int64(offset))
+	})
+}
+
+func (fs *confinedLoopbackFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) fuse.Status {
+	var a time.Time
+	if Atime != nil {
+		a = *Atime
+	}
+	var m time.Time
+	if Mtime != nil {
+		m = *Mtime
+	}
+	return fs.onFile(name, func(p string) error {
+		return os.Chtimes(p, a, m)
+	})
+}
+
+func (fs *confinedLoopbackFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.onFile(name, func(p string) error {
+		return syscall.Access(p, mode)
+	})
+}
+
+func (fs *confinedLoopbackFileSystem) StatFs(name string) *fuse.StatfsOut {
+	var out *fuse.StatfsOut
+	fs.onFile(name, func(p string) error {
+		out = statFs(p)
+		return nil
+	})
+	return out
+}
+
+func (fs *confinedLoopbackFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	var data []string
+	code := fs.onFile(name, func(p string) (err error) {
+		data, err = listXAttr(p)
+		return err
+	})
+	return data, code
+}
+
+func (fs *confinedLoopbackFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	return fs.onFile(name, func(p string) error {
+		return sysRemovexattr(p, attr)
+	})
+}
+
+func (fs *confinedLoopbackFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	return fs.onFile(name, func(p string) error {
+		return sysSetxattr(p, attr, data, flags)
+	})
+}
+
+func (fs *confinedLoopbackFileSystem) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	var data []byte
+	code := fs.onFile(name, func(p string) (err error) {
+		data, err = getXAttr(p, attr, make([]byte, 1024))
+		return err
+	})
+	return data, code
+}
+
+func (fs *confinedLoopbackFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	var out string
+	code := fs.onEntry(name, func(p string) (err error) {
+		out, err = os.Readlink(p)
+		return err
+	})
+	return out, code
+}
+
+// CanonicalPath returns the path of the backing file as the kernel
+// resolved it beneath the root, rather than the loopback's path, which
+// may lead through symlinks out of it.
+func (fs *confinedLoopbackFileSystem) CanonicalPath(name string, context *fuse.Context) (string, fuse.Status) {
+	fd, code := fs.resolve(name, name == "")
+	if !code.Ok() {
+		return "", code
+	}
+	defer syscall.Close(fd)
+
+	path, err := os.Readlink(procFdPath(fd))
+	return path, fuse.ToStatus(err)
+}
+
+func (fs *confinedLoopbackFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	return fs.onEntry(name, func(p string) error {
+		return fs.create(func() error {
+			return syscall.Mknod(p, mode, int(dev))
+		})
+	})
+}
+
+func (fs *confinedLoopbackFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.onEntry(name, func(p string) error {
+		return fs.create(func() error {
+			return os.Mkdir(p, fuse.ToFileMode(mode))
+		})
+	})
+}
+
+func (fs *confinedLoopbackFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	return fs.onEntry(name, func(p string) error {
+		return syscall.Unlink(p)
+	})
+}
+
+func (fs *confinedLoopbackFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	return fs.onEntry(name, func(p string) error {
+		return syscall.Rmdir(p)
+	})
+}
+
+func (fs *confinedLoopbackFileSystem) Symlink(pointedTo string, linkName string, context *fuse.Context) fuse.Status {
+	return fs.onEntry(linkName, func(p string) error {
+		return os.Symlink(pointedTo, p)
+	})
+}
+
+// onEntries is like onEntry, for operations on two names.
+func (fs *confinedLoopbackFileSystem) onEntries(name1, name2 string, op func(path1, path2 string) error) fuse.Status {
+	fd1, path1, code := fs.resolveParent(name1)
+	if !code.Ok() {
+		return code
+	}
+	defer syscall.Close(fd1)
+	fd2, path2, code := fs.resolveParent(name2)
+	if !code.Ok() {
+		return code
+	}
+	defer syscall.Close(fd2)
+	return fuse.ToStatus(op(path1, path2))
+}
+
+func (fs *confinedLoopbackFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	return fs.onEntries(oldName, newName, os.Rename)
+}
+
+func (fs *confinedLoopbackFileSystem) Rename2(oldName string, newName string, flags uint32, context *fuse.Context) fuse.Status {
+	return fs.onEntries(oldName, newName, func(path1, path2 string) error {
+		if code := renameat2(path1, path2, flags); !code.Ok() {
+			return syscall.Errno(code)
+		}
+		return nil
+	})
+}
+
+func (fs *confinedLoopbackFileSystem) Link(orig string, newName string, context *fuse.Context) fuse.Status {
+	// link(2) doesn't follow a symlink given as orig.
+	return fs.onEntries(orig, newName, os.Link)
+}
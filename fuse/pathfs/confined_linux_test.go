@@ -0,0 +1,136 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestConfinedLoopback(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "go-fuse-confined")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := filepath.Join(tmp, "root")
+	outside := filepath.Join(tmp, "outside")
+	os.Mkdir(root, 0755)
+	os.Mkdir(outside, 0755)
+	secret := filepath.Join(outside, "secret")
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	for link, target := range map[string]string{
+		"etc":    "/etc",
+		"up":     "../outside",
+		"escape": secret,
+		"rel":    "file",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatalf("Symlink: %v", err)
+		}
+	}
+
+	fs, err := NewConfinedLoopbackFileSystem(root)
+	if err != nil {
+		t.Skipf("NewConfinedLoopbackFileSystem: %v", err)
+	}
+
+	checkOpenNoFollow(t, fs, "rel", "file")
+
+	// Names inside the root work as usual.
+	for _, name := range []string{"file", "rel"} {
+		f, code := fs.Open(name, uint32(os.O_RDONLY), nil)
+		if !code.Ok() {
+			t.Fatalf("Open(%q): %v", name, code)
+		}
+		buf := make([]byte, 10)
+		res, code := f.Read(buf, 0)
+		if !code.Ok() {
+			t.Fatalf("Read: %v", code)
+		}
+		content, _ := res.Bytes(buf)
+		if string(content) != "hello" {
+			t.Errorf("Read(%q): got %q, want %q", name, content, "hello")
+		}
+		f.Release()
+	}
+	if a, code := fs.GetAttr("etc", nil); !code.Ok() || !a.IsSymlink() {
+		t.Errorf("GetAttr(etc): got %v, %v, want a symlink", a, code)
+	}
+	if val, code := fs.Readlink("etc", nil); !code.Ok() || val != "/etc" {
+		t.Errorf("Readlink(etc): got %q, %v", val, code)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatalf("EvalSymlinks: %v", err)
+	}
+	cp := fs.(CanonicalPathFileSystem)
+	for _, name := range []string{"file", "rel", "etc"} {
+		want := filepath.Join(realRoot, name)
+		if got, code := cp.CanonicalPath(name, nil); !code.Ok() || got != want {
+			t.Errorf("CanonicalPath(%q): got %q, %v, want %q", name, got, code, want)
+		}
+	}
+
+	// Nothing reaches outside it.
+	for _, name := range []string{"etc/passwd", "up/secret", "escape", "../outside/secret"} {
+		if p, code := cp.CanonicalPath(name, nil); code.Ok() && !strings.HasPrefix(p, realRoot+"/") {
+			t.Errorf("CanonicalPath(%q) = %q, outside the root", name, p)
+		}
+		if a, code := fs.GetAttr(name, nil); code.Ok() && !a.IsSymlink() {
+			t.Errorf("GetAttr(%q) reached the target", name)
+		}
+		if f, code := fs.Open(name, uint32(os.O_RDONLY), nil); code.Ok() {
+			f.Release()
+			t.Errorf("Open(%q) succeeded", name)
+		}
+		if code := fs.Chmod(name, 0777, nil); code.Ok() {
+			t.Errorf("Chmod(%q) succeeded", name)
+		}
+		if code := fs.Truncate(name, 0, nil); code.Ok() {
+			t.Errorf("Truncate(%q) succeeded", name)
+		}
+	}
+	for _, name := range []string{"up/new", "escape"} {
+		if f, code := fs.Create(name, uint32(os.O_WRONLY|os.O_TRUNC), 0644, nil); code.Ok() {
+			f.Release()
+			t.Errorf("Create(%q) succeeded", name)
+		}
+	}
+	if code := fs.Unlink("up/secret", nil); code != fuse.EACCES {
+		t.Errorf("Unlink(up/secret): got %v, want EACCES", code)
+	}
+
+	if content, err := ioutil.ReadFile(secret); err != nil || string(content) != "secret" {
+		t.Errorf("outside file changed: %q, %v", content, err)
+	}
+	if fi, err := os.Stat(secret); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("outside file mode changed: %v, %v", fi, err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); err == nil {
+		t.Errorf("file created outside the root")
+	}
+}
+
+func TestConfinedLoopbackCreateExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-confined-eexist")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewConfinedLoopbackFileSystem(dir)
+	if err != nil {
+		t.Skipf("NewConfinedLoopbackFileSystem: %v", err)
+	}
+	checkCreateExisting(t, fs)
+}
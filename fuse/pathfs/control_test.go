@@ -0,0 +1,65 @@
+package pathfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestControlFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-control")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stats := NewRequestStats()
+	fs := NewControlFileSystem(NewLoopbackFileSystem(dir), ".stats", map[string]func() []byte{
+		"requests": stats.Report,
+	})
+
+	requests := func() int {
+		if a, code := fs.GetAttr(".stats/requests", nil); !code.Ok() || !a.IsRegular() {
+			t.Fatalf("GetAttr: %v, %v", a, code)
+		}
+		data := readAt(t, fs, ".stats/requests", 0, 4096)
+		for _, line := range strings.Split(data, "\n") {
+			var op string
+			var count int
+			var avg float64
+			if _, err := fmt.Sscanf(line, "%s %d %f", &op, &count, &avg); err == nil && op == "LOOKUP" {
+				return count
+			}
+		}
+		return 0
+	}
+	if n := requests(); n != 0 {
+		t.Errorf("before any requests: got %d lookups", n)
+	}
+	for i := 0; i < 3; i++ {
+		stats.Add("LOOKUP", time.Millisecond)
+	}
+	stats.Add("GETATTR", time.Millisecond)
+	if n := requests(); n != 3 {
+		t.Errorf("got %d lookups, want 3", n)
+	}
+
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() || len(entries) != 1 || entries[0].Name != ".stats" {
+		t.Errorf("OpenDir of the root: got %v, %v", entries, code)
+	}
+	if _, code := fs.Open(".stats/requests", uint32(os.O_WRONLY), nil); code != fuse.EROFS {
+		t.Errorf("Open for writing: got %v, want EROFS", code)
+	}
+	if code := fs.Mkdir(".stats/new", 0755, nil); code != fuse.EROFS {
+		t.Errorf("Mkdir: got %v, want EROFS", code)
+	}
+	if _, code := fs.GetAttr(".stats/missing", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr of a missing file: got %v, want ENOENT", code)
+	}
+}
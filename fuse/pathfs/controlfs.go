@@ -0,0 +1,319 @@
+package pathfs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+type controlFileSystem struct {
+	FileSystem
+	dir   string
+	files map[string]func() []byte
+	start time.Time
+}
+
+// NewControlFileSystem returns a wrapper that adds a read-only
+// directory dir, such as ".stats", to the root of fs, like /proc. It
+// holds a file for each entry of files, whose contents are generated
+// by the function on every open, so operators can cat the current
+// state of the mount. dir hides a file of the same name in fs.
+//
+// The files are opened with FOPEN_DIRECT_IO, as their contents may
+// differ from the size that GetAttr reported.
+func NewControlFileSystem(fs FileSystem, dir string, files map[string]func() []byte) FileSystem {
+	return &controlFileSystem{
+		FileSystem: fs,
+		dir:        dir,
+		files:      files,
+		start:      time.Now(),
+	}
+}
+
+func (fs *controlFileSystem) String() string {
+	return fmt.Sprintf("controlFileSystem(%v)", fs.FileSystem)
+}
+
+// control returns whether name is dir or in it, and the name of the
+// control file, which is empty for dir itself.
+func (fs *controlFileSystem) control(name string) (string, bool) {
+	if name == fs.dir {
+		return "", true
+	}
+	if strings.HasPrefix(name, fs.dir+"/") {
+		return name[len(fs.dir)+1:], true
+	}
+	return "", false
+}
+
+func (fs *controlFileSystem) attr(mode uint32, size int) *fuse.Attr {
+	a := &fuse.Attr{
+		Mode:  mode,
+		Size:  uint64(size),
+		Nlink: 1,
+	}
+	a.SetTimes(&fs.start, &fs.start, &fs.start)
+	return a
+}
+
+func (fs *controlFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	file, ok := fs.control(name)
+	if !ok {
+		return fs.FileSystem.GetAttr(name, context)
+	}
+	if file == "" {
+		return fs.attr(syscall.S_IFDIR|0555, 0), fuse.OK
+	}
+	gen := fs.files[file]
+	if gen == nil {
+		return nil, fuse.ENOENT
+	}
+	return fs.attr(syscall.S_IFREG|0444, len(gen())), fuse.OK
+}
+
+func (fs *controlFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	file, ok := fs.control(name)
+	if !ok {
+		entries, code := fs.FileSystem.OpenDir(name, context)
+		if name != "" || !code.Ok() {
+			return entries, code
+		}
+		out := []fuse.DirEntry{{Name: fs.dir, Mode: syscall.S_IFDIR}}
+		for _, e := range entries {
+			if e.Name != fs.dir {
+				out = append(out, e)
+			}
+		}
+		return out, fuse.OK
+	}
+	if file != "" {
+		if fs.files[file] == nil {
+			return nil, fuse.ENOENT
+		}
+		return nil, fuse.ENOTDIR
+	}
+	names := make([]string, 0, len(fs.files))
+	for n := range fs.files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	entries := make([]fuse.DirEntry, 0, len(names))
+	for _, n := range names {
+		entries = append(entries, fuse.DirEntry{Name: n, Mode: syscall.S_IFREG})
+	}
+	return entries, fuse.OK
+}
+
+func (fs *controlFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	file, ok := fs.control(name)
+	if !ok {
+		return fs.FileSystem.Open(name, flags, context)
+	}
+	if file == "" {
+		return nil, fuse.Status(syscall.EISDIR)
+	}
+	gen := fs.files[file]
+	if gen == nil {
+		return nil, fuse.ENOENT
+	}
+	if flags&(syscall.O_ACCMODE|syscall.O_TRUNC|syscall.O_APPEND) != syscall.O_RDONLY {
+		return nil, fuse.EROFS
+	}
+	return &nodefs.WithFlags{
+		File:      nodefs.NewReadOnlyFile(nodefs.NewDataFile(gen())),
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
+
+func (fs *controlFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if _, ok := fs.control(name); !ok {
+		return fs.FileSystem.Access(name, mode, context)
+	}
+	if _, code := fs.GetAttr(name, context); !code.Ok() {
+		return code
+	}
+	if mode&fuse.W_OK != 0 {
+		return fuse.EROFS
+	}
+	return fuse.OK
+}
+
+func (fs *controlFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	if _, ok := fs.control(name); ok {
+		return "", fuse.EINVAL
+	}
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *controlFileSystem) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	if _, ok := fs.control(name); ok {
+		return nil, fuse.ENODATA
+	}
+	return fs.FileSystem.GetXAttr(name, attribute, context)
+}
+
+func (fs *controlFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	if _, ok := fs.control(name); ok {
+		return nil, fuse.OK
+	}
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *controlFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if _, ok := fs.control(name); ok {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *controlFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if _, ok := fs.control(name); ok {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *controlFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if _, ok := fs.control(name); ok {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *controlFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if _, ok := fs.control(name); ok {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *controlFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	if _, ok := fs.control(name); ok {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *controlFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	if _, ok := fs.control(name); ok {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *controlFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	if _, ok := fs.control(linkName); ok {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *controlFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	_, oldCtl := fs.control(oldName)
+	_, newCtl := fs.control(newName)
+	if oldCtl || newCtl {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *controlFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	_, oldCtl := fs.control(oldName)
+	_, newCtl := fs.control(newName)
+	if oldCtl || newCtl {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *controlFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if _, ok := fs.control(name); ok {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *controlFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if _, ok := fs.control(name); ok {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *controlFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if _, ok := fs.control(name); ok {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *controlFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if _, ok := fs.control(name); ok {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+func (fs *controlFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if _, ok := fs.control(name); ok {
+		return nil, fuse.EROFS
+	}
+	return fs.FileSystem.Create(name, flags, mode, context)
+}
+
+// RequestStats counts the requests a Server handles, and their time.
+// Pass it to Server.RecordLatencies, and Report to
+// NewControlFileSystem to show the counts.
+type RequestStats struct {
+	mu    sync.Mutex
+	stats map[string]*requestStat
+}
+
+type requestStat struct {
+	count int
+	total time.Duration
+}
+
+// NewRequestStats returns empty RequestStats.
+func NewRequestStats() *RequestStats {
+	return &RequestStats{stats: map[string]*requestStat{}}
+}
+
+// Add implements fuse.LatencyMap.
+func (s *RequestStats) Add(name string, dt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats[name]
+	if st == nil {
+		st = &requestStat{}
+		s.stats[name] = st
+	}
+	st.count++
+	st.total += dt
+}
+
+// Report returns a line for each operation, sorted by name, with the
+// number of requests and their average latency in microseconds.
+func (s *RequestStats) Report() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.stats))
+	for n := range s.stats {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, n := range names {
+		st := s.stats[n]
+		avg := st.total / time.Duration(st.count)
+		fmt.Fprintf(&buf, "%s %d %.1f\n", n, st.count, float64(avg)/float64(time.Microsecond))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,50 @@
+package pathfs
+
+import (
+	"fmt"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// NewDirectIOFileSystem returns a wrapper that opens the files for
+// which direct returns true with FOPEN_DIRECT_IO, so reads and writes
+// bypass the kernel page cache. This suits files that change behind
+// the kernel's back, like live logs. Other files are opened as fs
+// opens them. The decision is made on every open, so direct may
+// depend on the file's current attributes, eg. by calling GetAttr.
+func NewDirectIOFileSystem(fs FileSystem, direct func(name string) bool) FileSystem {
+	return &directIOFileSystem{
+		FileSystem: fs,
+		direct:     direct,
+	}
+}
+
+type directIOFileSystem struct {
+	FileSystem
+	direct func(name string) bool
+}
+
+func (fs *directIOFileSystem) String() string {
+	return fmt.Sprintf("DirectIOFileSystem(%v)", fs.FileSystem)
+}
+
+func (fs *directIOFileSystem) wrap(name string, f nodefs.File, code fuse.Status) (nodefs.File, fuse.Status) {
+	if !code.Ok() || !fs.direct(name) {
+		return f, code
+	}
+	return &nodefs.WithFlags{
+		File:      f,
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, code
+}
+
+func (fs *directIOFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, code := fs.FileSystem.Open(name, flags, context)
+	return fs.wrap(name, f, code)
+}
+
+func (fs *directIOFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, code := fs.FileSystem.Create(name, flags, mode, context)
+	return fs.wrap(name, f, code)
+}
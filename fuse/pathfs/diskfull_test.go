@@ -0,0 +1,79 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestDiskFullSimulator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-diskfull")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const capacity = 4 * diskFullBlockSize
+	fs := NewDiskFullSimulatorFileSystem(NewLoopbackFileSystem(dir), capacity)
+
+	s := fs.StatFs("")
+	if s == nil {
+		t.Fatalf("StatFs returned nil")
+	}
+	unit := uint64(s.Frsize)
+	if s.Blocks*unit != capacity || s.Bfree*unit != capacity || s.Bavail*unit != capacity {
+		t.Errorf("empty StatFs: got %d/%d/%d blocks of %d, want %d bytes",
+			s.Blocks, s.Bfree, s.Bavail, unit, capacity)
+	}
+
+	f, code := fs.Create("file", uint32(os.O_WRONLY|os.O_TRUNC), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	defer f.Release()
+
+	data := make([]byte, diskFullBlockSize)
+	var off int64
+	for ; off < capacity; off += int64(len(data)) {
+		if n, code := f.Write(data, off); !code.Ok() || int(n) != len(data) {
+			t.Fatalf("Write at %d: %d, %v", off, n, code)
+		}
+	}
+	if _, code := f.Write([]byte("x"), off); code != fuse.ENOSPC {
+		t.Errorf("Write past capacity: got %v, want ENOSPC", code)
+	}
+	// Overwriting data in place doesn't need space.
+	if _, code := f.Write([]byte("x"), 0); !code.Ok() {
+		t.Errorf("overwrite: %v", code)
+	}
+
+	if _, code := fs.Create("other", uint32(os.O_WRONLY), 0644, nil); code != fuse.ENOSPC {
+		t.Errorf("Create on full disk: got %v, want ENOSPC", code)
+	}
+	if code := fs.Mkdir("dir", 0755, nil); code != fuse.ENOSPC {
+		t.Errorf("Mkdir on full disk: got %v, want ENOSPC", code)
+	}
+
+	s = fs.StatFs("")
+	if s.Bfree != 0 || s.Bavail != 0 {
+		t.Errorf("full StatFs: got Bfree %d, Bavail %d, want 0", s.Bfree, s.Bavail)
+	}
+	if s.Blocks*unit != capacity {
+		t.Errorf("full StatFs: got %d blocks, want %d", s.Blocks, capacity/unit)
+	}
+
+	// Freeing space makes room again.
+	if code := f.Truncate(diskFullBlockSize); !code.Ok() {
+		t.Fatalf("Truncate: %v", code)
+	}
+	if s := fs.StatFs(""); s.Bfree*unit != capacity-diskFullBlockSize {
+		t.Errorf("StatFs after Truncate: got %d free blocks, want %d", s.Bfree, (capacity-diskFullBlockSize)/unit)
+	}
+	g, code := fs.Create("other", uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create after Truncate: %v", code)
+	}
+	g.Release()
+}
@@ -0,0 +1,100 @@
+package pathfs
+
+import (
+	"fmt"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// diskFullBlockSize is the block size reported by StatFs if fs does
+// not report one.
+const diskFullBlockSize = 4096
+
+type diskFullFileSystem struct {
+	*quotaFileSystem
+}
+
+// NewDiskFullSimulatorFileSystem returns a wrapper that behaves as if
+// fs were a disk holding capacity bytes, to test how writers handle
+// a full disk. Writes that would store more than capacity bytes fail
+// with ENOSPC, and so do Create, Mkdir, Mknod and Symlink once the
+// disk is full. StatFs reports the capacity and the space left.
+//
+// Usage is accounted like NewQuotaFileSystem does, from the creation
+// of the wrapper on.
+func NewDiskFullSimulatorFileSystem(fs FileSystem, capacity int64) FileSystem {
+	q := NewQuotaFileSystem(fs, []QuotaRule{{Limit: capacity}}).(*quotaFileSystem)
+	q.exceeded = fuse.ENOSPC
+	return &diskFullFileSystem{q}
+}
+
+func (fs *diskFullFileSystem) String() string {
+	return fmt.Sprintf("diskFullFileSystem(%v)", fs.FileSystem)
+}
+
+// free returns the number of bytes left.
+func (fs *diskFullFileSystem) free() int64 {
+	r := fs.rules[0]
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if r.used >= r.limit {
+		return 0
+	}
+	return r.limit - r.used
+}
+
+// full returns ENOSPC if no bytes are left, or OK.
+func (fs *diskFullFileSystem) full() fuse.Status {
+	if fs.free() == 0 {
+		return fuse.ENOSPC
+	}
+	return fuse.OK
+}
+
+func (fs *diskFullFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if code := fs.full(); !code.Ok() {
+		return nil, code
+	}
+	return fs.quotaFileSystem.Create(name, flags, mode, context)
+}
+
+func (fs *diskFullFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if code := fs.full(); !code.Ok() {
+		return code
+	}
+	return fs.quotaFileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *diskFullFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if code := fs.full(); !code.Ok() {
+		return code
+	}
+	return fs.quotaFileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *diskFullFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	if code := fs.full(); !code.Ok() {
+		return code
+	}
+	return fs.quotaFileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *diskFullFileSystem) StatFs(name string) *fuse.StatfsOut {
+	out := &fuse.StatfsOut{}
+	if s := fs.quotaFileSystem.StatFs(name); s != nil {
+		*out = *s
+	}
+	if out.Bsize == 0 {
+		out.Bsize = diskFullBlockSize
+	}
+	if out.Frsize == 0 {
+		out.Frsize = out.Bsize
+	}
+	// statfs(2) counts blocks in units of the fragment size.
+	unit := uint64(out.Frsize)
+	out.Blocks = uint64(fs.rules[0].limit) / unit
+	out.Bfree = uint64(fs.free()) / unit
+	out.Bavail = out.Bfree
+	return out
+}
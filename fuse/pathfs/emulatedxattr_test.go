@@ -0,0 +1,77 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// noXAttrFileSystem is a backing store without xattr support.
+type noXAttrFileSystem struct {
+	FileSystem
+}
+
+func (fs *noXAttrFileSystem) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	return nil, fuse.EOPNOTSUPP
+}
+
+func (fs *noXAttrFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	return nil, fuse.EOPNOTSUPP
+}
+
+func (fs *noXAttrFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	return fuse.EOPNOTSUPP
+}
+
+func (fs *noXAttrFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	return fuse.EOPNOTSUPP
+}
+
+func TestEmulatedXAttr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-emulatedxattr")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	fs := NewEmulatedXAttrFileSystem(&noXAttrFileSystem{NewLoopbackFileSystem(dir)})
+
+	if code := fs.SetXAttr("file", "user.color", []byte("red"), 0, nil); !code.Ok() {
+		t.Fatalf("SetXAttr: %v", code)
+	}
+	if code := fs.SetXAttr("file", "user.color", []byte("blue"), _XATTR_CREATE, nil); code.Ok() {
+		t.Errorf("SetXAttr with XATTR_CREATE on existing attribute succeeded")
+	}
+	if v, code := fs.GetXAttr("file", "user.color", nil); !code.Ok() || string(v) != "red" {
+		t.Errorf("GetXAttr: got %q, %v", v, code)
+	}
+	if _, code := fs.GetXAttr("missing", "user.color", nil); code != fuse.ENOENT {
+		t.Errorf("GetXAttr on missing file: got %v, want ENOENT", code)
+	}
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() || len(entries) != 1 || entries[0].Name != "file" {
+		t.Errorf("OpenDir: got %v, %v, want only file", entries, code)
+	}
+
+	if code := fs.Rename("file", "moved", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	if v, code := fs.GetXAttr("moved", "user.color", nil); !code.Ok() || string(v) != "red" {
+		t.Errorf("GetXAttr after rename: got %q, %v", v, code)
+	}
+	if names, code := fs.ListXAttr("moved", nil); !code.Ok() || len(names) != 1 || names[0] != "user.color" {
+		t.Errorf("ListXAttr after rename: got %v, %v", names, code)
+	}
+
+	if code := fs.Unlink("moved", nil); !code.Ok() {
+		t.Fatalf("Unlink: %v", code)
+	}
+	if left, _ := ioutil.ReadDir(dir); len(left) != 0 {
+		t.Errorf("files remain after Unlink: %v", left)
+	}
+}
@@ -0,0 +1,379 @@
+package pathfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+const _XATTR_SIDECAR_SUFFIX = ".xattr"
+
+const (
+	_XATTR_CREATE  = 1
+	_XATTR_REPLACE = 2
+)
+
+type emulatedXAttrFileSystem struct {
+	FileSystem
+
+	// mu serializes updates of the sidecar files.
+	mu sync.Mutex
+}
+
+// NewEmulatedXAttrFileSystem returns a wrapper that emulates extended
+// attributes for backing file systems that don't support them, such
+// as some tmpfs configurations. Attribute calls go to fs first; if it
+// answers EOPNOTSUPP or ENOSYS, the attributes of dir/name are kept
+// as JSON in a sidecar file dir/.name.xattr instead.
+//
+// Sidecars follow their file on Rename, are removed with it, and are
+// hidden from listings and lookups, so files in fs whose names look
+// like sidecars can't be reached through the wrapper. Hard links don't
+// share emulated attributes.
+func NewEmulatedXAttrFileSystem(fs FileSystem) FileSystem {
+	return &emulatedXAttrFileSystem{FileSystem: fs}
+}
+
+func (fs *emulatedXAttrFileSystem) String() string {
+	return fmt.Sprintf("emulatedXAttrFileSystem(%v)", fs.FileSystem)
+}
+
+// sidecar returns the name of the file that holds the attributes of
+// name.
+func sidecar(name string) string {
+	if name == "" {
+		return _XATTR_SIDECAR_SUFFIX
+	}
+	dir, base := filepath.Split(name)
+	return dir + "." + base + _XATTR_SIDECAR_SUFFIX
+}
+
+func isSidecar(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, _XATTR_SIDECAR_SUFFIX)
+}
+
+func xattrUnsupported(code fuse.Status) bool {
+	return code == fuse.EOPNOTSUPP || code == fuse.ENOSYS
+}
+
+// load returns the emulated attributes of name, which must exist.
+func (fs *emulatedXAttrFileSystem) load(name string, context *fuse.Context) (map[string][]byte, fuse.Status) {
+	if _, code := fs.FileSystem.GetAttr(name, context); !code.Ok() {
+		return nil, code
+	}
+	attrs := map[string][]byte{}
+	f, code := fs.FileSystem.Open(sidecar(name), uint32(os.O_RDONLY), context)
+	if code == fuse.ENOENT {
+		return attrs, fuse.OK
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	defer f.Release()
+	defer f.Flush()
+
+	var content []byte
+	buf := make([]byte, 64*(1<<10))
+	for {
+		res, code := f.Read(buf, int64(len(content)))
+		if !code.Ok() {
+			return nil, code
+		}
+		data, code := res.Bytes(buf)
+		if !code.Ok() {
+			return nil, code
+		}
+		if len(data) == 0 {
+			break
+		}
+		content = append(content, data...)
+	}
+	if err := json.Unmarshal(content, &attrs); err != nil {
+		return nil, fuse.EIO
+	}
+	return attrs, fuse.OK
+}
+
+// store replaces the emulated attributes of name. The sidecar is
+// removed when no attributes are left.
+func (fs *emulatedXAttrFileSystem) store(name string, attrs map[string][]byte, context *fuse.Context) fuse.Status {
+	if len(attrs) == 0 {
+		code := fs.FileSystem.Unlink(sidecar(name), context)
+		if code == fuse.ENOENT {
+			return fuse.OK
+		}
+		return code
+	}
+	content, err := json.Marshal(attrs)
+	if err != nil {
+		return fuse.EIO
+	}
+	f, code := fs.FileSystem.Create(sidecar(name), uint32(os.O_WRONLY|os.O_TRUNC), 0600, context)
+	if !code.Ok() {
+		return code
+	}
+	defer f.Release()
+	n, code := f.Write(content, 0)
+	if !code.Ok() {
+		f.Flush()
+		return code
+	}
+	if int(n) < len(content) {
+		f.Flush()
+		return fuse.EIO
+	}
+	return f.Flush()
+}
+
+// forget removes the sidecar of name, which has gone.
+func (fs *emulatedXAttrFileSystem) forget(name string, context *fuse.Context) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.FileSystem.Unlink(sidecar(name), context)
+}
+
+func (fs *emulatedXAttrFileSystem) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if isSidecar(name) {
+		return nil, fuse.ENOENT
+	}
+	data, code := fs.FileSystem.GetXAttr(name, attr, context)
+	if !xattrUnsupported(code) {
+		return data, code
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	attrs, code := fs.load(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	data, ok := attrs[attr]
+	if !ok {
+		return nil, fuse.ENODATA
+	}
+	return data, fuse.OK
+}
+
+func (fs *emulatedXAttrFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	if isSidecar(name) {
+		return nil, fuse.ENOENT
+	}
+	names, code := fs.FileSystem.ListXAttr(name, context)
+	if !xattrUnsupported(code) {
+		return names, code
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	attrs, code := fs.load(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	names = make([]string, 0, len(attrs))
+	for n := range attrs {
+		names = append(names, n)
+	}
+	return names, fuse.OK
+}
+
+func (fs *emulatedXAttrFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if isSidecar(name) {
+		return fuse.ENOENT
+	}
+	code := fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+	if !xattrUnsupported(code) {
+		return code
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	attrs, code := fs.load(name, context)
+	if !code.Ok() {
+		return code
+	}
+	_, exists := attrs[attr]
+	if flags&_XATTR_CREATE != 0 && exists {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if flags&_XATTR_REPLACE != 0 && !exists {
+		return fuse.ENODATA
+	}
+	attrs[attr] = append([]byte{}, data...)
+	return fs.store(name, attrs, context)
+}
+
+func (fs *emulatedXAttrFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if isSidecar(name) {
+		return fuse.ENOENT
+	}
+	code := fs.FileSystem.RemoveXAttr(name, attr, context)
+	if !xattrUnsupported(code) {
+		return code
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	attrs, code := fs.load(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if _, ok := attrs[attr]; !ok {
+		return fuse.ENODATA
+	}
+	delete(attrs, attr)
+	return fs.store(name, attrs, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	if isSidecar(name) {
+		return fuse.ENOENT
+	}
+	code := fs.FileSystem.Unlink(name, context)
+	if code.Ok() {
+		fs.forget(name, context)
+	}
+	return code
+}
+
+func (fs *emulatedXAttrFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	if isSidecar(name) {
+		return fuse.ENOENT
+	}
+	code := fs.FileSystem.Rmdir(name, context)
+	if code.Ok() {
+		fs.forget(name, context)
+	}
+	return code
+}
+
+func (fs *emulatedXAttrFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if isSidecar(oldName) || isSidecar(newName) {
+		return fuse.ENOENT
+	}
+	code := fs.FileSystem.Rename(oldName, newName, context)
+	if !code.Ok() {
+		return code
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	// The attributes of a file that was replaced go with it.
+	fs.FileSystem.Unlink(sidecar(newName), context)
+	fs.FileSystem.Rename(sidecar(oldName), sidecar(newName), context)
+	return fuse.OK
+}
+
+func (fs *emulatedXAttrFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if isSidecar(name) {
+		return nil, fuse.ENOENT
+	}
+	entries, code := fs.FileSystem.OpenDir(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	out := entries[:0]
+	for _, e := range entries {
+		if !isSidecar(e.Name) {
+			out = append(out, e)
+		}
+	}
+	return out, fuse.OK
+}
+
+func (fs *emulatedXAttrFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if isSidecar(name) {
+		return nil, fuse.ENOENT
+	}
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if isSidecar(name) {
+		return fuse.ENOENT
+	}
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	if isSidecar(name) {
+		return "", fuse.ENOENT
+	}
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if isSidecar(name) {
+		return nil, fuse.ENOENT
+	}
+	return fs.FileSystem.Open(name, flags, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if isSidecar(name) {
+		return nil, fuse.EPERM
+	}
+	return fs.FileSystem.Create(name, flags, mode, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if isSidecar(name) {
+		return fuse.EPERM
+	}
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if isSidecar(name) {
+		return fuse.EPERM
+	}
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	if isSidecar(linkName) {
+		return fuse.EPERM
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if isSidecar(oldName) {
+		return fuse.ENOENT
+	}
+	if isSidecar(newName) {
+		return fuse.EPERM
+	}
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if isSidecar(name) {
+		return fuse.ENOENT
+	}
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if isSidecar(name) {
+		return fuse.ENOENT
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if isSidecar(name) {
+		return fuse.ENOENT
+	}
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *emulatedXAttrFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if isSidecar(name) {
+		return fuse.ENOENT
+	}
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
@@ -0,0 +1,342 @@
+// +build go1.16
+
+package pathfs
+
+import (
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+type ioFileSystem struct {
+	FileSystem
+	fsys iofs.FS
+}
+
+// NewIoFSFileSystem serves fsys, such as an embed.FS or a zip.Reader,
+// as a read-only FileSystem. Operations that would change it return
+// EROFS. Symlinks are only reported as such if fsys has Lstat and
+// ReadLink methods, like fs.ReadLinkFS. Files that are neither
+// io.ReaderAt nor io.Seeker are read sequentially, and reopened to
+// read backwards.
+func NewIoFSFileSystem(fsys iofs.FS) FileSystem {
+	return &ioFileSystem{
+		FileSystem: NewDefaultFileSystem(),
+		fsys:       fsys,
+	}
+}
+
+func (fs *ioFileSystem) String() string {
+	return fmt.Sprintf("ioFileSystem(%T)", fs.fsys)
+}
+
+// ioFSName converts a FileSystem name to an fs.FS name.
+func ioFSName(name string) string {
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// ioFSMode converts the type and permission bits of m to a Unix mode.
+func ioFSMode(m iofs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&iofs.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&iofs.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&iofs.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	switch {
+	case m.IsDir():
+		mode |= syscall.S_IFDIR
+	case m&iofs.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+	case m&iofs.ModeNamedPipe != 0:
+		mode |= syscall.S_IFIFO
+	case m&iofs.ModeSocket != 0:
+		mode |= syscall.S_IFSOCK
+	case m&iofs.ModeCharDevice != 0:
+		mode |= syscall.S_IFCHR
+	case m&iofs.ModeDevice != 0:
+		mode |= syscall.S_IFBLK
+	default:
+		mode |= syscall.S_IFREG
+	}
+	return mode
+}
+
+func ioFSAttr(fi iofs.FileInfo) *fuse.Attr {
+	if a := fuse.ToAttr(fi); a != nil {
+		return a
+	}
+	a := &fuse.Attr{
+		Mode:  ioFSMode(fi.Mode()),
+		Size:  uint64(fi.Size()),
+		Nlink: 1,
+	}
+	a.Blocks = (a.Size + 511) / 512
+	t := fi.ModTime()
+	a.SetTimes(&t, &t, &t)
+	return a
+}
+
+func (fs *ioFileSystem) stat(name string) (iofs.FileInfo, error) {
+	if l, ok := fs.fsys.(interface {
+		Lstat(name string) (iofs.FileInfo, error)
+	}); ok && name != "" {
+		return l.Lstat(name)
+	}
+	return iofs.Stat(fs.fsys, ioFSName(name))
+}
+
+func (fs *ioFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	fi, err := fs.stat(name)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return ioFSAttr(fi), fuse.OK
+}
+
+func (fs *ioFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if _, err := fs.stat(name); err != nil {
+		return fuse.ToStatus(err)
+	}
+	if mode&fuse.W_OK != 0 {
+		return fuse.EROFS
+	}
+	return fuse.OK
+}
+
+func (fs *ioFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	l, ok := fs.fsys.(interface {
+		ReadLink(name string) (string, error)
+	})
+	if !ok {
+		return "", fuse.EINVAL
+	}
+	target, err := l.ReadLink(name)
+	if err != nil {
+		return "", fuse.ToStatus(err)
+	}
+	return target, fuse.OK
+}
+
+func (fs *ioFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	entries, err := iofs.ReadDir(fs.fsys, ioFSName(name))
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	out := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, fuse.DirEntry{
+			Name: e.Name(),
+			Mode: ioFSMode(e.Type()),
+		})
+	}
+	return out, fuse.OK
+}
+
+// ioDirStream lists a directory that is an fs.ReadDirFile a page at
+// a time.
+type ioDirStream struct {
+	f iofs.ReadDirFile
+}
+
+// OpenDirStream returns ENOSYS for directories that can't be read
+// incrementally, so OpenDir is used instead.
+func (fs *ioFileSystem) OpenDirStream(name string, context *fuse.Context) (nodefs.DirStream, fuse.Status) {
+	f, err := fs.fsys.Open(ioFSName(name))
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	d, ok := f.(iofs.ReadDirFile)
+	if !ok {
+		f.Close()
+		return nil, fuse.ENOSYS
+	}
+	return &ioDirStream{f: d}, fuse.OK
+}
+
+func (s *ioDirStream) Next(n int) ([]fuse.DirEntry, fuse.Status) {
+	entries, err := s.f.ReadDir(n)
+	if err != nil && err != io.EOF {
+		return nil, fuse.ToStatus(err)
+	}
+	out := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, fuse.DirEntry{
+			Name: e.Name(),
+			Mode: ioFSMode(e.Type()),
+		})
+	}
+	return out, fuse.OK
+}
+
+func (s *ioDirStream) Close() {
+	s.f.Close()
+}
+
+func (fs *ioFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&(syscall.O_ACCMODE|syscall.O_TRUNC|syscall.O_APPEND|syscall.O_CREAT) != syscall.O_RDONLY {
+		return nil, fuse.EROFS
+	}
+	f, err := fs.fsys.Open(ioFSName(name))
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return &ioFile{
+		File: nodefs.NewDefaultFile(),
+		fs:   fs,
+		name: name,
+		file: f,
+	}, fuse.OK
+}
+
+func (fs *ioFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) Truncate(name string, offset uint64, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs *ioFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return nil, fuse.EROFS
+}
+
+// ioFile is a File opened from an fs.FS.
+type ioFile struct {
+	nodefs.File
+	fs   *ioFileSystem
+	name string
+
+	mu   sync.Mutex
+	file iofs.File
+
+	// pos is the offset of a file that is read sequentially.
+	pos int64
+}
+
+func (f *ioFile) String() string {
+	return fmt.Sprintf("ioFile(%q)", f.name)
+}
+
+func (f *ioFile) GetAttr(out *fuse.Attr) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fi, err := f.file.Stat()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	*out = *ioFSAttr(fi)
+	return fuse.OK
+}
+
+func (f *ioFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var n int
+	var err error
+	switch r := f.file.(type) {
+	case io.ReaderAt:
+		n, err = r.ReadAt(buf, off)
+	case io.Seeker:
+		if _, err = r.Seek(off, io.SeekStart); err == nil {
+			n, err = io.ReadFull(f.file, buf)
+		}
+	default:
+		if err = f.seekForward(off); err == nil {
+			n, err = io.ReadFull(f.file, buf)
+			f.pos += int64(n)
+		}
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fuse.ToStatus(err)
+	}
+	return fuse.ReadResultData(buf[:n]), fuse.OK
+}
+
+// seekForward moves a sequential file to off, reopening it if off
+// is behind the current position.
+func (f *ioFile) seekForward(off int64) error {
+	if off < f.pos {
+		file, err := f.fs.fsys.Open(ioFSName(f.name))
+		if err != nil {
+			return err
+		}
+		f.file.Close()
+		f.file = file
+		f.pos = 0
+	}
+	n, err := io.CopyN(io.Discard, f.file, off-f.pos)
+	f.pos += n
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (f *ioFile) Flush() fuse.Status {
+	return fuse.OK
+}
+
+func (f *ioFile) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.file.Close()
+}
@@ -0,0 +1,107 @@
+// +build go1.16
+
+package pathfs
+
+import (
+	iofs "io/fs"
+	"os"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// sequentialFS hides the ReadAt and Seek methods of its files.
+type sequentialFS struct {
+	fstest.MapFS
+}
+
+type sequentialFile struct {
+	iofs.File
+}
+
+func (fsys sequentialFS) Open(name string) (iofs.File, error) {
+	f, err := fsys.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return sequentialFile{f}, nil
+}
+
+func TestIoFSFileSystem(t *testing.T) {
+	mapFS := fstest.MapFS{
+		"dir/file.txt": &fstest.MapFile{Data: []byte("0123456789"), Mode: 0644},
+		"top":          &fstest.MapFile{Data: []byte("hello"), Mode: 0755},
+	}
+	for _, fsys := range []iofs.FS{mapFS, sequentialFS{mapFS}} {
+		checkIoFS(t, NewIoFSFileSystem(fsys))
+	}
+}
+
+func checkIoFS(t *testing.T, fs FileSystem) {
+	a, code := fs.GetAttr("dir", nil)
+	if !code.Ok() || !a.IsDir() {
+		t.Fatalf("%v: GetAttr(dir): %v, %v", fs, a, code)
+	}
+	a, code = fs.GetAttr("top", nil)
+	if !code.Ok() || !a.IsRegular() || a.Mode&07777 != 0755 || a.Size != 5 {
+		t.Errorf("%v: GetAttr(top): %v, %v", fs, a, code)
+	}
+	if _, code := fs.GetAttr("missing", nil); code != fuse.ENOENT {
+		t.Errorf("%v: GetAttr(missing): got %v, want ENOENT", fs, code)
+	}
+
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() || len(entries) != 2 {
+		t.Fatalf("%v: OpenDir: %v, %v", fs, entries, code)
+	}
+	for _, e := range entries {
+		if want := map[string]uint32{"dir": syscall.S_IFDIR, "top": syscall.S_IFREG}[e.Name]; e.Mode&syscall.S_IFMT != want {
+			t.Errorf("%v: entry %q: got mode 0%o, want type 0%o", fs, e.Name, e.Mode, want)
+		}
+	}
+
+	// Read through the node layer, as a mount would.
+	rawFS := nodefs.NewFileSystemConnector(NewPathNodeFs(fs, nil).Root(), nil).RawFS()
+	var entry fuse.EntryOut
+	if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "dir", &entry); !code.Ok() {
+		t.Fatalf("%v: Lookup(dir): %v", fs, code)
+	}
+	if code := rawFS.Lookup(&fuse.InHeader{NodeId: entry.NodeId}, "file.txt", &entry); !code.Ok() {
+		t.Fatalf("%v: Lookup(file.txt): %v", fs, code)
+	}
+	var open fuse.OpenOut
+	openIn := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Flags: uint32(os.O_RDONLY)}
+	if code := rawFS.Open(&openIn, &open); !code.Ok() {
+		t.Fatalf("%v: Open: %v", fs, code)
+	}
+	// Read at an offset, then backwards.
+	for _, c := range []struct {
+		off  uint64
+		want string
+	}{{6, "6789"}, {2, "2345"}} {
+		buf := make([]byte, 4)
+		res, code := rawFS.Read(&fuse.ReadIn{InHeader: openIn.InHeader, Fh: open.Fh, Offset: c.off, Size: 4}, buf)
+		if !code.Ok() {
+			t.Fatalf("%v: Read: %v", fs, code)
+		}
+		data, _ := res.Bytes(buf)
+		if string(data) != c.want {
+			t.Errorf("%v: Read at %d: got %q, want %q", fs, c.off, data, c.want)
+		}
+		res.Done()
+	}
+	rawFS.Release(&fuse.ReleaseIn{InHeader: openIn.InHeader, Fh: open.Fh})
+
+	if _, code := fs.Open("top", uint32(os.O_WRONLY), nil); code != fuse.EROFS {
+		t.Errorf("%v: Open for writing: got %v, want EROFS", fs, code)
+	}
+	if code := fs.Unlink("top", nil); code != fuse.EROFS {
+		t.Errorf("%v: Unlink: got %v, want EROFS", fs, code)
+	}
+	if code := fs.Mkdir("new", 0755, nil); code != fuse.EROFS {
+		t.Errorf("%v: Mkdir: got %v, want EROFS", fs, code)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -16,16 +17,110 @@ type loopbackFileSystem struct {
 	// TODO - this should need default fill in.
 	FileSystem
 	Root string
+
+	opts LoopbackOptions
+
+	// rootDev is the device of Root, for NoCrossMounts.
+	rootDevOnce sync.Once
+	rootDev     uint64
 }
 
 // A FUSE filesystem that shunts all request to an underlying file
 // system.  Its main purpose is to provide test coverage without
 // having to build a synthetic filesystem.
 func NewLoopbackFileSystem(root string) FileSystem {
-	return &loopbackFileSystem{
+	return NewLoopbackFileSystemWithOptions(root, nil)
+}
+
+// NewLoopbackFileSystemWithOptions is NewLoopbackFileSystem with
+// options; nil opts gives the defaults.
+func NewLoopbackFileSystemWithOptions(root string, opts *LoopbackOptions) FileSystem {
+	fs := &loopbackFileSystem{
 		FileSystem: NewDefaultFileSystem(),
 		Root:       root,
 	}
+	if opts != nil {
+		fs.opts = *opts
+	}
+	return fs
+}
+
+// openFile opens path with the open flags from the kernel. These are
+// passed on unchanged, so O_NOFOLLOW fails with ELOOP on a symlink,
+// and with O_SYNC or O_DSYNC each write to the backing file is
+// durable before it returns.
+func (fs *loopbackFileSystem) openFile(path string, flags uint32, mode os.FileMode) (f *os.File, err error) {
+	err = fs.retryStale(func() (err error) {
+		f, err = fs.openWait(path, int(flags), mode)
+		if fs.opts.NoAtimeFallback && flags&_O_NOATIME != 0 && os.IsPermission(err) {
+			f, err = fs.openWait(path, int(flags&^_O_NOATIME), mode)
+		}
+		return err
+	})
+	return f, err
+}
+
+// retryStale runs call, which works on a path, and runs it once more
+// if it fails with ESTALE and LoopbackOptions.RetryStale is set. The
+// loopback keeps no descriptors for paths, so the second call looks
+// up the path from scratch.
+func (fs *loopbackFileSystem) retryStale(call func() error) error {
+	err := call()
+	if fs.opts.RetryStale && fuse.ToStatus(err) == fuse.Status(syscall.ESTALE) {
+		err = call()
+	}
+	return err
+}
+
+// openWait is os.OpenFile, retried while there are no descriptors
+// left, as set by LoopbackOptions.FdWait.
+func (fs *loopbackFileSystem) openWait(path string, flags int, mode os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(path, flags, mode)
+	if fs.opts.FdWait <= 0 {
+		return f, err
+	}
+	deadline := time.Now().Add(fs.opts.FdWait)
+	backoff := time.Millisecond
+	for isFdShortage(err) && time.Now().Before(deadline) {
+		if fs.opts.OnFdShortage != nil {
+			fs.opts.OnFdShortage()
+		}
+		time.Sleep(backoff)
+		if backoff < 100*time.Millisecond {
+			backoff *= 2
+		}
+		f, err = os.OpenFile(path, flags, mode)
+	}
+	return f, err
+}
+
+// newFile wraps an opened backing file.
+func (fs *loopbackFileSystem) newFile(f *os.File) nodefs.File {
+	if fs.opts.MaxFileSize > 0 {
+		return nodefs.NewSizeLimitedLoopbackFile(f, fs.opts.MaxFileSize)
+	}
+	return nodefs.NewLoopbackFile(f)
+}
+
+// umaskMu serializes clearing the process umask.
+var umaskMu sync.Mutex
+
+// create runs the call that creates an entry, with the umask cleared
+// if LoopbackOptions.IgnoreUmask is set.
+func (fs *loopbackFileSystem) create(call func() error) error {
+	if !fs.opts.IgnoreUmask {
+		return call()
+	}
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+	return call()
+}
+
+func isFdShortage(err error) bool {
+	code := fuse.ToStatus(err)
+	return code == fuse.Status(syscall.EMFILE) || code == fuse.Status(syscall.ENFILE)
 }
 
 func (fs *loopbackFileSystem) OnMount(nodeFs *PathNodeFs) {
@@ -37,21 +132,115 @@ func (fs *loopbackFileSystem) GetPath(relPath string) string {
 	return filepath.Join(fs.Root, relPath)
 }
 
+// Where an entry is, relative to the mounts under Root.
+const (
+	onRootMount = iota
+	atNestedMount
+	beyondNestedMount
+)
+
+// mountPosition tells where name, on device dev, is. Entries are
+// only looked at if NoCrossMounts is set; otherwise they are all on
+// Root's mount.
+func (fs *loopbackFileSystem) mountPosition(name string, dev uint64) int {
+	if !fs.opts.NoCrossMounts || name == "" {
+		return onRootMount
+	}
+	fs.rootDevOnce.Do(func() {
+		st := syscall.Stat_t{}
+		if syscall.Stat(fs.Root, &st) == nil {
+			fs.rootDev = uint64(st.Dev)
+		}
+	})
+	if dev == fs.rootDev {
+		return onRootMount
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(filepath.Dir(fs.GetPath(name)), &st); err == nil && uint64(st.Dev) == fs.rootDev {
+		return atNestedMount
+	}
+	return beyondNestedMount
+}
+
+// nestedMountDir returns whether the open directory f is the root of
+// a mount that isn't crossed. Directories beyond one fail with
+// ENOENT.
+func (fs *loopbackFileSystem) nestedMountDir(f *os.File, name string) (bool, fuse.Status) {
+	if !fs.opts.NoCrossMounts {
+		return false, fuse.OK
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return false, fuse.ToStatus(err)
+	}
+	switch fs.mountPosition(name, uint64(st.Dev)) {
+	case atNestedMount:
+		return true, fuse.OK
+	case beyondNestedMount:
+		return false, fuse.ENOENT
+	}
+	return false, fuse.OK
+}
+
+// checkParent returns whether the entry name may be created, opened
+// or removed. With NoCrossMounts, a mount that isn't crossed is shown
+// as an empty directory that can't be changed, so this fails with
+// EACCES in it, and with ENOENT beyond it.
+func (fs *loopbackFileSystem) checkParent(name string) fuse.Status {
+	return fs.checkDir(filepath.Dir(name))
+}
+
+// checkRename is checkParent for both ends of a rename.
+func (fs *loopbackFileSystem) checkRename(oldPath string, newPath string) fuse.Status {
+	if code := fs.checkParent(oldPath); !code.Ok() {
+		return code
+	}
+	return fs.checkParent(newPath)
+}
+
+// checkDir is checkParent for an entry in dir.
+func (fs *loopbackFileSystem) checkDir(dir string) fuse.Status {
+	if !fs.opts.NoCrossMounts || dir == "" || dir == "." {
+		return fuse.OK
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(fs.GetPath(dir), &st); err != nil {
+		return fuse.ToStatus(err)
+	}
+	switch fs.mountPosition(dir, uint64(st.Dev)) {
+	case atNestedMount:
+		return fuse.EACCES
+	case beyondNestedMount:
+		return fuse.ENOENT
+	}
+	return fuse.OK
+}
+
 func (fs *loopbackFileSystem) GetAttr(name string, context *fuse.Context) (a *fuse.Attr, code fuse.Status) {
 	fullPath := fs.GetPath(name)
-	var err error = nil
 	st := syscall.Stat_t{}
-	if name == "" {
-		// When GetAttr is called for the toplevel directory, we always want
-		// to look through symlinks.
-		err = syscall.Stat(fullPath, &st)
-	} else {
-		err = syscall.Lstat(fullPath, &st)
-	}
+	err := fs.retryStale(func() error {
+		if name == "" {
+			// When GetAttr is called for the toplevel directory, we always want
+			// to look through symlinks.
+			return syscall.Stat(fullPath, &st)
+		}
+		return syscall.Lstat(fullPath, &st)
+	})
 
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	switch fs.mountPosition(name, uint64(st.Dev)) {
+	case atNestedMount:
+		if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return nil, fuse.ENOENT
+		}
+		// It has no subdirectories, as it is shown empty.
+		st.Nlink = 2
+	case beyondNestedMount:
+		return nil, fuse.ENOENT
+	}
 	a = &fuse.Attr{}
 	a.FromStat(&st)
 	return a, fuse.OK
@@ -60,29 +249,30 @@ func (fs *loopbackFileSystem) GetAttr(name string, context *fuse.Context) (a *fu
 func (fs *loopbackFileSystem) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, status fuse.Status) {
 	// What other ways beyond O_RDONLY are there to open
 	// directories?
-	f, err := os.Open(fs.GetPath(name))
+	f, err := fs.openFile(fs.GetPath(name), uint32(os.O_RDONLY), 0)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	defer f.Close()
+	if nested, code := fs.nestedMountDir(f, name); nested || !code.Ok() {
+		return nil, code
+	}
+	return fs.readDirEntries(f, name)
+}
+
+// readDirEntries returns all entries of the open directory f, up to
+// LoopbackOptions.MaxDirEntries.
+func (fs *loopbackFileSystem) readDirEntries(f *os.File, name string) ([]fuse.DirEntry, fuse.Status) {
 	want := 500
 	output := make([]fuse.DirEntry, 0, want)
 	for {
 		infos, err := f.Readdir(want)
-		for i := range infos {
-			// workaround forhttps://code.google.com/p/go/issues/detail?id=5960
-			if infos[i] == nil {
-				continue
-			}
-			n := infos[i].Name()
-			d := fuse.DirEntry{
-				Name: n,
-			}
-			if s := fuse.ToStatT(infos[i]); s != nil {
-				d.Mode = uint32(s.Mode)
-			} else {
-				log.Printf("ReadDir entry %q for %q has no stat info", n, name)
-			}
-			output = append(output, d)
+		output = appendDirEntries(output, infos, name)
+		if code := fs.checkDirEntries(len(output), name); !code.Ok() {
+			return nil, code
+		}
+		if max := fs.opts.MaxDirEntries; max > 0 && len(output) > max {
+			return output[:max], fuse.OK
 		}
 		if len(infos) < want || err == io.EOF {
 			break
@@ -92,30 +282,139 @@ func (fs *loopbackFileSystem) OpenDir(name string, context *fuse.Context) (strea
 			break
 		}
 	}
-	f.Close()
-
 	return output, fuse.OK
 }
 
+// checkDirEntries returns EFBIG if a listing of n entries is over
+// the limit and may not be truncated.
+func (fs *loopbackFileSystem) checkDirEntries(n int, name string) fuse.Status {
+	max := fs.opts.MaxDirEntries
+	if max <= 0 || n <= max {
+		return fuse.OK
+	}
+	if !fs.opts.TruncateDirs {
+		return fuse.EFBIG
+	}
+	log.Printf("directory %q has more than %d entries; truncating the listing", name, max)
+	return fuse.OK
+}
+
+// OpenDirFlags doesn't ask for directory caching: the backing
+// directory can change without going through the mount.
+func (fs *loopbackFileSystem) OpenDirFlags(name string, context *fuse.Context) uint32 {
+	return 0
+}
+
+func appendDirEntries(output []fuse.DirEntry, infos []os.FileInfo, name string) []fuse.DirEntry {
+	for i := range infos {
+		// workaround forhttps://code.google.com/p/go/issues/detail?id=5960
+		if infos[i] == nil {
+			continue
+		}
+		n := infos[i].Name()
+		d := fuse.DirEntry{
+			Name: n,
+		}
+		if s := fuse.ToStatT(infos[i]); s != nil {
+			d.Mode = uint32(s.Mode)
+		} else {
+			log.Printf("ReadDir entry %q for %q has no stat info", n, name)
+		}
+		output = append(output, d)
+	}
+	return output
+}
+
+// loopbackDirStream reads a directory as the kernel consumes it.
+type loopbackDirStream struct {
+	fs   *loopbackFileSystem
+	f    *os.File
+	name string
+
+	// count is the number of entries returned so far.
+	count int
+}
+
+func (fs *loopbackFileSystem) OpenDirStream(name string, context *fuse.Context) (nodefs.DirStream, fuse.Status) {
+	f, err := fs.openFile(fs.GetPath(name), uint32(os.O_RDONLY), 0)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	if nested, code := fs.nestedMountDir(f, name); nested || !code.Ok() {
+		f.Close()
+		if nested {
+			// OpenDir lists it as empty.
+			return nil, fuse.ENOSYS
+		}
+		return nil, code
+	}
+	return &loopbackDirStream{fs: fs, f: f, name: name}, fuse.OK
+}
+
+func (s *loopbackDirStream) Next(n int) ([]fuse.DirEntry, fuse.Status) {
+	max := s.fs.opts.MaxDirEntries
+	if max > 0 && s.count >= max {
+		// Look one entry ahead, to tell a full directory from one
+		// that is too large.
+		infos, _ := s.f.Readdir(1)
+		if len(appendDirEntries(nil, infos, s.name)) == 0 {
+			return nil, fuse.OK
+		}
+		if code := s.fs.checkDirEntries(s.count+1, s.name); !code.Ok() {
+			return nil, code
+		}
+		return nil, fuse.OK
+	}
+	for {
+		if max > 0 && n > max-s.count {
+			n = max - s.count
+		}
+		infos, err := s.f.Readdir(n)
+		output := appendDirEntries(nil, infos, s.name)
+		if len(output) > 0 || err == io.EOF {
+			s.count += len(output)
+			return output, fuse.OK
+		}
+		if err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+	}
+}
+
+func (s *loopbackDirStream) Close() {
+	s.f.Close()
+}
+
 func (fs *loopbackFileSystem) Open(name string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
-	f, err := os.OpenFile(fs.GetPath(name), int(flags), 0)
+	if code := fs.checkParent(name); !code.Ok() {
+		return nil, code
+	}
+	f, err := fs.openFile(fs.GetPath(name), flags, 0)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	return nodefs.NewLoopbackFile(f), fuse.OK
+	return fs.newFile(f), fuse.OK
 }
 
 func (fs *loopbackFileSystem) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	err := os.Chmod(fs.GetPath(path), os.FileMode(mode))
-	return fuse.ToStatus(err)
+	return fuse.ToStatus(fs.retryStale(func() error {
+		return os.Chmod(fs.GetPath(path), fuse.ToFileMode(mode))
+	}))
 }
 
 func (fs *loopbackFileSystem) Chown(path string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(os.Chown(fs.GetPath(path), int(uid), int(gid)))
+	return fuse.ToStatus(fs.retryStale(func() error {
+		return os.Lchown(fs.GetPath(path), int(uid), int(gid))
+	}))
 }
 
 func (fs *loopbackFileSystem) Truncate(path string, offset uint64, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(os.Truncate(fs.GetPath(path), int64(offset)))
+	if fs.opts.MaxFileSize > 0 && offset > uint64(fs.opts.MaxFileSize) {
+		return fuse.EFBIG
+	}
+	return fuse.ToStatus(fs.retryStale(func() error {
+		return os.Truncate(fs.GetPath(path), int64(offset))
+	}))
 }
 
 func (fs *loopbackFileSystem) Utimens(path string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
@@ -127,49 +426,107 @@ func (fs *loopbackFileSystem) Utimens(path string, Atime *time.Time, Mtime *time
 	if Mtime != nil {
 		m = *Mtime
 	}
-	return fuse.ToStatus(os.Chtimes(fs.GetPath(path), a, m))
+	return fuse.ToStatus(fs.retryStale(func() error {
+		return os.Chtimes(fs.GetPath(path), a, m)
+	}))
 }
 
 func (fs *loopbackFileSystem) Readlink(name string, context *fuse.Context) (out string, code fuse.Status) {
-	f, err := os.Readlink(fs.GetPath(name))
-	return f, fuse.ToStatus(err)
+	err := fs.retryStale(func() (err error) {
+		out, err = os.Readlink(fs.GetPath(name))
+		return err
+	})
+	return out, fuse.ToStatus(err)
+}
+
+// CanonicalPath returns the path of the backing file, which is
+// absolute if the loopback's root is.
+func (fs *loopbackFileSystem) CanonicalPath(name string, context *fuse.Context) (path string, code fuse.Status) {
+	return fs.GetPath(name), fuse.OK
 }
 
 func (fs *loopbackFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(syscall.Mknod(fs.GetPath(name), mode, int(dev)))
+	if code := fs.checkParent(name); !code.Ok() {
+		return code
+	}
+	return fuse.ToStatus(fs.create(func() error {
+		return fs.retryStale(func() error {
+			return syscall.Mknod(fs.GetPath(name), mode, int(dev))
+		})
+	}))
 }
 
 func (fs *loopbackFileSystem) Mkdir(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(os.Mkdir(fs.GetPath(path), os.FileMode(mode)))
+	if code := fs.checkParent(path); !code.Ok() {
+		return code
+	}
+	return fuse.ToStatus(fs.create(func() error {
+		return fs.retryStale(func() error {
+			return os.Mkdir(fs.GetPath(path), fuse.ToFileMode(mode))
+		})
+	}))
 }
 
 // Don't use os.Remove, it removes twice (unlink followed by rmdir).
 func (fs *loopbackFileSystem) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(syscall.Unlink(fs.GetPath(name)))
+	if code := fs.checkParent(name); !code.Ok() {
+		return code
+	}
+	return fuse.ToStatus(fs.retryStale(func() error {
+		return syscall.Unlink(fs.GetPath(name))
+	}))
 }
 
 func (fs *loopbackFileSystem) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(syscall.Rmdir(fs.GetPath(name)))
+	if code := fs.checkParent(name); !code.Ok() {
+		return code
+	}
+	return fuse.ToStatus(fs.retryStale(func() error {
+		return syscall.Rmdir(fs.GetPath(name))
+	}))
 }
 
 func (fs *loopbackFileSystem) Symlink(pointedTo string, linkName string, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(os.Symlink(pointedTo, fs.GetPath(linkName)))
+	if code := fs.checkParent(linkName); !code.Ok() {
+		return code
+	}
+	return fuse.ToStatus(fs.retryStale(func() error {
+		return os.Symlink(pointedTo, fs.GetPath(linkName))
+	}))
 }
 
 func (fs *loopbackFileSystem) Rename(oldPath string, newPath string, context *fuse.Context) (codee fuse.Status) {
-	err := os.Rename(fs.GetPath(oldPath), fs.GetPath(newPath))
-	return fuse.ToStatus(err)
+	if code := fs.checkRename(oldPath, newPath); !code.Ok() {
+		return code
+	}
+	return fuse.ToStatus(fs.retryStale(func() error {
+		return os.Rename(fs.GetPath(oldPath), fs.GetPath(newPath))
+	}))
 }
 
 func (fs *loopbackFileSystem) Link(orig string, newName string, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(os.Link(fs.GetPath(orig), fs.GetPath(newName)))
+	if code := fs.checkParent(newName); !code.Ok() {
+		return code
+	}
+	return fuse.ToStatus(fs.retryStale(func() error {
+		return os.Link(fs.GetPath(orig), fs.GetPath(newName))
+	}))
 }
 
 func (fs *loopbackFileSystem) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	return fuse.ToStatus(syscall.Access(fs.GetPath(name), mode))
+	return fuse.ToStatus(fs.retryStale(func() error {
+		return syscall.Access(fs.GetPath(name), mode)
+	}))
 }
 
 func (fs *loopbackFileSystem) Create(path string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, code fuse.Status) {
-	f, err := os.OpenFile(fs.GetPath(path), int(flags)|os.O_CREATE, os.FileMode(mode))
-	return nodefs.NewLoopbackFile(f), fuse.ToStatus(err)
+	if code := fs.checkParent(path); !code.Ok() {
+		return nil, code
+	}
+	var f *os.File
+	err := fs.create(func() (err error) {
+		f, err = fs.openFile(fs.GetPath(path), flags|uint32(os.O_CREATE), fuse.ToFileMode(mode))
+		return err
+	})
+	return fs.newFile(f), fuse.ToStatus(err)
 }
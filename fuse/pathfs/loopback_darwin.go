@@ -6,6 +6,25 @@ import (
 	"github.com/hanwen/go-fuse/fuse"
 )
 
+// OSX has no O_NOATIME.
+const _O_NOATIME = 0
+
+// _MNT_RDONLY is the statfs(2) flag of read-only mounts.
+const _MNT_RDONLY = 1
+
+// ReadOnly returns whether the backing directory is on a read-only
+// mount.
+func (fs *loopbackFileSystem) ReadOnly() bool {
+	var s syscall.Statfs_t
+	return syscall.Statfs(fs.Root, &s) == nil && s.Flags&_MNT_RDONLY != 0
+}
+
+// Capabilities declares the optional operations of the loopback.
+// Extended attributes are not supported on OSX.
+func (fs *loopbackFileSystem) Capabilities() fuse.CapSet {
+	return fuse.CapFsync | fuse.CapFallocate
+}
+
 func (fs *loopbackFileSystem) StatFs(name string) *fuse.StatfsOut {
 	s := syscall.Statfs_t{}
 	err := syscall.Statfs(fs.GetPath(name), &s)
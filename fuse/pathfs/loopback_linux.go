@@ -2,14 +2,229 @@ package pathfs
 
 import (
 	"fmt"
+	"os"
+	"runtime"
 	"syscall"
+	"unsafe"
 
 	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
 )
 
+const _O_NOATIME = syscall.O_NOATIME
+
+// _ST_RDONLY is the statfs(2) flag of read-only mounts.
+const _ST_RDONLY = 1
+
+// sysRenameat2 is the renameat2(2) syscall number, which the syscall
+// package doesn't have. It is 0 on architectures we don't know, and
+// renames with flags then fail with EINVAL.
+var sysRenameat2 = map[string]uintptr{
+	"386":     353,
+	"amd64":   316,
+	"arm":     382,
+	"arm64":   276,
+	"ppc64":   357,
+	"ppc64le": 357,
+	"riscv64": 276,
+	"s390x":   347,
+}[runtime.GOARCH]
+
+// _AT_FDCWD makes *at syscalls resolve relative paths from the
+// working directory.
+const _AT_FDCWD = -100
+
+func renameat2(oldPath string, newPath string, flags uint32) fuse.Status {
+	if sysRenameat2 == 0 {
+		return fuse.EINVAL
+	}
+	oldp, err := syscall.BytePtrFromString(oldPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	newp, err := syscall.BytePtrFromString(newPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	fd := _AT_FDCWD
+	_, _, errno := syscall.Syscall6(sysRenameat2,
+		uintptr(fd), uintptr(unsafe.Pointer(oldp)),
+		uintptr(fd), uintptr(unsafe.Pointer(newp)),
+		uintptr(flags), 0)
+	switch errno {
+	case 0:
+		return fuse.OK
+	case syscall.ENOSYS:
+		// Kernels before 3.15.
+		return fuse.EINVAL
+	}
+	return fuse.ToStatus(errno)
+}
+
+// Rename2 renames with renameat2(2). RENAME_WHITEOUT leaves a
+// whiteout, a character device 0/0, at oldPath, and needs the
+// CAP_MKNOD capability. Backing file systems that don't support a
+// flag return EINVAL.
+func (fs *loopbackFileSystem) Rename2(oldPath string, newPath string, flags uint32, context *fuse.Context) fuse.Status {
+	if code := fs.checkRename(oldPath, newPath); !code.Ok() {
+		return code
+	}
+	code := renameat2(fs.GetPath(oldPath), fs.GetPath(newPath), flags)
+	if fs.opts.RetryStale && code == fuse.Status(syscall.ESTALE) {
+		code = renameat2(fs.GetPath(oldPath), fs.GetPath(newPath), flags)
+	}
+	return code
+}
+
+// _O_TMPFILE is O_TMPFILE from <fcntl.h>, which includes
+// O_DIRECTORY.
+const _O_TMPFILE = 020000000 | syscall.O_DIRECTORY
+
+// _AT_SYMLINK_FOLLOW makes linkat(2) follow a symlink in the source,
+// here the /proc/self/fd entry of an O_TMPFILE file.
+const _AT_SYMLINK_FOLLOW = 0x400
+
+// loopbackTmpfile is a file opened with O_TMPFILE. LinkTmpfile needs
+// its descriptor.
+type loopbackTmpfile struct {
+	nodefs.File
+	f *os.File
+}
+
+func (f *loopbackTmpfile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (fs *loopbackFileSystem) tmpfile(dirPath string, flags uint32, mode uint32) (nodefs.File, fuse.Status) {
+	var f *os.File
+	err := fs.create(func() (err error) {
+		flags := flags&^uint32(os.O_CREATE|os.O_EXCL) | _O_TMPFILE
+		f, err = fs.openFile(dirPath, flags, fuse.ToFileMode(mode))
+		return err
+	})
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return &loopbackTmpfile{fs.newFile(f), f}, fuse.OK
+}
+
+// Tmpfile opens an unnamed file in dir with O_TMPFILE. Backing file
+// systems without support for it return EOPNOTSUPP.
+func (fs *loopbackFileSystem) Tmpfile(dir string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if code := fs.checkDir(dir); !code.Ok() {
+		return nil, code
+	}
+	return fs.tmpfile(fs.GetPath(dir), flags, mode)
+}
+
+// findTmpfile returns the loopbackTmpfile that file wraps, or nil.
+func findTmpfile(file nodefs.File) *loopbackTmpfile {
+	for file != nil {
+		if t, ok := file.(*loopbackTmpfile); ok {
+			return t
+		}
+		file = file.InnerFile()
+	}
+	return nil
+}
+
+// linkTmpfile links the file open as f to dst.
+func linkTmpfile(f *os.File, dst string) fuse.Status {
+	src, err := syscall.BytePtrFromString(procFdPath(int(f.Fd())))
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	dstp, err := syscall.BytePtrFromString(dst)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	fd := _AT_FDCWD
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT,
+		uintptr(fd), uintptr(unsafe.Pointer(src)),
+		uintptr(fd), uintptr(unsafe.Pointer(dstp)),
+		_AT_SYMLINK_FOLLOW, 0)
+	runtime.KeepAlive(f)
+	return fuse.ToStatus(errno)
+}
+
+func (fs *loopbackFileSystem) LinkTmpfile(file nodefs.File, name string, context *fuse.Context) fuse.Status {
+	t := findTmpfile(file)
+	if t == nil {
+		return fuse.EINVAL
+	}
+	if code := fs.checkParent(name); !code.Ok() {
+		return code
+	}
+	return linkTmpfile(t.f, fs.GetPath(name))
+}
+
+// _FS_IOC_GETFLAGS is _IOR('f', 1, long) from <linux/fs.h>.
+const _FS_IOC_GETFLAGS = 2<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 1
+
+// statxInodeFlags are the inode flags that are also STATX_ATTR_*
+// bits.
+const statxInodeFlags = fuse.STATX_ATTR_COMPRESSED | fuse.STATX_ATTR_IMMUTABLE |
+	fuse.STATX_ATTR_APPEND | fuse.STATX_ATTR_NODUMP | fuse.STATX_ATTR_ENCRYPTED
+
+// StatxAttributes reports the inode flags of the backing file, as
+// chattr(1) sets them. Only regular files and directories are
+// opened to read them; other files, and backing file systems without
+// inode flags, report none.
+func (fs *loopbackFileSystem) StatxAttributes(name string, context *fuse.Context) (uint64, uint64, fuse.Status) {
+	path := fs.GetPath(name)
+	st := syscall.Stat_t{}
+	var err error
+	if name == "" {
+		err = syscall.Stat(path, &st)
+	} else {
+		err = syscall.Lstat(path, &st)
+	}
+	if err != nil {
+		return 0, 0, fuse.ToStatus(err)
+	}
+	if !hasInodeFlags(st.Mode) {
+		return 0, 0, fuse.OK
+	}
+	flags := syscall.O_RDONLY | syscall.O_NONBLOCK | syscall.O_NOCTTY | syscall.O_CLOEXEC
+	if name != "" {
+		flags |= syscall.O_NOFOLLOW
+	}
+	fd, err := syscall.Open(path, flags, 0)
+	if err != nil {
+		return 0, 0, fuse.OK
+	}
+	defer syscall.Close(fd)
+	return inodeAttributes(fd)
+}
+
+func hasInodeFlags(mode uint32) bool {
+	t := mode & syscall.S_IFMT
+	return t == syscall.S_IFREG || t == syscall.S_IFDIR
+}
+
+// inodeAttributes reads the inode flags of the open fd.
+func inodeAttributes(fd int) (uint64, uint64, fuse.Status) {
+	var flags uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), _FS_IOC_GETFLAGS, uintptr(unsafe.Pointer(&flags))); errno != 0 {
+		return 0, 0, fuse.OK
+	}
+	return uint64(flags) & statxInodeFlags, statxInodeFlags, fuse.OK
+}
+
 func (fs *loopbackFileSystem) StatFs(name string) *fuse.StatfsOut {
+	return statFs(fs.GetPath(name))
+}
+
+// ReadOnly returns whether the backing directory is on a read-only
+// mount.
+func (fs *loopbackFileSystem) ReadOnly() bool {
+	var s syscall.Statfs_t
+	return syscall.Statfs(fs.Root, &s) == nil && s.Flags&_ST_RDONLY != 0
+}
+
+func statFs(path string) *fuse.StatfsOut {
 	s := syscall.Statfs_t{}
-	err := syscall.Statfs(fs.GetPath(name), &s)
+	err := syscall.Statfs(path, &s)
 	if err == nil {
 		return &fuse.StatfsOut{
 			Blocks:  s.Blocks,
@@ -26,14 +241,33 @@ func (fs *loopbackFileSystem) StatFs(name string) *fuse.StatfsOut {
 }
 
 func (fs *loopbackFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
-	data, err := listXAttr(fs.GetPath(name))
-
+	var data []string
+	err := fs.retryStale(func() (err error) {
+		data, err = listXAttr(fs.GetPath(name))
+		return err
+	})
 	return data, fuse.ToStatus(err)
 }
 
 func (fs *loopbackFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
-	err := sysRemovexattr(fs.GetPath(name), attr)
-	return fuse.ToStatus(err)
+	return fuse.ToStatus(fs.retryStale(func() error {
+		return sysRemovexattr(fs.GetPath(name), attr)
+	}))
+}
+
+func (fs *loopbackFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	// POSIX ACLs are passed on in the kernel's binary format, so
+	// the backing file system interprets them.
+	return fuse.ToStatus(fs.retryStale(func() error {
+		return sysSetxattr(fs.GetPath(name), attr, data, flags)
+	}))
+}
+
+// Capabilities declares the optional operations of the loopback. It
+// doesn't pass on ioctls.
+func (fs *loopbackFileSystem) Capabilities() fuse.CapSet {
+	return fuse.CapXAttr | fuse.CapFsync | fuse.CapFallocate | fuse.CapCopyFileRange |
+		fuse.CapRename2 | fuse.CapTmpfile | fuse.CapStatx
 }
 
 func (fs *loopbackFileSystem) String() string {
@@ -41,8 +275,10 @@ func (fs *loopbackFileSystem) String() string {
 }
 
 func (fs *loopbackFileSystem) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
-	data := make([]byte, 1024)
-	data, err := getXAttr(fs.GetPath(name), attr, data)
-
+	var data []byte
+	err := fs.retryStale(func() (err error) {
+		data, err = getXAttr(fs.GetPath(name), attr, make([]byte, 1024))
+		return err
+	})
 	return data, fuse.ToStatus(err)
 }
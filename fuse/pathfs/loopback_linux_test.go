@@ -0,0 +1,758 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// _FS_IOC_SETFLAGS is _IOW('f', 2, long) from <linux/fs.h>.
+const _FS_IOC_SETFLAGS = 1<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 2
+
+func setInodeFlags(path string, flags uint32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), _FS_IOC_SETFLAGS, uintptr(unsafe.Pointer(&flags))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func TestLoopbackStatxImmutable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-statx")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := setInodeFlags(path, fuse.STATX_ATTR_IMMUTABLE); err != nil {
+		t.Skipf("can't make file immutable: %v", err)
+	}
+	defer setInodeFlags(path, 0)
+
+	fss := []FileSystem{NewLoopbackFileSystem(dir)}
+	if confined, err := NewConfinedLoopbackFileSystem(dir); err == nil {
+		fss = append(fss, confined)
+	}
+	for _, fs := range fss {
+		checkStatxImmutable(t, fs, path)
+	}
+}
+
+// checkStatxImmutable checks that fs reports the immutable flag of
+// "file" at path through STATX, and stops when it is cleared.
+func checkStatxImmutable(t *testing.T, fs FileSystem, path string) {
+	if err := setInodeFlags(path, fuse.STATX_ATTR_IMMUTABLE); err != nil {
+		t.Fatalf("setting flags: %v", err)
+	}
+	pfs := NewPathNodeFs(fs, nil)
+	rawFS := nodefs.NewFileSystemConnector(pfs.Root(), nil).RawFS()
+
+	var entry fuse.EntryOut
+	if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "file", &entry); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	in := fuse.StatxIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}
+	var out fuse.StatxOut
+	if code := rawFS.Statx(&in, &out); !code.Ok() {
+		t.Fatalf("%v: Statx: %v", fs, code)
+	}
+	if out.Stat.Size != 5 || out.Stat.Mask&fuse.STATX_BASIC_STATS != fuse.STATX_BASIC_STATS {
+		t.Errorf("%v: Statx: got size %d, mask 0x%x", fs, out.Stat.Size, out.Stat.Mask)
+	}
+	if out.Stat.AttributesMask&fuse.STATX_ATTR_IMMUTABLE == 0 || out.Stat.Attributes&fuse.STATX_ATTR_IMMUTABLE == 0 {
+		t.Errorf("%v: Statx: immutable not reported: attributes 0x%x, mask 0x%x",
+			fs, out.Stat.Attributes, out.Stat.AttributesMask)
+	}
+
+	if err := setInodeFlags(path, 0); err != nil {
+		t.Fatalf("clearing flags: %v", err)
+	}
+	out = fuse.StatxOut{}
+	if code := rawFS.Statx(&in, &out); !code.Ok() {
+		t.Fatalf("%v: Statx: %v", fs, code)
+	}
+	if out.Stat.Attributes&fuse.STATX_ATTR_IMMUTABLE != 0 {
+		t.Errorf("%v: Statx: immutable still reported after clearing it", fs)
+	}
+}
+
+// sysStatx is the statx(2) syscall number, or 0 if we don't know it.
+var sysStatx = map[string]uintptr{
+	"386":   383,
+	"amd64": 332,
+	"arm":   397,
+	"arm64": 291,
+}[runtime.GOARCH]
+
+func TestLoopbackStatxMount(t *testing.T) {
+	if sysStatx == 0 {
+		t.Skip("no statx on this architecture")
+	}
+	orig, err := ioutil.TempDir("", "go-fuse-statx")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	if err := ioutil.WriteFile(filepath.Join(orig, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// Without StatxFileSystem, STATX fails with ENOSYS and the
+	// kernel falls back to GETATTR.
+	for _, fs := range []FileSystem{NewLoopbackFileSystem(orig), struct{ FileSystem }{NewLoopbackFileSystem(orig)}} {
+		rawFS, id := rename2RawFS(t, fs, "file")
+		var out fuse.StatxOut
+		code := rawFS.Statx(&fuse.StatxIn{InHeader: fuse.InHeader{NodeId: id}}, &out)
+		want := fuse.ENOSYS
+		if _, ok := fs.(StatxFileSystem); ok {
+			want = fuse.OK
+		}
+		if code != want {
+			t.Errorf("%v: Statx: got %v, want %v", fs, code, want)
+		}
+
+		dir, clean := directMount(t, fs)
+		var st fuse.Statx
+		path, _ := syscall.BytePtrFromString(filepath.Join(dir, "file"))
+		fd := _AT_FDCWD
+		_, _, errno := syscall.Syscall6(sysStatx, uintptr(fd), uintptr(unsafe.Pointer(path)),
+			_AT_STATX_FORCE_SYNC, fuse.STATX_BASIC_STATS|fuse.STATX_BTIME, uintptr(unsafe.Pointer(&st)), 0)
+		clean()
+		if errno != 0 {
+			t.Fatalf("%v: statx through the mount: %v", fs, errno)
+		}
+		if st.Size != 5 || st.Mask&fuse.STATX_BASIC_STATS != fuse.STATX_BASIC_STATS {
+			t.Errorf("%v: statx through the mount: got size %d, mask 0x%x", fs, st.Size, st.Mask)
+		}
+	}
+}
+
+// _AT_STATX_FORCE_SYNC makes statx(2) ask the file system.
+const _AT_STATX_FORCE_SYNC = 0x2000
+
+func TestLoopbackCopyFileRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-copyrange")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "src"), []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dst"), []byte("abcdefghij"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(dir), nil)
+	rawFS := nodefs.NewFileSystemConnector(pfs.Root(), nil).RawFS()
+	open := func(name string, flags int) (nodeID, fh uint64) {
+		var entry fuse.EntryOut
+		if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, name, &entry); !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, code)
+		}
+		var out fuse.OpenOut
+		in := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Flags: uint32(flags)}
+		if code := rawFS.Open(&in, &out); !code.Ok() {
+			t.Fatalf("Open(%q): %v", name, code)
+		}
+		return entry.NodeId, out.Fh
+	}
+	srcID, srcFh := open("src", os.O_RDONLY)
+	dstID, dstFh := open("dst", os.O_WRONLY)
+
+	in := fuse.CopyFileRangeIn{
+		InHeader:  fuse.InHeader{NodeId: srcID},
+		FhIn:      srcFh,
+		OffIn:     2,
+		NodeIdOut: dstID,
+		FhOut:     dstFh,
+		OffOut:    4,
+		Len:       3,
+	}
+	n, code := rawFS.CopyFileRange(&in)
+	if code == fuse.EOPNOTSUPP || code == fuse.EXDEV {
+		t.Skipf("copy_file_range not supported here: %v", code)
+	}
+	if !code.Ok() || n != 3 {
+		t.Fatalf("CopyFileRange: got %d, %v; want 3, OK", n, code)
+	}
+	for _, h := range []struct{ id, fh uint64 }{{srcID, srcFh}, {dstID, dstFh}} {
+		rawFS.Release(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: h.id}, Fh: h.fh})
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(got) != "abcd234hij" {
+		t.Errorf("dst: got %q, want %q", got, "abcd234hij")
+	}
+}
+
+func TestLoopbackRenameWhiteout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-whiteout")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fss := []FileSystem{NewLoopbackFileSystem(dir)}
+	if confined, err := NewConfinedLoopbackFileSystem(dir); err == nil {
+		fss = append(fss, confined)
+	}
+	for _, fs := range fss {
+		checkRenameWhiteout(t, fs, dir)
+	}
+
+	// Without Rename2, flags are refused.
+	if err := ioutil.WriteFile(filepath.Join(dir, "plain"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	rawFS, _ := rename2RawFS(t, struct{ FileSystem }{NewLoopbackFileSystem(dir)}, "plain")
+	in := fuse.Rename2In{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, Newdir: fuse.FUSE_ROOT_ID, Flags: fuse.RENAME_WHITEOUT}
+	if code := rawFS.Rename2(&in, "plain", "moved"); code != fuse.EINVAL {
+		t.Errorf("Rename2 without Rename2FileSystem: got %v, want EINVAL", code)
+	}
+}
+
+func TestLoopbackRename2Mount(t *testing.T) {
+	if sysRenameat2 == 0 {
+		t.Skip("no renameat2 on this architecture")
+	}
+	orig, err := ioutil.TempDir("", "go-fuse-rename2")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	for name, content := range map[string]string{"a": "A", "b": "B"} {
+		if err := ioutil.WriteFile(filepath.Join(orig, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	dir, clean := directMount(t, NewLoopbackFileSystem(orig))
+	defer clean()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+
+	if code := renameat2(a, b, fuse.RENAME_NOREPLACE); code != fuse.Status(syscall.EEXIST) {
+		t.Errorf("RENAME_NOREPLACE onto a file: got %v, want EEXIST", code)
+	}
+	if code := renameat2(a, b, fuse.RENAME_EXCHANGE); !code.Ok() {
+		t.Fatalf("RENAME_EXCHANGE: %v", code)
+	}
+	// Opening files on the mount from this process would stall in
+	// epoll_ctl on a single CPU, so check the backing files.
+	for name, want := range map[string]string{"a": "B", "b": "A"} {
+		if got, err := ioutil.ReadFile(filepath.Join(orig, name)); err != nil || string(got) != want {
+			t.Errorf("after exchange, %s: got %q, %v; want %q", name, got, err, want)
+		}
+	}
+	c := filepath.Join(dir, "c")
+	if code := renameat2(a, c, fuse.RENAME_NOREPLACE); !code.Ok() {
+		t.Fatalf("RENAME_NOREPLACE onto nothing: %v", code)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(orig, "c")); err != nil || string(got) != "B" {
+		t.Errorf("backing c: got %q, %v; want \"B\"", got, err)
+	}
+}
+
+// rename2RawFS serves fs, and looks up name so it can be renamed.
+func rename2RawFS(t *testing.T, fs FileSystem, name string) (fuse.RawFileSystem, uint64) {
+	rawFS := nodefs.NewFileSystemConnector(NewPathNodeFs(fs, nil).Root(), nil).RawFS()
+	var entry fuse.EntryOut
+	if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, name, &entry); !code.Ok() {
+		t.Fatalf("Lookup(%q): %v", name, code)
+	}
+	return rawFS, entry.NodeId
+}
+
+// checkRenameWhiteout renames "src" in dir to "dst" through fs with
+// RENAME_WHITEOUT, and checks that a whiteout is left at "src".
+func checkRenameWhiteout(t *testing.T, fs FileSystem, dir string) {
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	os.Remove(src)
+	os.Remove(dst)
+	if err := ioutil.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	rawFS, id := rename2RawFS(t, fs, "src")
+
+	in := fuse.Rename2In{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, Newdir: fuse.FUSE_ROOT_ID, Flags: fuse.RENAME_WHITEOUT}
+	code := rawFS.Rename2(&in, "src", "dst")
+	if code == fuse.EPERM || code == fuse.EINVAL {
+		t.Skipf("%v: RENAME_WHITEOUT not supported here: %v", fs, code)
+	}
+	if !code.Ok() {
+		t.Fatalf("%v: Rename2: %v", fs, code)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(src, &st); err != nil {
+		t.Fatalf("%v: no whiteout at the source: %v", fs, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("%v: source: got mode 0%o, rdev %d; want a 0/0 character device", fs, st.Mode, st.Rdev)
+	}
+	if got, err := ioutil.ReadFile(dst); err != nil || string(got) != "hello" {
+		t.Errorf("%v: target: got %q, %v", fs, got, err)
+	}
+
+	// The renamed node now lives at dst, and src looks up the
+	// whiteout.
+	var entry fuse.EntryOut
+	if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "dst", &entry); !code.Ok() || entry.NodeId != id {
+		t.Errorf("%v: Lookup(dst): got node %d, %v; want %d", fs, entry.NodeId, code, id)
+	}
+	if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "src", &entry); !code.Ok() || entry.Attr.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+		t.Errorf("%v: Lookup(src): got mode 0%o, %v; want a character device", fs, entry.Attr.Mode, code)
+	}
+}
+
+func TestLoopbackGetAttrFh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-getattrfh")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	rawFS := nodefs.NewFileSystemConnector(NewPathNodeFs(NewLoopbackFileSystem(dir), nil).Root(), nil).RawFS()
+	var entry fuse.EntryOut
+	if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "file", &entry); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	var open fuse.OpenOut
+	openIn := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Flags: uint32(os.O_RDONLY)}
+	if code := rawFS.Open(&openIn, &open); !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+
+	// Rename and shrink the backing file behind the mount's back,
+	// so the path the node has is stale.
+	moved := filepath.Join(dir, "moved")
+	if err := os.Rename(filepath.Join(dir, "file"), moved); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := os.Truncate(moved, 7); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+
+	var out fuse.AttrOut
+	in := fuse.GetAttrIn{InHeader: openIn.InHeader, Flags_: fuse.FUSE_GETATTR_FH, Fh_: open.Fh}
+	if code := rawFS.GetAttr(&in, &out); !code.Ok() || out.Size != 7 {
+		t.Errorf("GetAttr with handle: got size %d, %v, want 7, OK", out.Size, code)
+	}
+
+	// Without open files, the stale path is all there is.
+	rawFS.Release(&fuse.ReleaseIn{InHeader: openIn.InHeader, Fh: open.Fh})
+	in = fuse.GetAttrIn{InHeader: openIn.InHeader}
+	if code := rawFS.GetAttr(&in, &out); code != fuse.ENOENT {
+		t.Errorf("GetAttr by path: got %v, want ENOENT", code)
+	}
+}
+
+func TestLoopbackRenamedHandle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-renamedhandle")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	rawFS := nodefs.NewFileSystemConnector(NewPathNodeFs(NewLoopbackFileSystem(dir), nil).Root(), nil).RawFS()
+	var entry fuse.EntryOut
+	if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "file", &entry); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	header := fuse.InHeader{NodeId: entry.NodeId}
+	open := func(flags int) uint64 {
+		var out fuse.OpenOut
+		if code := rawFS.Open(&fuse.OpenIn{InHeader: header, Flags: uint32(flags)}, &out); !code.Ok() {
+			t.Fatalf("Open: %v", code)
+		}
+		return out.Fh
+	}
+	rw, ro := open(os.O_RDWR), open(os.O_RDONLY)
+
+	// Rename behind the mount's back, so the node's path is stale.
+	moved := filepath.Join(dir, "moved")
+	if err := os.Rename(filepath.Join(dir, "file"), moved); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if n, code := rawFS.Write(&fuse.WriteIn{InHeader: header, Fh: rw, Offset: 5}, []byte(" world")); !code.Ok() || n != 6 {
+		t.Errorf("Write: got %d, %v", n, code)
+	}
+	if code := rawFS.Fsync(&fuse.FsyncIn{InHeader: header, Fh: rw}); !code.Ok() {
+		t.Errorf("Fsync: %v", code)
+	}
+	buf := make([]byte, 32)
+	res, code := rawFS.Read(&fuse.ReadIn{InHeader: header, Fh: ro, Size: uint32(len(buf))}, buf)
+	if !code.Ok() {
+		t.Fatalf("Read: %v", code)
+	}
+	if data, _ := res.Bytes(buf); string(data) != "hello world" {
+		t.Errorf("Read: got %q, want %q", data, "hello world")
+	}
+
+	var out fuse.AttrOut
+	in := &fuse.SetAttrIn{}
+	in.InHeader = header
+	in.Valid = fuse.FATTR_FH | fuse.FATTR_SIZE
+	in.Fh, in.Size = rw, 5
+	if code := rawFS.SetAttr(in, &out); !code.Ok() || out.Size != 5 {
+		t.Errorf("truncate: got size %d, %v, want 5, OK", out.Size, code)
+	}
+	rawFS.Release(&fuse.ReleaseIn{InHeader: header, Fh: rw})
+	if fi, err := os.Stat(moved); err != nil || fi.Size() != 5 {
+		t.Errorf("backing file: got %v, want size 5", err)
+	}
+	rawFS.Release(&fuse.ReleaseIn{InHeader: header, Fh: ro})
+}
+
+func TestLoopbackTmpfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-tmpfile")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rawFS := nodefs.NewFileSystemConnector(NewPathNodeFs(NewLoopbackFileSystem(dir), nil).Root(), nil).RawFS()
+	var out fuse.CreateOut
+	in := &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, Flags: uint32(os.O_RDWR), Mode: 0644}
+	code := rawFS.Tmpfile(in, &out)
+	if code == fuse.EOPNOTSUPP {
+		t.Skip("backing file system does not support O_TMPFILE")
+	}
+	if !code.Ok() {
+		t.Fatalf("Tmpfile: %v", code)
+	}
+	if out.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		t.Errorf("Tmpfile: got mode %o, want a regular file", out.Mode)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("unlinked file is visible: %v", entries)
+	}
+
+	header := fuse.InHeader{NodeId: out.NodeId}
+	if n, code := rawFS.Write(&fuse.WriteIn{InHeader: header, Fh: out.Fh}, []byte("hello")); !code.Ok() || n != 5 {
+		t.Errorf("Write: got %d, %v", n, code)
+	}
+
+	var entry fuse.EntryOut
+	link := &fuse.LinkIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, Oldnodeid: out.NodeId}
+	if code := rawFS.Link(link, "named", &entry); !code.Ok() {
+		t.Fatalf("Link: %v", code)
+	}
+	if entry.NodeId != out.NodeId || entry.Size != 5 {
+		t.Errorf("Link: got node %d size %d, want node %d size 5", entry.NodeId, entry.Size, out.NodeId)
+	}
+	rawFS.Release(&fuse.ReleaseIn{InHeader: header, Fh: out.Fh})
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "named")); err != nil || string(data) != "hello" {
+		t.Errorf("ReadFile: got %q, %v, want %q", data, err, "hello")
+	}
+	var lookup fuse.EntryOut
+	if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "named", &lookup); !code.Ok() || lookup.NodeId != out.NodeId {
+		t.Errorf("Lookup: got node %d, %v, want %d", lookup.NodeId, code, out.NodeId)
+	}
+}
+
+func TestLoopbackNoCrossMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-nocross")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	mnt := filepath.Join(dir, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	// A fresh tmpfs has a device of its own; a bind mount from the
+	// same file system would not.
+	if err := syscall.Mount("none", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("mount tmpfs: %v", err)
+	}
+	defer syscall.Unmount(mnt, 0)
+	if err := os.Mkdir(filepath.Join(mnt, "sub"), 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mnt, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	for _, noCross := range []bool{false, true} {
+		fs := NewLoopbackFileSystemWithOptions(dir, &LoopbackOptions{NoCrossMounts: noCross})
+		a, code := fs.GetAttr("mnt", nil)
+		if !code.Ok() || !a.IsDir() {
+			t.Fatalf("NoCrossMounts %v: GetAttr(mnt): got %v, %v", noCross, a, code)
+		}
+		entries, code := fs.OpenDir("mnt", nil)
+		if !code.Ok() {
+			t.Fatalf("NoCrossMounts %v: OpenDir(mnt): %v", noCross, code)
+		}
+		_, fileCode := fs.GetAttr("mnt/file", nil)
+		_, subCode := fs.OpenDir("mnt/sub", nil)
+		if noCross {
+			if len(entries) != 0 || fileCode != fuse.ENOENT || subCode != fuse.ENOENT {
+				t.Errorf("NoCrossMounts: got %d entries, %v, %v; want an empty, opaque mount", len(entries), fileCode, subCode)
+			}
+			if a.Nlink != 2 {
+				t.Errorf("NoCrossMounts: got Nlink %d, want 2", a.Nlink)
+			}
+			// Streams fall back to the empty OpenDir.
+			if _, code := fs.(DirStreamFileSystem).OpenDirStream("mnt", nil); code != fuse.ENOSYS {
+				t.Errorf("NoCrossMounts: OpenDirStream(mnt): got %v, want ENOSYS", code)
+			}
+
+			// The empty directory can't be changed, and what
+			// is beyond it stays hidden.
+			for name, want := range map[string]fuse.Status{"mnt/new": fuse.EACCES, "mnt/sub/new": fuse.ENOENT} {
+				if _, code := fs.Create(name, uint32(os.O_WRONLY), 0644, nil); code != want {
+					t.Errorf("NoCrossMounts: Create(%q): got %v, want %v", name, code, want)
+				}
+				if code := fs.Mkdir(name, 0755, nil); code != want {
+					t.Errorf("NoCrossMounts: Mkdir(%q): got %v, want %v", name, code, want)
+				}
+			}
+			if _, code := fs.Open("mnt/file", uint32(os.O_RDONLY), nil); code != fuse.EACCES {
+				t.Errorf("NoCrossMounts: Open(mnt/file): got %v, want EACCES", code)
+			}
+			if code := fs.Unlink("mnt/file", nil); code != fuse.EACCES {
+				t.Errorf("NoCrossMounts: Unlink(mnt/file): got %v, want EACCES", code)
+			}
+			if code := fs.Rename("mnt/file", "moved", nil); code != fuse.EACCES {
+				t.Errorf("NoCrossMounts: Rename(mnt/file): got %v, want EACCES", code)
+			}
+			if _, err := os.Lstat(filepath.Join(mnt, "file")); err != nil {
+				t.Errorf("NoCrossMounts: mnt/file is gone: %v", err)
+			}
+			for _, name := range []string{"new", "sub/new"} {
+				if _, err := os.Lstat(filepath.Join(mnt, name)); err == nil {
+					t.Errorf("NoCrossMounts: mnt/%s was created", name)
+				}
+			}
+		} else if len(entries) != 2 || !fileCode.Ok() || !subCode.Ok() {
+			t.Errorf("crossing: got %d entries, %v, %v; want the mount's contents", len(entries), fileCode, subCode)
+		}
+
+		// Entries on Root's own file system are not affected.
+		if _, code := fs.OpenDir("", nil); !code.Ok() {
+			t.Errorf("NoCrossMounts %v: OpenDir(root): %v", noCross, code)
+		}
+		if code := fs.Mkdir("dir", 0755, nil); !code.Ok() {
+			t.Errorf("NoCrossMounts %v: Mkdir(dir): %v", noCross, code)
+		}
+		f, code := fs.Create("dir/file", uint32(os.O_WRONLY), 0644, nil)
+		if !code.Ok() {
+			t.Errorf("NoCrossMounts %v: Create(dir/file): %v", noCross, code)
+		} else {
+			f.Release()
+		}
+		os.RemoveAll(filepath.Join(dir, "dir"))
+	}
+}
+
+func TestLoopbackSparseBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-sparse")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const size = 64 << 20
+	f, err := os.Create(filepath.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	f.Write(make([]byte, 4096))
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Stat(filepath.Join(dir, "sparse"), &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if st.Blocks*512 >= size {
+		t.Skipf("backing file system allocated %d blocks; it has no sparse files", st.Blocks)
+	}
+
+	fs := NewLoopbackFileSystem(dir)
+	a, code := fs.GetAttr("sparse", nil)
+	if !code.Ok() {
+		t.Fatalf("GetAttr: %v", code)
+	}
+	file, code := fs.Open("sparse", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	defer file.Release()
+	var fa fuse.Attr
+	if code := file.GetAttr(&fa); !code.Ok() {
+		t.Fatalf("File.GetAttr: %v", code)
+	}
+
+	for _, got := range []*fuse.Attr{a, &fa} {
+		if got.Size != size || got.Blocks != uint64(st.Blocks) || got.Blksize != uint32(st.Blksize) {
+			t.Errorf("got size %d, %d blocks of %d bytes; want %d, %d blocks of %d bytes",
+				got.Size, got.Blocks, got.Blksize, size, st.Blocks, st.Blksize)
+		}
+	}
+}
+
+func TestDeleteNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-deletenotify")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	orig, mnt := filepath.Join(dir, "orig"), filepath.Join(dir, "mnt")
+	os.Mkdir(orig, 0755)
+	os.Mkdir(mnt, 0755)
+	if err := ioutil.WriteFile(filepath.Join(orig, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	pfs := NewPathNodeFs(NewLoopbackFileSystem(orig), nil)
+	opts := nodefs.NewOptions()
+	opts.EntryTimeout = time.Hour
+	opts.AttrTimeout = time.Hour
+	state, _, err := nodefs.MountRoot(mnt, pfs.Root(), opts)
+	if err != nil {
+		t.Fatalf("MountRoot: %v", err)
+	}
+	go state.Serve()
+	defer state.Unmount()
+	state.WaitMount()
+
+	if _, err := os.Lstat(filepath.Join(mnt, "file")); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	// Remove the file behind the mount's back. The kernel still
+	// has the entry cached.
+	if err := os.Remove(filepath.Join(orig, "file")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(mnt, "file")); err != nil {
+		t.Fatalf("Lstat of the cached entry: %v", err)
+	}
+
+	if code := pfs.DeleteNotify("", "file"); !code.Ok() {
+		t.Fatalf("DeleteNotify: %v", code)
+	}
+	if _, err := os.Lstat(filepath.Join(mnt, "file")); !os.IsNotExist(err) {
+		t.Errorf("Lstat after DeleteNotify: got %v, want ENOENT", err)
+	}
+}
+
+// backingFlags returns the open flags of the descriptor of this
+// process that refers to path, from /proc/self/fdinfo.
+func backingFlags(t *testing.T, path string) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("ReadDir(/proc/self/fd): %v", err)
+	}
+	for _, fd := range fds {
+		if target, _ := os.Readlink("/proc/self/fd/" + fd.Name()); target != path {
+			continue
+		}
+		info, err := ioutil.ReadFile("/proc/self/fdinfo/" + fd.Name())
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		for _, l := range strings.Split(string(info), "\n") {
+			if v := strings.TrimPrefix(l, "flags:"); v != l {
+				flags, err := strconv.ParseInt(strings.TrimSpace(v), 8, 64)
+				if err != nil {
+					t.Fatalf("fdinfo %q: %v", l, err)
+				}
+				return int(flags)
+			}
+		}
+	}
+	t.Fatalf("no descriptor open for %q", path)
+	return 0
+}
+
+func TestLoopbackSyncFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-sync")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	fs := NewLoopbackFileSystem(dir)
+
+	for _, flag := range []int{syscall.O_SYNC, syscall.O_DSYNC} {
+		f, code := fs.Create("file", uint32(os.O_WRONLY|flag), 0644, nil)
+		if !code.Ok() {
+			t.Fatalf("Create: %v", code)
+		}
+		if got := backingFlags(t, filepath.Join(dir, "file")); got&flag != flag {
+			t.Errorf("Create with %o: backing descriptor has flags %o", flag, got)
+		}
+		f.Release()
+
+		f, code = fs.Open("file", uint32(os.O_WRONLY|flag), nil)
+		if !code.Ok() {
+			t.Fatalf("Open: %v", code)
+		}
+		if got := backingFlags(t, filepath.Join(dir, "file")); got&flag != flag {
+			t.Errorf("Open with %o: backing descriptor has flags %o", flag, got)
+		}
+		f.Release()
+	}
+}
+
+func TestLoopbackCapabilities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-caps")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := fuse.CapXAttr | fuse.CapFsync | fuse.CapFallocate | fuse.CapCopyFileRange |
+		fuse.CapRename2 | fuse.CapTmpfile | fuse.CapStatx
+	fs := NewLoopbackFileSystem(dir)
+	rawFS := nodefs.NewFileSystemConnector(NewPathNodeFs(fs, nil).Root(), nil).RawFS()
+	for _, c := range []fuse.CapSet{fuse.Capabilities(fs), fuse.Capabilities(rawFS)} {
+		if c != want {
+			t.Errorf("got capabilities %v, want %v", c, want)
+		}
+		if c.Has(fuse.CapIoctl) {
+			t.Errorf("loopback declares ioctl support")
+		}
+	}
+
+	// Wrappers pass on what they don't take away.
+	filtered := NewCapabilityFilterFileSystem(fs, map[Operation]fuse.Status{OpXAttr: fuse.ENOSYS})
+	if got := fuse.Capabilities(filtered); got != want&^fuse.CapXAttr {
+		t.Errorf("filtered: got capabilities %v, want %v", got, want&^fuse.CapXAttr)
+	}
+	filtered = NewCapabilityFilterFileSystem(fs, map[Operation]fuse.Status{OpXAttr: fuse.EPERM})
+	if got := fuse.Capabilities(filtered); got != want {
+		t.Errorf("filtered with EPERM: got capabilities %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,498 @@
+package pathfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+func TestLoopbackSpecialModeBits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-modes")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewLoopbackFileSystem(dir)
+
+	if code := fs.Mkdir("dir", 01755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	if a, code := fs.GetAttr("dir", nil); !code.Ok() || a.Mode&syscall.S_ISVTX == 0 {
+		t.Errorf("Mkdir: got mode %o, %v, want sticky bit", a.Mode, code)
+	}
+
+	f, code := fs.Create("file", uint32(os.O_WRONLY), 04755, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Release()
+	if a, code := fs.GetAttr("file", nil); !code.Ok() || a.Mode&syscall.S_ISUID == 0 {
+		t.Errorf("Create: got mode %o, %v, want setuid bit", a.Mode, code)
+	}
+
+	for _, mode := range []uint32{06755, 01700, 0644} {
+		if code := fs.Chmod("file", mode, nil); !code.Ok() {
+			t.Fatalf("Chmod: %v", code)
+		}
+		if a, code := fs.GetAttr("file", nil); !code.Ok() || a.Mode&07777 != mode {
+			t.Errorf("Chmod(%o): got mode %o, %v", mode, a.Mode&07777, code)
+		}
+	}
+}
+
+// openFds returns how many of our file descriptors refer to path.
+func openFds(t *testing.T, path string) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	n := 0
+	for _, fd := range fds {
+		if target, _ := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); target == path {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLoopbackReleaseDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-releasedir")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), nil, 0644)
+	}
+
+	pathFs := NewPathNodeFs(NewLoopbackFileSystem(dir), nil)
+	rawFS := nodefs.NewFileSystemConnector(pathFs.Root(), nil).RawFS()
+	in := &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}}
+	var out fuse.OpenOut
+	if code := rawFS.OpenDir(in, &out); !code.Ok() {
+		t.Fatalf("OpenDir: %v", code)
+	}
+	if n := openFds(t, dir); n != 1 {
+		t.Errorf("after OPENDIR: %d fds open, want 1", n)
+	}
+
+	readIn := &fuse.ReadIn{InHeader: in.InHeader, Fh: out.Fh, Size: 4096}
+	list := fuse.NewDirEntryList(make([]byte, 4096), 0)
+	if code := rawFS.ReadDir(readIn, list); !code.Ok() {
+		t.Fatalf("ReadDir: %v", code)
+	}
+
+	rawFS.ReleaseDir(&fuse.ReleaseIn{InHeader: in.InHeader, Fh: out.Fh})
+	if n := openFds(t, dir); n != 0 {
+		t.Errorf("after RELEASEDIR: %d fds open, want 0", n)
+	}
+}
+
+func TestLoopbackPermissionErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-perms")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewLoopbackFileSystem(dir)
+
+	// Even root can't execute a file without x bits.
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if code := fs.Access("file", fuse.X_OK, nil); code != fuse.EACCES {
+		t.Errorf("Access(X_OK): got %v, want EACCES", code)
+	}
+
+	// Nor hard link a directory.
+	if code := fs.Mkdir("dir", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	if code := fs.Link("dir", "link", nil); code != fuse.EPERM {
+		t.Errorf("Link(dir): got %v, want EPERM", code)
+	}
+}
+
+// checkCreateExisting checks that fs fails the creation of names
+// that exist with EEXIST, except for Create without O_EXCL, which
+// opens the file.
+func checkCreateExisting(t *testing.T, fs FileSystem) {
+	f, code := fs.Create("file", uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Write([]byte("hello"), 0)
+	f.Release()
+	if code := fs.Mkdir("dir", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+
+	eexist := fuse.Status(syscall.EEXIST)
+	for _, name := range []string{"file", "dir"} {
+		if code := fs.Mkdir(name, 0755, nil); code != eexist {
+			t.Errorf("Mkdir(%q): got %v, want EEXIST", name, code)
+		}
+		if code := fs.Mknod(name, syscall.S_IFIFO|0644, 0, nil); code != eexist {
+			t.Errorf("Mknod(%q): got %v, want EEXIST", name, code)
+		}
+		if code := fs.Symlink("target", name, nil); code != eexist {
+			t.Errorf("Symlink(%q): got %v, want EEXIST", name, code)
+		}
+	}
+	if _, code := fs.Create("file", uint32(os.O_WRONLY|os.O_EXCL), 0644, nil); code != eexist {
+		t.Errorf("Create(O_EXCL): got %v, want EEXIST", code)
+	}
+
+	f, code = fs.Create("file", uint32(os.O_RDONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create without O_EXCL: %v", code)
+	}
+	defer f.Release()
+	buf := make([]byte, 16)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatalf("Read: %v", code)
+	}
+	if data, _ := res.Bytes(buf); string(data) != "hello" {
+		t.Errorf("Create without O_EXCL: read %q, want the existing content", data)
+	}
+}
+
+func TestLoopbackCreateExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-eexist")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	checkCreateExisting(t, NewLoopbackFileSystem(dir))
+}
+
+// checkOpenNoFollow checks that fs fails an O_NOFOLLOW open of the
+// symlink link to file with ELOOP, and opens file itself fine.
+func checkOpenNoFollow(t *testing.T, fs FileSystem, link, file string) {
+	if _, code := fs.Open(link, uint32(os.O_RDONLY|syscall.O_NOFOLLOW), nil); code != fuse.Status(syscall.ELOOP) {
+		t.Errorf("Open(%q, O_NOFOLLOW): got %v, want ELOOP", link, code)
+	}
+	f, code := fs.Open(link, uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open(%q): %v", link, code)
+	}
+	f.Release()
+	f, code = fs.Open(file, uint32(os.O_RDONLY|syscall.O_NOFOLLOW), nil)
+	if !code.Ok() {
+		t.Fatalf("Open(%q, O_NOFOLLOW): %v", file, code)
+	}
+	f.Release()
+}
+
+func TestLoopbackOpenNoFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-nofollow")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Symlink("file", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	checkOpenNoFollow(t, NewLoopbackFileSystem(dir), "link", "file")
+}
+
+func TestLoopbackFdWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-fdwait")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	var orig syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &orig); err != nil {
+		t.Fatalf("Getrlimit: %v", err)
+	}
+	low := orig
+	low.Cur = 64
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &low); err != nil {
+		t.Fatalf("Setrlimit: %v", err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &orig)
+
+	var held []nodefs.File
+	defer func() {
+		for _, f := range held {
+			f.Release()
+		}
+	}()
+	release := func() {
+		if len(held) > 0 {
+			held[0].Release()
+			held = held[1:]
+		}
+	}
+
+	// Use up the descriptors.
+	fs := NewLoopbackFileSystem(dir)
+	for {
+		f, code := fs.Open("file", uint32(os.O_RDONLY), nil)
+		if code == fuse.Status(syscall.EMFILE) {
+			break
+		}
+		if !code.Ok() {
+			t.Fatalf("Open: %v", code)
+		}
+		held = append(held, f)
+		if len(held) > int(low.Cur) {
+			t.Fatalf("no EMFILE after %d opens", len(held))
+		}
+	}
+
+	// The open waits for a descriptor to be freed.
+	calls := 0
+	fs = NewLoopbackFileSystemWithOptions(dir, &LoopbackOptions{
+		FdWait: time.Second,
+		OnFdShortage: func() {
+			calls++
+			release()
+		},
+	})
+	f, code := fs.Open("file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open with FdWait: %v", code)
+	}
+	f.Release()
+	if calls != 1 {
+		t.Errorf("OnFdShortage called %d times, want 1", calls)
+	}
+
+	// Past FdWait, the error is returned.
+	for {
+		f, code := NewLoopbackFileSystem(dir).Open("file", uint32(os.O_RDONLY), nil)
+		if !code.Ok() {
+			break
+		}
+		held = append(held, f)
+	}
+	fs = NewLoopbackFileSystemWithOptions(dir, &LoopbackOptions{FdWait: 10 * time.Millisecond})
+	if _, code := fs.Open("file", uint32(os.O_RDONLY), nil); code != fuse.Status(syscall.EMFILE) {
+		t.Errorf("Open past FdWait: got %v, want EMFILE", code)
+	}
+}
+
+func TestLoopbackMaxDirEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-maxdirentries")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"full", "big"} {
+		os.Mkdir(filepath.Join(dir, sub), 0755)
+	}
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(filepath.Join(dir, "full", fmt.Sprint(i)), nil, 0644)
+	}
+	for i := 0; i < 5; i++ {
+		ioutil.WriteFile(filepath.Join(dir, "big", fmt.Sprint(i)), nil, 0644)
+	}
+
+	readStream := func(fs FileSystem, name string) (int, fuse.Status) {
+		s, code := fs.(DirStreamFileSystem).OpenDirStream(name, nil)
+		if !code.Ok() {
+			return 0, code
+		}
+		defer s.Close()
+		total := 0
+		for {
+			entries, code := s.Next(2)
+			if !code.Ok() {
+				return total, code
+			}
+			if len(entries) == 0 {
+				return total, fuse.OK
+			}
+			total += len(entries)
+		}
+	}
+
+	for _, truncate := range []bool{false, true} {
+		fs := NewLoopbackFileSystemWithOptions(dir, &LoopbackOptions{MaxDirEntries: 3, TruncateDirs: truncate})
+		if entries, code := fs.OpenDir("full", nil); !code.Ok() || len(entries) != 3 {
+			t.Errorf("truncate=%v: OpenDir(full): got %d entries, %v", truncate, len(entries), code)
+		}
+		if n, code := readStream(fs, "full"); !code.Ok() || n != 3 {
+			t.Errorf("truncate=%v: stream of full: got %d entries, %v", truncate, n, code)
+		}
+
+		entries, code := fs.OpenDir("big", nil)
+		n, streamCode := readStream(fs, "big")
+		if truncate {
+			if !code.Ok() || len(entries) != 3 {
+				t.Errorf("OpenDir(big): got %d entries, %v, want 3", len(entries), code)
+			}
+			if !streamCode.Ok() || n != 3 {
+				t.Errorf("stream of big: got %d entries, %v, want 3", n, streamCode)
+			}
+		} else {
+			if code != fuse.EFBIG {
+				t.Errorf("OpenDir(big): got %v, want EFBIG", code)
+			}
+			if streamCode != fuse.EFBIG {
+				t.Errorf("stream of big: got %v, want EFBIG", streamCode)
+			}
+		}
+	}
+}
+
+func TestLoopbackIgnoreUmask(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-umask")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := syscall.Umask(077)
+	defer syscall.Umask(old)
+
+	for _, c := range []struct {
+		opts *LoopbackOptions
+		want os.FileMode
+	}{
+		{nil, 0700},
+		{&LoopbackOptions{IgnoreUmask: true}, 0777},
+	} {
+		sub, err := ioutil.TempDir(dir, "")
+		if err != nil {
+			t.Fatalf("TempDir: %v", err)
+		}
+		fs := NewLoopbackFileSystemWithOptions(sub, c.opts)
+		f, code := fs.Create("file", uint32(os.O_WRONLY), 0777, nil)
+		if !code.Ok() {
+			t.Fatalf("Create: %v", code)
+		}
+		f.Release()
+		if code := fs.Mkdir("dir", 0777, nil); !code.Ok() {
+			t.Fatalf("Mkdir: %v", code)
+		}
+		if code := fs.Mknod("fifo", syscall.S_IFIFO|0777, 0, nil); !code.Ok() {
+			t.Fatalf("Mknod: %v", code)
+		}
+		for _, name := range []string{"file", "dir", "fifo"} {
+			fi, err := os.Lstat(filepath.Join(sub, name))
+			if err != nil {
+				t.Fatalf("Lstat: %v", err)
+			}
+			if got := fi.Mode().Perm(); got != c.want {
+				t.Errorf("%+v: %s has mode %o, want %o", c.opts, name, got, c.want)
+			}
+		}
+	}
+	if got := syscall.Umask(077); got != 077 {
+		t.Errorf("umask changed to %o", got)
+	}
+}
+
+func TestLoopbackReadlinkLong(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-readlink")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The longest target symlink(2) takes.
+	target := strings.Repeat("a/", 2047) + "b"
+	if err := os.Symlink(target, filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	rawFS := nodefs.NewFileSystemConnector(NewPathNodeFs(NewLoopbackFileSystem(dir), nil).Root(), nil).RawFS()
+	var out fuse.EntryOut
+	if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "link", &out); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	got, code := rawFS.Readlink(&fuse.InHeader{NodeId: out.NodeId})
+	if !code.Ok() {
+		t.Fatalf("Readlink: %v", code)
+	}
+	if string(got) != target {
+		t.Errorf("Readlink: got %d bytes, want %d", len(got), len(target))
+	}
+}
+
+func TestLoopbackCanonicalPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-canonical")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", "b", "file"), nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	rawFS := nodefs.NewFileSystemConnector(NewPathNodeFs(NewLoopbackFileSystem(dir), nil).Root(), nil).RawFS()
+	parent := uint64(fuse.FUSE_ROOT_ID)
+	for _, name := range []string{"a", "b", "file"} {
+		var out fuse.EntryOut
+		if code := rawFS.Lookup(&fuse.InHeader{NodeId: parent}, name, &out); !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, code)
+		}
+		parent = out.NodeId
+	}
+
+	got, code := rawFS.CanonicalPath(&fuse.InHeader{NodeId: parent})
+	if !code.Ok() {
+		t.Fatalf("CanonicalPath: %v", code)
+	}
+	if want := filepath.Join(dir, "a", "b", "file"); got != want {
+		t.Errorf("CanonicalPath: got %q, want %q", got, want)
+	}
+}
+
+func TestLoopbackRetryStale(t *testing.T) {
+	// A stale file handle can't be made without NFS, so the
+	// backing calls are faked.
+	staleOnce := func(calls *int) func() error {
+		return func() error {
+			*calls++
+			if *calls == 1 {
+				return &os.PathError{Op: "stat", Path: "file", Err: syscall.ESTALE}
+			}
+			return nil
+		}
+	}
+
+	fs := NewLoopbackFileSystemWithOptions("/", &LoopbackOptions{RetryStale: true}).(*loopbackFileSystem)
+	calls := 0
+	if err := fs.retryStale(staleOnce(&calls)); err != nil || calls != 2 {
+		t.Errorf("RetryStale: got %v after %d calls, want success after 2", err, calls)
+	}
+
+	calls = 0
+	alwaysStale := func() error {
+		calls++
+		return syscall.ESTALE
+	}
+	if code := fuse.ToStatus(fs.retryStale(alwaysStale)); code != fuse.Status(syscall.ESTALE) || calls != 2 {
+		t.Errorf("RetryStale, stale twice: got %v after %d calls, want ESTALE after 2", code, calls)
+	}
+
+	fs = NewLoopbackFileSystem("/").(*loopbackFileSystem)
+	calls = 0
+	if code := fuse.ToStatus(fs.retryStale(staleOnce(&calls))); code != fuse.Status(syscall.ESTALE) || calls != 1 {
+		t.Errorf("default: got %v after %d calls, want ESTALE after 1", code, calls)
+	}
+}
@@ -0,0 +1,131 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// failingSyncFS returns EIO for Fsync on all its files.
+type failingSyncFS struct {
+	FileSystem
+}
+
+type failingSyncFile struct {
+	nodefs.File
+}
+
+func (f *failingSyncFile) Fsync(flags int) fuse.Status {
+	return fuse.EIO
+}
+
+func (fs *failingSyncFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, code := fs.FileSystem.Create(name, flags, mode, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &failingSyncFile{f}, fuse.OK
+}
+
+func newMirrorTestDirs(t *testing.T) (dirs []string, clean func()) {
+	tmp, err := ioutil.TempDir("", "go-fuse-mirror")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	for _, d := range []string{"primary", "secondary"} {
+		d = filepath.Join(tmp, d)
+		os.Mkdir(d, 0755)
+		dirs = append(dirs, d)
+	}
+	return dirs, func() { os.RemoveAll(tmp) }
+}
+
+func TestMirrorDurableFsync(t *testing.T) {
+	dirs, clean := newMirrorTestDirs(t)
+	defer clean()
+
+	fs := NewMirrorFileSystem(NewLoopbackFileSystem(dirs[0]),
+		[]FileSystem{NewLoopbackFileSystem(dirs[1])}, MirrorDurable)
+	if code := fs.Mkdir("dir", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	f, code := fs.Create("dir/file", uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	defer f.Release()
+
+	want := "hello"
+	if _, code := f.Write([]byte("xxxxx"), 0); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+	if _, code := f.Write([]byte(want), 0); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+	if code := f.Fsync(0); !code.Ok() {
+		t.Fatalf("Fsync: %v", code)
+	}
+
+	for _, d := range dirs {
+		content, err := ioutil.ReadFile(filepath.Join(d, "dir/file"))
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if string(content) != want {
+			t.Errorf("%s: got %q, want %q", d, content, want)
+		}
+	}
+}
+
+func TestMirrorDurableFsyncError(t *testing.T) {
+	dirs, clean := newMirrorTestDirs(t)
+	defer clean()
+
+	fs := NewMirrorFileSystem(NewLoopbackFileSystem(dirs[0]),
+		[]FileSystem{&failingSyncFS{NewLoopbackFileSystem(dirs[1])}}, MirrorDurable)
+	f, code := fs.Create("file", uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	defer f.Release()
+	if code := f.Fsync(0); code != fuse.EIO {
+		t.Errorf("Fsync: got %v, want EIO", code)
+	}
+}
+
+func TestMirrorAsync(t *testing.T) {
+	dirs, clean := newMirrorTestDirs(t)
+	defer clean()
+
+	fs := NewMirrorFileSystem(NewLoopbackFileSystem(dirs[0]),
+		[]FileSystem{&failingSyncFS{NewLoopbackFileSystem(dirs[1])}}, MirrorAsync)
+	f, code := fs.Create("file", uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	want := "hello"
+	if _, code := f.Write([]byte(want), 0); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+	// Failures of secondaries are not reported.
+	if code := f.Fsync(0); !code.Ok() {
+		t.Errorf("Fsync: %v", code)
+	}
+	f.Release()
+
+	// OnUnmount waits for the secondaries to catch up.
+	fs.OnUnmount()
+	for _, d := range dirs {
+		content, err := ioutil.ReadFile(filepath.Join(d, "file"))
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if string(content) != want {
+			t.Errorf("%s: got %q, want %q", d, content, want)
+		}
+	}
+}
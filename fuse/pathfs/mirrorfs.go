@@ -0,0 +1,432 @@
+package pathfs
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// MirrorMode selects how a MirrorFileSystem treats its secondaries.
+type MirrorMode int
+
+const (
+	// MirrorDurable applies each change to the primary, and
+	// then to every secondary, before returning. Fsync is sent
+	// to all backends at once, and returns once all of them
+	// are durable. Any failure is returned.
+	MirrorDurable MirrorMode = iota
+
+	// MirrorAsync returns as soon as the primary has applied a
+	// change. Secondaries are updated in the background, in the
+	// original order; their failures are logged, not returned.
+	MirrorAsync
+)
+
+// _MIRROR_QUEUE_LEN is the number of changes that may be pending for
+// an asynchronous secondary before further changes block.
+const _MIRROR_QUEUE_LEN = 1024
+
+type mirrorFileSystem struct {
+	// The primary. Reads are only served from it.
+	FileSystem
+
+	secondaries []FileSystem
+	mode        MirrorMode
+
+	// For MirrorAsync, one queue per secondary.
+	queues []chan func()
+}
+
+// NewMirrorFileSystem returns a wrapper that replicates all changes
+// to primary onto each of the secondaries, which should start out
+// with the same contents. A change is only sent to the secondaries
+// after the primary has accepted it, and changes to a single file
+// reach every backend in the same order.
+func NewMirrorFileSystem(primary FileSystem, secondaries []FileSystem, mode MirrorMode) FileSystem {
+	fs := &mirrorFileSystem{
+		FileSystem:  primary,
+		secondaries: secondaries,
+		mode:        mode,
+	}
+	if mode == MirrorAsync {
+		for range secondaries {
+			q := make(chan func(), _MIRROR_QUEUE_LEN)
+			fs.queues = append(fs.queues, q)
+			go func() {
+				for f := range q {
+					f()
+				}
+			}()
+		}
+	}
+	return fs
+}
+
+func (fs *mirrorFileSystem) String() string {
+	return fmt.Sprintf("mirrorFileSystem(%v, %v)", fs.FileSystem, fs.secondaries)
+}
+
+// worse returns the first failure of a and b.
+func worse(a, b fuse.Status) fuse.Status {
+	if !a.Ok() {
+		return a
+	}
+	return b
+}
+
+// copyContext returns a copy of c that stays valid after the request
+// that c belongs to has finished.
+func copyContext(c *fuse.Context) *fuse.Context {
+	if c == nil {
+		return nil
+	}
+	cc := *c
+	return &cc
+}
+
+// replicate runs op for each secondary. In MirrorAsync mode, op runs
+// in the background, and failures are logged, with desc to identify
+// the operation.
+func (fs *mirrorFileSystem) replicate(desc string, op func(i int, sec FileSystem) fuse.Status) fuse.Status {
+	code := fuse.OK
+	for i, sec := range fs.secondaries {
+		if fs.mode == MirrorDurable {
+			code = worse(code, op(i, sec))
+			continue
+		}
+		i, sec := i, sec
+		fs.queues[i] <- func() {
+			if c := op(i, sec); !c.Ok() {
+				log.Printf("mirror %v: %s: %v", sec, desc, c)
+			}
+		}
+	}
+	return code
+}
+
+// mutate applies op to the primary and, if that succeeds, to the
+// secondaries.
+func (fs *mirrorFileSystem) mutate(desc string, context *fuse.Context, op func(b FileSystem, context *fuse.Context) fuse.Status) fuse.Status {
+	code := op(fs.FileSystem, context)
+	if !code.Ok() {
+		return code
+	}
+	if fs.mode == MirrorAsync {
+		context = copyContext(context)
+	}
+	return fs.replicate(desc, func(i int, sec FileSystem) fuse.Status {
+		return op(sec, context)
+	})
+}
+
+func (fs *mirrorFileSystem) SetDebug(debug bool) {
+	fs.FileSystem.SetDebug(debug)
+	for _, sec := range fs.secondaries {
+		sec.SetDebug(debug)
+	}
+}
+
+func (fs *mirrorFileSystem) OnMount(nodeFs *PathNodeFs) {
+	fs.FileSystem.OnMount(nodeFs)
+	for _, sec := range fs.secondaries {
+		sec.OnMount(nodeFs)
+	}
+}
+
+// OnUnmount waits for pending changes to reach asynchronous
+// secondaries.
+func (fs *mirrorFileSystem) OnUnmount() {
+	fs.FileSystem.OnUnmount()
+	var wg sync.WaitGroup
+	for i, q := range fs.queues {
+		wg.Add(1)
+		sec := fs.secondaries[i]
+		q <- func() {
+			defer wg.Done()
+			sec.OnUnmount()
+		}
+	}
+	wg.Wait()
+	if fs.mode == MirrorDurable {
+		for _, sec := range fs.secondaries {
+			sec.OnUnmount()
+		}
+	}
+}
+
+func (fs *mirrorFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.mutate("chmod "+name, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.Chmod(name, mode, c)
+	})
+}
+
+func (fs *mirrorFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	return fs.mutate("chown "+name, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.Chown(name, uid, gid, c)
+	})
+}
+
+func (fs *mirrorFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	return fs.mutate("utimens "+name, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.Utimens(name, atime, mtime, c)
+	})
+}
+
+func (fs *mirrorFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	return fs.mutate("truncate "+name, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.Truncate(name, size, c)
+	})
+}
+
+func (fs *mirrorFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	return fs.mutate("link "+newName, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.Link(oldName, newName, c)
+	})
+}
+
+func (fs *mirrorFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.mutate("mkdir "+name, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.Mkdir(name, mode, c)
+	})
+}
+
+func (fs *mirrorFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	return fs.mutate("mknod "+name, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.Mknod(name, mode, dev, c)
+	})
+}
+
+func (fs *mirrorFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	return fs.mutate("rename "+oldName, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.Rename(oldName, newName, c)
+	})
+}
+
+func (fs *mirrorFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	return fs.mutate("rmdir "+name, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.Rmdir(name, c)
+	})
+}
+
+func (fs *mirrorFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	return fs.mutate("unlink "+name, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.Unlink(name, c)
+	})
+}
+
+func (fs *mirrorFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	return fs.mutate("symlink "+linkName, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.Symlink(value, linkName, c)
+	})
+}
+
+func (fs *mirrorFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if fs.mode == MirrorAsync {
+		data = append([]byte{}, data...)
+	}
+	return fs.mutate("setxattr "+name, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.SetXAttr(name, attr, data, flags, c)
+	})
+}
+
+func (fs *mirrorFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	return fs.mutate("removexattr "+name, context, func(b FileSystem, c *fuse.Context) fuse.Status {
+		return b.RemoveXAttr(name, attr, c)
+	})
+}
+
+// openFile opens the secondary copies of a file that was opened
+// for writing on the primary.
+func (fs *mirrorFileSystem) openFile(f nodefs.File, name string, flags uint32, context *fuse.Context, open func(sec FileSystem, c *fuse.Context) (nodefs.File, fuse.Status)) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE == 0 {
+		return f, fuse.OK
+	}
+	mf := &mirrorFile{
+		File:        f,
+		fs:          fs,
+		name:        name,
+		secondaries: make([]nodefs.File, len(fs.secondaries)),
+	}
+	if fs.mode == MirrorAsync {
+		context = copyContext(context)
+	}
+	code := fs.replicate("open "+name, func(i int, sec FileSystem) fuse.Status {
+		sf, code := open(sec, context)
+		mf.secondaries[i] = sf
+		return code
+	})
+	if !code.Ok() {
+		mf.Release()
+		return nil, code
+	}
+	return mf, fuse.OK
+}
+
+func (fs *mirrorFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, code := fs.FileSystem.Open(name, flags, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.openFile(f, name, flags, context, func(sec FileSystem, c *fuse.Context) (nodefs.File, fuse.Status) {
+		return sec.Open(name, flags, c)
+	})
+}
+
+func (fs *mirrorFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, code := fs.FileSystem.Create(name, flags, mode, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.openFile(f, name, flags|fuse.O_ANYWRITE, context, func(sec FileSystem, c *fuse.Context) (nodefs.File, fuse.Status) {
+		return sec.Create(name, flags, mode, c)
+	})
+}
+
+// mirrorFile replicates changes made through a file handle. The
+// primary is the embedded File.
+type mirrorFile struct {
+	nodefs.File
+	fs   *mirrorFileSystem
+	name string
+
+	// secondaries has an entry per secondary, which is nil if
+	// opening it failed. For MirrorAsync, entry i is only
+	// accessed from the queue of secondary i.
+	secondaries []nodefs.File
+
+	// mu serializes changes, so they reach all backends in the
+	// same order.
+	mu sync.Mutex
+}
+
+func (f *mirrorFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *mirrorFile) String() string {
+	return fmt.Sprintf("mirrorFile(%s)", f.File.String())
+}
+
+// mutate applies op to the primary file and, if that succeeds, to
+// the secondary files.
+func (f *mirrorFile) mutate(desc string, op func(nodefs.File) fuse.Status) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	code := op(f.File)
+	if !code.Ok() {
+		return code
+	}
+	return f.replicate(desc, op)
+}
+
+func (f *mirrorFile) replicate(desc string, op func(nodefs.File) fuse.Status) fuse.Status {
+	return f.fs.replicate(desc+" "+f.name, func(i int, sec FileSystem) fuse.Status {
+		if f.secondaries[i] == nil {
+			return fuse.EBADF
+		}
+		return op(f.secondaries[i])
+	})
+}
+
+func (f *mirrorFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	if f.fs.mode == MirrorAsync {
+		data = append([]byte{}, data...)
+	}
+	var written uint32
+	primary := true
+	code := f.mutate("write", func(file nodefs.File) fuse.Status {
+		n, code := file.Write(data, off)
+		if primary {
+			written = n
+			primary = false
+		} else if code.Ok() && n != written {
+			code = fuse.EIO
+		}
+		return code
+	})
+	return written, code
+}
+
+func (f *mirrorFile) Truncate(size uint64) fuse.Status {
+	return f.mutate("truncate", func(file nodefs.File) fuse.Status {
+		return file.Truncate(size)
+	})
+}
+
+func (f *mirrorFile) Chown(uid uint32, gid uint32) fuse.Status {
+	return f.mutate("chown", func(file nodefs.File) fuse.Status {
+		return file.Chown(uid, gid)
+	})
+}
+
+func (f *mirrorFile) Chmod(perms uint32) fuse.Status {
+	return f.mutate("chmod", func(file nodefs.File) fuse.Status {
+		return file.Chmod(perms)
+	})
+}
+
+func (f *mirrorFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	return f.mutate("utimens", func(file nodefs.File) fuse.Status {
+		return file.Utimens(atime, mtime)
+	})
+}
+
+func (f *mirrorFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	return f.mutate("allocate", func(file nodefs.File) fuse.Status {
+		return file.Allocate(off, size, mode)
+	})
+}
+
+func (f *mirrorFile) Flush() fuse.Status {
+	return f.mutate("flush", func(file nodefs.File) fuse.Status {
+		return file.Flush()
+	})
+}
+
+// Fsync syncs all backends concurrently. In MirrorDurable mode, it
+// returns when all of them are done, with the first failure, if any.
+func (f *mirrorFile) Fsync(flags int) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fs.mode == MirrorAsync {
+		code := f.File.Fsync(flags)
+		f.replicate("fsync", func(file nodefs.File) fuse.Status {
+			return file.Fsync(flags)
+		})
+		return code
+	}
+
+	codes := make([]fuse.Status, len(f.secondaries)+1)
+	var wg sync.WaitGroup
+	for i, file := range append([]nodefs.File{f.File}, f.secondaries...) {
+		if file == nil {
+			codes[i] = fuse.EBADF
+			continue
+		}
+		wg.Add(1)
+		go func(i int, file nodefs.File) {
+			defer wg.Done()
+			codes[i] = file.Fsync(flags)
+		}(i, file)
+	}
+	wg.Wait()
+
+	code := fuse.OK
+	for _, c := range codes {
+		code = worse(code, c)
+	}
+	return code
+}
+
+func (f *mirrorFile) Release() {
+	f.File.Release()
+	f.replicate("release", func(file nodefs.File) fuse.Status {
+		file.Release()
+		return fuse.OK
+	})
+}
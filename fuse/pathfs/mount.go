@@ -0,0 +1,142 @@
+package pathfs
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// MountAtOptions are the options for MountAt.
+type MountAtOptions struct {
+	// Create makes the mountpoint if it doesn't exist. Its parent
+	// must exist. MountState.Unmount removes it again.
+	Create bool
+
+	// Options for the PathNodeFs, the connector and the server.
+	// nil gives the defaults.
+	PathNodeFs *PathNodeFsOptions
+	Connector  *nodefs.Options
+	Mount      *fuse.MountOptions
+}
+
+// MountState is a file system mounted by MountAt.
+type MountState struct {
+	Server *fuse.Server
+	NodeFs *PathNodeFs
+
+	dir     string
+	created bool
+}
+
+// MountAt mounts fs on dir, and serves it in the background until
+// Unmount is called. This saves setting up the PathNodeFs,
+// connector and server by hand, eg. in tests and small tools. If fs
+// is a ReadOnlyFileSystem that reports it can't be written, it is
+// mounted with the "ro" option.
+//
+// The same fs can be mounted at several places by calling MountAt
+// for each. Every mount gets a PathNodeFs and connector of its own,
+// and fs.OnMount is called for each of them, so fs sees the calls of
+// all mounts and must be safe for concurrent use. Unmounting one
+// leaves the others working. File systems that keep the PathNodeFs
+// of their mount, such as those of unionfs and zipfs, support a
+// single mount and panic in OnMount if mounted again.
+func MountAt(dir string, fs FileSystem, opts *MountAtOptions) (*MountState, error) {
+	if opts == nil {
+		opts = &MountAtOptions{}
+	}
+	m := &MountState{dir: dir}
+	if opts.Create {
+		err := os.Mkdir(dir, 0755)
+		if err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		m.created = err == nil
+	}
+
+	m.NodeFs = NewPathNodeFs(fs, opts.PathNodeFs)
+	conn := nodefs.NewFileSystemConnector(m.NodeFs.Root(), opts.Connector)
+	server, err := fuse.NewServer(conn.RawFS(), dir, mountOptions(fs, opts.Mount))
+	if err != nil {
+		if m.created {
+			os.Remove(dir)
+		}
+		return nil, err
+	}
+	m.Server = server
+	go server.Serve()
+	server.WaitMount()
+	return m, nil
+}
+
+// mountOptions returns opts, with "ro" added if fs is read-only.
+func mountOptions(fs FileSystem, opts *fuse.MountOptions) *fuse.MountOptions {
+	ro, ok := fs.(ReadOnlyFileSystem)
+	if !ok || !ro.ReadOnly() {
+		return opts
+	}
+	o := fuse.MountOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	o.Options = append(append([]string{}, o.Options...), "ro")
+	return &o
+}
+
+// Unmount unmounts the file system, and removes the mountpoint if
+// MountAt created it.
+func (m *MountState) Unmount() error {
+	if err := m.Server.Unmount(); err != nil {
+		return err
+	}
+	if m.created {
+		m.created = false
+		return os.Remove(m.dir)
+	}
+	return nil
+}
+
+// HandleSignals unmounts m when the process gets SIGINT or SIGTERM,
+// so a daemon that is stopped doesn't leave a dead mount behind.
+// Unmounting waits for the requests being served, and then
+// Server.Serve returns, so the program can exit as usual. If the
+// unmount fails, eg. because the mount is busy, the error is logged
+// and the next signal tries again. Once unmounted, the signals get
+// their default behavior back.
+//
+// Libraries shouldn't take over the signals of their callers, so
+// nothing is installed unless this is called. The returned function
+// removes the handler.
+func HandleSignals(m *MountState) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-ch:
+				if err := m.Unmount(); err != nil {
+					log.Printf("%v: unmount %s: %v", sig, m.dir, err)
+					continue
+				}
+				signal.Stop(ch)
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
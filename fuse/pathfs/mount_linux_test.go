@@ -0,0 +1,71 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// directMount serves fs on a fresh directory with mount(2), so the
+// kernel is in the loop. It skips if that is not permitted.
+func directMount(t *testing.T, fs FileSystem) (dir string, clean func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("direct mounts need CAP_SYS_ADMIN")
+	}
+	dir, err := ioutil.TempDir("", "go-fuse-pathfs")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	rawFS := nodefs.NewFileSystemConnector(NewPathNodeFs(fs, nil).Root(), nil).RawFS()
+	ms, err := fuse.NewServer(rawFS, dir, &fuse.MountOptions{DirectMount: true})
+	if err != nil {
+		os.Remove(dir)
+		t.Skipf("NewServer: %v", err)
+	}
+	go ms.Serve()
+	ms.WaitMount()
+	return dir, func() {
+		if err := ms.Unmount(); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+		os.Remove(dir)
+	}
+}
+
+func TestMountOptionsReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-readonly")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ro := filepath.Join(dir, "ro")
+	os.Mkdir(ro, 0755)
+
+	if got := mountOptions(NewLoopbackFileSystem(dir), nil); got != nil {
+		t.Errorf("writable loopback: got options %v", got.Options)
+	}
+	if got := mountOptions(NewReadonlyFileSystem(NewLoopbackFileSystem(dir)), nil); got == nil || len(got.Options) != 1 || got.Options[0] != "ro" {
+		t.Errorf("readonly wrapper: got %+v, want ro", got)
+	}
+
+	// A read-only bind mount needs CAP_SYS_ADMIN.
+	if err := syscall.Mount(dir, ro, "", syscall.MS_BIND, ""); err != nil {
+		t.Skipf("bind mount: %v", err)
+	}
+	defer syscall.Unmount(ro, 0)
+	if err := syscall.Mount("", ro, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		t.Skipf("remount read-only: %v", err)
+	}
+	fs := NewLoopbackFileSystem(ro)
+	if !fs.(ReadOnlyFileSystem).ReadOnly() {
+		t.Errorf("loopback of a read-only mount is not ReadOnly")
+	}
+	if got := mountOptions(fs, nil); got == nil || len(got.Options) != 1 || got.Options[0] != "ro" {
+		t.Errorf("read-only loopback: got %+v, want ro", got)
+	}
+}
@@ -0,0 +1,105 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestMountAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-mountat")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	orig, mnt := filepath.Join(dir, "orig"), filepath.Join(dir, "mnt")
+	os.Mkdir(orig, 0755)
+	if err := ioutil.WriteFile(filepath.Join(orig, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	m, err := MountAt(mnt, NewLoopbackFileSystem(orig), &MountAtOptions{Create: true})
+	if err != nil {
+		t.Fatalf("MountAt: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(mnt, "file"))
+	if err != nil || string(content) != "hello" {
+		t.Errorf("ReadFile: got %q, %v", content, err)
+	}
+	if err := m.Unmount(); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	if _, err := os.Lstat(mnt); !os.IsNotExist(err) {
+		t.Errorf("mountpoint remains after Unmount: %v", err)
+	}
+}
+
+func TestMountAtTwice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-mounttwice")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	orig := filepath.Join(dir, "orig")
+	os.Mkdir(orig, 0755)
+
+	fs := NewLoopbackFileSystem(orig)
+	var ms []*MountState
+	for _, name := range []string{"a", "b"} {
+		m, err := MountAt(filepath.Join(dir, name), fs, &MountAtOptions{Create: true})
+		if err != nil {
+			t.Fatalf("MountAt: %v", err)
+		}
+		defer m.Unmount()
+		ms = append(ms, m)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "b", "file")); err != nil || string(content) != "hello" {
+		t.Errorf("ReadFile through the other mount: got %q, %v", content, err)
+	}
+
+	if err := ms[0].Unmount(); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "b", "file")); err != nil || string(content) != "hello" {
+		t.Errorf("ReadFile after unmounting the other mount: got %q, %v", content, err)
+	}
+}
+
+func TestHandleSignals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-signals")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The server isn't mounted, so the unmount shows in the
+	// removal of the mountpoint that "MountAt" created.
+	mnt := filepath.Join(dir, "mnt")
+	os.Mkdir(mnt, 0755)
+	m := &MountState{Server: &fuse.Server{}, dir: mnt, created: true}
+	stop := HandleSignals(m)
+	defer stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("Kill: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Lstat(mnt); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("SIGTERM did not unmount")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
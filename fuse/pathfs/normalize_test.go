@@ -0,0 +1,65 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// composeAcute is a stand-in for NFC that only composes e with a
+// combining acute accent.
+func composeAcute(name string) string {
+	return strings.Replace(name, "e\u0301", "\u00e9", -1)
+}
+
+func TestNameNormalizing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-normalize")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const nfc = "caf\u00e9"
+	const nfd = "cafe\u0301"
+	fs := NewNameNormalizingFileSystem(NewLoopbackFileSystem(dir), composeAcute)
+
+	f, code := fs.Create(nfd, uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Release()
+	if _, err := os.Lstat(filepath.Join(dir, nfc)); err != nil {
+		t.Errorf("backing file not in NFC: %v", err)
+	}
+
+	for _, name := range []string{nfc, nfd} {
+		if _, code := fs.GetAttr(name, nil); !code.Ok() {
+			t.Errorf("GetAttr(%q): %v", name, code)
+		}
+	}
+
+	// Names are listed in NFC, whatever the backing store holds.
+	if err := ioutil.WriteFile(filepath.Join(dir, "re\u0301sume\u0301"), nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() {
+		t.Fatalf("OpenDir: %v", code)
+	}
+	got := map[string]bool{}
+	for _, e := range entries {
+		got[e.Name] = true
+	}
+	if len(got) != 2 || !got[nfc] || !got["r\u00e9sum\u00e9"] {
+		t.Errorf("OpenDir: got %v", got)
+	}
+
+	if code := fs.Unlink(nfd, nil); !code.Ok() {
+		t.Errorf("Unlink: %v", code)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, nfc)); !os.IsNotExist(err) {
+		t.Errorf("Unlink: file still there: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package pathfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+type nameNormalizingFileSystem struct {
+	FileSystem
+	normalize func(name string) string
+}
+
+// NewNameNormalizingFileSystem returns a wrapper that passes all
+// names through normalize before handing them to fs, and also
+// normalizes the names that OpenDir returns, so a listed name looks
+// up the same file. normalize must be idempotent, for example
+// norm.NFC.String from golang.org/x/text/unicode/norm to serve
+// clients that send NFD names from a backing store in NFC. It is
+// called on whole slash-separated paths. Symlink targets are left
+// alone.
+//
+// Names in the backing store should already be normalized. Others
+// are listed in normalized form, but can't be looked up; if several
+// names normalize to the same string, OpenDir lists only the first.
+func NewNameNormalizingFileSystem(fs FileSystem, normalize func(name string) string) FileSystem {
+	return &nameNormalizingFileSystem{
+		FileSystem: fs,
+		normalize:  normalize,
+	}
+}
+
+func (fs *nameNormalizingFileSystem) String() string {
+	return fmt.Sprintf("nameNormalizingFileSystem(%v)", fs.FileSystem)
+}
+
+func (fs *nameNormalizingFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	return fs.FileSystem.GetAttr(fs.normalize(name), context)
+}
+
+func (fs *nameNormalizingFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.Chmod(fs.normalize(name), mode, context)
+}
+
+func (fs *nameNormalizingFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.Chown(fs.normalize(name), uid, gid, context)
+}
+
+func (fs *nameNormalizingFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.Utimens(fs.normalize(name), atime, mtime, context)
+}
+
+func (fs *nameNormalizingFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.Truncate(fs.normalize(name), size, context)
+}
+
+func (fs *nameNormalizingFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.Access(fs.normalize(name), mode, context)
+}
+
+func (fs *nameNormalizingFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.Link(fs.normalize(oldName), fs.normalize(newName), context)
+}
+
+func (fs *nameNormalizingFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.Mkdir(fs.normalize(name), mode, context)
+}
+
+func (fs *nameNormalizingFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.Mknod(fs.normalize(name), mode, dev, context)
+}
+
+func (fs *nameNormalizingFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.Rename(fs.normalize(oldName), fs.normalize(newName), context)
+}
+
+func (fs *nameNormalizingFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.Rmdir(fs.normalize(name), context)
+}
+
+func (fs *nameNormalizingFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.Unlink(fs.normalize(name), context)
+}
+
+func (fs *nameNormalizingFileSystem) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	return fs.FileSystem.GetXAttr(fs.normalize(name), attribute, context)
+}
+
+func (fs *nameNormalizingFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	return fs.FileSystem.ListXAttr(fs.normalize(name), context)
+}
+
+func (fs *nameNormalizingFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.RemoveXAttr(fs.normalize(name), attr, context)
+}
+
+func (fs *nameNormalizingFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.SetXAttr(fs.normalize(name), attr, data, flags, context)
+}
+
+func (fs *nameNormalizingFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return fs.FileSystem.Open(fs.normalize(name), flags, context)
+}
+
+func (fs *nameNormalizingFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return fs.FileSystem.Create(fs.normalize(name), flags, mode, context)
+}
+
+func (fs *nameNormalizingFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	entries, code := fs.FileSystem.OpenDir(fs.normalize(name), context)
+	if !code.Ok() {
+		return nil, code
+	}
+	seen := make(map[string]bool, len(entries))
+	out := entries[:0]
+	for _, e := range entries {
+		e.Name = fs.normalize(e.Name)
+		if seen[e.Name] {
+			continue
+		}
+		seen[e.Name] = true
+		out = append(out, e)
+	}
+	return out, fuse.OK
+}
+
+func (fs *nameNormalizingFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.Symlink(value, fs.normalize(linkName), context)
+}
+
+func (fs *nameNormalizingFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	return fs.FileSystem.Readlink(fs.normalize(name), context)
+}
+
+func (fs *nameNormalizingFileSystem) StatFs(name string) *fuse.StatfsOut {
+	return fs.FileSystem.StatFs(fs.normalize(name))
+}
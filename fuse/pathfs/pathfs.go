@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -164,6 +165,26 @@ func (fs *PathNodeFs) EntryNotify(dir string, name string) fuse.Status {
 	return fs.connector.EntryNotify(node, name)
 }
 
+// DeleteNotify tells the kernel that name was removed from dir
+// behind its back, for example by another client of the backing
+// store, so it drops the entry at once, rather than when the entry
+// times out. Unlike EntryNotify, this also works if the entry is in
+// use, eg. as the working directory of a process. The node is
+// forgotten, so a new file with that name gets a new node.
+func (fs *PathNodeFs) DeleteNotify(dir string, name string) fuse.Status {
+	node, rest := fs.connector.Node(fs.root.Inode(), dir)
+	if len(rest) > 0 {
+		return fuse.ENOENT
+	}
+	child := node.GetChild(name)
+	if child == nil {
+		return fs.connector.EntryNotify(node, name)
+	}
+	code := fs.connector.DeleteNotify(node, child, name)
+	node.Node().(*pathInode).rmChild(name)
+	return code
+}
+
 // Notify ensures that the path name is invalidates: if the inode is
 // known, it issues an file content Notify, if not, an entry notify
 // for the path is issued. The latter will clear out non-existence
@@ -226,6 +247,10 @@ type pathInode struct {
 	// real filesystem.
 	clientInode uint64
 	inode       *nodefs.Inode
+
+	// tmpfile is set for files opened with O_TMPFILE, until they
+	// are linked into a directory.
+	tmpfile bool
 }
 
 func (n *pathInode) OnMount(conn *nodefs.FileSystemConnector) {
@@ -442,7 +467,95 @@ func (n *pathInode) Flush(file nodefs.File, openFlags uint32, context *fuse.Cont
 }
 
 func (n *pathInode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
-	return n.fs.OpenDir(n.GetPath(), context)
+	entries, code := n.fs.OpenDir(n.GetPath(), context)
+	if code.Ok() && n.pathFs.options.ResolveUnknownTypes {
+		n.resolveTypes(entries, context)
+	}
+	return entries, code
+}
+
+// resolveTypes fills in the file type of entries that lack one
+// from GetAttr. Entries that can't be stat'ed are left alone.
+func (n *pathInode) resolveTypes(entries []fuse.DirEntry, context *fuse.Context) {
+	dir := n.GetPath()
+	for i := range entries {
+		e := &entries[i]
+		if e.Mode&syscall.S_IFMT != 0 {
+			continue
+		}
+		if a, code := n.fs.GetAttr(filepath.Join(dir, e.Name), context); code.Ok() {
+			e.Mode |= a.Mode & syscall.S_IFMT
+		}
+	}
+}
+
+func (n *pathInode) OpenDirStream(context *fuse.Context) (nodefs.DirStream, fuse.Status) {
+	fs, ok := n.fs.(DirStreamFileSystem)
+	if !ok {
+		return nil, fuse.ENOSYS
+	}
+	s, code := fs.OpenDirStream(n.GetPath(), context)
+	if code.Ok() && n.pathFs.options.ResolveUnknownTypes {
+		// context points into the OPENDIR request, which is
+		// reused once it is answered.
+		s = &typedDirStream{DirStream: s, dir: n, context: *context}
+	}
+	return s, code
+}
+
+// typedDirStream resolves unknown entry types for
+// PathNodeFsOptions.ResolveUnknownTypes.
+type typedDirStream struct {
+	nodefs.DirStream
+	dir     *pathInode
+	context fuse.Context
+}
+
+func (s *typedDirStream) Next(n int) ([]fuse.DirEntry, fuse.Status) {
+	entries, code := s.DirStream.Next(n)
+	if code.Ok() {
+		s.dir.resolveTypes(entries, &s.context)
+	}
+	return entries, code
+}
+
+func (n *pathInode) OpenDirFlags(context *fuse.Context) uint32 {
+	if fs, ok := n.fs.(OpenDirFlagsFileSystem); ok {
+		return fs.OpenDirFlags(n.GetPath(), context)
+	}
+	return 0
+}
+
+func (n *pathInode) CacheTimeouts() (entry time.Duration, attr time.Duration) {
+	if fs, ok := n.fs.(CacheTimeoutFileSystem); ok {
+		return fs.CacheTimeouts(n.GetPath())
+	}
+	return -1, -1
+}
+
+func (n *pathInode) StatxAttributes(file nodefs.File, context *fuse.Context) (attributes uint64, mask uint64, code fuse.Status) {
+	if fs, ok := n.fs.(StatxFileSystem); ok {
+		return fs.StatxAttributes(n.GetPath(), context)
+	}
+	return 0, 0, fuse.ENOSYS
+}
+
+func (n *pathInode) Capabilities() fuse.CapSet {
+	return fuse.Capabilities(n.fs)
+}
+
+func (n *pathInode) SetVolumeName(name string) fuse.Status {
+	if fs, ok := n.fs.(VolumeNameFileSystem); ok {
+		return fs.SetVolumeName(name)
+	}
+	return fuse.ENOSYS
+}
+
+func (n *pathInode) CanonicalPath(context *fuse.Context) (path string, code fuse.Status) {
+	if fs, ok := n.fs.(CanonicalPathFileSystem); ok {
+		return fs.CanonicalPath(n.GetPath(), context)
+	}
+	return "", fuse.ENOSYS
 }
 
 func (n *pathInode) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
@@ -511,13 +624,40 @@ func (n *pathInode) Rename(oldName string, newParent nodefs.Node, newName string
 	return code
 }
 
+func (n *pathInode) Rename2(oldName string, newParent nodefs.Node, newName string, flags uint32, context *fuse.Context) (code fuse.Status) {
+	fs, ok := n.fs.(Rename2FileSystem)
+	if !ok {
+		return fuse.EINVAL
+	}
+	p := newParent.(*pathInode)
+	oldPath := filepath.Join(n.GetPath(), oldName)
+	newPath := filepath.Join(p.GetPath(), newName)
+	code = fs.Rename2(oldPath, newPath, flags, context)
+	if !code.Ok() {
+		return code
+	}
+	ch := n.rmChild(oldName)
+	target := p.rmChild(newName)
+	p.Inode().AddChild(newName, ch.Inode())
+	p.addChild(newName, ch)
+	if flags&fuse.RENAME_EXCHANGE != 0 && target != nil {
+		n.Inode().AddChild(oldName, target.Inode())
+		n.addChild(oldName, target)
+	}
+	return code
+}
+
 func (n *pathInode) Link(name string, existingFsnode nodefs.Node, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	newPath := filepath.Join(n.GetPath(), name)
+	existing := existingFsnode.(*pathInode)
+	if existing.tmpfile {
+		return n.linkTmpfile(name, newPath, existing, context)
+	}
+
 	if !n.pathFs.options.ClientInodes {
 		return nil, fuse.ENOSYS
 	}
 
-	newPath := filepath.Join(n.GetPath(), name)
-	existing := existingFsnode.(*pathInode)
 	oldPath := existing.GetPath()
 	code := n.fs.Link(oldPath, newPath, context)
 
@@ -554,6 +694,35 @@ func (n *pathInode) Create(name string, flags uint32, mode uint32, context *fuse
 	return file, child, code
 }
 
+func (n *pathInode) Tmpfile(flags uint32, mode uint32, context *fuse.Context) (nodefs.File, nodefs.Node, fuse.Status) {
+	fs, ok := n.fs.(TmpfileFileSystem)
+	if !ok {
+		return nil, nil, fuse.ENOSYS
+	}
+	file, code := fs.Tmpfile(n.GetPath(), flags, mode, context)
+	if !code.Ok() {
+		return nil, nil, code
+	}
+	return file, &pathInode{fs: n.fs, pathFs: n.pathFs, tmpfile: true}, code
+}
+
+// linkTmpfile names a file that was opened with O_TMPFILE. It has no
+// path, so it is linked through its open file.
+func (n *pathInode) linkTmpfile(name string, newPath string, existing *pathInode, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	file := existing.Inode().AnyFile()
+	if file == nil {
+		return nil, fuse.ENOENT
+	}
+	code := n.fs.(TmpfileFileSystem).LinkTmpfile(file, newPath, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	existing.tmpfile = false
+	n.Inode().AddChild(name, existing.Inode())
+	n.addChild(name, existing)
+	return existing.Inode(), code
+}
+
 func (n *pathInode) createChild(name string, isDir bool) *pathInode {
 	i := new(pathInode)
 	i.fs = n.fs
@@ -603,8 +772,12 @@ func (n *pathInode) findChild(fi *fuse.Attr, name string, fullPath string) (out
 		out = n.createChild(name, fi.IsDir())
 		out.clientInode = fi.Ino
 		n.addChild(name, out)
-	} else {
-		// should add 'out' as a child to n ?
+	} else if n.Inode().GetChild(name) == nil {
+		// Another name of a known inode: record it, so the
+		// inode keeps a valid path if the other names are
+		// unlinked.
+		n.Inode().AddChild(name, out.Inode())
+		n.addChild(name, out)
 	}
 	return out
 }
@@ -639,6 +812,14 @@ func (n *pathInode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Cont
 }
 
 func (n *pathInode) Chmod(file nodefs.File, perms uint32, context *fuse.Context) (code fuse.Status) {
+	// Prefer the handle from the request, as Truncate does.
+	if file != nil {
+		code = file.Chmod(perms)
+		if code.Ok() {
+			return code
+		}
+	}
+
 	files := n.Inode().Files(fuse.O_ANYWRITE)
 	for _, f := range files {
 		// TODO - pass context
@@ -655,6 +836,13 @@ func (n *pathInode) Chmod(file nodefs.File, perms uint32, context *fuse.Context)
 }
 
 func (n *pathInode) Chown(file nodefs.File, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	if file != nil {
+		code = file.Chown(uid, gid)
+		if code.Ok() {
+			return code
+		}
+	}
+
 	files := n.Inode().Files(fuse.O_ANYWRITE)
 	for _, f := range files {
 		// TODO - pass context
@@ -671,6 +859,15 @@ func (n *pathInode) Chown(file nodefs.File, uid uint32, gid uint32, context *fus
 }
 
 func (n *pathInode) Truncate(file nodefs.File, size uint64, context *fuse.Context) (code fuse.Status) {
+	// Prefer the handle from the request: the path may have been
+	// renamed since the file was opened.
+	if file != nil {
+		code = file.Truncate(size)
+		if code.Ok() {
+			return code
+		}
+	}
+
 	files := n.Inode().Files(fuse.O_ANYWRITE)
 	for _, f := range files {
 		// TODO - pass context
@@ -686,6 +883,13 @@ func (n *pathInode) Truncate(file nodefs.File, size uint64, context *fuse.Contex
 }
 
 func (n *pathInode) Utimens(file nodefs.File, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	if file != nil {
+		code = file.Utimens(atime, mtime)
+		if code.Ok() {
+			return code
+		}
+	}
+
 	files := n.Inode().Files(fuse.O_ANYWRITE)
 	for _, f := range files {
 		// TODO - pass context
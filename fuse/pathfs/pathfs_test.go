@@ -0,0 +1,247 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// unknownTypeFileSystem lists directories like a backend that
+// returns DT_UNKNOWN for every entry. It records the uids that
+// GetAttr is called with.
+type unknownTypeFileSystem struct {
+	FileSystem
+	getAttrUids []uint32
+}
+
+func (fs *unknownTypeFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	fs.getAttrUids = append(fs.getAttrUids, context.Uid)
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func clearTypes(entries []fuse.DirEntry) {
+	for i := range entries {
+		entries[i].Mode &^= syscall.S_IFMT
+	}
+}
+
+func (fs *unknownTypeFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	entries, code := fs.FileSystem.OpenDir(name, context)
+	clearTypes(entries)
+	return entries, code
+}
+
+func (fs *unknownTypeFileSystem) OpenDirStream(name string, context *fuse.Context) (nodefs.DirStream, fuse.Status) {
+	s, code := fs.FileSystem.(DirStreamFileSystem).OpenDirStream(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &unknownTypeDirStream{s}, fuse.OK
+}
+
+type unknownTypeDirStream struct {
+	nodefs.DirStream
+}
+
+func (s *unknownTypeDirStream) Next(n int) ([]fuse.DirEntry, fuse.Status) {
+	entries, code := s.DirStream.Next(n)
+	clearTypes(entries)
+	return entries, code
+}
+
+func TestResolveUnknownTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-dirtypes")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := os.Symlink("file", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	want := map[string]uint32{
+		"file": syscall.S_IFREG,
+		"dir":  syscall.S_IFDIR,
+		"link": syscall.S_IFLNK,
+	}
+
+	for _, resolve := range []bool{false, true} {
+		fs := &unknownTypeFileSystem{FileSystem: NewLoopbackFileSystem(dir)}
+		pfs := NewPathNodeFs(fs, &PathNodeFsOptions{ResolveUnknownTypes: resolve})
+		nodefs.NewFileSystemConnector(pfs.Root(), nil)
+		root := pfs.Root()
+
+		entries, code := root.OpenDir(&fuse.Context{})
+		if !code.Ok() {
+			t.Fatalf("OpenDir: %v", code)
+		}
+		// The OPENDIR context is reused for other requests
+		// before READDIR.
+		ctx := &fuse.Context{Owner: fuse.Owner{Uid: 1}}
+		s, code := root.(nodefs.DirStreamNode).OpenDirStream(ctx)
+		if !code.Ok() {
+			t.Fatalf("OpenDirStream: %v", code)
+		}
+		ctx.Uid = 2
+		fs.getAttrUids = nil
+		streamed, code := s.Next(100)
+		s.Close()
+		if !code.Ok() {
+			t.Fatalf("Next: %v", code)
+		}
+
+		for _, uid := range fs.getAttrUids {
+			if uid != 1 {
+				t.Errorf("GetAttr from Next: got uid %d, want the OPENDIR uid 1", uid)
+			}
+		}
+
+		for _, l := range [][]fuse.DirEntry{entries, streamed} {
+			if len(l) != len(want) {
+				t.Errorf("got %d entries, want %d", len(l), len(want))
+			}
+			for _, e := range l {
+				got := e.Mode & syscall.S_IFMT
+				if !resolve {
+					if got != 0 {
+						t.Errorf("%q: got type 0%o without ResolveUnknownTypes, want 0", e.Name, got)
+					}
+				} else if got != want[e.Name] {
+					t.Errorf("%q: got type 0%o, want 0%o", e.Name, got, want[e.Name])
+				}
+			}
+		}
+	}
+}
+
+// fsyncRecordingFileSystem records the flags of Fsync calls on its
+// files.
+type fsyncRecordingFileSystem struct {
+	FileSystem
+	flags []int
+}
+
+type fsyncRecordingFile struct {
+	nodefs.File
+	fs *fsyncRecordingFileSystem
+}
+
+func (f *fsyncRecordingFile) Fsync(flags int) fuse.Status {
+	f.fs.flags = append(f.fs.flags, flags)
+	return f.File.Fsync(flags)
+}
+
+func (fs *fsyncRecordingFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, code := fs.FileSystem.Open(name, flags, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &fsyncRecordingFile{f, fs}, fuse.OK
+}
+
+func TestFsyncFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-fsync")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	rec := &fsyncRecordingFileSystem{FileSystem: NewLoopbackFileSystem(dir)}
+	// The whole-file codec buffers writes until Flush or Fsync.
+	fs := NewTimeoutFileSystem(NewCodecFileSystem(rec, wholeXorCodec{xorCodec{}}), time.Minute, fuse.EIO)
+	rawFS := nodefs.NewFileSystemConnector(NewPathNodeFs(fs, nil).Root(), nil).RawFS()
+
+	var entry fuse.EntryOut
+	if code := rawFS.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "file", &entry); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	var open fuse.OpenOut
+	openIn := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Flags: uint32(os.O_RDWR)}
+	if code := rawFS.Open(&openIn, &open); !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	defer rawFS.Release(&fuse.ReleaseIn{InHeader: openIn.InHeader, Fh: open.Fh})
+
+	for _, flags := range []uint32{fuse.FSYNC_FDATASYNC, 0} {
+		if code := rawFS.Fsync(&fuse.FsyncIn{InHeader: openIn.InHeader, Fh: open.Fh, FsyncFlags: flags}); !code.Ok() {
+			t.Fatalf("Fsync(%d): %v", flags, code)
+		}
+	}
+	if len(rec.flags) != 2 || rec.flags[0] != fuse.FSYNC_FDATASYNC || rec.flags[1] != 0 {
+		t.Errorf("backing Fsync flags: got %v, want [%d 0]", rec.flags, fuse.FSYNC_FDATASYNC)
+	}
+}
+
+// blobFileSystem caches files under immutable/ for a day, and those
+// under volatile/ not at all.
+type blobFileSystem struct {
+	FileSystem
+}
+
+func (fs *blobFileSystem) CacheTimeouts(name string) (entry time.Duration, attr time.Duration) {
+	switch filepath.Dir(name) {
+	case "immutable":
+		return 24 * time.Hour, 24 * time.Hour
+	case "volatile":
+		return 0, 0
+	}
+	return -1, -1
+}
+
+func TestCacheTimeouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-cachetimeouts")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"immutable", "volatile"} {
+		os.Mkdir(filepath.Join(dir, d), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, d, "blob"), nil, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	opts := nodefs.NewOptions()
+	rawFS := nodefs.NewFileSystemConnector(NewPathNodeFs(&blobFileSystem{NewLoopbackFileSystem(dir)}, nil).Root(), opts).RawFS()
+
+	lookup := func(parent uint64, name string) *fuse.EntryOut {
+		out := &fuse.EntryOut{}
+		if code := rawFS.Lookup(&fuse.InHeader{NodeId: parent}, name, out); !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, code)
+		}
+		return out
+	}
+	for _, c := range []struct {
+		dir         string
+		entry, attr uint64
+	}{
+		{"immutable", 24 * 3600, 24 * 3600},
+		{"volatile", 0, 0},
+	} {
+		d := lookup(fuse.FUSE_ROOT_ID, c.dir)
+		if d.EntryValid != uint64(opts.EntryTimeout/time.Second) {
+			t.Errorf("%s: got entry timeout %ds, want the default", c.dir, d.EntryValid)
+		}
+		e := lookup(d.NodeId, "blob")
+		if e.EntryValid != c.entry || e.AttrValid != c.attr || e.EntryValidNsec != 0 || e.AttrValidNsec != 0 {
+			t.Errorf("%s/blob: got entry %ds, attr %ds, want %d, %d", c.dir, e.EntryValid, e.AttrValid, c.entry, c.attr)
+		}
+		var out fuse.AttrOut
+		if code := rawFS.GetAttr(&fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: e.NodeId}}, &out); !code.Ok() || out.AttrValid != c.attr {
+			t.Errorf("%s/blob: GetAttr got attr timeout %ds, %v, want %d", c.dir, out.AttrValid, code, c.attr)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func readAll(t *testing.T, fs FileSystem, name string) (string, fuse.Status) {
+	f, code := fs.Open(name, uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		return "", code
+	}
+	defer f.Release()
+	buf := make([]byte, 100)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatalf("Read(%q): %v", name, code)
+	}
+	data, code := res.Bytes(buf)
+	if !code.Ok() {
+		t.Fatalf("Read(%q): %v", name, code)
+	}
+	res.Done()
+	return string(data), fuse.OK
+}
+
+func TestPinningFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-pin")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"lib", "other"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("hello "+name), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	fs := NewPinningFileSystem(NewLoopbackFileSystem(dir))
+
+	if code := fs.Pin("lib"); !code.Ok() {
+		t.Fatalf("Pin: %v", code)
+	}
+	if code := fs.Pin(""); code != fuse.EINVAL {
+		t.Errorf("Pin of a directory: got %v, want EINVAL", code)
+	}
+
+	// Removed behind the wrapper's back, the pinned file is
+	// still served.
+	if err := os.Remove(filepath.Join(dir, "lib")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if got, code := readAll(t, fs, "lib"); !code.Ok() || got != "hello lib" {
+		t.Errorf("read of pinned file: got %q, %v", got, code)
+	}
+	// An open handle outlives the pin.
+	f, code := fs.Open("lib", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	fs.Unpin("lib")
+	if _, code := f.Read(make([]byte, 10), 0); !code.Ok() {
+		t.Errorf("Read after Unpin: %v", code)
+	}
+	f.Release()
+	if _, code := readAll(t, fs, "lib"); code != fuse.ENOENT {
+		t.Errorf("read after Unpin: got %v, want ENOENT", code)
+	}
+
+	// Unlink through the wrapper drops the pin.
+	if code := fs.Pin("other"); !code.Ok() {
+		t.Fatalf("Pin: %v", code)
+	}
+	if code := fs.Unlink("other", nil); !code.Ok() {
+		t.Fatalf("Unlink: %v", code)
+	}
+	if _, code := readAll(t, fs, "other"); code != fuse.ENOENT {
+		t.Errorf("read after Unlink: got %v, want ENOENT", code)
+	}
+}
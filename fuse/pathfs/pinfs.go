@@ -0,0 +1,177 @@
+package pathfs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// PinningFileSystem passes operations to the wrapped FileSystem, but
+// keeps pinned files open, so that read-only opens of them are served
+// from the pinned File without opening the backing file again.
+//
+// The wrapper only sees changes that go through it: Unlink and Rename
+// of a pinned file, or of a directory above it, drop the pin, but a
+// pinned file that is removed or replaced behind its back is still
+// served, with its old contents, until it is unpinned.
+type PinningFileSystem struct {
+	FileSystem
+
+	mu   sync.Mutex
+	pins map[string]*pinnedFile
+}
+
+// pinnedFile is an open File shared by the pin and the handles
+// opened from it.
+type pinnedFile struct {
+	file nodefs.File
+
+	// refs counts the pin and the open handles. It is protected
+	// by the PinningFileSystem's mu; file is released when it
+	// drops to zero.
+	refs int
+}
+
+// NewPinningFileSystem returns a PinningFileSystem wrapping fs, with
+// no files pinned.
+func NewPinningFileSystem(fs FileSystem) *PinningFileSystem {
+	return &PinningFileSystem{
+		FileSystem: fs,
+		pins:       map[string]*pinnedFile{},
+	}
+}
+
+func (fs *PinningFileSystem) String() string {
+	return fmt.Sprintf("PinningFileSystem(%v)", fs.FileSystem)
+}
+
+// Pin opens the regular file name for reading and keeps it open
+// until Unpin. Pinning a pinned file does nothing.
+func (fs *PinningFileSystem) Pin(name string) fuse.Status {
+	name = strings.Trim(name, "/")
+	fs.mu.Lock()
+	_, ok := fs.pins[name]
+	fs.mu.Unlock()
+	if ok {
+		return fuse.OK
+	}
+
+	a, code := fs.FileSystem.GetAttr(name, nil)
+	if !code.Ok() {
+		return code
+	}
+	if !a.IsRegular() {
+		return fuse.EINVAL
+	}
+	f, code := fs.FileSystem.Open(name, syscall.O_RDONLY, nil)
+	if !code.Ok() {
+		return code
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.pins[name]; ok {
+		// Lost a race with another Pin.
+		f.Release()
+		return fuse.OK
+	}
+	fs.pins[name] = &pinnedFile{file: f, refs: 1}
+	return fuse.OK
+}
+
+// Unpin drops the pin on name. The backing file is closed once the
+// handles that were opened from the pin are released too.
+func (fs *PinningFileSystem) Unpin(name string) {
+	name = strings.Trim(name, "/")
+	fs.mu.Lock()
+	p := fs.pins[name]
+	delete(fs.pins, name)
+	fs.mu.Unlock()
+	if p != nil {
+		fs.unref(p)
+	}
+}
+
+// unpinTree drops the pins on name and everything below it.
+func (fs *PinningFileSystem) unpinTree(name string) {
+	var dropped []*pinnedFile
+	fs.mu.Lock()
+	for n, p := range fs.pins {
+		if name == "" || n == name || strings.HasPrefix(n, name+"/") {
+			delete(fs.pins, n)
+			dropped = append(dropped, p)
+		}
+	}
+	fs.mu.Unlock()
+	for _, p := range dropped {
+		fs.unref(p)
+	}
+}
+
+func (fs *PinningFileSystem) unref(p *pinnedFile) {
+	fs.mu.Lock()
+	p.refs--
+	release := p.refs == 0
+	fs.mu.Unlock()
+	if release {
+		p.file.Release()
+	}
+}
+
+func (fs *PinningFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&(syscall.O_ACCMODE|syscall.O_TRUNC) == syscall.O_RDONLY {
+		fs.mu.Lock()
+		p := fs.pins[name]
+		if p != nil {
+			p.refs++
+		}
+		fs.mu.Unlock()
+		if p != nil {
+			return &pinnedHandle{File: p.file, fs: fs, pin: p}, fuse.OK
+		}
+	}
+	return fs.FileSystem.Open(name, flags, context)
+}
+
+func (fs *PinningFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	code := fs.FileSystem.Unlink(name, context)
+	if code.Ok() {
+		fs.unpinTree(name)
+	}
+	return code
+}
+
+func (fs *PinningFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	code := fs.FileSystem.Rename(oldName, newName, context)
+	if code.Ok() {
+		fs.unpinTree(oldName)
+		fs.unpinTree(newName)
+	}
+	return code
+}
+
+// pinnedHandle is a handle opened from a pin. Releasing it leaves
+// the pinned File open.
+type pinnedHandle struct {
+	nodefs.File
+	fs  *PinningFileSystem
+	pin *pinnedFile
+
+	once sync.Once
+}
+
+func (f *pinnedHandle) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *pinnedHandle) String() string {
+	return fmt.Sprintf("pinnedHandle(%s)", f.File.String())
+}
+
+func (f *pinnedHandle) Release() {
+	f.once.Do(func() { f.fs.unref(f.pin) })
+}
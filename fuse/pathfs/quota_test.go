@@ -0,0 +1,163 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+func newQuotaTestFs(t *testing.T) (FileSystem, func()) {
+	dir, err := ioutil.TempDir("", "go-fuse-quota")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	fs := NewQuotaFileSystem(NewLoopbackFileSystem(dir), []QuotaRule{
+		{Prefix: "projectA", Limit: 10},
+		{Prefix: "/projectB/", Limit: 20},
+	})
+	for _, d := range []string{"projectA", "projectB"} {
+		if code := fs.Mkdir(d, 0755, nil); !code.Ok() {
+			t.Fatalf("Mkdir(%q): %v", d, code)
+		}
+	}
+	return fs, func() { os.RemoveAll(dir) }
+}
+
+func quotaCreate(t *testing.T, fs FileSystem, name string) nodefs.File {
+	f, code := fs.Create(name, uint32(os.O_WRONLY|os.O_TRUNC), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create(%q): %v", name, code)
+	}
+	return f
+}
+
+func TestQuotaSubtrees(t *testing.T) {
+	fs, clean := newQuotaTestFs(t)
+	defer clean()
+
+	a := quotaCreate(t, fs, "projectA/file")
+	defer a.Release()
+	b := quotaCreate(t, fs, "projectB/file")
+	defer b.Release()
+
+	if _, code := a.Write(make([]byte, 8), 0); !code.Ok() {
+		t.Fatalf("Write A: %v", code)
+	}
+	if _, code := a.Write(make([]byte, 4), 8); code != fuse.EDQUOT {
+		t.Errorf("Write A over limit: got %v, want EDQUOT", code)
+	}
+	// Overwriting existing data does not need more quota.
+	if _, code := a.Write(make([]byte, 8), 0); !code.Ok() {
+		t.Errorf("Overwrite A: %v", code)
+	}
+
+	// B has its own limit.
+	if _, code := b.Write(make([]byte, 16), 0); !code.Ok() {
+		t.Fatalf("Write B: %v", code)
+	}
+	if _, code := b.Write(make([]byte, 8), 16); code != fuse.EDQUOT {
+		t.Errorf("Write B over limit: got %v, want EDQUOT", code)
+	}
+
+	// Outside the rules, there is no limit.
+	c := quotaCreate(t, fs, "other")
+	defer c.Release()
+	if _, code := c.Write(make([]byte, 100), 0); !code.Ok() {
+		t.Errorf("Write other: %v", code)
+	}
+
+	// Truncation credits back.
+	if code := a.Truncate(2); !code.Ok() {
+		t.Fatalf("Truncate: %v", code)
+	}
+	if _, code := a.Write(make([]byte, 8), 2); !code.Ok() {
+		t.Errorf("Write A after truncate: %v", code)
+	}
+}
+
+func TestQuotaUnlinkAndRename(t *testing.T) {
+	fs, clean := newQuotaTestFs(t)
+	defer clean()
+
+	a := quotaCreate(t, fs, "projectA/file")
+	if _, code := a.Write(make([]byte, 10), 0); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+	a.Release()
+
+	// Moving the file transfers its charge to B.
+	if code := fs.Rename("projectA/file", "projectB/file", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	a = quotaCreate(t, fs, "projectA/file2")
+	if _, code := a.Write(make([]byte, 10), 0); !code.Ok() {
+		t.Errorf("Write A after rename: %v", code)
+	}
+	a.Release()
+
+	b := quotaCreate(t, fs, "projectB/file3")
+	if _, code := b.Write(make([]byte, 11), 0); code != fuse.EDQUOT {
+		t.Errorf("Write B: got %v, want EDQUOT", code)
+	}
+	b.Release()
+
+	// A is full, so it cannot take B's file.
+	if code := fs.Rename("projectB/file", "projectA/file", nil); code != fuse.EDQUOT {
+		t.Errorf("Rename into full subtree: got %v, want EDQUOT", code)
+	}
+
+	if code := fs.Unlink("projectA/file2", nil); !code.Ok() {
+		t.Fatalf("Unlink: %v", code)
+	}
+	if code := fs.Rename("projectB/file", "projectA/file", nil); !code.Ok() {
+		t.Errorf("Rename after unlink: %v", code)
+	}
+
+	if code := fs.Mkdir("projectA/dir", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	if code := fs.Rename("projectA/dir", "projectB/dir", nil); code != fuse.EXDEV {
+		t.Errorf("Rename dir: got %v, want EXDEV", code)
+	}
+}
+
+func TestQuotaRenameRuleDir(t *testing.T) {
+	fs, clean := newQuotaTestFs(t)
+	defer clean()
+
+	if code := fs.Mkdir("top", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	if code := fs.Rename("projectA", "top/projectA", nil); !code.Ok() {
+		t.Fatalf("Rename rule dir: %v", code)
+	}
+	if code := fs.Rename("top", "top2", nil); !code.Ok() {
+		t.Fatalf("Rename parent dir: %v", code)
+	}
+
+	// The limit of projectA moved along with it.
+	a := quotaCreate(t, fs, "top2/projectA/file")
+	defer a.Release()
+	if _, code := a.Write(make([]byte, 11), 0); code != fuse.EDQUOT {
+		t.Errorf("Write: got %v, want EDQUOT", code)
+	}
+	if _, code := a.Write(make([]byte, 10), 0); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+
+	// The charge of an open file follows a rename of the rule dir.
+	if code := fs.Rename("top2/projectA", "projectA", nil); !code.Ok() {
+		t.Fatalf("Rename back: %v", code)
+	}
+	if code := a.Truncate(0); !code.Ok() {
+		t.Fatalf("Truncate: %v", code)
+	}
+	b := quotaCreate(t, fs, "projectA/file2")
+	defer b.Release()
+	if _, code := b.Write(make([]byte, 10), 0); !code.Ok() {
+		t.Errorf("Write after truncate: %v", code)
+	}
+}
@@ -0,0 +1,351 @@
+package pathfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// QuotaRule limits the number of bytes stored in a subtree.
+type QuotaRule struct {
+	// Prefix is the root of the subtree, relative to the root of
+	// the file system. The empty prefix covers the whole file
+	// system.
+	Prefix string
+
+	// Limit is the maximum number of bytes in the subtree.
+	Limit int64
+}
+
+type quotaRule struct {
+	prefix string
+	limit  int64
+	used   int64
+}
+
+func (r *quotaRule) contains(name string) bool {
+	return r.prefix == "" || name == r.prefix || strings.HasPrefix(name, r.prefix+"/")
+}
+
+// rulesByPrefix sorts the longest prefix first.
+type rulesByPrefix []*quotaRule
+
+func (r rulesByPrefix) Len() int           { return len(r) }
+func (r rulesByPrefix) Less(i, j int) bool { return len(r[i].prefix) > len(r[j].prefix) }
+func (r rulesByPrefix) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+type quotaFileSystem struct {
+	FileSystem
+
+	// exceeded is returned for writes over a limit.
+	exceeded fuse.Status
+
+	mu sync.Mutex
+
+	// rules is sorted with the longest prefix first. The prefixes
+	// follow renames of the directories they name.
+	rules []*quotaRule
+	files map[*quotaFile]struct{}
+}
+
+// NewQuotaFileSystem returns a wrapper that limits the size of the
+// files in each of the given subtrees, returning EDQUOT for writes
+// that would exceed the limit. A file is charged to the rule with
+// the longest matching prefix. Usage is accounted from the creation
+// of the wrapper on, by the apparent size of files; data stored
+// before then is only credited back as far as it was charged.
+//
+// Renaming a file into another subtree transfers its charge; renaming
+// a directory across subtrees returns EXDEV, so that mv(1) falls back
+// to copying. Rules for the renamed directory and the subtrees below
+// it move along with it.
+func NewQuotaFileSystem(fs FileSystem, rules []QuotaRule) FileSystem {
+	q := &quotaFileSystem{
+		FileSystem: fs,
+		exceeded:   fuse.EDQUOT,
+		files:      map[*quotaFile]struct{}{},
+	}
+	for _, r := range rules {
+		q.rules = append(q.rules, &quotaRule{
+			prefix: strings.Trim(r.Prefix, "/"),
+			limit:  r.Limit,
+		})
+	}
+	sort.Sort(rulesByPrefix(q.rules))
+	return q
+}
+
+func (fs *quotaFileSystem) String() string {
+	return fmt.Sprintf("quotaFileSystem(%v)", fs.FileSystem)
+}
+
+// ruleFor returns the rule that name is charged to, or nil.
+func (fs *quotaFileSystem) ruleFor(name string) *quotaRule {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, r := range fs.rules {
+		if r.contains(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// reserve charges delta bytes to r, or returns fs.exceeded if that
+// would exceed its limit.
+func (fs *quotaFileSystem) reserve(r *quotaRule, delta int64) fuse.Status {
+	if r == nil {
+		return fuse.OK
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if delta > 0 && r.used+delta > r.limit {
+		return fs.exceeded
+	}
+	r.used += delta
+	if r.used < 0 {
+		r.used = 0
+	}
+	return fuse.OK
+}
+
+// adjust charges delta bytes to r regardless of its limit.
+func (fs *quotaFileSystem) adjust(r *quotaRule, delta int64) {
+	if r == nil {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	r.used += delta
+	if r.used < 0 {
+		r.used = 0
+	}
+}
+
+// fileSize returns the size of name if it is a file that owns its
+// data, ie. it is not a directory and has no other links.
+func (fs *quotaFileSystem) fileSize(name string, context *fuse.Context) int64 {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if !code.Ok() || a.IsDir() || a.Nlink > 1 {
+		return 0
+	}
+	return int64(a.Size)
+}
+
+func (fs *quotaFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	size := fs.fileSize(name, context)
+	code := fs.FileSystem.Unlink(name, context)
+	if code.Ok() {
+		fs.adjust(fs.ruleFor(name), -size)
+	}
+	return code
+}
+
+func (fs *quotaFileSystem) Truncate(name string, offset uint64, context *fuse.Context) fuse.Status {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if !code.Ok() {
+		return code
+	}
+	r := fs.ruleFor(name)
+	delta := int64(offset) - int64(a.Size)
+	if code := fs.reserve(r, delta); !code.Ok() {
+		return code
+	}
+	code = fs.FileSystem.Truncate(name, offset, context)
+	if !code.Ok() {
+		fs.adjust(r, -delta)
+	}
+	return code
+}
+
+func (fs *quotaFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	src, dst := fs.ruleFor(oldName), fs.ruleFor(newName)
+
+	// A rule for oldName itself moves along, and keeps its charge.
+	to := dst
+	if src != nil && src.prefix == oldName {
+		to = src
+	}
+	var size int64
+	if src != to {
+		a, code := fs.FileSystem.GetAttr(oldName, context)
+		if !code.Ok() {
+			return code
+		}
+		if a.IsDir() {
+			return fuse.EXDEV
+		}
+		size = int64(a.Size)
+	}
+	replaced := fs.fileSize(newName, context)
+
+	if code := fs.reserve(to, size); !code.Ok() {
+		return code
+	}
+	code := fs.FileSystem.Rename(oldName, newName, context)
+	if !code.Ok() {
+		fs.adjust(to, -size)
+		return code
+	}
+	fs.adjust(src, -size)
+	fs.adjust(dst, -replaced)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, r := range fs.rules {
+		if r.prefix != "" {
+			r.prefix = renamePath(r.prefix, oldName, newName)
+		}
+	}
+	sort.Sort(rulesByPrefix(fs.rules))
+	for f := range fs.files {
+		f.name = renamePath(f.name, oldName, newName)
+	}
+	return code
+}
+
+// renamePath returns the new name of name after renaming oldName to
+// newName.
+func renamePath(name, oldName, newName string) string {
+	if name == oldName {
+		return newName
+	}
+	if strings.HasPrefix(name, oldName+"/") {
+		return newName + name[len(oldName):]
+	}
+	return name
+}
+
+func (fs *quotaFileSystem) newFile(f nodefs.File, name string) nodefs.File {
+	qf := &quotaFile{
+		File: f,
+		fs:   fs,
+		name: name,
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files[qf] = struct{}{}
+	return qf
+}
+
+func (fs *quotaFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	var size int64
+	if flags&syscall.O_TRUNC != 0 {
+		size = fs.fileSize(name, context)
+	}
+	f, code := fs.FileSystem.Open(name, flags, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	fs.adjust(fs.ruleFor(name), -size)
+	return fs.newFile(f, name), code
+}
+
+func (fs *quotaFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	var size int64
+	if flags&syscall.O_TRUNC != 0 {
+		size = fs.fileSize(name, context)
+	}
+	f, code := fs.FileSystem.Create(name, flags, mode, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	fs.adjust(fs.ruleFor(name), -size)
+	return fs.newFile(f, name), code
+}
+
+// quotaFile charges size changes of a File to its quota rule.
+type quotaFile struct {
+	nodefs.File
+	fs *quotaFileSystem
+
+	// name is protected by fs.mu.
+	name string
+
+	// mu serializes operations that change the size.
+	mu sync.Mutex
+}
+
+func (f *quotaFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *quotaFile) String() string {
+	return fmt.Sprintf("quotaFile(%s)", f.File.String())
+}
+
+func (f *quotaFile) size() (int64, fuse.Status) {
+	var a fuse.Attr
+	code := f.File.GetAttr(&a)
+	return int64(a.Size), code
+}
+
+// resize reserves quota for changing the file size to end, runs op,
+// and then settles the charge to the actual change in size.
+func (f *quotaFile) resize(end int64, grow bool, op func() fuse.Status) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fs.mu.Lock()
+	name := f.name
+	f.fs.mu.Unlock()
+	r := f.fs.ruleFor(name)
+	if r == nil {
+		return op()
+	}
+
+	old, code := f.size()
+	if !code.Ok() {
+		return code
+	}
+	reserved := end - old
+	if grow && reserved < 0 {
+		reserved = 0
+	}
+	if code := f.fs.reserve(r, reserved); !code.Ok() {
+		return code
+	}
+
+	code = op()
+	actual := old
+	if sz, c := f.size(); c.Ok() {
+		actual = sz
+	} else if code.Ok() {
+		actual = old + reserved
+	}
+	f.fs.adjust(r, actual-old-reserved)
+	return code
+}
+
+func (f *quotaFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	var n uint32
+	code := f.resize(off+int64(len(data)), true, func() (code fuse.Status) {
+		n, code = f.File.Write(data, off)
+		return code
+	})
+	return n, code
+}
+
+func (f *quotaFile) Truncate(size uint64) fuse.Status {
+	return f.resize(int64(size), false, func() fuse.Status {
+		return f.File.Truncate(size)
+	})
+}
+
+func (f *quotaFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	return f.resize(int64(off+size), true, func() fuse.Status {
+		return f.File.Allocate(off, size, mode)
+	})
+}
+
+func (f *quotaFile) Release() {
+	f.fs.mu.Lock()
+	delete(f.fs.files, f)
+	f.fs.mu.Unlock()
+	f.File.Release()
+}
@@ -14,6 +14,10 @@ func NewReadonlyFileSystem(fs FileSystem) FileSystem {
 	return &readonlyFileSystem{fs}
 }
 
+func (fs *readonlyFileSystem) ReadOnly() bool {
+	return true
+}
+
 type readonlyFileSystem struct {
 	FileSystem
 }
@@ -0,0 +1,99 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// flakyFileSystem fails GetAttr, Open and Mkdir with EIO until each
+// has been called failures times.
+type flakyFileSystem struct {
+	FileSystem
+	failures int
+	calls    map[string]int
+}
+
+func (fs *flakyFileSystem) fail(op string) bool {
+	fs.calls[op]++
+	return fs.calls[op] <= fs.failures
+}
+
+func (fs *flakyFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if fs.fail("GetAttr") {
+		return nil, fuse.EIO
+	}
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *flakyFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if fs.fail("Open") {
+		return nil, fuse.EIO
+	}
+	return fs.FileSystem.Open(name, flags, context)
+}
+
+func (fs *flakyFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.fail("Mkdir") {
+		return fuse.EIO
+	}
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func TestRetryingFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-retry")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	flaky := &flakyFileSystem{
+		FileSystem: NewLoopbackFileSystem(dir),
+		failures:   2,
+		calls:      map[string]int{},
+	}
+	fs := NewRetryingFileSystem(flaky, &RetryOptions{Backoff: time.Millisecond})
+
+	a, code := fs.GetAttr("file", nil)
+	if !code.Ok() {
+		t.Fatalf("GetAttr: %v", code)
+	}
+	if a.Size != 5 {
+		t.Errorf("GetAttr: got size %d, want 5", a.Size)
+	}
+	if got := flaky.calls["GetAttr"]; got != 3 {
+		t.Errorf("GetAttr called %d times, want 3", got)
+	}
+
+	f, code := fs.Open("file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	f.Release()
+
+	// Mkdir is not idempotent, so the first failure is final.
+	if code := fs.Mkdir("dir", 0755, nil); code != fuse.EIO {
+		t.Errorf("Mkdir: got %v, want EIO", code)
+	}
+	if got := flaky.calls["Mkdir"]; got != 1 {
+		t.Errorf("Mkdir called %d times, want 1", got)
+	}
+
+	// Too many failures: the last error is returned.
+	flaky.failures = 10
+	flaky.calls = map[string]int{}
+	if _, code := fs.GetAttr("file", nil); code != fuse.EIO {
+		t.Errorf("GetAttr: got %v, want EIO", code)
+	}
+	if got := flaky.calls["GetAttr"]; got != 3 {
+		t.Errorf("GetAttr called %d times, want 3", got)
+	}
+}
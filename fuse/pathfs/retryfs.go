@@ -0,0 +1,264 @@
+package pathfs
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// RetryOptions configures NewRetryingFileSystem.
+type RetryOptions struct {
+	// Retryable lists the statuses that are retried. The default
+	// is EIO and EAGAIN.
+	Retryable []fuse.Status
+
+	// MaxAttempts bounds the number of calls per operation,
+	// including the first. The default is 3.
+	MaxAttempts int
+
+	// Backoff is the wait before the first retry. It doubles for
+	// each further retry, up to MaxBackoff. The defaults are 10ms
+	// and 1s.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// If Deadline is set, no retry starts later than Deadline
+	// after the first call.
+	Deadline time.Duration
+}
+
+type retryingFileSystem struct {
+	FileSystem
+	opts      RetryOptions
+	retryable map[fuse.Status]bool
+}
+
+// NewRetryingFileSystem returns a wrapper that retries operations on
+// fs that fail with a transient error, with exponential backoff.
+//
+// Only operations that have the same effect when applied twice are
+// retried: GetAttr, Access, Readlink, OpenDir, GetXAttr, ListXAttr,
+// Chmod, Chown, Utimens, Truncate, SetXAttr without flags, and Open
+// without O_TRUNC. For files, Read and GetAttr are retried, and so is
+// Write, which writes the same data at the same offset again, unless
+// the file was opened with O_APPEND. Operations that create, remove
+// or rename names fail on the first error, since a call that failed
+// on the way back may have been applied. Flush and Fsync are not
+// retried either: after a failed fsync, the kernel may have dropped
+// the dirty data, and a second fsync would wrongly succeed.
+func NewRetryingFileSystem(fs FileSystem, opts *RetryOptions) FileSystem {
+	o := RetryOptions{
+		Retryable:   []fuse.Status{fuse.EIO, fuse.Status(syscall.EAGAIN)},
+		MaxAttempts: 3,
+		Backoff:     10 * time.Millisecond,
+		MaxBackoff:  time.Second,
+	}
+	if opts != nil {
+		if opts.Retryable != nil {
+			o.Retryable = opts.Retryable
+		}
+		if opts.MaxAttempts > 0 {
+			o.MaxAttempts = opts.MaxAttempts
+		}
+		if opts.Backoff > 0 {
+			o.Backoff = opts.Backoff
+		}
+		if opts.MaxBackoff > 0 {
+			o.MaxBackoff = opts.MaxBackoff
+		}
+		o.Deadline = opts.Deadline
+	}
+	r := &retryingFileSystem{
+		FileSystem: fs,
+		opts:       o,
+		retryable:  make(map[fuse.Status]bool, len(o.Retryable)),
+	}
+	for _, code := range o.Retryable {
+		r.retryable[code] = true
+	}
+	return r
+}
+
+func (fs *retryingFileSystem) String() string {
+	return fmt.Sprintf("retryingFileSystem(%v)", fs.FileSystem)
+}
+
+// retry calls f until it returns a status that is not retryable, or
+// the attempts or the deadline run out, and returns the last status.
+func (fs *retryingFileSystem) retry(f func() fuse.Status) fuse.Status {
+	start := time.Now()
+	wait := fs.opts.Backoff
+	for attempt := 1; ; attempt++ {
+		code := f()
+		if !fs.retryable[code] || attempt >= fs.opts.MaxAttempts {
+			return code
+		}
+		if fs.opts.Deadline > 0 && time.Since(start)+wait > fs.opts.Deadline {
+			return code
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > fs.opts.MaxBackoff {
+			wait = fs.opts.MaxBackoff
+		}
+	}
+}
+
+func (fs *retryingFileSystem) GetAttr(name string, context *fuse.Context) (a *fuse.Attr, code fuse.Status) {
+	code = fs.retry(func() fuse.Status {
+		a, code = fs.FileSystem.GetAttr(name, context)
+		return code
+	})
+	return a, code
+}
+
+func (fs *retryingFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.retry(func() fuse.Status {
+		return fs.FileSystem.Access(name, mode, context)
+	})
+}
+
+func (fs *retryingFileSystem) Readlink(name string, context *fuse.Context) (out string, code fuse.Status) {
+	code = fs.retry(func() fuse.Status {
+		out, code = fs.FileSystem.Readlink(name, context)
+		return code
+	})
+	return out, code
+}
+
+func (fs *retryingFileSystem) OpenDir(name string, context *fuse.Context) (entries []fuse.DirEntry, code fuse.Status) {
+	code = fs.retry(func() fuse.Status {
+		entries, code = fs.FileSystem.OpenDir(name, context)
+		return code
+	})
+	return entries, code
+}
+
+func (fs *retryingFileSystem) GetXAttr(name string, attribute string, context *fuse.Context) (data []byte, code fuse.Status) {
+	code = fs.retry(func() fuse.Status {
+		data, code = fs.FileSystem.GetXAttr(name, attribute, context)
+		return code
+	})
+	return data, code
+}
+
+func (fs *retryingFileSystem) ListXAttr(name string, context *fuse.Context) (attrs []string, code fuse.Status) {
+	code = fs.retry(func() fuse.Status {
+		attrs, code = fs.FileSystem.ListXAttr(name, context)
+		return code
+	})
+	return attrs, code
+}
+
+func (fs *retryingFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.retry(func() fuse.Status {
+		return fs.FileSystem.Chmod(name, mode, context)
+	})
+}
+
+func (fs *retryingFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	return fs.retry(func() fuse.Status {
+		return fs.FileSystem.Chown(name, uid, gid, context)
+	})
+}
+
+func (fs *retryingFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	return fs.retry(func() fuse.Status {
+		return fs.FileSystem.Utimens(name, atime, mtime, context)
+	})
+}
+
+func (fs *retryingFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	return fs.retry(func() fuse.Status {
+		return fs.FileSystem.Truncate(name, size, context)
+	})
+}
+
+func (fs *retryingFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if flags != 0 {
+		// XATTR_CREATE and XATTR_REPLACE fail if the first
+		// call got through.
+		return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+	}
+	return fs.retry(func() fuse.Status {
+		return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+	})
+}
+
+func (fs *retryingFileSystem) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	if flags&syscall.O_TRUNC != 0 {
+		// Retrying could truncate data written in between.
+		file, code = fs.FileSystem.Open(name, flags, context)
+	} else {
+		code = fs.retry(func() fuse.Status {
+			file, code = fs.FileSystem.Open(name, flags, context)
+			return code
+		})
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.newFile(file, flags), fuse.OK
+}
+
+func (fs *retryingFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	file, code := fs.FileSystem.Create(name, flags, mode, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.newFile(file, flags), fuse.OK
+}
+
+func (fs *retryingFileSystem) newFile(file nodefs.File, flags uint32) nodefs.File {
+	return &retryingFile{
+		File:   file,
+		fs:     fs,
+		append: flags&syscall.O_APPEND != 0,
+	}
+}
+
+// retryingFile retries the idempotent data operations of a File
+// returned by the retryingFileSystem.
+type retryingFile struct {
+	nodefs.File
+	fs *retryingFileSystem
+
+	// append is set for O_APPEND files, whose writes are not
+	// retried, as each one adds to the end.
+	append bool
+}
+
+func (f *retryingFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *retryingFile) String() string {
+	return fmt.Sprintf("retryingFile(%s)", f.File.String())
+}
+
+func (f *retryingFile) Read(buf []byte, off int64) (res fuse.ReadResult, code fuse.Status) {
+	code = f.fs.retry(func() fuse.Status {
+		res, code = f.File.Read(buf, off)
+		return code
+	})
+	return res, code
+}
+
+func (f *retryingFile) Write(data []byte, off int64) (n uint32, code fuse.Status) {
+	if f.append {
+		return f.File.Write(data, off)
+	}
+	code = f.fs.retry(func() fuse.Status {
+		n, code = f.File.Write(data, off)
+		return code
+	})
+	return n, code
+}
+
+func (f *retryingFile) GetAttr(out *fuse.Attr) fuse.Status {
+	return f.fs.retry(func() fuse.Status {
+		return f.File.GetAttr(out)
+	})
+}
@@ -0,0 +1,94 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestRootSquash(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs to run as root to create files for other users")
+	}
+	dir, err := ioutil.TempDir("", "go-fuse-rootsquash")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	const anon = 65534
+	fs := NewRootSquashFileSystem(NewLoopbackFileSystem(dir), anon, anon)
+	root := &fuse.Context{Owner: fuse.Owner{Uid: 0, Gid: 0}}
+
+	if code := fs.Chown("file", anon, anon, root); code != fuse.EPERM {
+		t.Errorf("Chown: got %v, want EPERM", code)
+	}
+	if code := fs.Chmod("file", 0666, root); code != fuse.EPERM {
+		t.Errorf("Chmod: got %v, want EPERM", code)
+	}
+	if _, code := fs.Open("file", uint32(os.O_WRONLY), root); code != fuse.EACCES {
+		t.Errorf("Open for writing: got %v, want EACCES", code)
+	}
+	f, code := fs.Open("file", uint32(os.O_RDONLY), root)
+	if !code.Ok() {
+		t.Fatalf("Open for reading: %v", code)
+	}
+	f.Release()
+
+	f, code = fs.Create("new", uint32(os.O_WRONLY), 0644, root)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	f.Release()
+	fi, err := os.Lstat(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != anon || st.Gid != anon {
+		t.Errorf("created file is owned by %d:%d, want %d:%d", st.Uid, st.Gid, anon, anon)
+	}
+	if code := fs.Chmod("new", 0600, root); !code.Ok() {
+		t.Errorf("Chmod of own file: %v", code)
+	}
+
+	// A symlink is handed over itself, not its target.
+	outside, err := ioutil.TempFile("", "go-fuse-rootsquash-target")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	outside.Close()
+	defer os.Remove(outside.Name())
+	if code := fs.Symlink(outside.Name(), "link", root); !code.Ok() {
+		t.Fatalf("Symlink: %v", code)
+	}
+	fi, err = os.Stat(outside.Name())
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 0 || st.Gid != 0 {
+		t.Errorf("symlink target is owned by %d:%d, want 0:0", st.Uid, st.Gid)
+	}
+	fi, err = os.Lstat(filepath.Join(dir, "link"))
+	if err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != anon || st.Gid != anon {
+		t.Errorf("symlink is owned by %d:%d, want %d:%d", st.Uid, st.Gid, anon, anon)
+	}
+
+	// Other callers are passed through.
+	user := &fuse.Context{Owner: fuse.Owner{Uid: 1000, Gid: 1000}}
+	if code := fs.Chown("file", 1000, 1000, user); !code.Ok() {
+		t.Errorf("Chown by uid 1000: %v", code)
+	}
+}
@@ -0,0 +1,318 @@
+package pathfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+type rootSquashFileSystem struct {
+	FileSystem
+	anon fuse.Owner
+}
+
+// NewRootSquashFileSystem returns a wrapper that treats callers with
+// uid 0 as the anonymous user uid:gid, like root_squash in NFS, so
+// that a root user of the mount has no privileges on the backing
+// store. Such calls are passed on to fs with the anonymous owner in
+// their Context, and the wrapper does the permission checks that
+// root would bypass, from the mode bits that GetAttr reports: a
+// squashed caller may not chown, may only chmod files it owns, and
+// needs the usual read, write and search permissions. Files it
+// creates are chowned to the anonymous user. Other callers are not
+// affected.
+//
+// As the server often runs as root itself, the mount should be
+// served with the default_permissions option off, so the kernel
+// doesn't grant root access first.
+func NewRootSquashFileSystem(fs FileSystem, uid uint32, gid uint32) FileSystem {
+	return &rootSquashFileSystem{
+		FileSystem: fs,
+		anon:       fuse.Owner{Uid: uid, Gid: gid},
+	}
+}
+
+func (fs *rootSquashFileSystem) String() string {
+	return fmt.Sprintf("rootSquashFileSystem(%v)", fs.FileSystem)
+}
+
+// squash returns the context to pass on, and whether the caller is
+// squashed.
+func (fs *rootSquashFileSystem) squash(context *fuse.Context) (*fuse.Context, bool) {
+	if context == nil || context.Uid != 0 {
+		return context, false
+	}
+	c := *context
+	c.Owner = fs.anon
+	return &c, true
+}
+
+func parentDir(name string) string {
+	if d := filepath.Dir(name); d != "." {
+		return d
+	}
+	return ""
+}
+
+// check returns EACCES unless the anonymous user has the R_OK, W_OK
+// and X_OK bits of perm on name.
+func (fs *rootSquashFileSystem) check(name string, perm uint32, context *fuse.Context) fuse.Status {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if !code.Ok() {
+		return code
+	}
+	mode := a.Mode & 07
+	if a.Uid == fs.anon.Uid {
+		mode = (a.Mode >> 6) & 07
+	} else if a.Gid == fs.anon.Gid {
+		mode = (a.Mode >> 3) & 07
+	}
+	if mode&perm != perm {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// checkOwner returns EPERM unless the anonymous user owns name.
+func (fs *rootSquashFileSystem) checkOwner(name string, context *fuse.Context) fuse.Status {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if a.Uid != fs.anon.Uid {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// created hands a new entry to the anonymous user. It is undone if
+// that fails. As Chown doesn't follow symlinks, a squashed caller
+// can't take over a file by creating a symlink to it, or by renaming
+// one over the new entry.
+func (fs *rootSquashFileSystem) created(name string, code fuse.Status, context *fuse.Context) fuse.Status {
+	if !code.Ok() {
+		return code
+	}
+	if code := fs.FileSystem.Chown(name, fs.anon.Uid, fs.anon.Gid, context); !code.Ok() {
+		if a, c := fs.FileSystem.GetAttr(name, context); c.Ok() && a.IsDir() {
+			fs.FileSystem.Rmdir(name, context)
+		} else {
+			fs.FileSystem.Unlink(name, context)
+		}
+		return code
+	}
+	return fuse.OK
+}
+
+func (fs *rootSquashFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if squashed {
+		if code := fs.checkOwner(name, c); !code.Ok() {
+			return code
+		}
+	}
+	return fs.FileSystem.Chmod(name, mode, c)
+}
+
+func (fs *rootSquashFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if squashed {
+		// Only a no-op chown is allowed.
+		a, code := fs.FileSystem.GetAttr(name, c)
+		if !code.Ok() {
+			return code
+		}
+		if (uid != ^uint32(0) && uid != a.Uid) || (gid != ^uint32(0) && gid != a.Gid) {
+			return fuse.EPERM
+		}
+	}
+	return fs.FileSystem.Chown(name, uid, gid, c)
+}
+
+func (fs *rootSquashFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if squashed && !fs.checkOwner(name, c).Ok() {
+		if code := fs.check(name, fuse.W_OK, c); !code.Ok() {
+			return fuse.EPERM
+		}
+	}
+	return fs.FileSystem.Utimens(name, atime, mtime, c)
+}
+
+func (fs *rootSquashFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if squashed {
+		if code := fs.check(name, fuse.W_OK, c); !code.Ok() {
+			return code
+		}
+	}
+	return fs.FileSystem.Truncate(name, size, c)
+}
+
+func (fs *rootSquashFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if squashed {
+		if code := fs.check(name, mode&(fuse.R_OK|fuse.W_OK|fuse.X_OK), c); !code.Ok() {
+			return code
+		}
+	}
+	return fs.FileSystem.Access(name, mode, c)
+}
+
+func (fs *rootSquashFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if squashed {
+		if code := fs.check(parentDir(newName), fuse.W_OK|fuse.X_OK, c); !code.Ok() {
+			return code
+		}
+	}
+	return fs.FileSystem.Link(oldName, newName, c)
+}
+
+func (fs *rootSquashFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if !squashed {
+		return fs.FileSystem.Mkdir(name, mode, c)
+	}
+	if code := fs.check(parentDir(name), fuse.W_OK|fuse.X_OK, c); !code.Ok() {
+		return code
+	}
+	return fs.created(name, fs.FileSystem.Mkdir(name, mode, c), c)
+}
+
+func (fs *rootSquashFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if !squashed {
+		return fs.FileSystem.Mknod(name, mode, dev, c)
+	}
+	if t := mode & syscall.S_IFMT; t == syscall.S_IFCHR || t == syscall.S_IFBLK {
+		return fuse.EPERM
+	}
+	if code := fs.check(parentDir(name), fuse.W_OK|fuse.X_OK, c); !code.Ok() {
+		return code
+	}
+	return fs.created(name, fs.FileSystem.Mknod(name, mode, dev, c), c)
+}
+
+func (fs *rootSquashFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if !squashed {
+		return fs.FileSystem.Symlink(value, linkName, c)
+	}
+	if code := fs.check(parentDir(linkName), fuse.W_OK|fuse.X_OK, c); !code.Ok() {
+		return code
+	}
+	return fs.created(linkName, fs.FileSystem.Symlink(value, linkName, c), c)
+}
+
+func (fs *rootSquashFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if squashed {
+		for _, dir := range []string{parentDir(oldName), parentDir(newName)} {
+			if code := fs.check(dir, fuse.W_OK|fuse.X_OK, c); !code.Ok() {
+				return code
+			}
+		}
+	}
+	return fs.FileSystem.Rename(oldName, newName, c)
+}
+
+func (fs *rootSquashFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if squashed {
+		if code := fs.check(parentDir(name), fuse.W_OK|fuse.X_OK, c); !code.Ok() {
+			return code
+		}
+	}
+	return fs.FileSystem.Rmdir(name, c)
+}
+
+func (fs *rootSquashFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if squashed {
+		if code := fs.check(parentDir(name), fuse.W_OK|fuse.X_OK, c); !code.Ok() {
+			return code
+		}
+	}
+	return fs.FileSystem.Unlink(name, c)
+}
+
+func (fs *rootSquashFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if squashed {
+		if code := fs.check(name, fuse.W_OK, c); !code.Ok() {
+			return code
+		}
+	}
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, c)
+}
+
+func (fs *rootSquashFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	c, squashed := fs.squash(context)
+	if squashed {
+		if code := fs.check(name, fuse.W_OK, c); !code.Ok() {
+			return code
+		}
+	}
+	return fs.FileSystem.RemoveXAttr(name, attr, c)
+}
+
+// openPerm returns the permissions that opening with flags needs.
+func openPerm(flags uint32) uint32 {
+	var perm uint32
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		perm = fuse.R_OK
+	case syscall.O_WRONLY:
+		perm = fuse.W_OK
+	default:
+		perm = fuse.R_OK | fuse.W_OK
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		perm |= fuse.W_OK
+	}
+	return perm
+}
+
+func (fs *rootSquashFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	c, squashed := fs.squash(context)
+	if squashed {
+		if code := fs.check(name, openPerm(flags), c); !code.Ok() {
+			return nil, code
+		}
+	}
+	return fs.FileSystem.Open(name, flags, c)
+}
+
+func (fs *rootSquashFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	c, squashed := fs.squash(context)
+	if !squashed {
+		return fs.FileSystem.Create(name, flags, mode, c)
+	}
+	if code := fs.check(parentDir(name), fuse.W_OK|fuse.X_OK, c); !code.Ok() {
+		return nil, code
+	}
+	f, code := fs.FileSystem.Create(name, flags, mode, c)
+	if !code.Ok() {
+		return nil, code
+	}
+	if code := fs.created(name, code, c); !code.Ok() {
+		f.Release()
+		return nil, code
+	}
+	return f, fuse.OK
+}
+
+func (fs *rootSquashFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	c, squashed := fs.squash(context)
+	if squashed {
+		if code := fs.check(name, fuse.R_OK, c); !code.Ok() {
+			return nil, code
+		}
+	}
+	return fs.FileSystem.OpenDir(name, c)
+}
@@ -0,0 +1,128 @@
+package pathfs
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// overlapFileSystem records how many calls run at the same time on
+// each name.
+type overlapFileSystem struct {
+	FileSystem
+
+	mu       sync.Mutex
+	inflight map[string]int
+	overlap  map[string]bool
+
+	// If barrier is set, GetAttr waits for barrier callers to be
+	// inside it at once.
+	barrier *sync.WaitGroup
+}
+
+func (fs *overlapFileSystem) enter(name string) func() {
+	fs.mu.Lock()
+	fs.inflight[name]++
+	if fs.inflight[name] > 1 {
+		fs.overlap[name] = true
+	}
+	fs.mu.Unlock()
+	return func() {
+		fs.mu.Lock()
+		fs.inflight[name]--
+		fs.mu.Unlock()
+	}
+}
+
+func (fs *overlapFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	defer fs.enter(name)()
+	if fs.barrier != nil {
+		fs.barrier.Done()
+		done := make(chan struct{})
+		go func() {
+			fs.barrier.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			return nil, fuse.EIO
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return &fuse.Attr{Mode: fuse.S_IFREG | 0644}, fuse.OK
+}
+
+func (fs *overlapFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return &overlapFile{File: nodefs.NewDefaultFile(), fs: fs, name: name}, fuse.OK
+}
+
+type overlapFile struct {
+	nodefs.File
+	fs   *overlapFileSystem
+	name string
+}
+
+func (f *overlapFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	defer f.fs.enter(f.name)()
+	time.Sleep(time.Millisecond)
+	return uint32(len(data)), fuse.OK
+}
+
+func TestSerializePerInode(t *testing.T) {
+	backing := &overlapFileSystem{
+		FileSystem: NewDefaultFileSystem(),
+		inflight:   map[string]int{},
+		overlap:    map[string]bool{},
+	}
+	fs := NewSerializePerInodeFileSystem(backing)
+
+	// Writes through separate handles of one file, mixed with
+	// GetAttr on it.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, code := fs.Open("file", uint32(os.O_WRONLY), nil)
+			if !code.Ok() {
+				t.Errorf("Open: %v", code)
+				return
+			}
+			defer f.Release()
+			for j := 0; j < 10; j++ {
+				f.Write([]byte("data"), int64(j))
+				fs.GetAttr("file", nil)
+			}
+		}()
+	}
+	wg.Wait()
+	if backing.overlap["file"] {
+		t.Errorf("operations on the same file overlapped")
+	}
+
+	// Different names must not wait for each other; the barrier
+	// only opens if all calls are in the backend at once.
+	const n = 4
+	backing.barrier = &sync.WaitGroup{}
+	backing.barrier.Add(n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, code := fs.GetAttr(fmt.Sprintf("file%d", i), nil); !code.Ok() {
+				t.Errorf("GetAttr: %v; calls on different names were serialized", code)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if locks := fs.(*serializePerInodeFileSystem).locks; len(locks) != 0 {
+		t.Errorf("%d locks left after all files were released", len(locks))
+	}
+}
@@ -0,0 +1,247 @@
+package pathfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// nameLock serializes the operations on one name. refs counts the
+// operations and open files that use it.
+type nameLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+type serializePerInodeFileSystem struct {
+	FileSystem
+
+	mu    sync.Mutex
+	locks map[string]*nameLock
+}
+
+// NewSerializePerInodeFileSystem returns a wrapper that holds a lock
+// for each name around the calls that touch it, for backends that
+// can't handle concurrent operations on the same file, such as a
+// single-threaded remote protocol. Calls on different names still
+// run concurrently.
+//
+// Files are locked by the name they were opened with: their Reads
+// and Writes are serialized with each other, and with the calls on
+// that name. Calls that add or remove a directory entry also lock
+// the directory. Files are known by name, so hard links of the same
+// file don't share a lock.
+func NewSerializePerInodeFileSystem(fs FileSystem) FileSystem {
+	return &serializePerInodeFileSystem{
+		FileSystem: fs,
+		locks:      map[string]*nameLock{},
+	}
+}
+
+func (fs *serializePerInodeFileSystem) String() string {
+	return fmt.Sprintf("serializePerInodeFileSystem(%v)", fs.FileSystem)
+}
+
+func (fs *serializePerInodeFileSystem) acquire(name string) *nameLock {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	l := fs.locks[name]
+	if l == nil {
+		l = &nameLock{}
+		fs.locks[name] = l
+	}
+	l.refs++
+	return l
+}
+
+func (fs *serializePerInodeFileSystem) release(name string, l *nameLock) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(fs.locks, name)
+	}
+}
+
+// locked locks names, and returns the function that unlocks them.
+// Locks are taken in sorted order, so calls that lock several names
+// don't deadlock.
+func (fs *serializePerInodeFileSystem) locked(names ...string) func() {
+	sort.Strings(names)
+	var held []string
+	var locks []*nameLock
+	for i, n := range names {
+		if i > 0 && n == names[i-1] {
+			continue
+		}
+		l := fs.acquire(n)
+		l.mu.Lock()
+		held = append(held, n)
+		locks = append(locks, l)
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].mu.Unlock()
+			fs.release(held[i], locks[i])
+		}
+	}
+}
+
+// parentName returns the directory that holds name.
+func parentName(name string) string {
+	dir := filepath.Dir(name)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+func (fs *serializePerInodeFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	defer fs.locked(name)()
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *serializePerInodeFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	defer fs.locked(name)()
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *serializePerInodeFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	defer fs.locked(name)()
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *serializePerInodeFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	defer fs.locked(name)()
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+func (fs *serializePerInodeFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	defer fs.locked(name)()
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *serializePerInodeFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	defer fs.locked(name)()
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+func (fs *serializePerInodeFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	defer fs.locked(name)()
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *serializePerInodeFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	defer fs.locked(name)()
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+func (fs *serializePerInodeFileSystem) StatFs(name string) *fuse.StatfsOut {
+	defer fs.locked(name)()
+	return fs.FileSystem.StatFs(name)
+}
+
+func (fs *serializePerInodeFileSystem) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	defer fs.locked(name)()
+	return fs.FileSystem.GetXAttr(name, attr, context)
+}
+
+func (fs *serializePerInodeFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	defer fs.locked(name)()
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *serializePerInodeFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	defer fs.locked(name)()
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *serializePerInodeFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	defer fs.locked(name)()
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *serializePerInodeFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	defer fs.locked(parentName(name), name)()
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *serializePerInodeFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	defer fs.locked(parentName(name), name)()
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *serializePerInodeFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	defer fs.locked(parentName(name), name)()
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *serializePerInodeFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	defer fs.locked(parentName(name), name)()
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *serializePerInodeFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	defer fs.locked(parentName(linkName), linkName)()
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *serializePerInodeFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	defer fs.locked(parentName(oldName), oldName, parentName(newName), newName)()
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *serializePerInodeFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	defer fs.locked(oldName, parentName(newName), newName)()
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+// serializedFile keeps the lock of the name it was opened with
+// until it is released.
+type serializedFile struct {
+	nodefs.File
+	fs   *serializePerInodeFileSystem
+	name string
+	lock *nameLock
+}
+
+func (f *serializedFile) Release() {
+	f.File.Release()
+	f.fs.release(f.name, f.lock)
+}
+
+// wrap returns file, serialized on the lock of name.
+func (fs *serializePerInodeFileSystem) wrap(name string, file nodefs.File) nodefs.File {
+	l := fs.acquire(name)
+	return &serializedFile{
+		File: nodefs.NewLockingFile(&l.mu, file),
+		fs:   fs,
+		name: name,
+		lock: l,
+	}
+}
+
+func (fs *serializePerInodeFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	unlock := fs.locked(name)
+	file, code := fs.FileSystem.Open(name, flags, context)
+	unlock()
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.wrap(name, file), code
+}
+
+func (fs *serializePerInodeFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	unlock := fs.locked(parentName(name), name)
+	file, code := fs.FileSystem.Create(name, flags, mode, context)
+	unlock()
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.wrap(name, file), code
+}
@@ -0,0 +1,146 @@
+package pathfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+type slowFileSystem struct {
+	FileSystem
+	delay time.Duration
+
+	// opened gets the files of slow Opens.
+	opened chan *releaseFile
+
+	// xattrs gets the values of slow SetXAttrs.
+	xattrs chan string
+}
+
+func (fs *slowFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	time.Sleep(fs.delay)
+	fs.xattrs <- string(data)
+	return fuse.OK
+}
+
+func (fs *slowFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if name == "slow" {
+		time.Sleep(fs.delay)
+	}
+	return &fuse.Attr{Mode: fuse.S_IFREG | 0644}, fuse.OK
+}
+
+func (fs *slowFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if name == "slow" {
+		time.Sleep(fs.delay)
+		f := &releaseFile{File: nodefs.NewDataFile([]byte("hello")), released: make(chan struct{})}
+		fs.opened <- f
+		return f, fuse.OK
+	}
+	return &slowFile{nodefs.NewDataFile([]byte("hello")), fs.delay}, fuse.OK
+}
+
+// releaseFile signals when it is released.
+type releaseFile struct {
+	nodefs.File
+	released chan struct{}
+}
+
+func (f *releaseFile) Release() {
+	close(f.released)
+}
+
+type slowFile struct {
+	nodefs.File
+	delay time.Duration
+}
+
+func (f *slowFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	time.Sleep(f.delay)
+	return f.File.Read(buf, off)
+}
+
+func TestTimeoutFileSystem(t *testing.T) {
+	slow := &slowFileSystem{
+		FileSystem: NewDefaultFileSystem(),
+		delay:      time.Second,
+	}
+	fs := NewTimeoutFileSystem(slow, 10*time.Millisecond, fuse.OK)
+
+	if _, code := fs.GetAttr("fast", nil); !code.Ok() {
+		t.Errorf("fast GetAttr: %v", code)
+	}
+
+	start := time.Now()
+	a, code := fs.GetAttr("slow", nil)
+	if code != fuse.EIO || a != nil {
+		t.Errorf("slow GetAttr: got %v %v, want EIO", a, code)
+	}
+	if dt := time.Now().Sub(start); dt > slow.delay/2 {
+		t.Errorf("timeout did not fire: GetAttr took %v", dt)
+	}
+
+	f, code := fs.Open("file", 0, nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	if _, code := f.Read(make([]byte, 10), 0); code != fuse.EIO {
+		t.Errorf("slow Read: got %v, want EIO", code)
+	}
+}
+
+func TestTimeoutFileSystemCode(t *testing.T) {
+	slow := &slowFileSystem{
+		FileSystem: NewDefaultFileSystem(),
+		delay:      time.Second,
+	}
+	fs := NewTimeoutFileSystem(slow, 10*time.Millisecond, fuse.EBUSY)
+	if _, code := fs.GetAttr("slow", nil); code != fuse.EBUSY {
+		t.Errorf("slow GetAttr: got %v, want EBUSY", code)
+	}
+}
+
+func TestTimeoutFileSystemReleasesLateOpen(t *testing.T) {
+	slow := &slowFileSystem{
+		FileSystem: NewDefaultFileSystem(),
+		delay:      50 * time.Millisecond,
+		opened:     make(chan *releaseFile, 1),
+	}
+	fs := NewTimeoutFileSystem(slow, 10*time.Millisecond, fuse.OK)
+
+	context := &fuse.Context{Owner: fuse.Owner{Uid: 1, Gid: 2}}
+	if _, code := fs.Open("slow", 0, context); code != fuse.EIO {
+		t.Fatalf("slow Open: got %v, want EIO", code)
+	}
+	// The server reuses the request, Context included.
+	*context = fuse.Context{}
+
+	f := <-slow.opened
+	select {
+	case <-f.released:
+	case <-time.After(time.Second):
+		t.Errorf("file of abandoned Open was not released")
+	}
+}
+
+func TestTimeoutFileSystemSetXAttrData(t *testing.T) {
+	slow := &slowFileSystem{
+		FileSystem: NewDefaultFileSystem(),
+		delay:      50 * time.Millisecond,
+		xattrs:     make(chan string, 1),
+	}
+	fs := NewTimeoutFileSystem(slow, 10*time.Millisecond, fuse.OK)
+
+	data := []byte("value")
+	if code := fs.SetXAttr("slow", "user.attr", data, 0, &fuse.Context{}); code != fuse.EIO {
+		t.Fatalf("slow SetXAttr: got %v, want EIO", code)
+	}
+	// The server reuses the request buffer.
+	copy(data, "xxxxx")
+
+	if got := <-slow.xattrs; got != "value" {
+		t.Errorf("abandoned SetXAttr got %q, want \"value\"", got)
+	}
+}
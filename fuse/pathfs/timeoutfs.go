@@ -0,0 +1,414 @@
+package pathfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+type timeoutFileSystem struct {
+	// Should be public so people reusing can access the wrapped
+	// FS.
+	FS      FileSystem
+	timeout time.Duration
+	code    fuse.Status
+}
+
+// NewTimeoutFileSystem returns a wrapper that returns code (EIO if
+// code is OK) for each operation on fs that does not complete within
+// the timeout. The slow call is abandoned: its goroutine keeps
+// running, with a copy of the request's Context, as the original
+// points into a request buffer that is reused, and its eventual
+// result is discarded; a File that an abandoned Open or Create
+// returns is released. Files returned from Open and Create are
+// wrapped similarly.
+func NewTimeoutFileSystem(fs FileSystem, timeout time.Duration, code fuse.Status) FileSystem {
+	if code.Ok() {
+		code = fuse.EIO
+	}
+	return &timeoutFileSystem{
+		FS:      fs,
+		timeout: timeout,
+		code:    code,
+	}
+}
+
+// runTimeout runs f in a goroutine. It returns f's result, or code
+// if f takes longer than d. Results that f stores in variables may
+// only be used if the returned ok is true. If f finishes after the
+// caller gave up on it, abandoned, if non-nil, is called in its
+// goroutine, to clean up what f stored.
+func runTimeout(d time.Duration, code fuse.Status, f func() fuse.Status, abandoned func()) (result fuse.Status, ok bool) {
+	done := make(chan fuse.Status, 1)
+
+	// mu orders the result against giving up, so exactly one
+	// side owns what f stored.
+	var mu sync.Mutex
+	gaveUp := false
+	go func() {
+		r := f()
+		mu.Lock()
+		if !gaveUp {
+			done <- r
+			mu.Unlock()
+			return
+		}
+		mu.Unlock()
+		if abandoned != nil {
+			abandoned()
+		}
+	}()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case result = <-done:
+		return result, true
+	case <-t.C:
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	select {
+	case result = <-done:
+		// It finished just in time.
+		return result, true
+	default:
+	}
+	gaveUp = true
+	return code, false
+}
+
+func (fs *timeoutFileSystem) run(f func() fuse.Status) (fuse.Status, bool) {
+	return runTimeout(fs.timeout, fs.code, f, nil)
+}
+
+// releaseLate releases the File that an abandoned Open or Create
+// stored in *file, as nobody else will.
+func releaseLate(file *nodefs.File) func() {
+	return func() {
+		if *file != nil {
+			(*file).Release()
+		}
+	}
+}
+
+func (fs *timeoutFileSystem) String() string {
+	return fmt.Sprintf("timeoutFileSystem(%v)", fs.FS)
+}
+
+func (fs *timeoutFileSystem) SetDebug(debug bool) {
+	fs.FS.SetDebug(debug)
+}
+
+func (fs *timeoutFileSystem) StatFs(name string) *fuse.StatfsOut {
+	var out *fuse.StatfsOut
+	if _, ok := fs.run(func() fuse.Status {
+		out = fs.FS.StatFs(name)
+		return fuse.OK
+	}); !ok {
+		return nil
+	}
+	return out
+}
+
+func (fs *timeoutFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	context = copyContext(context)
+	var a *fuse.Attr
+	code, ok := fs.run(func() (code fuse.Status) {
+		a, code = fs.FS.GetAttr(name, context)
+		return code
+	})
+	if !ok {
+		return nil, code
+	}
+	return a, code
+}
+
+func (fs *timeoutFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	context = copyContext(context)
+	var val string
+	code, ok := fs.run(func() (code fuse.Status) {
+		val, code = fs.FS.Readlink(name, context)
+		return code
+	})
+	if !ok {
+		return "", code
+	}
+	return val, code
+}
+
+func (fs *timeoutFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	context = copyContext(context)
+	code, _ := fs.run(func() fuse.Status {
+		return fs.FS.Mknod(name, mode, dev, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	context = copyContext(context)
+	code, _ := fs.run(func() fuse.Status {
+		return fs.FS.Mkdir(name, mode, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	context = copyContext(context)
+	code, _ = fs.run(func() fuse.Status {
+		return fs.FS.Unlink(name, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	context = copyContext(context)
+	code, _ = fs.run(func() fuse.Status {
+		return fs.FS.Rmdir(name, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) Symlink(value string, linkName string, context *fuse.Context) (code fuse.Status) {
+	context = copyContext(context)
+	code, _ = fs.run(func() fuse.Status {
+		return fs.FS.Symlink(value, linkName, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	context = copyContext(context)
+	code, _ = fs.run(func() fuse.Status {
+		return fs.FS.Rename(oldName, newName, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	context = copyContext(context)
+	code, _ = fs.run(func() fuse.Status {
+		return fs.FS.Link(oldName, newName, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	context = copyContext(context)
+	code, _ = fs.run(func() fuse.Status {
+		return fs.FS.Chmod(name, mode, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	context = copyContext(context)
+	code, _ = fs.run(func() fuse.Status {
+		return fs.FS.Chown(name, uid, gid, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) Truncate(name string, offset uint64, context *fuse.Context) (code fuse.Status) {
+	context = copyContext(context)
+	code, _ = fs.run(func() fuse.Status {
+		return fs.FS.Truncate(name, offset, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	context = copyContext(context)
+	code, _ = fs.run(func() fuse.Status {
+		return fs.FS.Utimens(name, atime, mtime, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	context = copyContext(context)
+	code, _ = fs.run(func() fuse.Status {
+		return fs.FS.Access(name, mode, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) newFile(f nodefs.File) nodefs.File {
+	if f == nil {
+		return nil
+	}
+	return &timeoutFile{
+		File: f,
+		fs:   fs,
+	}
+}
+
+func (fs *timeoutFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	context = copyContext(context)
+	var file nodefs.File
+	code, ok := runTimeout(fs.timeout, fs.code, func() (code fuse.Status) {
+		file, code = fs.FS.Open(name, flags, context)
+		return code
+	}, releaseLate(&file))
+	if !ok {
+		return nil, code
+	}
+	return fs.newFile(file), code
+}
+
+func (fs *timeoutFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	context = copyContext(context)
+	var file nodefs.File
+	code, ok := runTimeout(fs.timeout, fs.code, func() (code fuse.Status) {
+		file, code = fs.FS.Create(name, flags, mode, context)
+		return code
+	}, releaseLate(&file))
+	if !ok {
+		return nil, code
+	}
+	return fs.newFile(file), code
+}
+
+func (fs *timeoutFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	context = copyContext(context)
+	var stream []fuse.DirEntry
+	code, ok := fs.run(func() (code fuse.Status) {
+		stream, code = fs.FS.OpenDir(name, context)
+		return code
+	})
+	if !ok {
+		return nil, code
+	}
+	return stream, code
+}
+
+func (fs *timeoutFileSystem) OnMount(nodeFs *PathNodeFs) {
+	fs.FS.OnMount(nodeFs)
+}
+
+func (fs *timeoutFileSystem) OnUnmount() {
+	fs.FS.OnUnmount()
+}
+
+func (fs *timeoutFileSystem) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	context = copyContext(context)
+	var data []byte
+	code, ok := fs.run(func() (code fuse.Status) {
+		data, code = fs.FS.GetXAttr(name, attr, context)
+		return code
+	})
+	if !ok {
+		return nil, code
+	}
+	return data, code
+}
+
+func (fs *timeoutFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	context = copyContext(context)
+	// data points into the request buffer, as in Write.
+	data = append([]byte(nil), data...)
+	code, _ := fs.run(func() fuse.Status {
+		return fs.FS.SetXAttr(name, attr, data, flags, context)
+	})
+	return code
+}
+
+func (fs *timeoutFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	context = copyContext(context)
+	var attrs []string
+	code, ok := fs.run(func() (code fuse.Status) {
+		attrs, code = fs.FS.ListXAttr(name, context)
+		return code
+	})
+	if !ok {
+		return nil, code
+	}
+	return attrs, code
+}
+
+func (fs *timeoutFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	context = copyContext(context)
+	code, _ := fs.run(func() fuse.Status {
+		return fs.FS.RemoveXAttr(name, attr, context)
+	})
+	return code
+}
+
+// timeoutFile bounds the data operations of a File returned by the
+// timeoutFileSystem.
+type timeoutFile struct {
+	nodefs.File
+	fs *timeoutFileSystem
+}
+
+func (f *timeoutFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *timeoutFile) String() string {
+	return fmt.Sprintf("timeoutFile(%s)", f.File.String())
+}
+
+func (f *timeoutFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	// The abandoned call may still write into buf, so give it a
+	// private copy that we can discard.
+	dest := make([]byte, len(buf))
+	var res fuse.ReadResult
+	code, ok := f.fs.run(func() (code fuse.Status) {
+		res, code = f.File.Read(dest, off)
+		return code
+	})
+	if !ok {
+		return nil, code
+	}
+	return res, code
+}
+
+func (f *timeoutFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	// data points into the request buffer, which is reused after
+	// we return.
+	data = append([]byte(nil), data...)
+	var n uint32
+	code, ok := f.fs.run(func() (code fuse.Status) {
+		n, code = f.File.Write(data, off)
+		return code
+	})
+	if !ok {
+		return 0, code
+	}
+	return n, code
+}
+
+func (f *timeoutFile) Flush() fuse.Status {
+	code, _ := f.fs.run(f.File.Flush)
+	return code
+}
+
+func (f *timeoutFile) Fsync(flags int) fuse.Status {
+	code, _ := f.fs.run(func() fuse.Status {
+		return f.File.Fsync(flags)
+	})
+	return code
+}
+
+func (f *timeoutFile) Truncate(size uint64) fuse.Status {
+	code, _ := f.fs.run(func() fuse.Status {
+		return f.File.Truncate(size)
+	})
+	return code
+}
+
+func (f *timeoutFile) GetAttr(out *fuse.Attr) fuse.Status {
+	var a fuse.Attr
+	code, ok := f.fs.run(func() fuse.Status {
+		return f.File.GetAttr(&a)
+	})
+	if ok && code.Ok() {
+		*out = a
+	}
+	return code
+}
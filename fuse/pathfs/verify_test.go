@@ -0,0 +1,80 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// staleCacheFileSystem is a buggy cache, which never drops the
+// attributes it has seen.
+type staleCacheFileSystem struct {
+	FileSystem
+	mu    sync.Mutex
+	attrs map[string]*fuse.Attr
+}
+
+func (fs *staleCacheFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if a := fs.attrs[name]; a != nil {
+		return a, fuse.OK
+	}
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if code.Ok() {
+		fs.attrs[name] = a
+	}
+	return a, code
+}
+
+func TestVerifyingFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-verify")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	base := NewLoopbackFileSystem(dir)
+	var mismatches []string
+	fs := NewVerifyingFileSystem(&staleCacheFileSystem{FileSystem: base, attrs: map[string]*fuse.Attr{}}, base, &VerifyOptions{
+		OnMismatch: func(op string, name string, got interface{}, want interface{}) {
+			mismatches = append(mismatches, op+" "+name)
+		},
+	})
+
+	fs.GetAttr("file", nil)
+	fs.OpenDir("", nil)
+	f, code := fs.Open("file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	buf := make([]byte, 16)
+	if res, code := f.Read(buf, 0); !code.Ok() {
+		t.Fatalf("Read: %v", code)
+	} else if data, _ := res.Bytes(buf); string(data) != "hello" {
+		t.Errorf("Read: got %q, want %q", data, "hello")
+	}
+	f.Release()
+	if len(mismatches) != 0 {
+		t.Fatalf("agreeing file systems: got mismatches %v", mismatches)
+	}
+
+	// The cache keeps the old size.
+	if err := ioutil.WriteFile(file, []byte("hello world"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if a, _ := fs.GetAttr("file", nil); a.Size != 5 {
+		t.Errorf("GetAttr: got size %d, want the stale 5", a.Size)
+	}
+	if len(mismatches) != 1 || mismatches[0] != "GetAttr file" {
+		t.Errorf("got mismatches %v, want [GetAttr file]", mismatches)
+	}
+}
@@ -0,0 +1,179 @@
+package pathfs
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// VerifyOptions are options for NewVerifyingFileSystem.
+type VerifyOptions struct {
+	// OnMismatch is called when the wrapper under test and the
+	// reference disagree, with what each of them returned. The
+	// default logs the mismatch. Tests can pass a function that
+	// calls t.Errorf.
+	OnMismatch func(op string, name string, got interface{}, want interface{})
+}
+
+type verifyingFileSystem struct {
+	FileSystem
+	reference FileSystem
+	opts      VerifyOptions
+}
+
+// NewVerifyingFileSystem returns a wrapper that checks fs, typically
+// a caching or mirroring wrapper under development, against
+// reference, usually the file system that fs wraps. GetAttr,
+// Readlink, OpenDir and the Reads of opened files are done on both,
+// and differences are reported to opts.OnMismatch. The results of fs
+// are returned.
+//
+// Inode numbers, access and change times are not compared, and
+// directories are compared as sets of names and types. The reference
+// is only opened for reading, so writes go to fs alone.
+func NewVerifyingFileSystem(fs FileSystem, reference FileSystem, opts *VerifyOptions) FileSystem {
+	v := &verifyingFileSystem{FileSystem: fs, reference: reference}
+	if opts != nil {
+		v.opts = *opts
+	}
+	return v
+}
+
+func (fs *verifyingFileSystem) String() string {
+	return fmt.Sprintf("verifyingFileSystem(%v)", fs.FileSystem)
+}
+
+func (fs *verifyingFileSystem) mismatch(op string, name string, got interface{}, want interface{}) {
+	if fs.opts.OnMismatch != nil {
+		fs.opts.OnMismatch(op, name, got, want)
+		return
+	}
+	log.Printf("verify: %s %q: got %v, want %v", op, name, got, want)
+}
+
+// verifiedAttr holds the attributes that are compared.
+type verifiedAttr struct {
+	Mode      uint32
+	Size      uint64
+	Nlink     uint32
+	Owner     fuse.Owner
+	Rdev      uint32
+	Mtime     uint64
+	Mtimensec uint32
+	Status    fuse.Status
+}
+
+func newVerifiedAttr(a *fuse.Attr, code fuse.Status) verifiedAttr {
+	v := verifiedAttr{Status: code}
+	if a != nil && code.Ok() {
+		v.Mode, v.Size, v.Nlink, v.Owner = a.Mode, a.Size, a.Nlink, a.Owner
+		v.Rdev, v.Mtime, v.Mtimensec = a.Rdev, a.Mtime, a.Mtimensec
+	}
+	return v
+}
+
+func (fs *verifyingFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	ra, rcode := fs.reference.GetAttr(name, context)
+	if got, want := newVerifiedAttr(a, code), newVerifiedAttr(ra, rcode); got != want {
+		fs.mismatch("GetAttr", name, got, want)
+	}
+	return a, code
+}
+
+func (fs *verifyingFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	target, code := fs.FileSystem.Readlink(name, context)
+	rtarget, rcode := fs.reference.Readlink(name, context)
+	if code != rcode || (code.Ok() && target != rtarget) {
+		fs.mismatch("Readlink", name, fmt.Sprintf("%q, %v", target, code), fmt.Sprintf("%q, %v", rtarget, rcode))
+	}
+	return target, code
+}
+
+// dirSet describes a listing as sorted "name type" strings.
+func dirSet(entries []fuse.DirEntry, code fuse.Status) []string {
+	if !code.Ok() {
+		return []string{code.String()}
+	}
+	out := make([]string, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, fmt.Sprintf("%s %o", e.Name, e.Mode&syscall.S_IFMT))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (fs *verifyingFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	entries, code := fs.FileSystem.OpenDir(name, context)
+	rentries, rcode := fs.reference.OpenDir(name, context)
+	got, want := dirSet(entries, code), dirSet(rentries, rcode)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		fs.mismatch("OpenDir", name, got, want)
+	}
+	return entries, code
+}
+
+func (fs *verifyingFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, code := fs.FileSystem.Open(name, flags, context)
+	if !code.Ok() {
+		return f, code
+	}
+	ref, rcode := fs.reference.Open(name, syscall.O_RDONLY, context)
+	if !rcode.Ok() {
+		fs.mismatch("Open", name, code, rcode)
+		return f, code
+	}
+	return &verifyingFile{File: f, fs: fs, name: name, reference: ref}, fuse.OK
+}
+
+// verifyingFile compares the reads of an opened file with those of
+// the same file in the reference.
+type verifyingFile struct {
+	nodefs.File
+	fs        *verifyingFileSystem
+	name      string
+	reference nodefs.File
+}
+
+func (f *verifyingFile) String() string {
+	return fmt.Sprintf("verifyingFile(%v)", f.File)
+}
+
+func (f *verifyingFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *verifyingFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	res, code := f.File.Read(dest, off)
+	var data []byte
+	if code.Ok() {
+		data, code = res.Bytes(dest)
+		res.Done()
+	}
+
+	rbuf := make([]byte, len(dest))
+	var rdata []byte
+	rres, rcode := f.reference.Read(rbuf, off)
+	if rcode.Ok() {
+		rdata, rcode = rres.Bytes(rbuf)
+		rres.Done()
+	}
+	if code != rcode || !bytes.Equal(data, rdata) {
+		f.fs.mismatch("Read", fmt.Sprintf("%s@%d", f.name, off),
+			fmt.Sprintf("%d bytes, %v", len(data), code), fmt.Sprintf("%d bytes, %v", len(rdata), rcode))
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	return fuse.ReadResultData(data), fuse.OK
+}
+
+func (f *verifyingFile) Release() {
+	f.reference.Release()
+	f.File.Release()
+}
@@ -0,0 +1,77 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newWatchTestFs(t *testing.T) (*WatchFileSystem, func()) {
+	dir, err := ioutil.TempDir("", "go-fuse-watch")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	return NewWatchFileSystem(NewLoopbackFileSystem(dir)), func() { os.RemoveAll(dir) }
+}
+
+func TestWatchWrite(t *testing.T) {
+	fs, clean := newWatchTestFs(t)
+	defer clean()
+
+	chans := []<-chan WatchEvent{
+		fs.Subscribe(10, WatchBlock),
+		fs.Subscribe(10, WatchDropOldest),
+	}
+
+	f, code := fs.Create("x", uint32(os.O_WRONLY), 0644, nil)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	if _, code := f.Write([]byte("hello"), 0); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+	f.Release()
+	if code := fs.Rename("x", "y", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	// Failed operations are not reported.
+	if code := fs.Unlink("x", nil); code.Ok() {
+		t.Fatalf("Unlink of renamed file succeeded")
+	}
+
+	want := []WatchEvent{
+		{Op: WatchCreate, Path: "x"},
+		{Op: WatchWrite, Path: "x"},
+		{Op: WatchRename, Path: "x", OtherPath: "y"},
+	}
+	for i, ch := range chans {
+		fs.Unsubscribe(ch)
+		var got []WatchEvent
+		for ev := range ch {
+			got = append(got, ev)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("subscriber %d: got %v, want %v", i, got, want)
+		}
+		for j := range want {
+			if got[j] != want[j] {
+				t.Errorf("subscriber %d: event %d: got %v, want %v", i, j, got[j], want[j])
+			}
+		}
+	}
+}
+
+func TestWatchDropOldest(t *testing.T) {
+	fs, clean := newWatchTestFs(t)
+	defer clean()
+
+	ch := fs.Subscribe(1, WatchDropOldest)
+	for _, n := range []string{"a", "b", "c"} {
+		if code := fs.Mkdir(n, 0755, nil); !code.Ok() {
+			t.Fatalf("Mkdir(%q): %v", n, code)
+		}
+	}
+	if ev := <-ch; ev.Path != "c" {
+		t.Errorf("got %v, want the newest event", ev)
+	}
+}
@@ -0,0 +1,303 @@
+package pathfs
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// WatchOp is the kind of change a WatchEvent reports.
+type WatchOp int
+
+const (
+	// A file, symlink, device or hard link was created.
+	WatchCreate WatchOp = iota
+	WatchMkdir
+	// File contents changed, by a write or a truncate.
+	WatchWrite
+	WatchUnlink
+	WatchRmdir
+	WatchRename
+	// Permissions, owner, times or extended attributes changed.
+	WatchAttr
+)
+
+var watchOpNames = map[WatchOp]string{
+	WatchCreate: "Create",
+	WatchMkdir:  "Mkdir",
+	WatchWrite:  "Write",
+	WatchUnlink: "Unlink",
+	WatchRmdir:  "Rmdir",
+	WatchRename: "Rename",
+	WatchAttr:   "Attr",
+}
+
+func (op WatchOp) String() string {
+	if s, ok := watchOpNames[op]; ok {
+		return s
+	}
+	return fmt.Sprintf("WatchOp(%d)", int(op))
+}
+
+// WatchEvent describes a successful change made through a
+// WatchFileSystem. Paths are relative to the root, as passed to the
+// FileSystem.
+type WatchEvent struct {
+	Op   WatchOp
+	Path string
+
+	// For WatchRename, the new name. For WatchCreate of a hard
+	// link, the name of the existing file.
+	OtherPath string
+}
+
+func (e WatchEvent) String() string {
+	if e.OtherPath != "" {
+		return fmt.Sprintf("{%v %q %q}", e.Op, e.Path, e.OtherPath)
+	}
+	return fmt.Sprintf("{%v %q}", e.Op, e.Path)
+}
+
+// WatchPolicy selects what happens when a subscriber falls behind.
+type WatchPolicy int
+
+const (
+	// WatchBlock makes file system operations wait until the
+	// subscriber has room for the event.
+	WatchBlock WatchPolicy = iota
+
+	// WatchDropOldest discards the oldest pending event to make
+	// room for a new one.
+	WatchDropOldest
+)
+
+type watchSubscriber struct {
+	ch     chan WatchEvent
+	policy WatchPolicy
+
+	// done is closed on Unsubscribe, to release blocked senders.
+	done chan struct{}
+
+	// mu serializes sends, so events arrive in order.
+	mu sync.Mutex
+}
+
+// send delivers ev according to the subscriber's policy. Must be
+// called with s.mu held.
+func (s *watchSubscriber) send(ev WatchEvent) {
+	if s.policy == WatchBlock {
+		select {
+		case s.ch <- ev:
+		case <-s.done:
+		}
+		return
+	}
+	for {
+		select {
+		case s.ch <- ev:
+			return
+		default:
+		}
+		select {
+		case <-s.ch:
+		default:
+		}
+	}
+}
+
+// WatchFileSystem passes operations to the wrapped FileSystem, and
+// reports each successful change as a WatchEvent to its subscribers.
+type WatchFileSystem struct {
+	FileSystem
+
+	mu   sync.Mutex
+	subs map[<-chan WatchEvent]*watchSubscriber
+}
+
+// NewWatchFileSystem returns a WatchFileSystem wrapping fs.
+func NewWatchFileSystem(fs FileSystem) *WatchFileSystem {
+	return &WatchFileSystem{
+		FileSystem: fs,
+		subs:       map[<-chan WatchEvent]*watchSubscriber{},
+	}
+}
+
+func (fs *WatchFileSystem) String() string {
+	return fmt.Sprintf("WatchFileSystem(%v)", fs.FileSystem)
+}
+
+// Subscribe returns a channel that receives the events from now on.
+// The channel buffers up to size events; policy says what happens
+// when it is full.
+func (fs *WatchFileSystem) Subscribe(size int, policy WatchPolicy) <-chan WatchEvent {
+	if policy == WatchDropOldest && size < 1 {
+		size = 1
+	}
+	s := &watchSubscriber{
+		ch:     make(chan WatchEvent, size),
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.subs[s.ch] = s
+	return s.ch
+}
+
+// Unsubscribe stops sending events to ch, and closes it.
+func (fs *WatchFileSystem) Unsubscribe(ch <-chan WatchEvent) {
+	fs.mu.Lock()
+	s := fs.subs[ch]
+	delete(fs.subs, ch)
+	fs.mu.Unlock()
+	if s == nil {
+		return
+	}
+
+	close(s.done)
+	s.mu.Lock()
+	close(s.ch)
+	s.mu.Unlock()
+}
+
+func (fs *WatchFileSystem) emit(code fuse.Status, op WatchOp, path string, other string) fuse.Status {
+	if !code.Ok() {
+		return code
+	}
+
+	fs.mu.Lock()
+	subs := make([]*watchSubscriber, 0, len(fs.subs))
+	for _, s := range fs.subs {
+		subs = append(subs, s)
+	}
+	fs.mu.Unlock()
+
+	ev := WatchEvent{Op: op, Path: path, OtherPath: other}
+	for _, s := range subs {
+		s.mu.Lock()
+		select {
+		case <-s.done:
+		default:
+			s.send(ev)
+		}
+		s.mu.Unlock()
+	}
+	return code
+}
+
+func (fs *WatchFileSystem) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.Chmod(name, mode, context), WatchAttr, name, "")
+}
+
+func (fs *WatchFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.Chown(name, uid, gid, context), WatchAttr, name, "")
+}
+
+func (fs *WatchFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.Utimens(name, atime, mtime, context), WatchAttr, name, "")
+}
+
+func (fs *WatchFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.Truncate(name, size, context), WatchWrite, name, "")
+}
+
+func (fs *WatchFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.Link(oldName, newName, context), WatchCreate, newName, oldName)
+}
+
+func (fs *WatchFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.Mkdir(name, mode, context), WatchMkdir, name, "")
+}
+
+func (fs *WatchFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.Mknod(name, mode, dev, context), WatchCreate, name, "")
+}
+
+func (fs *WatchFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.Rename(oldName, newName, context), WatchRename, oldName, newName)
+}
+
+func (fs *WatchFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.Rmdir(name, context), WatchRmdir, name, "")
+}
+
+func (fs *WatchFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.Unlink(name, context), WatchUnlink, name, "")
+}
+
+func (fs *WatchFileSystem) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.Symlink(value, linkName, context), WatchCreate, linkName, "")
+}
+
+func (fs *WatchFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.SetXAttr(name, attr, data, flags, context), WatchAttr, name, "")
+}
+
+func (fs *WatchFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	return fs.emit(fs.FileSystem.RemoveXAttr(name, attr, context), WatchAttr, name, "")
+}
+
+func (fs *WatchFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, code := fs.FileSystem.Open(name, flags, context)
+	if !code.Ok() || flags&fuse.O_ANYWRITE == 0 {
+		return f, code
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		fs.emit(code, WatchWrite, name, "")
+	}
+	return &watchFile{File: f, fs: fs, name: name}, code
+}
+
+func (fs *WatchFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, code := fs.FileSystem.Create(name, flags, mode, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	fs.emit(code, WatchCreate, name, "")
+	return &watchFile{File: f, fs: fs, name: name}, code
+}
+
+// watchFile reports changes made through an open file. Events carry
+// the name the file was opened with, even if it was renamed since.
+type watchFile struct {
+	nodefs.File
+	fs   *WatchFileSystem
+	name string
+}
+
+func (f *watchFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *watchFile) String() string {
+	return fmt.Sprintf("watchFile(%s)", f.File.String())
+}
+
+func (f *watchFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	n, code := f.File.Write(data, off)
+	return n, f.fs.emit(code, WatchWrite, f.name, "")
+}
+
+func (f *watchFile) Truncate(size uint64) fuse.Status {
+	return f.fs.emit(f.File.Truncate(size), WatchWrite, f.name, "")
+}
+
+func (f *watchFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	return f.fs.emit(f.File.Allocate(off, size, mode), WatchWrite, f.name, "")
+}
+
+func (f *watchFile) Chown(uid uint32, gid uint32) fuse.Status {
+	return f.fs.emit(f.File.Chown(uid, gid), WatchAttr, f.name, "")
+}
+
+func (f *watchFile) Chmod(perms uint32) fuse.Status {
+	return f.fs.emit(f.File.Chmod(perms), WatchAttr, f.name, "")
+}
+
+func (f *watchFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	return f.fs.emit(f.File.Utimens(atime, mtime), WatchAttr, f.name, "")
+}
@@ -0,0 +1,242 @@
+package pathfs
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// Workload describes a synthetic sequence of calls for RunWorkload.
+type Workload struct {
+	// Dir is the directory the files are created in. It must not
+	// exist yet. The default is "workload".
+	Dir string
+
+	// Files is the number of files, of FileSize bytes each. The
+	// defaults are 16 files of 64 KiB.
+	Files    int
+	FileSize int
+
+	// IOSize is the size of each Read and Write. The default is
+	// 4 KiB.
+	IOSize int
+
+	// The relative weights of the operations. GetAttr and Open
+	// go to a random file, Read and Write to a random block of a
+	// random file, and OpenDir lists Dir. Open releases the file
+	// again. If all weights are zero, GetAttr, Read and Write are
+	// equally likely.
+	GetAttr int
+	Open    int
+	Read    int
+	Write   int
+	OpenDir int
+
+	// Ops is the total number of operations, spread over
+	// Concurrency goroutines. The defaults are 1000 and 1.
+	Ops         int
+	Concurrency int
+
+	// Seed seeds the choice of operations, so runs can be
+	// compared.
+	Seed int64
+}
+
+// WorkloadResult is the outcome of RunWorkload.
+type WorkloadResult struct {
+	Ops     int
+	Errors  int
+	Elapsed time.Duration
+
+	// Latency percentiles and maximum over all operations.
+	P50, P90, P99, Max time.Duration
+}
+
+// OpsPerSecond returns the throughput.
+func (r *WorkloadResult) OpsPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Elapsed.Seconds()
+}
+
+func (r *WorkloadResult) String() string {
+	return fmt.Sprintf("%d ops (%d errors) in %v, %.0f ops/s, latency p50 %v p90 %v p99 %v max %v",
+		r.Ops, r.Errors, r.Elapsed, r.OpsPerSecond(), r.P50, r.P90, r.P99, r.Max)
+}
+
+type workloadOp int
+
+const (
+	workloadGetAttr workloadOp = iota
+	workloadOpen
+	workloadRead
+	workloadWrite
+	workloadOpenDir
+)
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// RunWorkload drives fs with the calls described by w, without a
+// kernel mount, and measures them. It is meant for comparing
+// FileSystem implementations and wrappers, for example from a
+// benchmark. The setup, which creates and fills the files, is not
+// measured, and neither is opening the files that Read and Write
+// use. Failing operations are counted in Errors; RunWorkload only
+// returns an error if the setup fails.
+func RunWorkload(fs FileSystem, w *Workload) (*WorkloadResult, fuse.Status) {
+	o := *w
+	if o.Dir == "" {
+		o.Dir = "workload"
+	}
+	if o.Files <= 0 {
+		o.Files = 16
+	}
+	if o.FileSize <= 0 {
+		o.FileSize = 64 << 10
+	}
+	if o.IOSize <= 0 {
+		o.IOSize = 4 << 10
+	}
+	if o.Ops <= 0 {
+		o.Ops = 1000
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	var mix []workloadOp
+	for op, weight := range []int{o.GetAttr, o.Open, o.Read, o.Write, o.OpenDir} {
+		for i := 0; i < weight; i++ {
+			mix = append(mix, workloadOp(op))
+		}
+	}
+	if len(mix) == 0 {
+		mix = []workloadOp{workloadGetAttr, workloadRead, workloadWrite}
+	}
+
+	names, code := setupWorkload(fs, &o)
+	if !code.Ok() {
+		return nil, code
+	}
+
+	var mu sync.Mutex
+	var all durations
+	res := &WorkloadResult{}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for g := 0; g < o.Concurrency; g++ {
+		ops := o.Ops / o.Concurrency
+		if g < o.Ops%o.Concurrency {
+			ops++
+		}
+		wg.Add(1)
+		go func(g int, ops int) {
+			defer wg.Done()
+			lat, errors := runWorkloadWorker(fs, &o, names, mix, rand.New(rand.NewSource(o.Seed+int64(g))), ops)
+			mu.Lock()
+			all = append(all, lat...)
+			res.Errors += errors
+			mu.Unlock()
+		}(g, ops)
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	res.Ops = len(all)
+
+	sort.Sort(all)
+	if n := len(all); n > 0 {
+		res.P50 = all[n*50/100]
+		res.P90 = all[n*90/100]
+		res.P99 = all[n*99/100]
+		res.Max = all[n-1]
+	}
+	return res, fuse.OK
+}
+
+func setupWorkload(fs FileSystem, o *Workload) ([]string, fuse.Status) {
+	if code := fs.Mkdir(o.Dir, 0755, nil); !code.Ok() {
+		return nil, code
+	}
+	data := make([]byte, o.FileSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	names := make([]string, o.Files)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s/file%d", o.Dir, i)
+		f, code := fs.Create(names[i], uint32(os.O_WRONLY|os.O_TRUNC), 0644, nil)
+		if !code.Ok() {
+			return nil, code
+		}
+		n, code := f.Write(data, 0)
+		f.Release()
+		if !code.Ok() {
+			return nil, code
+		}
+		if int(n) < len(data) {
+			return nil, fuse.EIO
+		}
+	}
+	return names, fuse.OK
+}
+
+func runWorkloadWorker(fs FileSystem, o *Workload, names []string, mix []workloadOp, rnd *rand.Rand, ops int) (lat durations, errors int) {
+	files := make([]nodefs.File, len(names))
+	for i, name := range names {
+		f, code := fs.Open(name, uint32(os.O_RDWR), nil)
+		if !code.Ok() {
+			return nil, ops
+		}
+		defer f.Release()
+		files[i] = f
+	}
+
+	buf := make([]byte, o.IOSize)
+	blocks := o.FileSize / o.IOSize
+	if blocks == 0 {
+		blocks = 1
+	}
+	lat = make(durations, 0, ops)
+	for i := 0; i < ops; i++ {
+		op := mix[rnd.Intn(len(mix))]
+		n := rnd.Intn(len(names))
+		off := int64(rnd.Intn(blocks) * o.IOSize)
+
+		var code fuse.Status
+		start := time.Now()
+		switch op {
+		case workloadGetAttr:
+			_, code = fs.GetAttr(names[n], nil)
+		case workloadOpen:
+			var f nodefs.File
+			if f, code = fs.Open(names[n], uint32(os.O_RDONLY), nil); code.Ok() {
+				f.Release()
+			}
+		case workloadRead:
+			var r fuse.ReadResult
+			if r, code = files[n].Read(buf, off); code.Ok() {
+				_, code = r.Bytes(buf)
+				r.Done()
+			}
+		case workloadWrite:
+			_, code = files[n].Write(buf, off)
+		case workloadOpenDir:
+			_, code = fs.OpenDir(o.Dir, nil)
+		}
+		lat = append(lat, time.Since(start))
+		if !code.Ok() {
+			errors++
+		}
+	}
+	return lat, errors
+}
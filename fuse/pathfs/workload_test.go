@@ -0,0 +1,59 @@
+package pathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRunWorkload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-workload")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := &Workload{
+		Files:       4,
+		FileSize:    16 << 10,
+		GetAttr:     1,
+		Open:        1,
+		Read:        2,
+		Write:       2,
+		OpenDir:     1,
+		Ops:         203,
+		Concurrency: 4,
+	}
+	res, code := RunWorkload(NewLoopbackFileSystem(dir), w)
+	if !code.Ok() {
+		t.Fatalf("RunWorkload: %v", code)
+	}
+	if res.Ops != w.Ops || res.Errors != 0 {
+		t.Errorf("got %d ops, %d errors, want %d ops", res.Ops, res.Errors, w.Ops)
+	}
+	if res.P50 > res.P99 || res.P99 > res.Max || res.OpsPerSecond() <= 0 {
+		t.Errorf("inconsistent result: %v", res)
+	}
+	t.Log(res)
+
+	// The directory must be new.
+	if _, code := RunWorkload(NewLoopbackFileSystem(dir), w); code.Ok() {
+		t.Errorf("second RunWorkload in the same directory succeeded")
+	}
+}
+
+func BenchmarkLoopbackWorkload(b *testing.B) {
+	dir, err := ioutil.TempDir("", "go-fuse-workload")
+	if err != nil {
+		b.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := NewLoopbackFileSystem(dir)
+	res, code := RunWorkload(fs, &Workload{Ops: b.N, Concurrency: 4})
+	if !code.Ok() {
+		b.Fatalf("RunWorkload: %v", code)
+	}
+	// ns/op includes the setup; the logged rate doesn't.
+	b.Log(res)
+}
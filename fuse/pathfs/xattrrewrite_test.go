@@ -0,0 +1,52 @@
+package pathfs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestXAttrRewrite(t *testing.T) {
+	backing := NewXAttrFs(xattrFilename, map[string][]byte{
+		"user.other": []byte("not ours"),
+	})
+	backing.tester = t
+	fs := NewXAttrRewriteFileSystem(backing, &XAttrRewriteOptions{
+		ToBacking: func(name string) string {
+			return strings.Replace(name, "user.", "user.myapp.", 1)
+		},
+		FromBacking: func(stored string) (string, bool) {
+			if !strings.HasPrefix(stored, "user.myapp.") {
+				return "", false
+			}
+			return strings.Replace(stored, "user.myapp.", "user.", 1), true
+		},
+		Codec: &GzipCodec{},
+	})
+
+	if code := fs.SetXAttr(xattrFilename, "user.tags", []byte("red,blue"), 0, nil); !code.Ok() {
+		t.Fatalf("SetXAttr: %v", code)
+	}
+	stored, ok := backing.attrs["user.myapp.tags"]
+	if !ok || string(stored) == "red,blue" {
+		t.Errorf("backing attributes %v, want user.myapp.tags encoded", backing.attrs)
+	}
+
+	if v, code := fs.GetXAttr(xattrFilename, "user.tags", nil); !code.Ok() || string(v) != "red,blue" {
+		t.Errorf("GetXAttr: got %q, %v", v, code)
+	}
+	if names, code := fs.ListXAttr(xattrFilename, nil); !code.Ok() || len(names) != 1 || names[0] != "user.tags" {
+		t.Errorf("ListXAttr: got %v, %v, want [user.tags]", names, code)
+	}
+
+	if code := fs.RemoveXAttr(xattrFilename, "user.tags", nil); !code.Ok() {
+		t.Fatalf("RemoveXAttr: %v", code)
+	}
+	if _, code := fs.GetXAttr(xattrFilename, "user.tags", nil); code != fuse.ENODATA {
+		t.Errorf("GetXAttr after remove: got %v, want ENODATA", code)
+	}
+	if _, ok := backing.attrs["user.other"]; !ok {
+		t.Errorf("unmapped attribute removed: %v", backing.attrs)
+	}
+}
@@ -0,0 +1,95 @@
+package pathfs
+
+import (
+	"fmt"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// XAttrRewriteOptions are options for NewXAttrRewriteFileSystem.
+type XAttrRewriteOptions struct {
+	// ToBacking maps an attribute name of the client to the name
+	// stored in the backing file system. The default keeps the
+	// name.
+	ToBacking func(name string) string
+
+	// FromBacking is the inverse of ToBacking. It returns false for
+	// stored names that no client name maps to; these are left out
+	// of ListXAttr. The default keeps all names.
+	FromBacking func(stored string) (name string, ok bool)
+
+	// If Codec is set, values are encoded with it before they are
+	// stored, and decoded when they are read. Values that don't
+	// decode read as EIO.
+	Codec Codec
+}
+
+type xattrRewriteFileSystem struct {
+	FileSystem
+	opts XAttrRewriteOptions
+}
+
+// NewXAttrRewriteFileSystem returns a wrapper that renames extended
+// attributes, and optionally transforms their values, between the
+// conventions of the client and those of fs, for example to store
+// the client's user.tags as user.myapp.tags. ListXAttr reports the
+// client's names.
+func NewXAttrRewriteFileSystem(fs FileSystem, opts *XAttrRewriteOptions) FileSystem {
+	x := &xattrRewriteFileSystem{FileSystem: fs}
+	if opts != nil {
+		x.opts = *opts
+	}
+	return x
+}
+
+func (fs *xattrRewriteFileSystem) String() string {
+	return fmt.Sprintf("xattrRewriteFileSystem(%v)", fs.FileSystem)
+}
+
+func (fs *xattrRewriteFileSystem) toBacking(attr string) string {
+	if fs.opts.ToBacking == nil {
+		return attr
+	}
+	return fs.opts.ToBacking(attr)
+}
+
+func (fs *xattrRewriteFileSystem) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	data, code := fs.FileSystem.GetXAttr(name, fs.toBacking(attr), context)
+	if !code.Ok() || fs.opts.Codec == nil {
+		return data, code
+	}
+	plain, err := fs.opts.Codec.Decode(data)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	return plain, fuse.OK
+}
+
+func (fs *xattrRewriteFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if fs.opts.Codec != nil {
+		stored, err := fs.opts.Codec.Encode(data)
+		if err != nil {
+			return fuse.EIO
+		}
+		data = stored
+	}
+	return fs.FileSystem.SetXAttr(name, fs.toBacking(attr), data, flags, context)
+}
+
+func (fs *xattrRewriteFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	return fs.FileSystem.RemoveXAttr(name, fs.toBacking(attr), context)
+}
+
+func (fs *xattrRewriteFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	stored, code := fs.FileSystem.ListXAttr(name, context)
+	if !code.Ok() || fs.opts.FromBacking == nil {
+		return stored, code
+	}
+	names := make([]string, 0, len(stored))
+	for _, s := range stored {
+		if n, ok := fs.opts.FromBacking(s); ok {
+			names = append(names, n)
+		}
+	}
+	return names, fuse.OK
+}
@@ -39,6 +39,10 @@ func init() {
 		CAP_AUTO_INVAL_DATA:  "AUTO_INVAL_DATA",
 		CAP_READDIRPLUS:      "READDIRPLUS",
 		CAP_READDIRPLUS_AUTO: "READDIRPLUS_AUTO",
+		CAP_ASYNC_DIO:        "ASYNC_DIO",
+		CAP_WRITEBACK_CACHE:  "WRITEBACK_CACHE",
+		CAP_NO_OPEN_SUPPORT:  "NO_OPEN_SUPPORT",
+		CAP_PARALLEL_DIROPS:  "PARALLEL_DIROPS",
 	}
 	releaseFlagNames = map[int64]string{
 		RELEASE_FLUSH: "FLUSH",
@@ -62,6 +66,7 @@ func init() {
 		FOPEN_DIRECT_IO:   "DIRECT",
 		FOPEN_KEEP_CACHE:  "CACHE",
 		FOPEN_NONSEEKABLE: "NONSEEK",
+		FOPEN_CACHE_DIR:   "CACHE_DIR",
 	}
 	accessFlagName = map[int64]string{
 		X_OK: "x",
@@ -105,6 +110,10 @@ func (me *RenameIn) string() string {
 	return fmt.Sprintf("{%d}", me.Newdir)
 }
 
+func (me *Rename2In) string() string {
+	return fmt.Sprintf("{%d fl 0x%x}", me.Newdir, me.Flags)
+}
+
 func (me *SetAttrIn) string() string {
 	s := []string{}
 	if me.Valid&FATTR_MODE != 0 {
@@ -221,6 +230,31 @@ func (f *FallocateIn) string() string {
 		f.Fh, f.Offset, f.Length, f.Mode)
 }
 
+func (in *StatxIn) string() string {
+	return fmt.Sprintf("{Fh %d fl %d sxfl 0x%x mask 0x%x}",
+		in.Fh, in.GetattrFlags, in.SxFlags, in.SxMask)
+}
+
+func (o *StatxOut) string() string {
+	return fmt.Sprintf("{A%d.%09d mask 0x%x M0%o sz %d attr 0x%x/0x%x}",
+		o.AttrValid, o.AttrValidNsec, o.Stat.Mask, o.Stat.Mode, o.Stat.Size,
+		o.Stat.Attributes, o.Stat.AttributesMask)
+}
+
+func (f *CopyFileRangeIn) string() string {
+	return fmt.Sprintf("{Fh %d off %d => i%d Fh %d off %d sz %d fl %d}",
+		f.FhIn, f.OffIn, f.NodeIdOut, f.FhOut, f.OffOut, f.Len, f.Flags)
+}
+
+func (f *SetupMappingIn) string() string {
+	return fmt.Sprintf("{Fh %d foff %d sz %d moff %d fl %d}",
+		f.Fh, f.Foffset, f.Len, f.Moffset, f.Flags)
+}
+
+func (f *RemoveMappingIn) string() string {
+	return fmt.Sprintf("{n %d}", f.Count)
+}
+
 // Print pretty prints FUSE data types for kernel communication
 func Print(obj interface{}) string {
 	t, ok := obj.(interface {
@@ -0,0 +1,47 @@
+package fuse
+
+import (
+	"unsafe"
+)
+
+// Priority classes for MountOptions.PriorityQueue. Lower values are
+// served first.
+const (
+	_PRIORITY_INTERACTIVE = iota
+	_PRIORITY_METADATA
+	_PRIORITY_BULK
+)
+
+// requestPriorities holds the classes of opcodes that are not
+// _PRIORITY_METADATA.
+var requestPriorities = map[int32]int{
+	_OP_LOOKUP:      _PRIORITY_INTERACTIVE,
+	_OP_GETATTR:     _PRIORITY_INTERACTIVE,
+	_OP_ACCESS:      _PRIORITY_INTERACTIVE,
+	_OP_READLINK:    _PRIORITY_INTERACTIVE,
+	_OP_OPENDIR:     _PRIORITY_INTERACTIVE,
+	_OP_READDIR:     _PRIORITY_INTERACTIVE,
+	_OP_READDIRPLUS: _PRIORITY_INTERACTIVE,
+	_OP_RELEASEDIR:  _PRIORITY_INTERACTIVE,
+	_OP_STATFS:      _PRIORITY_INTERACTIVE,
+	_OP_GETXATTR:    _PRIORITY_INTERACTIVE,
+	_OP_LISTXATTR:   _PRIORITY_INTERACTIVE,
+	_OP_READ:        _PRIORITY_BULK,
+	_OP_WRITE:       _PRIORITY_BULK,
+	_OP_FSYNC:       _PRIORITY_BULK,
+	_OP_FSYNCDIR:    _PRIORITY_BULK,
+	_OP_FALLOCATE:   _PRIORITY_BULK,
+}
+
+// requestPriority returns the priority class of the raw request in
+// buf.
+func requestPriority(buf []byte) int {
+	if len(buf) < int(unsafe.Sizeof(InHeader{})) {
+		return _PRIORITY_METADATA
+	}
+	h := (*InHeader)(unsafe.Pointer(&buf[0]))
+	if p, ok := requestPriorities[h.Opcode]; ok {
+		return p
+	}
+	return _PRIORITY_METADATA
+}
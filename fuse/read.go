@@ -26,6 +26,23 @@ func ReadResultData(b []byte) ReadResult {
 	return &readResultData{b}
 }
 
+// ReadResultPoolData returns b, which must have been obtained from
+// pool.AllocBuffer, and frees it to pool once the data has been
+// sent.
+func ReadResultPoolData(pool BufferPool, b []byte) ReadResult {
+	return &readResultPoolData{readResultData{b}, pool}
+}
+
+type readResultPoolData struct {
+	readResultData
+	pool BufferPool
+}
+
+func (r *readResultPoolData) Done() {
+	r.pool.FreeBuffer(r.Data)
+	r.Data = nil
+}
+
 func ReadResultFd(fd uintptr, off int64, sz int) ReadResult {
 	return &readResultFd{fd, off, sz}
 }
@@ -51,16 +68,46 @@ func (r *readResultFd) Bytes(buf []byte) ([]byte, Status) {
 		sz = len(buf)
 	}
 
-	n, err := syscall.Pread(int(r.Fd), buf[:sz], r.Off)
-	if err == io.EOF {
-		err = nil
+	// Pread may return less than asked for, eg. for large reads
+	// on network filesystems, so loop until EOF or sz.
+	total := 0
+	for total < sz {
+		n, err := syscall.Pread(int(r.Fd), buf[total:sz], r.Off+int64(total))
+		if err == io.EOF {
+			err = nil
+		}
+		if n > 0 {
+			total += n
+		}
+		if err != nil {
+			return buf[:total], ToStatus(err)
+		}
+		if n <= 0 {
+			break
+		}
 	}
 
-	if n < 0 {
-		n = 0
-	}
+	return buf[:total], OK
+}
 
-	return buf[:n], ToStatus(err)
+// clampSize reduces Sz to the data that is actually available in a
+// regular file, so we don't reserve pipe or buffer space for reads
+// past EOF.
+func (r *readResultFd) clampSize() {
+	if r.Off < 0 {
+		return
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(r.Fd), &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return
+	}
+	avail := st.Size - r.Off
+	if avail < 0 {
+		avail = 0
+	}
+	if int64(r.Sz) > avail {
+		r.Sz = int(avail)
+	}
 }
 
 func (r *readResultFd) Size() int {
@@ -0,0 +1,240 @@
+package fuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"unsafe"
+)
+
+// countingPool records which buffers were handed out and returned,
+// and the largest size asked for.
+type countingPool struct {
+	BufferPool
+	allocated map[*byte]bool
+	freed     map[*byte]bool
+	largest   uint32
+}
+
+func newCountingPool() *countingPool {
+	return &countingPool{
+		BufferPool: NewGcBufferPool(),
+		allocated:  map[*byte]bool{},
+		freed:      map[*byte]bool{},
+	}
+}
+
+func (p *countingPool) AllocBuffer(size uint32) []byte {
+	b := p.BufferPool.AllocBuffer(size)
+	p.allocated[&b[0]] = true
+	if size > p.largest {
+		p.largest = size
+	}
+	return b
+}
+
+func (p *countingPool) FreeBuffer(b []byte) {
+	if len(b) > 0 {
+		p.freed[&b[0]] = true
+	}
+}
+
+type readFS struct {
+	RawFileSystem
+	read func(buf []byte) ReadResult
+}
+
+func (fs *readFS) Read(input *ReadIn, buf []byte) (ReadResult, Status) {
+	return fs.read(buf), OK
+}
+
+func readInput(size uint32) []byte {
+	in := ReadIn{
+		InHeader: InHeader{Opcode: _OP_READ, NodeId: 2},
+		Size:     size,
+	}
+	in.Length = uint32(unsafe.Sizeof(in))
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	return append([]byte{}, b...)
+}
+
+func runRead(t *testing.T, pool *countingPool, read func(buf []byte) ReadResult) {
+	ms := newTestServer(&readFS{NewDefaultRawFileSystem(), read})
+	ms.opts.Buffers = pool
+	req := dispatch(ms, readInput(PAGESIZE))
+	if !req.status.Ok() {
+		t.Fatalf("READ: %v", req.status)
+	}
+	ms.returnRequest(req)
+}
+
+func TestReadOwnBufferNotFreed(t *testing.T) {
+	pool := newCountingPool()
+	own := []byte("hello")
+	var serverBuf []byte
+	runRead(t, pool, func(buf []byte) ReadResult {
+		serverBuf = buf
+		return ReadResultData(own)
+	})
+
+	if !pool.freed[&serverBuf[0]] {
+		t.Errorf("server buffer was not returned to the pool")
+	}
+	if pool.freed[&own[0]] {
+		t.Errorf("filesystem-owned buffer was freed")
+	}
+}
+
+func TestReadPoolBufferFreed(t *testing.T) {
+	pool := newCountingPool()
+	var fsBuf []byte
+	runRead(t, pool, func(buf []byte) ReadResult {
+		fsBuf = pool.AllocBuffer(PAGESIZE)
+		return ReadResultPoolData(pool, fsBuf)
+	})
+
+	if !pool.freed[&fsBuf[0]] {
+		t.Errorf("pool buffer from ReadResultPoolData was not freed")
+	}
+	if len(pool.freed) != 2 {
+		t.Errorf("got %d freed buffers, want 2", len(pool.freed))
+	}
+}
+
+func TestReadFdClampedToFileSize(t *testing.T) {
+	f, err := ioutil.TempFile("", "go-fuse-read")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	content := bytes.Repeat([]byte("x"), 4096)
+	if _, err := f.Write(content); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	const size = 1 << 20
+	pool := newCountingPool()
+	ms := newTestServer(&readFS{NewDefaultRawFileSystem(), func(buf []byte) ReadResult {
+		return ReadResultFd(f.Fd(), 0, len(buf))
+	}})
+	ms.opts.Buffers = pool
+	req := dispatch(ms, readInput(size))
+	defer ms.returnRequest(req)
+	if !req.status.Ok() {
+		t.Fatalf("READ: %v", req.status)
+	}
+	if got := req.fdData.Size(); got != len(content) {
+		t.Errorf("got Size %d, want %d", got, len(content))
+	}
+	if pool.largest > _READ_CHUNK {
+		t.Errorf("allocated a buffer of %d bytes, want at most %d", pool.largest, _READ_CHUNK)
+	}
+
+	data, code := req.fdData.Bytes(make([]byte, size))
+	if !code.Ok() {
+		t.Fatalf("Bytes: %v", code)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("got %d bytes, want %d", len(data), len(content))
+	}
+}
+
+// dataFS serves a file with the given contents, from its own memory.
+type dataFS struct {
+	RawFileSystem
+	data  []byte
+	reads int
+}
+
+func (fs *dataFS) Read(input *ReadIn, buf []byte) (ReadResult, Status) {
+	fs.reads++
+	if len(buf) != int(input.Size) {
+		return nil, EINVAL
+	}
+	off := int(input.Offset)
+	if off > len(fs.data) {
+		off = len(fs.data)
+	}
+	end := off + len(buf)
+	if end > len(fs.data) {
+		end = len(fs.data)
+	}
+	return ReadResultData(fs.data[off:end]), OK
+}
+
+func TestReadChunked(t *testing.T) {
+	const size = 1 << 20
+	for _, n := range []int{4096, _READ_CHUNK, 3*_READ_CHUNK + 10, 2 * size} {
+		content := bytes.Repeat([]byte("0123456789"), n/10+1)[:n]
+		fs := &dataFS{RawFileSystem: NewDefaultRawFileSystem(), data: content}
+		pool := newCountingPool()
+		ms := newTestServer(fs)
+		ms.opts.Buffers = pool
+
+		req := dispatch(ms, readInput(size))
+		if !req.status.Ok() {
+			t.Fatalf("READ of %d byte file: %v", n, req.status)
+		}
+		want := content
+		if len(want) > size {
+			want = want[:size]
+		}
+		if !bytes.Equal(req.flatData, want) {
+			t.Errorf("READ of %d byte file: got %d bytes, want %d", n, len(req.flatData), len(want))
+		}
+		// A short file is read with a single chunk.
+		if n < _READ_CHUNK && (fs.reads != 1 || pool.largest > _READ_CHUNK) {
+			t.Errorf("READ of %d byte file: %d reads, allocated %d bytes, want 1 read of at most %d bytes",
+				n, fs.reads, pool.largest, _READ_CHUNK)
+		}
+		ms.returnRequest(req)
+	}
+}
+
+// failingIOFS fails the test if it is asked to read or write.
+type failingIOFS struct {
+	RawFileSystem
+	t *testing.T
+}
+
+func (fs *failingIOFS) Read(input *ReadIn, buf []byte) (ReadResult, Status) {
+	fs.t.Errorf("Read called for %d bytes", input.Size)
+	return nil, EIO
+}
+
+func (fs *failingIOFS) Write(input *WriteIn, data []byte) (uint32, Status) {
+	fs.t.Errorf("Write called for %d bytes", len(data))
+	return 0, EIO
+}
+
+func TestZeroLengthReadWrite(t *testing.T) {
+	pool := newCountingPool()
+	ms := newTestServer(&failingIOFS{NewDefaultRawFileSystem(), t})
+	ms.opts.Buffers = pool
+
+	req := dispatch(ms, readInput(0))
+	if !req.status.Ok() || len(req.flatData) != 0 || req.fdData != nil {
+		t.Errorf("READ: got %v with %d bytes, want OK and no data", req.status, len(req.flatData))
+	}
+	ms.returnRequest(req)
+
+	in := WriteIn{
+		InHeader: InHeader{Opcode: _OP_WRITE, NodeId: 2},
+	}
+	in.Length = uint32(unsafe.Sizeof(in))
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	req = dispatch(ms, append([]byte{}, b...))
+	if !req.status.Ok() || (*WriteOut)(req.outData).Size != 0 {
+		t.Errorf("WRITE: got %v, size %d, want OK and 0", req.status, (*WriteOut)(req.outData).Size)
+	}
+	ms.returnRequest(req)
+
+	if len(pool.allocated) != 0 {
+		t.Errorf("allocated %d buffers, want none", len(pool.allocated))
+	}
+}
@@ -38,6 +38,13 @@ type request struct {
 	// All information pertaining to opcode of this request.
 	handler *operationHandler
 
+	// Set if the request holds one of the MaxInFlight slots.
+	inFlight bool
+
+	// Errors passed to RecordError while handling, with
+	// debugging on.
+	errors []error
+
 	// Request storage. For large inputs and outputs, use data
 	// obtained through bufferpool.
 	bufferPoolInputBuf  []byte
@@ -68,6 +75,7 @@ func (r *request) clear() {
 	r.startTime = time.Time{}
 	r.handler = nil
 	r.readResult = nil
+	r.errors = nil
 }
 
 func (r *request) InputDebug() string {
@@ -114,8 +122,13 @@ func (r *request) OutputDebug() string {
 		}
 	}
 
-	return fmt.Sprintf("Serialize: %s code: %v value: %v%v",
-		operationName(r.inHeader.Opcode), r.status, dataStr, flatStr)
+	errStr := ""
+	if len(r.errors) > 0 {
+		errStr = fmt.Sprintf(" errors: %v", r.errors)
+	}
+
+	return fmt.Sprintf("Serialize: %s code: %v value: %v%v%s",
+		operationName(r.inHeader.Opcode), r.status, dataStr, flatStr, errStr)
 }
 
 // setInput returns true if it takes ownership of the argument, false if not.
@@ -1,9 +1,13 @@
 package fuse
 
-const outputHeaderSize = 200
+// StatxOut is the largest fixed-size reply.
+const outputHeaderSize = 304
 
 const (
 	_FUSE_KERNEL_VERSION   = 7
 	_MINIMUM_MINOR_VERSION = 8
 	_OUR_MINOR_VERSION     = 8
 )
+
+// Init flags negotiated on top of the portable ones.
+const _PLATFORM_INIT_FLAGS = CAP_VOL_RENAME
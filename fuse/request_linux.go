@@ -1,9 +1,13 @@
 package fuse
 
-const outputHeaderSize = 160
+// StatxOut is the largest fixed-size reply.
+const outputHeaderSize = 304
 
 const (
 	_FUSE_KERNEL_VERSION   = 7
 	_MINIMUM_MINOR_VERSION = 12
-	_OUR_MINOR_VERSION     = 21
+	_OUR_MINOR_VERSION     = 23
 )
+
+// Init flags negotiated on top of the portable ones.
+const _PLATFORM_INIT_FLAGS = 0
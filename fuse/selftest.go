@@ -0,0 +1,70 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var selfTestCounter uint64
+
+// SelfTest checks that the mount is serving requests, by creating a
+// scratch file in the root of the mount, writing it, reading it back
+// and removing it again. It returns how long this took. If the cycle
+// does not complete within timeout, an error is returned; the
+// operations in flight are abandoned, and may stay blocked until the
+// file system recovers.
+//
+// This is meant for liveness probes, and needs a file system that
+// allows creating files in its root directory.
+func (ms *Server) SelfTest(timeout time.Duration) (time.Duration, error) {
+	mnt := ms.mountPoint
+	if mnt == "" {
+		return 0, fmt.Errorf("server is not mounted")
+	}
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- selfTest(mnt)
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		return time.Since(start), err
+	case <-t.C:
+		return time.Since(start), fmt.Errorf("self test of %s timed out after %v", mnt, timeout)
+	}
+}
+
+func selfTest(dir string) error {
+	name := filepath.Join(dir, fmt.Sprintf(".go-fuse-selftest.%d.%d",
+		os.Getpid(), atomic.AddUint64(&selfTestCounter, 1)))
+	want := []byte(name)
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(want)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		var got []byte
+		got, err = ioutil.ReadFile(name)
+		if err == nil && !bytes.Equal(got, want) {
+			err = fmt.Errorf("read back %q, want %q", got, want)
+		}
+	}
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -31,6 +31,9 @@ type Server struct {
 	// I/O with kernel and daemon.
 	mountFd int
 
+	// Set if we mounted with mount(2) rather than fusermount.
+	directMount bool
+
 	// Dump debug info onto stdout.
 	debug bool
 
@@ -53,6 +56,24 @@ type Server struct {
 	singleReader bool
 	canSplice    bool
 	loops        sync.WaitGroup
+
+	// unsupported holds the optional operations that the file
+	// system declares it doesn't implement.
+	unsupported CapSet
+
+	// For MountOptions.MaxInFlight, protected by reqMu: the
+	// number of limited requests being handled, the requests
+	// waiting for a slot in arrival order, and how many slots in
+	// a row went to another request than the oldest waiter.
+	inFlight    int
+	slotWaiters []*slotWaiter
+	bypassed    int
+
+	// For MountOptions.SlowRequestThreshold: when a slow request
+	// was last logged, and how many were not logged since.
+	slowMu      sync.Mutex
+	slowLogged  time.Time
+	slowSkipped int
 }
 
 func (ms *Server) SetDebug(dbg bool) {
@@ -84,16 +105,20 @@ func (ms *Server) RecordLatencies(l LatencyMap) {
 	ms.latencies = l
 }
 
-// Unmount calls fusermount -u on the mount. This has the effect of
-// shutting down the filesystem. After the Server is unmounted, it
-// should be discarded.
+// Unmount calls fusermount -u on the mount, or umount(2) if it was
+// mounted directly. This has the effect of shutting down the
+// filesystem. After the Server is unmounted, it should be discarded.
 func (ms *Server) Unmount() (err error) {
 	if ms.mountPoint == "" {
 		return nil
 	}
 	delay := time.Duration(0)
 	for try := 0; try < 5; try++ {
-		err = unmount(ms.mountPoint)
+		if ms.directMount {
+			err = syscall.Unmount(ms.mountPoint, 0)
+		} else {
+			err = unmount(ms.mountPoint)
+		}
 		if err == nil {
 			break
 		}
@@ -121,6 +146,9 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 		}
 	}
 	o := *opts
+	if o.MaxBackground == 0 {
+		o.MaxBackground = _DEFAULT_BACKGROUND_TASKS
+	}
 	if o.SingleThreaded {
 		fs = NewLockingRawFileSystem(fs)
 	}
@@ -137,6 +165,12 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 	if o.MaxWrite > MAX_KERNEL_WRITE {
 		o.MaxWrite = MAX_KERNEL_WRITE
 	}
+	if o.MaxNameLength == 0 {
+		o.MaxNameLength = _NAME_MAX
+	}
+	if o.MaxPathLength == 0 {
+		o.MaxPathLength = _PATH_MAX - 1
+	}
 	opts = &o
 	ms := &Server{
 		fileSystem: fs,
@@ -146,6 +180,7 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 		// FUSE device: on unmount, sometime some reads do not
 		// error-out, meaning that unmount will hang.
 		singleReader: runtime.GOOS == "darwin",
+		unsupported:  CapAll &^ Capabilities(fs),
 	}
 	ms.reqPool.New = func() interface{} { return new(request) }
 	ms.readPool.New = func() interface{} { return make([]byte, o.MaxWrite+PAGESIZE) }
@@ -173,7 +208,7 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 		}
 		mountPoint = filepath.Clean(filepath.Join(cwd, mountPoint))
 	}
-	fd, err := mount(mountPoint, strings.Join(optStrs, ","))
+	fd, direct, err := mount(mountPoint, strings.Join(optStrs, ","), opts.DirectMount)
 	if err != nil {
 		return nil, err
 	}
@@ -181,6 +216,7 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 	ms.fileSystem.Init(ms)
 	ms.mountPoint = mountPoint
 	ms.mountFd = fd
+	ms.directMount = direct
 	return ms, nil
 }
 
@@ -201,8 +237,13 @@ const _MAX_READERS = 2
 // Returns a new request, or error. In case exitIdle is given, returns
 // nil, OK if we have too many readers already.
 func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
+read:
 	ms.reqMu.Lock()
-	if ms.reqReaders > _MAX_READERS {
+	// With many requests waiting for a slot, stop adding
+	// readers, but keep one: forgets, interrupts and our own
+	// requests must still get through.
+	if ms.reqReaders > _MAX_READERS ||
+		(ms.opts.MaxInFlight > 0 && ms.reqReaders > 0 && ms.reqReaders+len(ms.slotWaiters) >= ms.maxWaiters()) {
 		ms.reqMu.Unlock()
 		return nil, OK
 	}
@@ -222,9 +263,14 @@ func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
 		return nil, code
 	}
 
-	if ms.latencies != nil {
+	if ms.latencies != nil || ms.opts.SlowRequestThreshold > 0 {
 		req.startTime = time.Now()
 	}
+	limited := ms.opts.MaxInFlight > 0 && ms.isLimited(dest[:n])
+	priority := 0
+	if limited {
+		priority = requestPriority(dest[:n])
+	}
 	gobbled := req.setInput(dest[:n])
 
 	ms.reqMu.Lock()
@@ -234,19 +280,98 @@ func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
 		dest = nil
 	}
 	ms.reqReaders--
+	if limited {
+		req.inFlight = true
+		if ms.inFlight < ms.opts.MaxInFlight {
+			ms.inFlight++
+		} else {
+			// returnRequest hands the request to a handler
+			// when a slot frees up. Meanwhile, we go on
+			// reading.
+			ms.slotWaiters = append(ms.slotWaiters, &slotWaiter{priority: priority, req: req})
+			ms.reqMu.Unlock()
+			goto read
+		}
+	}
 	if !ms.singleReader && ms.reqReaders <= 0 {
 		ms.loops.Add(1)
 		go ms.loop(true)
 	}
 	ms.reqMu.Unlock()
-
 	return req, OK
 }
 
+// slotWaiter is a request waiting for a MaxInFlight slot.
+type slotWaiter struct {
+	priority int
+	req      *request
+}
+
+// _MAX_BYPASS is how many slots in a row may go to higher priority
+// requests while an older one waits.
+const _MAX_BYPASS = 8
+
+// maxWaiters returns how many requests may wait for a slot.
+func (ms *Server) maxWaiters() int {
+	if ms.opts.PriorityQueue > 0 {
+		return ms.opts.PriorityQueue
+	}
+	return ms.opts.MaxInFlight
+}
+
+// nextWaiter removes and returns the waiter that gets the next free
+// slot, or nil if there is none. Without PriorityQueue, that is the
+// oldest. Must be called with reqMu held.
+func (ms *Server) nextWaiter() *slotWaiter {
+	if len(ms.slotWaiters) == 0 {
+		return nil
+	}
+	next := 0
+	if ms.opts.PriorityQueue > 0 && ms.bypassed < _MAX_BYPASS {
+		for i, w := range ms.slotWaiters {
+			if w.priority < ms.slotWaiters[next].priority {
+				next = i
+			}
+		}
+	}
+	if next == 0 {
+		ms.bypassed = 0
+	} else {
+		ms.bypassed++
+	}
+	w := ms.slotWaiters[next]
+	ms.slotWaiters = append(ms.slotWaiters[:next], ms.slotWaiters[next+1:]...)
+	return w
+}
+
+// isLimited returns true if the raw request in buf counts towards
+// MaxInFlight.
+func (ms *Server) isLimited(buf []byte) bool {
+	if len(buf) < int(unsafe.Sizeof(InHeader{})) {
+		return false
+	}
+	h := (*InHeader)(unsafe.Pointer(&buf[0]))
+	switch h.Opcode {
+	case _OP_FORGET, _OP_BATCH_FORGET, _OP_INTERRUPT:
+		return false
+	}
+	return int(h.Pid) != os.Getpid()
+}
+
 // returnRequest returns a request to the pool of unused requests.
 func (ms *Server) returnRequest(req *request) {
 	ms.recordStats(req)
+	ms.logSlow(req)
+
+	// Done must be called even if nothing was written, so results
+	// holding on to pool buffers can release them.
+	if req.readResult != nil {
+		req.readResult.Done()
+	}
 
+	// The output buffer passed to Read is always ours, and the
+	// data has been written out, so it goes back to the pool even
+	// if the ReadResult pointed into it.
 	if req.bufferPoolOutputBuf != nil {
 		ms.opts.Buffers.FreeBuffer(req.bufferPoolOutputBuf)
 		req.bufferPoolOutputBuf = nil
@@ -254,7 +379,16 @@ func (ms *Server) returnRequest(req *request) {
 
 	req.clear()
 	ms.reqMu.Lock()
-	if req.bufferPoolOutputBuf != nil {
+	if req.inFlight {
+		req.inFlight = false
+		if w := ms.nextWaiter(); w != nil {
+			// The slot passes to the waiter.
+			go ms.handleRequest(w.req)
+		} else {
+			ms.inFlight--
+		}
+	}
+	if req.bufferPoolInputBuf != nil {
 		ms.readPool.Put(req.bufferPoolInputBuf)
 		req.bufferPoolInputBuf = nil
 		ms.outstandingReadBufs--
@@ -271,6 +405,40 @@ func (ms *Server) recordStats(req *request) {
 	}
 }
 
+// logSlow logs req if it took longer than
+// MountOptions.SlowRequestThreshold, at most once per second.
+func (ms *Server) logSlow(req *request) {
+	threshold := ms.opts.SlowRequestThreshold
+	if threshold <= 0 || req.startTime.IsZero() {
+		return
+	}
+	now := time.Now()
+	dt := now.Sub(req.startTime)
+	if dt < threshold {
+		return
+	}
+
+	ms.slowMu.Lock()
+	if now.Sub(ms.slowLogged) < time.Second {
+		ms.slowSkipped++
+		ms.slowMu.Unlock()
+		return
+	}
+	skipped := ms.slowSkipped
+	ms.slowLogged, ms.slowSkipped = now, 0
+	ms.slowMu.Unlock()
+
+	msg := fmt.Sprintf("slow request: %s node %d", operationName(req.inHeader.Opcode), req.inHeader.NodeId)
+	if len(req.filenames) > 0 {
+		msg += fmt.Sprintf(" %q", req.filenames)
+	}
+	msg += fmt.Sprintf(" took %v", dt)
+	if skipped > 0 {
+		msg += fmt.Sprintf(" (%d more slow requests not logged)", skipped)
+	}
+	log.Println(msg)
+}
+
 // Serve initiates the FUSE loop. Normally, callers should run Serve()
 // and wait for it to exit, but tests will want to run this in a
 // goroutine.
@@ -283,6 +451,8 @@ func (ms *Server) Serve() {
 
 	ms.writeMu.Lock()
 	syscall.Close(ms.mountFd)
+	// The number may be reused for another file.
+	ms.mountFd = -1
 	ms.writeMu.Unlock()
 }
 
@@ -330,13 +500,30 @@ func (ms *Server) handleRequest(req *request) {
 	}
 
 	if req.status.Ok() {
-		req.handler.Func(ms, req)
+		req.status = ms.checkNames(req)
+	}
+
+	if req.status.Ok() {
+		req.status = ms.checkCapability(req)
+	}
+
+	if req.status.Ok() {
+		if ms.debug {
+			req.recordErrors()
+			req.handler.Func(ms, req)
+			req.stopRecordingErrors()
+		} else {
+			req.handler.Func(ms, req)
+		}
 	}
 
 	errNo := ms.write(req)
 	if errNo != 0 {
 		log.Printf("writer: Write/Writev failed, err: %v. opcode: %v",
 			errNo, operationName(req.inHeader.Opcode))
+		if req.status.Ok() {
+			undoReply(ms, req)
+		}
 	}
 	ms.returnRequest(req)
 }
@@ -353,6 +540,18 @@ func (ms *Server) allocOut(req *request, size uint32) []byte {
 	return req.bufferPoolOutputBuf
 }
 
+// growOut replaces the output buffer of req, whose contents are buf,
+// with one of size bytes, and returns the contents in the new buffer.
+func (ms *Server) growOut(req *request, buf []byte, size int) []byte {
+	grown := ms.opts.Buffers.AllocBuffer(uint32(size))
+	n := copy(grown, buf)
+	if req.bufferPoolOutputBuf != nil {
+		ms.opts.Buffers.FreeBuffer(req.bufferPoolOutputBuf)
+	}
+	req.bufferPoolOutputBuf = grown
+	return grown[:n]
+}
+
 func (ms *Server) write(req *request) Status {
 	// Forget does not wait for reply.
 	if req.inHeader.Opcode == _OP_FORGET || req.inHeader.Opcode == _OP_BATCH_FORGET {
@@ -375,6 +574,18 @@ func (ms *Server) write(req *request) Status {
 	return s
 }
 
+// writeNotify writes a notification, or returns EBADF if the server
+// has stopped serving.
+func (ms *Server) writeNotify(req *request) Status {
+	// Protect against concurrent close.
+	ms.writeMu.Lock()
+	defer ms.writeMu.Unlock()
+	if ms.mountFd < 0 {
+		return EBADF
+	}
+	return ms.write(req)
+}
+
 // InodeNotify invalidates the information associated with the inode
 // (ie. data cache, attributes, etc.)
 func (ms *Server) InodeNotify(node uint64, off int64, length int64) Status {
@@ -392,10 +603,7 @@ func (ms *Server) InodeNotify(node uint64, off int64, length int64) Status {
 	}
 	req.outData = unsafe.Pointer(entry)
 
-	// Protect against concurrent close.
-	ms.writeMu.Lock()
-	result := ms.write(&req)
-	ms.writeMu.Unlock()
+	result := ms.writeNotify(&req)
 
 	if ms.debug {
 		log.Println("Response: INODE_NOTIFY", result)
@@ -434,10 +642,7 @@ func (ms *Server) DeleteNotify(parent uint64, child uint64, name string) Status
 	req.outData = unsafe.Pointer(entry)
 	req.flatData = nameBytes
 
-	// Protect against concurrent close.
-	ms.writeMu.Lock()
-	result := ms.write(&req)
-	ms.writeMu.Unlock()
+	result := ms.writeNotify(&req)
 
 	if ms.debug {
 		log.Printf("Response: DELETE_NOTIFY: %v", result)
@@ -469,10 +674,7 @@ func (ms *Server) EntryNotify(parent uint64, name string) Status {
 	req.outData = unsafe.Pointer(entry)
 	req.flatData = nameBytes
 
-	// Protect against concurrent close.
-	ms.writeMu.Lock()
-	result := ms.write(&req)
-	ms.writeMu.Unlock()
+	result := ms.writeNotify(&req)
 
 	if ms.debug {
 		log.Printf("Response: ENTRY_NOTIFY: %v", result)
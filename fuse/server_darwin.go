@@ -18,8 +18,5 @@ func (ms *Server) systemWrite(req *request, header []byte) Status {
 	}
 
 	_, err := writev(int(ms.mountFd), [][]byte{header, req.flatData})
-	if req.readResult != nil {
-		req.readResult.Done()
-	}
 	return ToStatus(err)
 }
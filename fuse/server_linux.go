@@ -15,10 +15,13 @@ func (ms *Server) systemWrite(req *request, header []byte) Status {
 		if ms.canSplice {
 			err := ms.trySplice(header, req, req.fdData)
 			if err == nil {
-				req.readResult.Done()
 				return OK
 			}
-			log.Println("trySplice:", err)
+			// A full pipe is expected under load; the copy
+			// below handles it.
+			if !isEAGAIN(err) {
+				log.Println("trySplice:", err)
+			}
 		}
 
 		sz := req.flatDataSize()
@@ -28,8 +31,5 @@ func (ms *Server) systemWrite(req *request, header []byte) Status {
 	}
 
 	_, err := writev(ms.mountFd, [][]byte{header, req.flatData})
-	if req.readResult != nil {
-		req.readResult.Done()
-	}
 	return ToStatus(err)
 }
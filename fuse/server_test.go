@@ -0,0 +1,416 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// blockingFS blocks GetAttr until release is closed, and records the
+// highest number of concurrent calls.
+type blockingFS struct {
+	RawFileSystem
+	release chan struct{}
+
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (fs *blockingFS) GetAttr(input *GetAttrIn, out *AttrOut) Status {
+	fs.mu.Lock()
+	fs.running++
+	if fs.running > fs.max {
+		fs.max = fs.running
+	}
+	fs.mu.Unlock()
+
+	if int(input.Pid) != os.Getpid() {
+		<-fs.release
+	}
+
+	fs.mu.Lock()
+	fs.running--
+	fs.mu.Unlock()
+	return OK
+}
+
+func getAttrInput(unique uint64, pid uint32) []byte {
+	in := GetAttrIn{InHeader: InHeader{Opcode: _OP_GETATTR, NodeId: 1, Unique: unique}}
+	in.Pid = pid
+	in.Length = uint32(unsafe.Sizeof(in))
+
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	return append([]byte{}, b...)
+}
+
+// newSocketServer returns a Server for fs that reads requests from a
+// socket rather than the FUSE device, and the other end of the
+// socket.
+func newSocketServer(t *testing.T, fs RawFileSystem) (*Server, int) {
+	// A seqpacket socket keeps message boundaries, like the FUSE
+	// device.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+	// The sockets stay open: at EOF, the server would spin on
+	// empty reads, while the kernel returns ENODEV after unmount.
+
+	ms := newTestServer(fs)
+	ms.opts.MaxWrite = 1 << 16
+	ms.mountFd = fds[0]
+	ms.reqPool.New = func() interface{} { return new(request) }
+	ms.readPool.New = func() interface{} { return make([]byte, ms.opts.MaxWrite+PAGESIZE) }
+	return ms, fds[1]
+}
+
+func TestMaxInFlight(t *testing.T) {
+	const limit = 3
+	fs := &blockingFS{
+		RawFileSystem: NewDefaultRawFileSystem(),
+		release:       make(chan struct{}),
+	}
+	ms, fd := newSocketServer(t, fs)
+	ms.opts.MaxInFlight = limit
+	go ms.Serve()
+	// Fail rather than hang if a reply doesn't come.
+	tv := syscall.Timeval{Sec: 5}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatalf("SetsockoptTimeval: %v", err)
+	}
+
+	// Fill the slots, and more than fill the queue of requests
+	// waiting for one.
+	n := 2*limit + 1
+	for i := 0; i < n; i++ {
+		if _, err := syscall.Write(fd, getAttrInput(uint64(i+1), 1)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// A request from our own process is not held up by the limit.
+	self := uint64(n + 1)
+	if _, err := syscall.Write(fd, getAttrInput(self, uint32(os.Getpid()))); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	reply := make([]byte, 4096)
+	m, err := syscall.Read(fd, reply)
+	if err != nil || m < int(unsafe.Sizeof(OutHeader{})) {
+		t.Fatalf("Read: %d, %v", m, err)
+	}
+	if got := (*OutHeader)(unsafe.Pointer(&reply[0])).Unique; got != self {
+		t.Fatalf("got reply for %d, want %d", got, self)
+	}
+
+	// Further requests stay queued.
+	for i := 0; i < 50; i++ {
+		if _, err := syscall.Write(fd, getAttrInput(self+uint64(i+1), 1)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		n++
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	fs.mu.Lock()
+	running := fs.running
+	fs.mu.Unlock()
+	if running != limit {
+		t.Errorf("got %d requests running, want %d", running, limit)
+	}
+	// They are read, but by a single reader.
+	waitFor(t, func() bool {
+		ms.reqMu.Lock()
+		defer ms.reqMu.Unlock()
+		return len(ms.slotWaiters) == n-limit && ms.reqReaders == 1
+	})
+
+	close(fs.release)
+	for i := 0; i < n; i++ {
+		if _, err := syscall.Read(fd, reply); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if fs.max > limit+1 {
+		t.Errorf("got %d concurrent requests, want at most %d", fs.max, limit+1)
+	}
+}
+
+// failingFS fails GetAttr the way a wrapper around a backend might.
+type failingFS struct {
+	RawFileSystem
+}
+
+func (fs *failingFS) GetAttr(input *GetAttrIn, out *AttrOut) Status {
+	_, err := os.Stat("/does/not/exist")
+	return RecordError(&input.Context, ToStatus(err), fmt.Errorf("backend lookup: %v", err))
+}
+
+func TestRecordError(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	ms, fd := newSocketServer(t, &failingFS{NewDefaultRawFileSystem()})
+	ms.SetDebug(true)
+	go ms.Serve()
+
+	if _, err := syscall.Write(fd, getAttrInput(1, 1)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	reply := make([]byte, 4096)
+	if _, err := syscall.Read(fd, reply); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got := Status(-(*OutHeader)(unsafe.Pointer(&reply[0])).Status); got != ENOENT {
+		t.Errorf("got status %v, want ENOENT", got)
+	}
+
+	// The debug line is logged before the reply is written.
+	want := "errors: [backend lookup: stat /does/not/exist: no such file or directory]"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("debug log %q does not contain %q", buf.String(), want)
+	}
+}
+
+// orderFS records the order in which requests are served. Reads
+// block until release is closed.
+type orderFS struct {
+	RawFileSystem
+	release chan struct{}
+
+	mu    sync.Mutex
+	order []int32
+}
+
+func (fs *orderFS) record(op int32) {
+	fs.mu.Lock()
+	fs.order = append(fs.order, op)
+	fs.mu.Unlock()
+}
+
+func (fs *orderFS) served() []int32 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]int32{}, fs.order...)
+}
+
+func (fs *orderFS) GetAttr(input *GetAttrIn, out *AttrOut) Status {
+	fs.record(_OP_GETATTR)
+	return OK
+}
+
+func (fs *orderFS) Read(input *ReadIn, buf []byte) (ReadResult, Status) {
+	fs.record(_OP_READ)
+	<-fs.release
+	return ReadResultData(nil), OK
+}
+
+func TestPriorityQueue(t *testing.T) {
+	const R, G = _OP_READ, _OP_GETATTR
+	for _, c := range []struct {
+		name   string
+		queued []int32
+		want   []int32
+	}{
+		{"priority", []int32{R, R, R, G, G, G}, []int32{R, G, G, G, R, R, R}},
+		// After _MAX_BYPASS getattrs, the waiting read is served.
+		{"aging",
+			[]int32{R, G, G, G, G, G, G, G, G, G, G},
+			[]int32{R, G, G, G, G, G, G, G, G, R, G, G}},
+	} {
+		fs := &orderFS{
+			RawFileSystem: NewDefaultRawFileSystem(),
+			release:       make(chan struct{}),
+		}
+		ms, fd := newSocketServer(t, fs)
+		ms.opts.MaxInFlight = 1
+		ms.opts.PriorityQueue = 32
+		go ms.Serve()
+
+		// The first read takes the slot, and the rest queue up
+		// behind it.
+		unique := uint64(1)
+		send := func(op int32) {
+			in := getAttrInput(unique, 1)
+			if op == R {
+				in = readInput(16)
+				(*InHeader)(unsafe.Pointer(&in[0])).Unique = unique
+			}
+			unique++
+			if _, err := syscall.Write(fd, in); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+		send(R)
+		waitFor(t, func() bool { return len(fs.served()) == 1 })
+		for _, op := range c.queued {
+			send(op)
+		}
+		waitFor(t, func() bool {
+			ms.reqMu.Lock()
+			defer ms.reqMu.Unlock()
+			return len(ms.slotWaiters) == len(c.queued)
+		})
+
+		close(fs.release)
+		reply := make([]byte, 4096)
+		for i := 0; i < len(c.want); i++ {
+			if _, err := syscall.Read(fd, reply); err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+		}
+		got := fs.served()
+		if len(got) != len(c.want) {
+			t.Fatalf("%s: served %v, want %v", c.name, got, c.want)
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: served %v, want %v", c.name, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+// waitFor polls cond until it holds, or fails the test after a
+// while.
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 1000; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
+
+// handleFS hands out handles, and records which it got back.
+type handleFS struct {
+	RawFileSystem
+	released []uint64
+	forgot   []uint64
+}
+
+func (fs *handleFS) Create(input *CreateIn, name string, out *CreateOut) Status {
+	out.NodeId = 7
+	out.Fh = 8
+	return OK
+}
+
+func (fs *handleFS) Open(input *OpenIn, out *OpenOut) Status {
+	out.Fh = 9
+	return OK
+}
+
+func (fs *handleFS) Release(input *ReleaseIn) {
+	fs.released = append(fs.released, input.NodeId, input.Fh)
+}
+
+func (fs *handleFS) Forget(nodeID, nlookup uint64) {
+	fs.forgot = append(fs.forgot, nodeID, nlookup)
+}
+
+func TestUndeliveredReplyReleased(t *testing.T) {
+	fs := &handleFS{RawFileSystem: NewDefaultRawFileSystem()}
+	ms := newTestServer(fs)
+	// Replies to the read end of a pipe fail, as they do for
+	// interrupted requests.
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+	ms.mountFd = p[0]
+
+	create := CreateIn{InHeader: InHeader{Opcode: _OP_CREATE, NodeId: 1, Unique: 1}}
+	var b []byte
+	toSlice(&b, unsafe.Pointer(&create), unsafe.Sizeof(create))
+	input := append(append([]byte{}, b...), "file\x00"...)
+	(*InHeader)(unsafe.Pointer(&input[0])).Length = uint32(len(input))
+
+	open := OpenIn{InHeader: InHeader{Opcode: _OP_OPEN, NodeId: 3, Unique: 2}}
+	open.Length = uint32(unsafe.Sizeof(open))
+	toSlice(&b, unsafe.Pointer(&open), unsafe.Sizeof(open))
+
+	for _, in := range [][]byte{input, append([]byte{}, b...)} {
+		req := new(request)
+		req.setInput(in)
+		ms.handleRequest(req)
+	}
+	if want := []uint64{7, 8, 3, 9}; fmt.Sprint(fs.released) != fmt.Sprint(want) {
+		t.Errorf("released node, handle pairs %v, want %v", fs.released, want)
+	}
+	if want := []uint64{7, 1}; fmt.Sprint(fs.forgot) != fmt.Sprint(want) {
+		t.Errorf("forgot %v, want %v", fs.forgot, want)
+	}
+}
+
+// slowFS takes its time over GetAttr.
+type slowFS struct {
+	RawFileSystem
+}
+
+func (fs *slowFS) GetAttr(input *GetAttrIn, out *AttrOut) Status {
+	time.Sleep(20 * time.Millisecond)
+	return OK
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	ms, fd := newSocketServer(t, &slowFS{NewDefaultRawFileSystem()})
+	ms.opts.SlowRequestThreshold = 10 * time.Millisecond
+	go ms.Serve()
+
+	reply := make([]byte, 4096)
+	for i := 0; i < 3; i++ {
+		if _, err := syscall.Write(fd, getAttrInput(uint64(i+1), 1)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if _, err := syscall.Read(fd, reply); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	// The reply is written before the request is logged.
+	time.Sleep(10 * time.Millisecond)
+
+	// The others are within a second of the first.
+	if got := strings.Count(buf.String(), "slow request: GETATTR node 1 took"); got != 1 {
+		t.Errorf("got %d slow request lines, want 1. Log: %q", got, buf.String())
+	}
+}
+
+func TestNotifyAfterServe(t *testing.T) {
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer syscall.Close(p[0])
+
+	// Reading from the write end of a pipe fails, so Serve returns
+	// right away, and closes it.
+	ms := newTestServer(NewDefaultRawFileSystem())
+	ms.mountFd = p[1]
+	ms.reqPool.New = func() interface{} { return new(request) }
+	ms.readPool.New = func() interface{} { return make([]byte, PAGESIZE) }
+	ms.Serve()
+
+	if code := ms.InodeNotify(FUSE_ROOT_ID, 0, 0); code != EBADF {
+		t.Errorf("InodeNotify: got %v, want EBADF", code)
+	}
+	if code := ms.EntryNotify(FUSE_ROOT_ID, "file"); code != EBADF {
+		t.Errorf("EntryNotify: got %v, want EBADF", code)
+	}
+}
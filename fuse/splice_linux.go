@@ -3,6 +3,8 @@ package fuse
 import (
 	"fmt"
 	"io"
+	"os"
+	"syscall"
 
 	"github.com/hanwen/go-fuse/splice"
 )
@@ -11,19 +13,31 @@ func (s *Server) setSplice() {
 	s.canSplice = splice.Resizable()
 }
 
+// trySplice writes the reply for req through a pipe, so the file data
+// is not copied into user space. If it fails, nothing has been
+// written to the device, and the caller should send the reply with
+// a copy instead.
 func (ms *Server) trySplice(header []byte, req *request, fdData *readResultFd) error {
 	pair, err := splice.Get()
 	if err != nil {
 		return err
 	}
-	defer splice.Done(pair)
+	if err := ms.spliceReply(pair, header, req, fdData); err != nil {
+		// The pipe may still hold part of the reply.
+		splice.Drop(pair)
+		return err
+	}
+	splice.Done(pair)
+	return nil
+}
 
+func (ms *Server) spliceReply(pair *splice.Pair, header []byte, req *request, fdData *readResultFd) error {
 	total := len(header) + fdData.Size()
 	if err := pair.Grow(total); err != nil {
 		return err
 	}
 
-	_, err = pair.Write(header)
+	_, err := pair.Write(header)
 	if err != nil {
 		return err
 	}
@@ -52,7 +66,6 @@ func (ms *Server) trySplice(header []byte, req *request, fdData *readResultFd) e
 	}
 
 	if err != nil {
-		// TODO - extract the data from splice.
 		return err
 	}
 
@@ -66,3 +79,15 @@ func (ms *Server) trySplice(header []byte, req *request, fdData *readResultFd) e
 	}
 	return nil
 }
+
+// isEAGAIN returns true if err says that the nonblocking pipe could
+// not take or give the data right away.
+func isEAGAIN(err error) bool {
+	switch e := err.(type) {
+	case *os.SyscallError:
+		err = e.Err
+	case *os.PathError:
+		err = e.Err
+	}
+	return err == syscall.EAGAIN
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 
@@ -29,6 +30,12 @@ func (fs *cacheFs) Open(name string, flags uint32, context *fuse.Context) (fuseF
 }
 
 func setupCacheTest(t *testing.T) (string, *pathfs.PathNodeFs, func()) {
+	return setupWrappedCacheTest(t, nil)
+}
+
+// setupWrappedCacheTest is like setupCacheTest, but mounts
+// wrap(cacheFs) if wrap is given.
+func setupWrappedCacheTest(t *testing.T, wrap func(pathfs.FileSystem) pathfs.FileSystem) (string, *pathfs.PathNodeFs, func()) {
 	dir, err := ioutil.TempDir("", "go-fuse-cachetest")
 	if err != nil {
 		t.Fatalf("TempDir failed: %v", err)
@@ -36,9 +43,12 @@ func setupCacheTest(t *testing.T) (string, *pathfs.PathNodeFs, func()) {
 	os.Mkdir(dir+"/mnt", 0755)
 	os.Mkdir(dir+"/orig", 0755)
 
-	fs := &cacheFs{
+	var fs pathfs.FileSystem = &cacheFs{
 		pathfs.NewLoopbackFileSystem(dir + "/orig"),
 	}
+	if wrap != nil {
+		fs = wrap(fs)
+	}
 	pfs := pathfs.NewPathNodeFs(fs, nil)
 	state, conn, err := nodefs.MountRoot(dir+"/mnt", pfs.Root(), nil)
 	if err != nil {
@@ -105,6 +115,45 @@ func TestCacheFs(t *testing.T) {
 	}
 }
 
+func TestDirectIOFs(t *testing.T) {
+	volatile := func(name string) bool { return strings.HasSuffix(name, ".log") }
+	wd, _, clean := setupWrappedCacheTest(t, func(fs pathfs.FileSystem) pathfs.FileSystem {
+		return pathfs.NewDirectIOFileSystem(fs, volatile)
+	})
+	defer clean()
+
+	names := []string{"file.txt", "live.log"}
+	for _, n := range names {
+		if err := ioutil.WriteFile(wd+"/orig/"+n, []byte("hello"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		if c, err := ioutil.ReadFile(wd + "/mnt/" + n); err != nil || string(c) != "hello" {
+			t.Fatalf("ReadFile(%q): %q, %v", n, c, err)
+		}
+	}
+
+	// Change the backing files without changing their size, so
+	// the kernel has no reason to drop its cache.
+	for _, n := range names {
+		if err := ioutil.WriteFile(wd+"/orig/"+n, []byte("qqqqq"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	for _, n := range names {
+		want := "hello"
+		if volatile(n) {
+			want = "qqqqq"
+		}
+		c, err := ioutil.ReadFile(wd + "/mnt/" + n)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if string(c) != want {
+			t.Errorf("%s: got %q, want %q", n, c, want)
+		}
+	}
+}
+
 type nonseekFs struct {
 	pathfs.FileSystem
 	Length int
@@ -210,3 +259,59 @@ func TestGetAttrRace(t *testing.T) {
 		t.Error(statErr)
 	}
 }
+
+// staleSizeFs reports size 0 for all files, as a backend that hasn't
+// seen the cached writes yet would.
+type staleSizeFs struct {
+	pathfs.FileSystem
+}
+
+func (fs *staleSizeFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	a, code := fs.FileSystem.GetAttr(name, context)
+	if a != nil && !a.IsDir() {
+		a.Size = 0
+	}
+	return a, code
+}
+
+func TestWritebackCacheSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-writeback")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/mnt", 0755)
+	os.Mkdir(dir+"/orig", 0755)
+
+	pfs := pathfs.NewPathNodeFs(&staleSizeFs{pathfs.NewLoopbackFileSystem(dir + "/orig")}, nil)
+	conn := nodefs.NewFileSystemConnector(pfs.Root(), &nodefs.Options{})
+	state, err := fuse.NewServer(conn.RawFS(), dir+"/mnt", &fuse.MountOptions{EnableWritebackCache: true})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	state.SetDebug(VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+	state.WaitMount()
+	if state.KernelSettings().Flags&fuse.CAP_WRITEBACK_CACHE == 0 {
+		t.Skip("kernel does not cache writes")
+	}
+
+	f, err := os.Create(dir + "/mnt/file")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	// The attributes aren't cached, so this asks the file system,
+	// but the kernel keeps the size of its own writes.
+	fi, err := os.Stat(dir + "/mnt/file")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Size() != 5 {
+		t.Errorf("got size %d, want 5", fi.Size())
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
 )
 
 func TestTouch(t *testing.T) {
@@ -68,3 +70,53 @@ func TestFallocate(t *testing.T) {
 			fi.Size())
 	}
 }
+
+func TestPosixACL(t *testing.T) {
+	ts := NewTestCase(t)
+	defer ts.Cleanup()
+
+	if err := ioutil.WriteFile(ts.origFile, []byte("acl"), 0640); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	const attr = "system.posix_acl_access"
+	acl := fuse.PosixACL{
+		{Tag: fuse.ACL_USER_OBJ, Perm: 6, Id: fuse.ACL_UNDEFINED_ID},
+		{Tag: fuse.ACL_USER, Perm: 4, Id: 4242},
+		{Tag: fuse.ACL_GROUP_OBJ, Perm: 4, Id: fuse.ACL_UNDEFINED_ID},
+		{Tag: fuse.ACL_MASK, Perm: 4, Id: fuse.ACL_UNDEFINED_ID},
+		{Tag: fuse.ACL_OTHER, Perm: 0, Id: fuse.ACL_UNDEFINED_ID},
+	}
+	if err := syscall.Setxattr(ts.origFile, attr, acl.Bytes(), 0); err != nil {
+		t.Skipf("backing file system does not support ACLs: %v", err)
+	}
+	if err := syscall.Removexattr(ts.origFile, attr); err != nil {
+		t.Fatalf("Removexattr failed: %v", err)
+	}
+
+	if err := syscall.Setxattr(ts.mountFile, attr, acl.Bytes(), 0); err != nil {
+		t.Fatalf("Setxattr failed: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	sz, err := syscall.Getxattr(ts.mountFile, attr, buf)
+	if err != nil {
+		t.Fatalf("Getxattr failed: %v", err)
+	}
+	got, code := fuse.ParsePosixACL(buf[:sz])
+	if !code.Ok() {
+		t.Fatalf("ParsePosixACL: %v", code)
+	}
+	if len(got) != len(acl) {
+		t.Fatalf("got %v, want %v", got, acl)
+	}
+	for i := range acl {
+		if got[i] != acl[i] {
+			t.Errorf("entry %d: got %v, want %v", i, &got[i], &acl[i])
+		}
+	}
+
+	if err := syscall.Setxattr(ts.mountFile, attr, []byte("garbage"), 0); err == nil {
+		t.Errorf("Setxattr with malformed ACL should fail")
+	}
+}
@@ -362,6 +362,61 @@ func TestLinkForget(t *testing.T) {
 	}
 }
 
+// Unlinking one name of a hard linked file should leave the other
+// names working.
+func TestLinkUnlinkOther(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	c := RandomData(5)
+	err := ioutil.WriteFile(tc.orig+"/file1", c, 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	err = os.Link(tc.orig+"/file1", tc.orig+"/file2")
+	if err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	var s1, s2 syscall.Stat_t
+	if err := syscall.Lstat(tc.mnt+"/file1", &s1); err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if err := syscall.Lstat(tc.mnt+"/file2", &s2); err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if s1.Ino != s2.Ino || s2.Nlink != 2 {
+		t.Fatalf("got ino %d, %d nlink %d, want shared inode with 2 links", s1.Ino, s2.Ino, s2.Nlink)
+	}
+
+	if err := os.Remove(tc.mnt + "/file1"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	if err := syscall.Lstat(tc.mnt+"/file2", &s2); err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if s2.Nlink != 1 {
+		t.Errorf("got nlink %d, want 1", s2.Nlink)
+	}
+	back, err := ioutil.ReadFile(tc.mnt + "/file2")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, back, c)
+
+	if err := ioutil.WriteFile(tc.mnt+"/file2", []byte("new"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	back, err = ioutil.ReadFile(tc.orig + "/file2")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if string(back) != "new" {
+		t.Errorf("got %q, want %q", back, "new")
+	}
+}
+
 func TestSymlink(t *testing.T) {
 	tc := NewTestCase(t)
 	defer tc.Cleanup()
@@ -603,6 +658,46 @@ func TestFSync(t *testing.T) {
 	}
 }
 
+func TestTruncateRenamedHandle(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	if err := ioutil.WriteFile(tc.origFile, []byte("hello there"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	f, err := os.OpenFile(tc.mountFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile(%q): %v", tc.mountFile, err)
+	}
+	defer f.Close()
+
+	// Rename behind the kernel's back, and put a different file in
+	// the old place, so truncating by path hits the wrong file.
+	renamed := tc.origFile + ".renamed"
+	if err := os.Rename(tc.origFile, renamed); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := ioutil.WriteFile(tc.origFile, []byte("other file"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if err := f.Truncate(5); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+
+	if got, err := ioutil.ReadFile(renamed); err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	} else if string(got) != "hello" {
+		t.Errorf("renamed file: got %q, want %q", got, "hello")
+	}
+	if got, err := ioutil.ReadFile(tc.origFile); err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	} else if string(got) != "other file" {
+		t.Errorf("file at old path was modified: got %q", got)
+	}
+}
+
 func TestReadZero(t *testing.T) {
 	tc := NewTestCase(t)
 	defer tc.Cleanup()
@@ -962,3 +1057,21 @@ func TestUmask(t *testing.T) {
 		t.Errorf("got %o, expect mode %o for file %s", got, expect, fn)
 	}
 }
+
+func TestSelfTest(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	d, err := tc.state.SelfTest(5 * time.Second)
+	if err != nil {
+		t.Fatalf("SelfTest failed after %v: %v", d, err)
+	}
+
+	entries, err := ioutil.ReadDir(tc.orig)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("SelfTest left files behind: %v", entries)
+	}
+}
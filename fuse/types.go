@@ -2,6 +2,7 @@ package fuse
 
 import (
 	"syscall"
+	"unsafe"
 )
 
 const PAGESIZE = 4096
@@ -29,6 +30,15 @@ const (
 	EBADF   = Status(syscall.EBADF)
 	ENODEV  = Status(syscall.ENODEV)
 	EROFS   = Status(syscall.EROFS)
+	EDQUOT  = Status(syscall.EDQUOT)
+	ENOSPC  = Status(syscall.ENOSPC)
+	EFBIG   = Status(syscall.EFBIG)
+
+	ENAMETOOLONG = Status(syscall.ENAMETOOLONG)
+
+	// EOPNOTSUPP is an alternative to ENOSYS that the kernel does
+	// not remember. See RawFileSystem.
+	EOPNOTSUPP = Status(syscall.EOPNOTSUPP)
 )
 
 type ForgetIn struct {
@@ -61,6 +71,25 @@ type RenameIn struct {
 	Newdir uint64
 }
 
+// Flags for Rename2In, as for renameat2(2).
+const (
+	RENAME_NOREPLACE = (1 << 0)
+	RENAME_EXCHANGE  = (1 << 1)
+	RENAME_WHITEOUT  = (1 << 2)
+)
+
+// FSYNC_FDATASYNC is set in FsyncIn.FsyncFlags for fdatasync(2),
+// which only needs the data and the metadata to read it back, such as
+// the size, to be made durable.
+const FSYNC_FDATASYNC = (1 << 0)
+
+type Rename2In struct {
+	InHeader
+	Newdir  uint64
+	Flags   uint32
+	Padding uint32
+}
+
 type LinkIn struct {
 	InHeader
 	Oldnodeid uint64
@@ -82,6 +111,10 @@ const ( // SetAttrIn.Valid
 	FATTR_ATIME_NOW = (1 << 7)
 	FATTR_MTIME_NOW = (1 << 8)
 	FATTR_LOCKOWNER = (1 << 9)
+
+	// FATTR_CTIME is only sent with CAP_WRITEBACK_CACHE. The new
+	// ctime is in Unused2 and Unused3 of SetAttrInCommon.
+	FATTR_CTIME = (1 << 10)
 )
 
 type SetAttrInCommon struct {
@@ -125,6 +158,11 @@ const (
 	FOPEN_DIRECT_IO   = (1 << 0)
 	FOPEN_KEEP_CACHE  = (1 << 1)
 	FOPEN_NONSEEKABLE = (1 << 2)
+
+	// For OPENDIR: keep the directory contents in the kernel
+	// cache. Without FOPEN_KEEP_CACHE, the cache is dropped on
+	// each open.
+	FOPEN_CACHE_DIR = (1 << 3)
 )
 
 type OpenOut struct {
@@ -150,6 +188,10 @@ const (
 	CAP_AUTO_INVAL_DATA  = (1 << 12)
 	CAP_READDIRPLUS      = (1 << 13)
 	CAP_READDIRPLUS_AUTO = (1 << 14)
+	CAP_ASYNC_DIO        = (1 << 15)
+	CAP_WRITEBACK_CACHE  = (1 << 16)
+	CAP_NO_OPEN_SUPPORT  = (1 << 17)
+	CAP_PARALLEL_DIROPS  = (1 << 18)
 )
 
 type InitIn struct {
@@ -408,6 +450,118 @@ const (
 	WRITE_LOCKOWNER = (1 << 1)
 )
 
+const (
+	// SetupMappingIn.Flags
+	SETUPMAPPING_FLAG_WRITE = (1 << 0)
+	SETUPMAPPING_FLAG_READ  = (1 << 1)
+)
+
+// SetupMappingIn asks the server to map part of an open file into
+// the DAX window that is shared with the kernel.  This is only
+// issued by virtio-fs style transports.
+type SetupMappingIn struct {
+	InHeader
+	Fh      uint64
+	Foffset uint64
+	Len     uint64
+	Flags   uint64
+	Moffset uint64
+}
+
+// RemoveMappingIn is followed by Count RemoveMappingOne entries.
+type RemoveMappingIn struct {
+	InHeader
+	Count uint32
+}
+
+// The kernel struct is not padded to 8 bytes, so unsafe.Sizeof
+// overestimates the wire size of RemoveMappingIn.
+const sizeOfRemoveMappingIn = unsafe.Sizeof(InHeader{}) + 4
+
+type RemoveMappingOne struct {
+	Moffset uint64
+	Len     uint64
+}
+
+const (
+	// Statx.Mask bits.
+	STATX_BASIC_STATS = 0x7ff
+	STATX_BTIME       = 0x800
+
+	// Statx.Attributes bits. They have the same values as the
+	// FS_*_FL inode flags of FS_IOC_GETFLAGS.
+	STATX_ATTR_COMPRESSED = 0x4
+	STATX_ATTR_IMMUTABLE  = 0x10
+	STATX_ATTR_APPEND     = 0x20
+	STATX_ATTR_NODUMP     = 0x40
+	STATX_ATTR_ENCRYPTED  = 0x800
+)
+
+type StatxIn struct {
+	InHeader
+	GetattrFlags uint32
+	Reserved     uint32
+	Fh           uint64
+	SxFlags      uint32
+	SxMask       uint32
+}
+
+type SxTime struct {
+	Sec      int64
+	Nsec     uint32
+	Reserved int32
+}
+
+// Statx is the attribute part of a STATX reply. Unlike Attr, it can
+// carry the birth time and the STATX_ATTR_* flags; Mask says which
+// of the inode fields are set, and AttributesMask which of the
+// Attributes bits the file system supports.
+type Statx struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	Spare0         uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          SxTime
+	Btime          SxTime
+	Ctime          SxTime
+	Mtime          SxTime
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	Spare2         [14]uint64
+}
+
+type StatxOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Flags         uint32
+	Spare         [2]uint64
+	Stat          Statx
+}
+
+// CopyFileRangeIn asks the server to copy Len bytes from the file
+// open as FhIn to the file open as FhOut, which may belong to
+// another node of the same mount.
+type CopyFileRangeIn struct {
+	InHeader
+	FhIn      uint64
+	OffIn     uint64
+	NodeIdOut uint64
+	FhOut     uint64
+	OffOut    uint64
+	Len       uint64
+	Flags     uint64
+}
+
 type FallocateIn struct {
 	InHeader
 	Fh      uint64
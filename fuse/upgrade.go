@@ -26,6 +26,10 @@ func (fs *wrappingFS) String() string {
 	return fmt.Sprintf("%v", fs.fs)
 }
 
+func (fs *wrappingFS) Capabilities() CapSet {
+	return Capabilities(fs.fs)
+}
+
 func (fs *wrappingFS) SetDebug(dbg bool) {
 	if s, ok := fs.fs.(interface {
 		SetDebug(bool)
@@ -96,6 +100,15 @@ func (fs *wrappingFS) Readlink(header *InHeader) (out []byte, code Status) {
 	return nil, ENOSYS
 }
 
+func (fs *wrappingFS) CanonicalPath(header *InHeader) (path string, code Status) {
+	if s, ok := fs.fs.(interface {
+		CanonicalPath(header *InHeader) (path string, code Status)
+	}); ok {
+		return s.CanonicalPath(header)
+	}
+	return "", ENOSYS
+}
+
 func (fs *wrappingFS) Mknod(input *MknodIn, name string, out *EntryOut) (code Status) {
 	if s, ok := fs.fs.(interface {
 		Mknod(input *MknodIn, name string, out *EntryOut) (code Status)
@@ -150,6 +163,15 @@ func (fs *wrappingFS) Rename(input *RenameIn, oldName string, newName string) (c
 	return ENOSYS
 }
 
+func (fs *wrappingFS) Rename2(input *Rename2In, oldName string, newName string) (code Status) {
+	if s, ok := fs.fs.(interface {
+		Rename2(input *Rename2In, oldName string, newName string) (code Status)
+	}); ok {
+		return s.Rename2(input, oldName, newName)
+	}
+	return ENOSYS
+}
+
 func (fs *wrappingFS) Link(input *LinkIn, name string, out *EntryOut) (code Status) {
 	if s, ok := fs.fs.(interface {
 		Link(input *LinkIn, name string, out *EntryOut) (code Status)
@@ -222,6 +244,15 @@ func (fs *wrappingFS) Create(input *CreateIn, name string, out *CreateOut) (code
 	return ENOSYS
 }
 
+func (fs *wrappingFS) Tmpfile(input *CreateIn, out *CreateOut) (code Status) {
+	if s, ok := fs.fs.(interface {
+		Tmpfile(input *CreateIn, out *CreateOut) (code Status)
+	}); ok {
+		return s.Tmpfile(input, out)
+	}
+	return ENOSYS
+}
+
 func (fs *wrappingFS) OpenDir(input *OpenIn, out *OpenOut) (status Status) {
 	if s, ok := fs.fs.(interface {
 		OpenDir(input *OpenIn, out *OpenOut) (status Status)
@@ -318,3 +349,48 @@ func (fs *wrappingFS) Fallocate(in *FallocateIn) (code Status) {
 	}
 	return ENOSYS
 }
+
+func (fs *wrappingFS) Statx(input *StatxIn, out *StatxOut) (code Status) {
+	if s, ok := fs.fs.(interface {
+		Statx(input *StatxIn, out *StatxOut) (code Status)
+	}); ok {
+		return s.Statx(input, out)
+	}
+	return ENOSYS
+}
+
+func (fs *wrappingFS) CopyFileRange(in *CopyFileRangeIn) (written uint32, code Status) {
+	if s, ok := fs.fs.(interface {
+		CopyFileRange(in *CopyFileRangeIn) (written uint32, code Status)
+	}); ok {
+		return s.CopyFileRange(in)
+	}
+	return 0, ENOSYS
+}
+
+func (fs *wrappingFS) SetupMapping(in *SetupMappingIn) (code Status) {
+	if s, ok := fs.fs.(interface {
+		SetupMapping(in *SetupMappingIn) (code Status)
+	}); ok {
+		return s.SetupMapping(in)
+	}
+	return ENOSYS
+}
+
+func (fs *wrappingFS) RemoveMapping(in *RemoveMappingIn, mappings []RemoveMappingOne) (code Status) {
+	if s, ok := fs.fs.(interface {
+		RemoveMapping(in *RemoveMappingIn, mappings []RemoveMappingOne) (code Status)
+	}); ok {
+		return s.RemoveMapping(in, mappings)
+	}
+	return ENOSYS
+}
+
+func (fs *wrappingFS) SetVolumeName(name string) (code Status) {
+	if s, ok := fs.fs.(interface {
+		SetVolumeName(name string) (code Status)
+	}); ok {
+		return s.SetVolumeName(name)
+	}
+	return ENOSYS
+}
@@ -67,6 +67,8 @@ const (
 	_SCAN_CONFIG   = ".scan_config"
 )
 
+// NewAutoUnionFs returns a file system that mounts unions for the
+// configurations in directory. It can only be mounted once.
 func NewAutoUnionFs(directory string, options AutoUnionFsOptions) pathfs.FileSystem {
 	if options.HideReadonly {
 		options.HiddenFiles = append(options.HiddenFiles, _READONLY)
@@ -91,7 +93,12 @@ func (fs *autoUnionFs) String() string {
 	return fmt.Sprintf("autoUnionFs(%s)", fs.root)
 }
 
+// OnMount panics if fs is already mounted elsewhere: the unions are
+// mounted on the PathNodeFs of a single mount.
 func (fs *autoUnionFs) OnMount(nodeFs *pathfs.PathNodeFs) {
+	if fs.nodeFs != nil && fs.nodeFs != nodeFs {
+		log.Panicf("%v supports a single mount, and is mounted already", fs)
+	}
 	fs.nodeFs = nodeFs
 	if fs.options.UpdateOnMount {
 		time.AfterFunc(100*time.Millisecond, func() { fs.updateKnownFses() })
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -41,6 +42,13 @@ type cachingFileSystem struct {
 	dirs       *TimedCache
 	links      *TimedCache
 	xattr      *TimedCache
+
+	// nodeFses are the mounts of the file system, to tell the
+	// kernel about invalidations. There can be several, as the
+	// same file system may be mounted more than once. Mounts whose
+	// server has stopped are dropped by InvalidateAll.
+	mountsMu sync.Mutex
+	nodeFses []*pathfs.PathNodeFs
 }
 
 func readDir(fs pathfs.FileSystem, name string) *dirResponse {
@@ -80,33 +88,121 @@ func readLink(fs pathfs.FileSystem, name string) *linkResponse {
 }
 
 func NewCachingFileSystem(fs pathfs.FileSystem, ttl time.Duration) pathfs.FileSystem {
+	return NewCachingFileSystemWithClock(fs, ttl, fuse.RealClock)
+}
+
+// NewCachingFileSystemWithClock is like NewCachingFileSystem, but the
+// cached results expire by the time of clock.
+func NewCachingFileSystemWithClock(fs pathfs.FileSystem, ttl time.Duration, clock fuse.Clock) pathfs.FileSystem {
 	c := new(cachingFileSystem)
 	c.FileSystem = fs
-	c.attributes = NewTimedCache(func(n string) (interface{}, bool) {
+	c.attributes = NewTimedCacheWithClock(func(n string) (interface{}, bool) {
 		a := getAttr(fs, n)
 		return a, a.Ok()
-	}, ttl)
-	c.dirs = NewTimedCache(func(n string) (interface{}, bool) {
+	}, ttl, clock)
+	c.dirs = NewTimedCacheWithClock(func(n string) (interface{}, bool) {
 		d := readDir(fs, n)
 		return d, d.Ok()
-	}, ttl)
-	c.links = NewTimedCache(func(n string) (interface{}, bool) {
+	}, ttl, clock)
+	c.links = NewTimedCacheWithClock(func(n string) (interface{}, bool) {
 		l := readLink(fs, n)
 		return l, l.Ok()
-	}, ttl)
-	c.xattr = NewTimedCache(func(n string) (interface{}, bool) {
+	}, ttl, clock)
+	c.xattr = NewTimedCacheWithClock(func(n string) (interface{}, bool) {
 		l := getXAttr(fs, n)
 		return l, l.Ok()
-	}, ttl)
+	}, ttl, clock)
 	return c
 }
 
+// AttrPrimer is implemented by the FileSystem returned from
+// NewCachingFileSystem.
+type AttrPrimer interface {
+	// Prime stores attr as the attributes of path, so the next
+	// GetAttr of path does not hit the underlying file
+	// system. This is useful if attributes for a whole tree can
+	// be fetched in one go. The entry expires after ttl, or after
+	// the TTL of the cache if ttl is 0. A nil attr drops the
+	// entry. Like other entries, primed entries are dropped by
+	// writing to the .drop_cache file.
+	Prime(path string, attr *fuse.Attr, ttl time.Duration)
+}
+
+func (fs *cachingFileSystem) Prime(path string, attr *fuse.Attr, ttl time.Duration) {
+	if attr == nil {
+		fs.attributes.DropEntry(path)
+		return
+	}
+	if ttl == 0 {
+		ttl = fs.attributes.ttl
+	}
+	a := *attr
+	fs.attributes.SetWithTTL(path, &attrResponse{Attr: &a, Status: fuse.OK}, ttl)
+}
+
 func (fs *cachingFileSystem) DropCache() {
 	for _, c := range []*TimedCache{fs.attributes, fs.dirs, fs.links, fs.xattr} {
 		c.DropAll(nil)
 	}
 }
 
+// CacheInvalidator is implemented by the FileSystem returned from
+// NewCachingFileSystem.
+type CacheInvalidator interface {
+	// InvalidateAll drops all cached attributes, directory
+	// listings, symlinks and extended attributes, for example
+	// after the backing store was restored. If the file system
+	// is mounted, the kernel is also told to forget the entries,
+	// attributes and data it has cached for the known inodes.
+	InvalidateAll()
+}
+
+func (fs *cachingFileSystem) OnMount(nodeFs *pathfs.PathNodeFs) {
+	fs.mountsMu.Lock()
+	fs.nodeFses = append(fs.nodeFses, nodeFs)
+	fs.mountsMu.Unlock()
+	fs.FileSystem.OnMount(nodeFs)
+}
+
+func (fs *cachingFileSystem) InvalidateAll() {
+	fs.DropCache()
+	fs.mountsMu.Lock()
+	nodeFses := append([]*pathfs.PathNodeFs{}, fs.nodeFses...)
+	fs.mountsMu.Unlock()
+
+	for _, nodeFs := range nodeFses {
+		c := nodeFs.Connector()
+		if c.Server() == nil {
+			continue
+		}
+		if c.FileNotify(nodeFs.Root().Inode(), 0, 0) == fuse.EBADF {
+			// The server has stopped, so this mount is gone.
+			fs.forgetMount(nodeFs)
+			continue
+		}
+		var walk func(n *nodefs.Inode)
+		walk = func(n *nodefs.Inode) {
+			c.FileNotify(n, 0, 0)
+			for name, ch := range n.FsChildren() {
+				c.EntryNotify(n, name)
+				walk(ch)
+			}
+		}
+		walk(nodeFs.Root().Inode())
+	}
+}
+
+func (fs *cachingFileSystem) forgetMount(nodeFs *pathfs.PathNodeFs) {
+	fs.mountsMu.Lock()
+	defer fs.mountsMu.Unlock()
+	for i, n := range fs.nodeFses {
+		if n == nodeFs {
+			fs.nodeFses = append(fs.nodeFses[:i], fs.nodeFses[i+1:]...)
+			return
+		}
+	}
+}
+
 func (fs *cachingFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	if name == _DROP_CACHE {
 		return &fuse.Attr{
@@ -3,10 +3,15 @@ package unionfs
 import (
 	"io/ioutil"
 	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 )
 
@@ -67,3 +72,175 @@ func TestCachingFs(t *testing.T) {
 		t.Error("Unexpected readdir result", results, expected)
 	}
 }
+
+type countingGetAttrFs struct {
+	pathfs.FileSystem
+	calls int
+}
+
+func (fs *countingGetAttrFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	fs.calls++
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func TestCachingFsPrime(t *testing.T) {
+	wd, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(wd)
+
+	fs := &countingGetAttrFs{FileSystem: pathfs.NewLoopbackFileSystem(wd)}
+	cfs := NewCachingFileSystem(fs, time.Hour)
+	p := cfs.(AttrPrimer)
+
+	names := []string{"a", "b", "dir/c"}
+	for i, n := range names {
+		p.Prime(n, &fuse.Attr{Mode: fuse.S_IFREG | 0644, Size: uint64(i)}, 0)
+	}
+	for i, n := range names {
+		a, code := cfs.GetAttr(n, nil)
+		if !code.Ok() {
+			t.Fatalf("GetAttr(%q): %v", n, code)
+		}
+		if a.Size != uint64(i) {
+			t.Errorf("GetAttr(%q): got size %d, want %d", n, a.Size, i)
+		}
+	}
+	if fs.calls != 0 {
+		t.Errorf("got %d backend GetAttr calls, want 0", fs.calls)
+	}
+
+	// Primed entries expire after their own TTL.
+	p.Prime("a", &fuse.Attr{Mode: fuse.S_IFREG | 0644}, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if _, code := cfs.GetAttr("a", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr after expiry: got %v, want ENOENT", code)
+	}
+
+	// A nil attr drops the entry.
+	p.Prime("b", nil, 0)
+	if _, code := cfs.GetAttr("b", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr after drop: got %v, want ENOENT", code)
+	}
+	if fs.calls != 2 {
+		t.Errorf("got %d backend GetAttr calls, want 2", fs.calls)
+	}
+}
+
+// countingCacheFs counts the calls for everything the caching layer
+// caches.
+type countingCacheFs struct {
+	pathfs.FileSystem
+	calls map[string]int
+}
+
+func (fs *countingCacheFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	fs.calls["GetAttr"]++
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *countingCacheFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	fs.calls["Readlink"]++
+	return fs.FileSystem.Readlink(name, context)
+}
+
+func (fs *countingCacheFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	fs.calls["OpenDir"]++
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+func (fs *countingCacheFs) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	fs.calls["GetXAttr"]++
+	return []byte("value"), fuse.OK
+}
+
+func TestCachingFsInvalidateAll(t *testing.T) {
+	wd, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(wd)
+	os.Symlink("target", wd+"/link")
+
+	fs := &countingCacheFs{
+		FileSystem: pathfs.NewLoopbackFileSystem(wd),
+		calls:      map[string]int{},
+	}
+	cfs := NewCachingFileSystem(fs, time.Hour)
+
+	// Not mounted, but known to a PathNodeFs.
+	nodeFs := pathfs.NewPathNodeFs(cfs, nil)
+	nodefs.NewFileSystemConnector(nodeFs.Root(), nil)
+
+	use := func() {
+		for i := 0; i < 2; i++ {
+			cfs.GetAttr("link", nil)
+			cfs.Readlink("link", nil)
+			cfs.OpenDir("", nil)
+			cfs.GetXAttr("link", "user.attr", nil)
+		}
+	}
+	use()
+	want := map[string]int{"GetAttr": 1, "Readlink": 1, "OpenDir": 1, "GetXAttr": 1}
+	if !reflect.DeepEqual(fs.calls, want) {
+		t.Errorf("warm cache: got calls %v, want %v", fs.calls, want)
+	}
+
+	cfs.(CacheInvalidator).InvalidateAll()
+	use()
+	for k := range want {
+		want[k] = 2
+	}
+	if !reflect.DeepEqual(fs.calls, want) {
+		t.Errorf("after InvalidateAll: got calls %v, want %v", fs.calls, want)
+	}
+}
+
+// slowStatFs blocks GetAttr until release is closed.
+type slowStatFs struct {
+	pathfs.FileSystem
+	release chan struct{}
+	calls   int32
+}
+
+func (fs *slowStatFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	atomic.AddInt32(&fs.calls, 1)
+	<-fs.release
+	return nil, fuse.ENOENT
+}
+
+func TestCachingFsCoalesce(t *testing.T) {
+	fs := &slowStatFs{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		release:    make(chan struct{}),
+	}
+	cfs := NewCachingFileSystem(fs, time.Hour)
+
+	const n = 10
+	var started, done sync.WaitGroup
+	codes := make([]fuse.Status, n)
+	for i := 0; i < n; i++ {
+		started.Add(1)
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			started.Done()
+			_, codes[i] = cfs.GetAttr("file", nil)
+		}(i)
+	}
+	started.Wait()
+	// Give the goroutines time to join the first fetch.
+	time.Sleep(50 * time.Millisecond)
+	close(fs.release)
+	done.Wait()
+
+	if got := atomic.LoadInt32(&fs.calls); got != 1 {
+		t.Errorf("backend GetAttr called %d times, want 1", got)
+	}
+	for i, code := range codes {
+		if code != fuse.ENOENT {
+			t.Errorf("GetAttr %d: got %v, want ENOENT", i, code)
+		}
+	}
+
+	// Errors are not cached, so the next GetAttr asks again.
+	cfs.GetAttr("file", nil)
+	if got := atomic.LoadInt32(&fs.calls); got != 2 {
+		t.Errorf("after the shared call: backend called %d times, want 2", got)
+	}
+}
@@ -3,19 +3,30 @@ package unionfs
 import (
 	"sync"
 	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
 )
 
 type cacheEntry struct {
 	data interface{}
 
-	// expiry is the absolute timestamp of the expiry.
+	// expiry is the absolute timestamp of the expiry. If zero,
+	// the entry does not expire.
 	expiry time.Time
 }
 
+// inflightFetch is a fetch() that concurrent Get()s of its key wait
+// for.
+type inflightFetch struct {
+	done sync.WaitGroup
+	data interface{}
+}
+
 // TimedIntCache caches the result of fetch() for some time.  It is
 // thread-safe.  Calls of fetch() do no happen inside a critical
-// section, so when multiple concurrent Get()s happen for the same
-// key, multiple fetch() calls may be issued for the same key.
+// section. Concurrent Get()s of a key that is not cached share a
+// single fetch() call, and all get its result, also if it is not
+// cacheable, such as an error.
 type TimedCacheFetcher func(name string) (value interface{}, cacheable bool)
 type TimedCache struct {
 	fetch TimedCacheFetcher
@@ -23,19 +34,35 @@ type TimedCache struct {
 	// ttl is the duration of the cache.
 	ttl time.Duration
 
+	// clock tells the time for the expiry of entries.
+	clock fuse.Clock
+
 	cacheMapMutex sync.RWMutex
 	cacheMap      map[string]*cacheEntry
 
+	// inflight holds the running fetches of Get, by key. A fetch
+	// that is removed because its key was dropped or refetched in
+	// the meantime doesn't store its result.
+	inflight map[string]*inflightFetch
+
 	PurgeTimer *time.Timer
 }
 
 // Creates a new cache with the given TTL.  If TTL <= 0, the caching is
 // indefinite.
 func NewTimedCache(fetcher TimedCacheFetcher, ttl time.Duration) *TimedCache {
+	return NewTimedCacheWithClock(fetcher, ttl, fuse.RealClock)
+}
+
+// NewTimedCacheWithClock is like NewTimedCache, but entries expire by
+// the time of clock, eg. a fuse.FakeClock in tests.
+func NewTimedCacheWithClock(fetcher TimedCacheFetcher, ttl time.Duration, clock fuse.Clock) *TimedCache {
 	l := new(TimedCache)
 	l.ttl = ttl
+	l.clock = clock
 	l.fetch = fetcher
 	l.cacheMap = make(map[string]*cacheEntry)
+	l.inflight = make(map[string]*inflightFetch)
 	return l
 }
 
@@ -44,21 +71,63 @@ func (c *TimedCache) Get(name string) interface{} {
 	info, ok := c.cacheMap[name]
 	c.cacheMapMutex.RUnlock()
 
-	valid := ok && (c.ttl <= 0 || info.expiry.After(time.Now()))
+	valid := ok && (info.expiry.IsZero() || info.expiry.After(c.clock.Now()))
 	if valid {
 		return info.data
 	}
-	return c.GetFresh(name)
+	return c.fetchShared(name)
 }
 
-func (c *TimedCache) Set(name string, val interface{}) {
+// fetchShared fetches name, or waits for the fetch that another Get
+// started.
+func (c *TimedCache) fetchShared(name string) interface{} {
 	c.cacheMapMutex.Lock()
-	defer c.cacheMapMutex.Unlock()
+	if f := c.inflight[name]; f != nil {
+		c.cacheMapMutex.Unlock()
+		f.done.Wait()
+		return f.data
+	}
+	f := &inflightFetch{}
+	f.done.Add(1)
+	c.inflight[name] = f
+	c.cacheMapMutex.Unlock()
 
-	c.cacheMap[name] = &cacheEntry{
-		data:   val,
-		expiry: time.Now().Add(c.ttl),
+	data, ok := c.fetch(name)
+	f.data = data
+
+	c.cacheMapMutex.Lock()
+	if c.inflight[name] == f {
+		delete(c.inflight, name)
+		if ok {
+			c.cacheMap[name] = c.newCacheEntry(data, c.ttl)
+		}
 	}
+	c.cacheMapMutex.Unlock()
+	f.done.Done()
+	return data
+}
+
+func (c *TimedCache) newCacheEntry(val interface{}, ttl time.Duration) *cacheEntry {
+	e := &cacheEntry{data: val}
+	if ttl > 0 {
+		e.expiry = c.clock.Now().Add(ttl)
+	}
+	return e
+}
+
+func (c *TimedCache) Set(name string, val interface{}) {
+	c.SetWithTTL(name, val, c.ttl)
+}
+
+// SetWithTTL stores val for name, like Set, but with its own
+// TTL. If ttl <= 0, the entry stays until it is dropped.
+func (c *TimedCache) SetWithTTL(name string, val interface{}, ttl time.Duration) {
+	e := c.newCacheEntry(val, ttl)
+
+	c.cacheMapMutex.Lock()
+	defer c.cacheMapMutex.Unlock()
+	c.cacheMap[name] = e
+	delete(c.inflight, name)
 }
 
 func (c *TimedCache) DropEntry(name string) {
@@ -66,9 +135,16 @@ func (c *TimedCache) DropEntry(name string) {
 	defer c.cacheMapMutex.Unlock()
 
 	delete(c.cacheMap, name)
+	delete(c.inflight, name)
 }
 
+// GetFresh fetches name, without waiting for a fetch that a Get
+// started before, as the caller may have changed name since.
 func (c *TimedCache) GetFresh(name string) interface{} {
+	c.cacheMapMutex.Lock()
+	delete(c.inflight, name)
+	c.cacheMapMutex.Unlock()
+
 	data, ok := c.fetch(name)
 	if ok {
 		c.Set(name, data)
@@ -76,15 +152,15 @@ func (c *TimedCache) GetFresh(name string) interface{} {
 	return data
 }
 
-// Drop all expired entries.
+// Drop all expired entries. Entries without a TTL are kept.
 func (c *TimedCache) Purge() {
 	keys := make([]string, 0, len(c.cacheMap))
-	now := time.Now()
+	now := c.clock.Now()
 
 	c.cacheMapMutex.Lock()
 	defer c.cacheMapMutex.Unlock()
 	for k, v := range c.cacheMap {
-		if now.After(v.expiry) {
+		if !v.expiry.IsZero() && now.After(v.expiry) {
 			keys = append(keys, k)
 		}
 	}
@@ -99,9 +175,11 @@ func (c *TimedCache) DropAll(names []string) {
 
 	if names == nil {
 		c.cacheMap = make(map[string]*cacheEntry, len(c.cacheMap))
+		c.inflight = make(map[string]*inflightFetch)
 	} else {
 		for _, nm := range names {
 			delete(c.cacheMap, nm)
+			delete(c.inflight, nm)
 		}
 	}
 }
@@ -3,6 +3,8 @@ package unionfs
 import (
 	"testing"
 	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
 )
 
 func TestTimedCacheUncacheable(t *testing.T) {
@@ -65,3 +67,34 @@ func TestTimedCache(t *testing.T) {
 		t.Error("Did not fetch again. Purge unsuccessful?")
 	}
 }
+
+func TestTimedCacheFakeClock(t *testing.T) {
+	fetchCount := 0
+	fetch := func(n string) (interface{}, bool) {
+		fetchCount++
+		return fetchCount, true
+	}
+
+	clock := fuse.NewFakeClock(time.Unix(1000, 0))
+	ttl := time.Minute
+	cache := NewTimedCacheWithClock(fetch, ttl, clock)
+	if v := cache.Get("n"); v != 1 {
+		t.Fatalf("got %v, want 1", v)
+	}
+
+	clock.Advance(ttl - time.Second)
+	if v := cache.Get("n"); v != 1 {
+		t.Errorf("entry expired before its TTL: got %v, want 1", v)
+	}
+
+	clock.Advance(2 * time.Second)
+	if v := cache.Get("n"); v != 2 {
+		t.Errorf("entry did not expire after its TTL: got %v, want 2", v)
+	}
+
+	clock.Advance(2 * ttl)
+	cache.Purge()
+	if n := len(cache.cacheMap); n != 0 {
+		t.Errorf("Purge left %d expired entries", n)
+	}
+}
@@ -80,18 +80,28 @@ type UnionFsOptions struct {
 	DeletionCacheTTL time.Duration
 	DeletionDirName  string
 	HiddenFiles      []string
+
+	// Clock tells the time for the expiry of the branch cache and
+	// for the timestamps that the union sets itself. If nil, the
+	// system time is used.
+	Clock fuse.Clock
 }
 
 const (
 	_DROP_CACHE = ".drop_cache"
 )
 
+// NewUnionFs returns a union of fileSystems, of which the first is
+// writable. It can only be mounted once.
 func NewUnionFs(fileSystems []pathfs.FileSystem, options UnionFsOptions) (pathfs.FileSystem, error) {
 	g := &unionFS{
 		options:     &options,
 		fileSystems: fileSystems,
 		FileSystem:  pathfs.NewDefaultFileSystem(),
 	}
+	if options.Clock == nil {
+		g.options.Clock = fuse.RealClock
+	}
 
 	writable := g.fileSystems[0]
 	code := g.createDeletionStore()
@@ -100,9 +110,9 @@ func NewUnionFs(fileSystems []pathfs.FileSystem, options UnionFsOptions) (pathfs
 	}
 
 	g.deletionCache = newDirCache(writable, options.DeletionDirName, options.DeletionCacheTTL)
-	g.branchCache = NewTimedCache(
+	g.branchCache = NewTimedCacheWithClock(
 		func(n string) (interface{}, bool) { return g.getBranchAttrNoCache(n), true },
-		options.BranchCacheTTL)
+		options.BranchCacheTTL, g.options.Clock)
 
 	g.hiddenFiles = make(map[string]bool)
 	for _, name := range options.HiddenFiles {
@@ -112,7 +122,12 @@ func NewUnionFs(fileSystems []pathfs.FileSystem, options UnionFsOptions) (pathfs
 	return g, nil
 }
 
+// OnMount panics if the union is already mounted elsewhere: it
+// keeps the PathNodeFs of a single mount.
 func (fs *unionFS) OnMount(nodeFs *pathfs.PathNodeFs) {
+	if fs.nodeFs != nil && fs.nodeFs != nodeFs {
+		log.Panicf("%v supports a single mount, and is mounted already", fs)
+	}
 	fs.nodeFs = nodeFs
 }
 
@@ -475,7 +490,7 @@ func (fs *unionFS) Truncate(path string, size uint64, context *fuse.Context) (co
 	}
 	if code.Ok() {
 		r.attr.Size = size
-		now := time.Now()
+		now := fs.options.Clock.Now()
 		r.attr.SetTimes(nil, &now, &now)
 		fs.branchCache.Set(path, r)
 	}
@@ -495,7 +510,7 @@ func (fs *unionFS) Utimens(name string, atime *time.Time, mtime *time.Time, cont
 		code = fs.fileSystems[0].Utimens(name, atime, mtime, context)
 	}
 	if code.Ok() {
-		now := time.Now()
+		now := fs.options.Clock.Now()
 		r.attr.SetTimes(atime, mtime, &now)
 		fs.branchCache.Set(name, r)
 	}
@@ -525,8 +540,7 @@ func (fs *unionFS) Chown(name string, uid uint32, gid uint32, context *fuse.Cont
 	}
 	r.attr.Uid = uid
 	r.attr.Gid = gid
-	now := time.Now()
-	r.attr.SetTimes(nil, nil, &now)
+	r.attr.Changed()
 	fs.branchCache.Set(name, r)
 	return fuse.OK
 }
@@ -557,8 +571,7 @@ func (fs *unionFS) Chmod(name string, mode uint32, context *fuse.Context) (code
 		fs.fileSystems[0].Chmod(name, mode, context)
 	}
 	r.attr.Mode = (r.attr.Mode &^ permMask) | mode
-	now := time.Now()
-	r.attr.SetTimes(nil, nil, &now)
+	r.attr.Changed()
 	fs.branchCache.Set(name, r)
 	return fuse.OK
 }
@@ -661,7 +674,7 @@ func (fs *unionFS) Create(name string, flags uint32, mode uint32, context *fuse.
 		fuseFile = fs.newUnionFsFile(fuseFile, 0)
 		fs.removeDeletion(name)
 
-		now := time.Now()
+		now := fs.options.Clock.Now()
 		a := fuse.Attr{
 			Mode: fuse.S_IFREG | mode,
 		}
@@ -948,8 +961,8 @@ func (fs *unionFS) Open(name string, flags uint32, context *fuse.Context) (fuseF
 			return nil, code
 		}
 		r.branch = 0
-		now := time.Now()
-		r.attr.SetTimes(nil, &now, nil)
+		now := fs.options.Clock.Now()
+		r.attr.SetTimes(nil, &now, &now)
 		fs.branchCache.Set(name, r)
 	}
 	fuseFile, status = fs.fileSystems[r.branch].Open(name, uint32(flags), context)
@@ -39,6 +39,8 @@ type MultiZipFs struct {
 	pathfs.FileSystem
 }
 
+// NewMultiZipFs returns an empty MultiZipFs. It can only be mounted
+// once.
 func NewMultiZipFs() *MultiZipFs {
 	m := &MultiZipFs{
 		zips:          make(map[string]nodefs.Node),
@@ -53,7 +55,12 @@ func (fs *MultiZipFs) String() string {
 	return "MultiZipFs"
 }
 
+// OnMount panics if fs is already mounted elsewhere: the zip files
+// are mounted on the PathNodeFs of a single mount.
 func (fs *MultiZipFs) OnMount(nodeFs *pathfs.PathNodeFs) {
+	if fs.nodeFs != nil && fs.nodeFs != nodeFs {
+		log.Panicf("%v supports a single mount, and is mounted already", fs)
+	}
 	fs.nodeFs = nodeFs
 }
 
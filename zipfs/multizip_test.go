@@ -123,3 +123,14 @@ func TestMultiZipFs(t *testing.T) {
 		t.Errorf("stat should fail after unmount, got %#v", fi)
 	}
 }
+
+func TestMultiZipFsSingleMount(t *testing.T) {
+	fs := NewMultiZipFs()
+	nodefs.NewFileSystemConnector(pathfs.NewPathNodeFs(fs, nil).Root(), nil)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("second mount did not panic")
+		}
+	}()
+	nodefs.NewFileSystemConnector(pathfs.NewPathNodeFs(fs, nil).Root(), nil)
+}